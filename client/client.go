@@ -0,0 +1,1044 @@
+// Package client 會議室signaling協定(/room/{roomid}/webSocket)的Go client，
+// 讓錄影、轉錄、壓測等bot能像瀏覽器一樣加入房間、接收與publish track
+// 以subprotocol "sfu.v2"(或Options.Protobuf時的"sfu.v2.proto")連線，server不支援時退回v1
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webrtc_sfu_conference/signalingpb"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// readTimeout server每10秒送出keepalive，超過此時間沒有任何訊息視為websocket斷線
+	readTimeout = 30 * time.Second
+
+	// resumeRetryInterval websocket斷線後重新連線的間隔
+	resumeRetryInterval = time.Second
+
+	// subprotocolV2 signaling協定v2，未協商subprotocol時為v1
+	subprotocolV2 = "sfu.v2"
+
+	// publishSlotTimeout Publish請server新增transceiver後等待offer的時間
+	publishSlotTimeout = 10 * time.Second
+)
+
+// server error event的code
+const (
+	ErrCodeMalformed      = "malformedMessage"
+	ErrCodeUnknownEvent   = "unknownEvent"
+	ErrCodeInvalidPayload = "invalidPayload"
+	ErrCodeNegotiation    = "negotiationFailed"
+	ErrCodeGlare          = "glare"
+	ErrCodeRoomFull       = "roomFull"
+	ErrCodeServerBusy     = "serverBusy"
+	ErrCodeLobbyDenied    = "lobbyDenied"
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeNotFound       = "notFound"
+	ErrCodeNotStarted     = "roomNotStarted"
+
+	ErrCodePasswordRequired = "passwordRequired"
+	ErrCodeInvalidPassword  = "invalidPassword"
+	ErrCodeTooManyAttempts  = "tooManyAttempts"
+
+	ErrCodeScreenShareBusy = "screenShareBusy"
+	ErrCodeTooManyTracks   = "tooManyTracks"
+)
+
+// track的用途，PublishLabeled時標示，未標示的track依kind視為camera或microphone
+const (
+	TrackLabelCamera      = "camera"
+	TrackLabelMicrophone  = "microphone"
+	TrackLabelScreen      = "screen"
+	TrackLabelScreenAudio = "screenAudio"
+)
+
+const (
+	// closeRoomFull server因房間已滿拒絕連線時的websocket close code
+	closeRoomFull = 4001
+	// closeLobbyDenied host拒絕lobby中的參與者時的websocket close code
+	closeLobbyDenied = 4003
+	// closeRoomNotStarted 排程房間開始之前加入時的websocket close code
+	closeRoomNotStarted = 4004
+	// closeRoomEnded 會議結束時的websocket close code
+	closeRoomEnded = 4005
+	// closeInvalidPassword 房間需要密碼，未帶或錯誤時的websocket close code
+	closeInvalidPassword = 4006
+	// closeTooManyAttempts 密碼錯誤或查詢不存在的room alias次數過多時的websocket close code
+	closeTooManyAttempts = 4029
+	// closeRoomNotFound URL中的room ID或alias不存在時的websocket close code
+	closeRoomNotFound = 4404
+	// closeRoomOnOrigin 房間需要在origin node加入(cluster中的lobby房間)時的websocket close code
+	closeRoomOnOrigin = 4307
+
+	// errCodeRoomOnOrigin 房間需要在origin node加入時的error code，message為origin的base URL
+	errCodeRoomOnOrigin = "roomOnOrigin"
+)
+
+var (
+	// ErrClosed Client已關閉
+	ErrClosed = errors.New("client closed")
+	// ErrResumeFailed websocket斷線後server已不保留此參與者
+	ErrResumeFailed = errors.New("resume failed")
+	// ErrNoPublishSlot server沒有可接收此kind的transceiver，且無法新增(舊版server或已達上限)
+	ErrNoPublishSlot = errors.New("no publish transceiver available")
+	// ErrRoomFull 房間已達參與者上限
+	ErrRoomFull = errors.New("room full")
+	// ErrServerBusy server已達容量上限，稍後再試
+	ErrServerBusy = errors.New("server busy")
+	// ErrLobbyDenied host拒絕加入
+	ErrLobbyDenied = errors.New("denied by host")
+	// ErrRoomNotStarted 排程房間尚未開始
+	ErrRoomNotStarted = errors.New("room not started")
+	// ErrRoomEnded 會議已結束(排程結束時間或server的會議時間上限)
+	ErrRoomEnded = errors.New("room ended")
+	// ErrInvalidPassword 房間需要密碼，Options.Password未設定或錯誤
+	ErrInvalidPassword = errors.New("invalid room password")
+	// ErrTooManyAttempts 密碼錯誤或查詢不存在的room alias次數過多，稍後再試
+	ErrTooManyAttempts = errors.New("too many password attempts")
+	// ErrRoomNotFound URL中的room ID或alias不存在
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrRoomOnOrigin 房間需要在origin node加入，改連線到origin後仍被拒絕
+	ErrRoomOnOrigin = errors.New("room must be joined on its origin node")
+)
+
+// message signaling協定v2的message
+type message struct {
+	Version int             `json:"v"`
+	Event   string          `json:"event"`
+	ID      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// legacyMessage signaling協定v1的message，data為JSON字串
+type legacyMessage struct {
+	Event string `json:"event"`
+	Data  string `json:"data"`
+}
+
+// sessionInfo server的session event
+type sessionInfo struct {
+	ParticipantID string `json:"participantID"`
+	ResumeToken   string `json:"resumeToken"`
+	GracePeriod   int    `json:"gracePeriod"`
+}
+
+// negotiationError v1 server的negotiationError event
+type negotiationError struct {
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// serverError v2 server的error event
+type serverError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// LobbyParticipant 在lobby中等待host允許的參與者
+type LobbyParticipant struct {
+	ParticipantID string `json:"participantID"`
+	Name          string `json:"name,omitempty"`
+}
+
+// roomEnding server的roomEnding、roomEnded event
+type roomEnding struct {
+	EndTime time.Time `json:"endTime"`
+	Reason  string    `json:"reason"`
+}
+
+// trackLabel 送出的trackLabel event
+type trackLabel struct {
+	TrackID string `json:"trackID"`
+	Label   string `json:"label"`
+}
+
+// TrackInfo 房間中一個track的用途與publisher
+type TrackInfo struct {
+	TrackID  string `json:"trackID"`
+	StreamID string `json:"streamID"`
+	Kind     string `json:"kind"`
+	Label    string `json:"label"`
+	// ParticipantID 同一個node上的publisher，SIP電話與其他node的track為空字串
+	ParticipantID string `json:"participantID,omitempty"`
+	// Subscribed 是否已訂閱，未訂閱的track不會送到此client
+	Subscribed bool `json:"subscribed"`
+}
+
+// Subscription Subscribe、Unsubscribe、Pause、Resume的對象，All為true時為所有track，Subscribe時包含之後加入的track
+type Subscription struct {
+	All            bool     `json:"all,omitempty"`
+	ParticipantIDs []string `json:"participantIDs,omitempty"`
+	TrackIDs       []string `json:"trackIDs,omitempty"`
+}
+
+// publishRequest 請server新增接收用的transceiver
+type publishRequest struct {
+	Kind string `json:"kind"`
+}
+
+// trackList server的tracks event
+type trackList struct {
+	Tracks []TrackInfo `json:"tracks"`
+}
+
+// Options Join的選項
+type Options struct {
+	// Configuration peerConnection設定，未設定ICEServers時使用google stun
+	Configuration webrtc.Configuration
+
+	// Header websocket handshake時帶上的header
+	Header http.Header
+
+	// MixedAudio 只接收房間混音後的一個audio track (?audio=mixed)
+	MixedAudio bool
+
+	// Publish 預計publish的track kind，server依此建立接收用的transceiver (?publish=audio,video)
+	// nil時沿用server預設的兩個video與一個audio，空slice為只收看，不足時Publish會再向server要求
+	Publish []webrtc.RTPCodecType
+
+	// ManualSubscribe 加入時不訂閱任何track，以Subscribe選擇要接收的參與者或track (?subscribe=none)
+	ManualSubscribe bool
+
+	// Protobuf 以protobuf binary message取代JSON，server不支援時退回JSON
+	Protobuf bool
+
+	// Name 顯示名稱，lobby中讓host辨識 (?name=)
+	Name string
+
+	// HostToken 建立房間時回傳的hostToken，以host加入時不需密碼與等待允許，且可以Admit、Deny
+	// handshake時以X-Host-Token header送出
+	HostToken string
+
+	// Password 房間的密碼或PIN，handshake時以X-Room-Password header送出
+	Password string
+
+	// OnTrack 收到房間中其他參與者的track，可用Client.TrackInfo取得track的用途
+	OnTrack func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
+
+	// OnTracks server在offer之前或track列表變動時送出房間中可以訂閱的所有track，screen share排在最前面
+	OnTracks func([]TrackInfo)
+
+	// OnKeyFrameRequest server要求publish的track送出keyframe(PLI或FIR)，trackID為Publish時的track ID
+	OnKeyFrameRequest func(trackID string)
+
+	// OnConnectionStateChange peerConnection狀態變化
+	OnConnectionStateChange func(webrtc.PeerConnectionState)
+
+	// OnError server回報的錯誤，code為ErrCode*，id為造成錯誤的request ID
+	// v1 server只回報negotiation錯誤，id為空字串
+	OnError func(code, message, id string)
+
+	// OnWaitingInLobby 房間需要host允許，開始在lobby等待，被拒絕時Client以ErrLobbyDenied結束
+	OnWaitingInLobby func()
+
+	// OnLobbyJoin、OnLobbyLeave 只有host會收到，參與者進入或離開lobby
+	OnLobbyJoin  func(LobbyParticipant)
+	OnLobbyLeave func(LobbyParticipant)
+
+	// OnRoomEnding 會議即將在endTime結束，reason為scheduledEnd或maxDuration，結束時Client以ErrRoomEnded結束
+	OnRoomEnding func(endTime time.Time, reason string)
+}
+
+// Client 房間中的一個參與者，server為offerer，Client回覆answer
+// 斷線時在server的grace period內自動帶resume token重新連線，沿用原本的peerConnection
+type Client struct {
+	url  string
+	opts Options
+
+	pc *webrtc.PeerConnection
+
+	// ws 目前的websocket，writeLock保護寫入
+	ws        *websocket.Conn
+	writeLock sync.Mutex
+
+	session sessionInfo
+
+	// tracks 最近一次tracks event，key: track ID，trackList為server送出的順序
+	tracks    map[string]TrackInfo
+	trackList []TrackInfo
+
+	// negotiated 第一次offer/answer完成後關閉，之後才有可publish的transceiver
+	negotiated     chan struct{}
+	negotiatedOnce sync.Once
+
+	// renegotiated 每次回覆offer後關閉並換新，Publish等待server新增的transceiver
+	renegotiated chan struct{}
+
+	// negotiation 回覆offer與AddTrack互斥，answer建立後、SetLocalDescription前加入的sender
+	// 會在沒有宣告SSRC與msid的情況下開始送出，server收到的track沒有ID
+	negotiation sync.Mutex
+
+	// publishing 等待server新增transceiver的publish request，key: request ID，server回覆error時送出
+	publishing map[string]chan error
+
+	// requests 產生request ID
+	requests uint64
+
+	// origin server要求改連線的origin node，只在加入前轉連線一次
+	origin     string
+	redirected bool
+
+	done chan struct{}
+	err  error
+
+	sync.Mutex
+}
+
+// Join 加入房間，roomWebSocketURL為建立房間API回傳的roomWebsocketURL
+func Join(roomWebSocketURL string, opts Options) (*Client, error) {
+	u, err := url.Parse(roomWebSocketURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	if opts.MixedAudio {
+		q.Set("audio", "mixed")
+	}
+	if opts.Publish != nil {
+		kinds := make([]string, 0, len(opts.Publish))
+		for _, kind := range opts.Publish {
+			kinds = append(kinds, kind.String())
+		}
+		q.Set("publish", strings.Join(kinds, ","))
+	}
+	if opts.ManualSubscribe {
+		q.Set("subscribe", "none")
+	}
+	if opts.Name != "" {
+		q.Set("name", opts.Name)
+	}
+	if opts.HostToken != "" || opts.Password != "" {
+		opts.Header = opts.Header.Clone()
+		if opts.Header == nil {
+			opts.Header = http.Header{}
+		}
+		if opts.HostToken != "" {
+			opts.Header.Set("X-Host-Token", opts.HostToken)
+		}
+		if opts.Password != "" {
+			opts.Header.Set("X-Room-Password", opts.Password)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	config := opts.Configuration
+	if len(config.ICEServers) == 0 {
+		config.ICEServers = []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		}
+	}
+
+	pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		url:          u.String(),
+		opts:         opts,
+		pc:           pc,
+		tracks:       make(map[string]TrackInfo),
+		negotiated:   make(chan struct{}),
+		renegotiated: make(chan struct{}),
+		publishing:   make(map[string]chan error),
+		done:         make(chan struct{}),
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		// 等待resume期間送不出去的candidate，resume後server會ICE restart
+		_ = c.send("candidate", "", candidate.ToJSON())
+	})
+
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if opts.OnConnectionStateChange != nil {
+			opts.OnConnectionStateChange(s)
+		}
+	})
+
+	if opts.OnTrack != nil {
+		pc.OnTrack(opts.OnTrack)
+	}
+
+	ws, err := c.dial(c.url)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	c.ws = ws
+
+	go c.run(ws)
+
+	return c, nil
+}
+
+// ParticipantID server指定的參與者ID，收到session event前為空字串
+func (c *Client) ParticipantID() string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.session.ParticipantID
+}
+
+// Subprotocol 目前websocket與server協商的signaling subprotocol，連線中斷時為空字串
+func (c *Client) Subprotocol() string {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.ws == nil {
+		return ""
+	}
+	return c.ws.Subprotocol()
+}
+
+// TrackInfo 收到的track的用途，server尚未送出此track的資訊時回傳false
+func (c *Client) TrackInfo(trackID string) (TrackInfo, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	info, ok := c.tracks[trackID]
+	return info, ok
+}
+
+// Tracks server最後送出的track列表，包含未訂閱的track，順序與OnTracks相同
+func (c *Client) Tracks() []TrackInfo {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]TrackInfo(nil), c.trackList...)
+}
+
+// Subscribe 開始接收指定的參與者或track，server會重新發送offer
+func (c *Client) Subscribe(s Subscription) error {
+	return c.send("subscribe", c.nextID(), &s)
+}
+
+// Unsubscribe 停止接收指定的參與者或track，server會從offer中移除這些track
+func (c *Client) Unsubscribe(s Subscription) error {
+	return c.send("unsubscribe", c.nextID(), &s)
+}
+
+// Pause 暫時停止接收已訂閱的參與者或track，例如tile在畫面外或分頁隱藏，不會renegotiation
+func (c *Client) Pause(s Subscription) error {
+	return c.send("pause", c.nextID(), &s)
+}
+
+// Resume 恢復接收Pause的參與者或track，server會向publisher要求keyframe
+func (c *Client) Resume(s Subscription) error {
+	return c.send("resume", c.nextID(), &s)
+}
+
+// PeerConnection 底層的peerConnection，可用於讀取stats或送出RTCP
+func (c *Client) PeerConnection() *webrtc.PeerConnection {
+	return c.pc
+}
+
+// Done Client結束(Close、斷線且無法resume)時關閉
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err Client結束的原因，Close時為ErrClosed
+func (c *Client) Err() error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.err
+}
+
+// Close 離開房間
+func (c *Client) Close() error {
+	c.finish(ErrClosed)
+	return c.pc.Close()
+}
+
+// Publish 將track送進房間，使用server offer中接收用的transceiver，server沒有空的transceiver時回傳ErrNoPublishSlot
+// pion無法rollback，因此不由client發起offer，而是以addTrack event請server重新發送offer
+func (c *Client) Publish(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	return c.PublishLabeled(track, "")
+}
+
+// PublishLabeled 與Publish相同，並標示track的用途(TrackLabel*)，label為空字串時不標示
+// server拒絕時(例如已有其他人在分享畫面)以OnError回報ErrCodeScreenShareBusy等code
+func (c *Client) PublishLabeled(track webrtc.TrackLocal, label string) (*webrtc.RTPSender, error) {
+	select {
+	case <-c.negotiated:
+	case <-c.done:
+		return nil, c.Err()
+	}
+
+	if !c.hasPublishSlot(track.Kind()) {
+		if err := c.requestPublishSlot(track.Kind()); err != nil {
+			return nil, err
+		}
+	}
+
+	// label需在帶有此track的answer之前送到server
+	if label != "" {
+		if err := c.send("trackLabel", c.nextID(), &trackLabel{TrackID: track.ID(), Label: label}); err != nil {
+			return nil, err
+		}
+	}
+
+	c.negotiation.Lock()
+	sender, err := c.pc.AddTrack(track)
+	c.negotiation.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// RTCP需要讀出，interceptor才會處理NACK等
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			if c.opts.OnKeyFrameRequest == nil {
+				continue
+			}
+			for _, p := range packets {
+				switch p.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					c.opts.OnKeyFrameRequest(track.ID())
+				}
+			}
+		}
+	}()
+
+	if err := c.send("addTrack", c.nextID(), nil); err != nil {
+		return sender, err
+	}
+	return sender, nil
+}
+
+// hasPublishSlot AddTrack會使用第一個沒有sender的同kind transceiver，server在該m-line必須會接收(recvonly或sendrecv)
+// 否則會佔用server只用來送出其他參與者track的transceiver
+func (c *Client) hasPublishSlot(kind webrtc.RTPCodecType) bool {
+	for _, t := range c.pc.GetTransceivers() {
+		if t.Kind() != kind || t.Sender() != nil {
+			continue
+		}
+		return c.remoteReceives(t.Mid())
+	}
+	return false
+}
+
+// requestPublishSlot 以publish event請server新增接收kind的transceiver，等待帶有該transceiver的offer
+func (c *Client) requestPublishSlot(kind webrtc.RTPCodecType) error {
+	id := c.nextID()
+	failed := make(chan error, 1)
+
+	c.Lock()
+	c.publishing[id] = failed
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.publishing, id)
+		c.Unlock()
+	}()
+
+	if err := c.send("publish", id, &publishRequest{Kind: kind.String()}); err != nil {
+		return err
+	}
+
+	timeout := time.After(publishSlotTimeout)
+	for {
+		c.Lock()
+		renegotiated := c.renegotiated
+		c.Unlock()
+
+		if c.hasPublishSlot(kind) {
+			return nil
+		}
+
+		select {
+		case <-renegotiated:
+		case err := <-failed:
+			return err
+		case <-c.done:
+			return c.Err()
+		case <-timeout:
+			return ErrNoPublishSlot
+		}
+	}
+}
+
+// Admit host允許lobby中的參與者加入
+func (c *Client) Admit(participantID string) error {
+	return c.send("admit", c.nextID(), &LobbyParticipant{ParticipantID: participantID})
+}
+
+// Deny host拒絕lobby中的參與者
+func (c *Client) Deny(participantID string) error {
+	return c.send("deny", c.nextID(), &LobbyParticipant{ParticipantID: participantID})
+}
+
+// remoteReceives server的offer中此mid的m-line是否會接收client送出的media
+func (c *Client) remoteReceives(mid string) bool {
+	desc := c.pc.RemoteDescription()
+	if desc == nil || mid == "" {
+		return false
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		return false
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		if value, _ := media.Attribute(sdp.AttrKeyMID); value != mid {
+			continue
+		}
+		for _, attr := range media.Attributes {
+			if attr.Key == "sendrecv" || attr.Key == "recvonly" {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// Unpublish 停止送出track，該transceiver不會再被Publish使用，之後的Publish會向server要求新的transceiver
+func (c *Client) Unpublish(sender *webrtc.RTPSender) error {
+	if err := c.pc.RemoveTrack(sender); err != nil {
+		return err
+	}
+	return c.send("addTrack", c.nextID(), nil)
+}
+
+// dial 連線並要求signaling協定v2
+func (c *Client) dial(u string) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{subprotocolV2}
+	if c.opts.Protobuf {
+		dialer.Subprotocols = []string{signalingpb.Subprotocol, subprotocolV2}
+	}
+
+	ws, _, err := dialer.Dial(u, c.opts.Header)
+	return ws, err
+}
+
+func (c *Client) nextID() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.requests, 1), 10)
+}
+
+// send 依websocket協商的版本寫入目前的websocket，payload為nil時沒有data
+func (c *Client) send(event, id string, payload interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.Lock()
+	ws := c.ws
+	c.Unlock()
+	if ws == nil {
+		return fmt.Errorf("websocket disconnected")
+	}
+
+	if ws.Subprotocol() == signalingpb.Subprotocol {
+		msg, err := toProtoMessage(event, id, payload)
+		if err != nil {
+			return err
+		}
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(websocket.BinaryMessage, b)
+	}
+
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	if ws.Subprotocol() != subprotocolV2 {
+		return ws.WriteJSON(&legacyMessage{Event: event, Data: string(data)})
+	}
+	return ws.WriteJSON(&message{Version: 2, Event: event, ID: id, Data: data})
+}
+
+// read 讀取下一個message，v1 message轉為v2格式
+func read(ws *websocket.Conn) (*message, error) {
+	switch ws.Subprotocol() {
+	case signalingpb.Subprotocol:
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		pb := &signalingpb.SignalingMessage{}
+		if err := proto.Unmarshal(data, pb); err != nil {
+			return nil, err
+		}
+		return fromProtoMessage(pb)
+
+	case subprotocolV2:
+		msg := &message{}
+		if err := ws.ReadJSON(msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	legacy := &legacyMessage{}
+	if err := ws.ReadJSON(legacy); err != nil {
+		return nil, err
+	}
+	msg := &message{Version: 1, Event: legacy.Event}
+	if legacy.Data != "" {
+		msg.Data = json.RawMessage(legacy.Data)
+	}
+	return msg, nil
+}
+
+func (c *Client) finish(err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	c.err = err
+	close(c.done)
+	if c.ws != nil {
+		_ = c.ws.Close()
+		c.ws = nil
+	}
+}
+
+// run 讀取websocket直到Client結束，斷線時在grace period內resume
+func (c *Client) run(ws *websocket.Conn) {
+	for {
+		err := c.readLoop(ws)
+
+		c.Lock()
+		if c.ws == ws {
+			c.ws = nil
+		}
+		session := c.session
+		c.Unlock()
+		_ = ws.Close()
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		// 尚未加入時依server回覆的origin重新連線
+		if errors.Is(err, ErrRoomOnOrigin) && session.ResumeToken == "" {
+			if ws, err = c.redirectToOrigin(); err == nil {
+				continue
+			}
+		}
+
+		if errors.Is(err, ErrResumeFailed) || errors.Is(err, ErrRoomFull) || errors.Is(err, ErrServerBusy) ||
+			errors.Is(err, ErrLobbyDenied) || errors.Is(err, ErrRoomNotStarted) || errors.Is(err, ErrRoomEnded) ||
+			errors.Is(err, ErrInvalidPassword) || errors.Is(err, ErrTooManyAttempts) || errors.Is(err, ErrRoomNotFound) ||
+			errors.Is(err, ErrRoomOnOrigin) ||
+			session.ResumeToken == "" {
+			c.finish(err)
+			_ = c.pc.Close()
+			return
+		}
+
+		ws, err = c.resume(session)
+		if err != nil {
+			c.finish(err)
+			_ = c.pc.Close()
+			return
+		}
+	}
+}
+
+// redirectToOrigin 以origin node的scheme與host取代URL中的host重新連線，path與query不變
+func (c *Client) redirectToOrigin() (*websocket.Conn, error) {
+	c.Lock()
+	origin, redirected := c.origin, c.redirected
+	c.redirected = true
+	c.Unlock()
+	if origin == "" || redirected {
+		return nil, ErrRoomOnOrigin
+	}
+
+	node, err := url.Parse(origin)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRoomOnOrigin, err)
+	}
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	// http -> ws, https -> wss
+	u.Scheme = "ws" + strings.TrimPrefix(node.Scheme, "http")
+	u.Host = node.Host
+	c.url = u.String()
+
+	ws, err := c.dial(c.url)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.ws = ws
+	c.Unlock()
+	return ws, nil
+}
+
+// resume 帶resume token重新連線，直到成功或超過grace period
+func (c *Client) resume(session sessionInfo) (*websocket.Conn, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("resume", session.ResumeToken)
+	u.RawQuery = q.Encode()
+
+	deadline := time.Now().Add(time.Duration(session.GracePeriod) * time.Second)
+	for {
+		select {
+		case <-c.done:
+			return nil, c.Err()
+		case <-time.After(resumeRetryInterval):
+		}
+
+		ws, err := c.dial(u.String())
+		if err == nil {
+			c.Lock()
+			c.ws = ws
+			c.Unlock()
+			return ws, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: %v", ErrResumeFailed, err)
+		}
+	}
+}
+
+// readLoop 處理server的signaling message，websocket斷線時回傳
+func (c *Client) readLoop(ws *websocket.Conn) error {
+	for {
+		if err := ws.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return err
+		}
+
+		msg, err := read(ws)
+		if err != nil {
+			// server拒絕連線時以close code說明原因
+			if websocket.IsCloseError(err, closeRoomFull) {
+				return ErrRoomFull
+			}
+			if websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				return ErrServerBusy
+			}
+			if websocket.IsCloseError(err, closeLobbyDenied) {
+				return ErrLobbyDenied
+			}
+			if websocket.IsCloseError(err, closeRoomNotStarted) {
+				return ErrRoomNotStarted
+			}
+			if websocket.IsCloseError(err, closeRoomEnded) {
+				return ErrRoomEnded
+			}
+			if websocket.IsCloseError(err, closeInvalidPassword) {
+				return ErrInvalidPassword
+			}
+			if websocket.IsCloseError(err, closeTooManyAttempts) {
+				return ErrTooManyAttempts
+			}
+			if websocket.IsCloseError(err, closeRoomNotFound) {
+				return ErrRoomNotFound
+			}
+			if websocket.IsCloseError(err, closeRoomOnOrigin) {
+				return ErrRoomOnOrigin
+			}
+			return err
+		}
+
+		switch msg.Event {
+		case "session":
+			session := sessionInfo{}
+			if err := json.Unmarshal(msg.Data, &session); err != nil {
+				return err
+			}
+			c.Lock()
+			c.session = session
+			c.Unlock()
+
+		case "resumeFailed":
+			return ErrResumeFailed
+
+		case "offer":
+			offer := webrtc.SessionDescription{}
+			if err := json.Unmarshal(msg.Data, &offer); err != nil {
+				return err
+			}
+			if err := c.handleOffer(offer, msg.ID); err != nil {
+				return err
+			}
+
+		case "answer":
+			answer := webrtc.SessionDescription{}
+			if err := json.Unmarshal(msg.Data, &answer); err != nil {
+				return err
+			}
+			if err := c.pc.SetRemoteDescription(answer); err != nil {
+				return err
+			}
+
+		case "candidate":
+			candidate := webrtc.ICECandidateInit{}
+			if err := json.Unmarshal(msg.Data, &candidate); err != nil {
+				return err
+			}
+			if err := c.pc.AddICECandidate(candidate); err != nil {
+				return err
+			}
+
+		case "error":
+			e := serverError{}
+			if err := json.Unmarshal(msg.Data, &e); err != nil {
+				return err
+			}
+			c.Lock()
+			failed, ok := c.publishing[msg.ID]
+			if e.Code == errCodeRoomOnOrigin {
+				c.origin = e.Message
+			}
+			c.Unlock()
+			if ok {
+				failed <- fmt.Errorf("%w: %s: %s", ErrNoPublishSlot, e.Code, e.Message)
+			}
+			if c.opts.OnError != nil {
+				c.opts.OnError(e.Code, e.Message, msg.ID)
+			}
+
+		case "negotiationError":
+			e := negotiationError{}
+			if err := json.Unmarshal(msg.Data, &e); err != nil {
+				return err
+			}
+			if c.opts.OnError != nil {
+				detail := e.Reason
+				if e.Error != "" {
+					detail += ": " + e.Error
+				}
+				c.opts.OnError(ErrCodeNegotiation, detail, "")
+			}
+
+		case "lobby":
+			if c.opts.OnWaitingInLobby != nil {
+				c.opts.OnWaitingInLobby()
+			}
+
+		case "admitted":
+			// 接著server會送出offer
+
+		case "lobbyJoin", "lobbyLeave":
+			p := LobbyParticipant{}
+			if err := json.Unmarshal(msg.Data, &p); err != nil {
+				return err
+			}
+			if msg.Event == "lobbyJoin" && c.opts.OnLobbyJoin != nil {
+				c.opts.OnLobbyJoin(p)
+			}
+			if msg.Event == "lobbyLeave" && c.opts.OnLobbyLeave != nil {
+				c.opts.OnLobbyLeave(p)
+			}
+
+		case "roomEnding":
+			ending := roomEnding{}
+			if err := json.Unmarshal(msg.Data, &ending); err != nil {
+				return err
+			}
+			if c.opts.OnRoomEnding != nil {
+				c.opts.OnRoomEnding(ending.EndTime, ending.Reason)
+			}
+
+		case "roomEnded":
+			// 接著server會關閉websocket
+
+		case "tracks":
+			list := trackList{}
+			if err := json.Unmarshal(msg.Data, &list); err != nil {
+				return err
+			}
+			c.Lock()
+			c.trackList = list.Tracks
+			c.tracks = make(map[string]TrackInfo, len(list.Tracks))
+			for _, t := range list.Tracks {
+				c.tracks[t.TrackID] = t
+			}
+			c.Unlock()
+			if c.opts.OnTracks != nil {
+				c.opts.OnTracks(list.Tracks)
+			}
+
+		case "keepalive":
+			// read deadline已更新
+
+		default:
+			// 較新的server可能送出還不認得的event
+		}
+	}
+}
+
+// handleOffer 回覆server的offer，answer帶回offer的request ID
+func (c *Client) handleOffer(offer webrtc.SessionDescription, id string) error {
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+
+	if err := c.pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	if err := c.send("answer", id, answer); err != nil {
+		return err
+	}
+
+	c.negotiatedOnce.Do(func() {
+		close(c.negotiated)
+	})
+
+	c.Lock()
+	close(c.renegotiated)
+	c.renegotiated = make(chan struct{})
+	c.Unlock()
+	return nil
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"webrtc_sfu_conference/signalingpb"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// toProtoMessage 將送出的payload轉為protobuf message
+func toProtoMessage(event, id string, payload interface{}) (*signalingpb.SignalingMessage, error) {
+	msg := &signalingpb.SignalingMessage{
+		Version: 2,
+		Event:   event,
+		Id:      id,
+	}
+
+	switch p := payload.(type) {
+	case nil:
+	case webrtc.SessionDescription:
+		msg.Payload = &signalingpb.SignalingMessage_Description{
+			Description: &signalingpb.SessionDescription{Type: p.Type.String(), Sdp: p.SDP},
+		}
+	case webrtc.ICECandidateInit:
+		candidate := &signalingpb.ICECandidate{
+			Candidate:        p.Candidate,
+			SdpMid:           p.SDPMid,
+			UsernameFragment: p.UsernameFragment,
+		}
+		if p.SDPMLineIndex != nil {
+			index := uint32(*p.SDPMLineIndex)
+			candidate.SdpMlineIndex = &index
+		}
+		msg.Payload = &signalingpb.SignalingMessage_Candidate{Candidate: candidate}
+	case *LobbyParticipant:
+		msg.Payload = &signalingpb.SignalingMessage_Lobby{
+			Lobby: &signalingpb.LobbyParticipant{ParticipantId: p.ParticipantID, Name: p.Name},
+		}
+	case *trackLabel:
+		msg.Payload = &signalingpb.SignalingMessage_TrackLabel{
+			TrackLabel: &signalingpb.TrackLabel{TrackId: p.TrackID, Label: p.Label},
+		}
+	case *Subscription:
+		msg.Payload = &signalingpb.SignalingMessage_Subscription{
+			Subscription: &signalingpb.Subscription{All: p.All, ParticipantIds: p.ParticipantIDs, TrackIds: p.TrackIDs},
+		}
+	case *publishRequest:
+		msg.Payload = &signalingpb.SignalingMessage_Publish{
+			Publish: &signalingpb.PublishRequest{Kind: p.Kind},
+		}
+	default:
+		return nil, fmt.Errorf("event %s payload %T has no protobuf encoding", event, payload)
+	}
+
+	return msg, nil
+}
+
+// fromProtoMessage 將收到的protobuf message轉為message，payload轉為JSON與其他encoding共用處理
+func fromProtoMessage(pb *signalingpb.SignalingMessage) (*message, error) {
+	msg := &message{
+		Version: int(pb.Version),
+		Event:   pb.Event,
+		ID:      pb.Id,
+	}
+
+	var payload interface{}
+	switch p := pb.Payload.(type) {
+	case *signalingpb.SignalingMessage_Description:
+		payload = &webrtc.SessionDescription{
+			Type: webrtc.NewSDPType(p.Description.GetType()),
+			SDP:  p.Description.GetSdp(),
+		}
+	case *signalingpb.SignalingMessage_Candidate:
+		candidate := &webrtc.ICECandidateInit{
+			Candidate:        p.Candidate.GetCandidate(),
+			SDPMid:           p.Candidate.SdpMid,
+			UsernameFragment: p.Candidate.UsernameFragment,
+		}
+		if p.Candidate.SdpMlineIndex != nil {
+			index := uint16(*p.Candidate.SdpMlineIndex)
+			candidate.SDPMLineIndex = &index
+		}
+		payload = candidate
+	case *signalingpb.SignalingMessage_Session:
+		payload = &sessionInfo{
+			ParticipantID: p.Session.GetParticipantId(),
+			ResumeToken:   p.Session.GetResumeToken(),
+			GracePeriod:   int(p.Session.GetGracePeriod()),
+		}
+	case *signalingpb.SignalingMessage_Error:
+		payload = &serverError{Code: p.Error.GetCode(), Message: p.Error.GetMessage()}
+	case *signalingpb.SignalingMessage_Lobby:
+		payload = &LobbyParticipant{ParticipantID: p.Lobby.GetParticipantId(), Name: p.Lobby.GetName()}
+	case *signalingpb.SignalingMessage_RoomEnding:
+		endTime, err := time.Parse(time.RFC3339Nano, p.RoomEnding.GetEndTime())
+		if err != nil {
+			return nil, err
+		}
+		payload = &roomEnding{EndTime: endTime, Reason: p.RoomEnding.GetReason()}
+	case *signalingpb.SignalingMessage_Tracks:
+		list := &trackList{Tracks: make([]TrackInfo, 0, len(p.Tracks.GetTracks()))}
+		for _, t := range p.Tracks.GetTracks() {
+			list.Tracks = append(list.Tracks, TrackInfo{
+				TrackID:       t.GetTrackId(),
+				StreamID:      t.GetStreamId(),
+				Kind:          t.GetKind(),
+				Label:         t.GetLabel(),
+				ParticipantID: t.GetParticipantId(),
+				Subscribed:    t.GetSubscribed(),
+			})
+		}
+		payload = list
+	default:
+		return msg, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.Data = data
+	return msg, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "time"
+
+// 非Linux平台沒有/proc與相同的rusage，report的CPU欄位顯示"-"
+func selfCPUTime() (time.Duration, error) {
+	return 0, errCPUUnsupported
+}
+
+func processCPUTime(pid int) (time.Duration, error) {
+	return 0, errCPUUnsupported
+}
@@ -0,0 +1,142 @@
+// loadtest 以signaling websocket加入N個模擬參與者，publish產生的(或檔案的)VP8/Opus track並訂閱其他人，
+// 統計加入延遲、renegotiation時間、封包遺失、bitrate與CPU，用來估計單一instance能承受的人數
+//
+//	go run ./cmd/loadtest -server http://127.0.0.1:8080 -n 20 -ramp 500ms -duration 1m
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+type config struct {
+	server   string
+	room     string
+	n        int
+	ramp     time.Duration
+	duration time.Duration
+	interval time.Duration
+
+	video        bool
+	audio        bool
+	videoBitrate int
+	videoFile    string
+	audioFile    string
+	protobuf     bool
+	password     string
+
+	serverPID int
+}
+
+func main() {
+	cfg := config{}
+	flag.StringVar(&cfg.server, "server", "http://127.0.0.1:8080", "SFU base URL")
+	flag.StringVar(&cfg.room, "room", "", "room ID，空字串時建立新房間")
+	flag.IntVar(&cfg.n, "n", 10, "參與者數量")
+	flag.DurationVar(&cfg.ramp, "ramp", 500*time.Millisecond, "每個參與者加入的間隔")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "全部加入後持續的時間")
+	flag.DurationVar(&cfg.interval, "interval", 5*time.Second, "統計輸出間隔")
+	flag.BoolVar(&cfg.video, "video", true, "publish video track")
+	flag.BoolVar(&cfg.audio, "audio", true, "publish audio track")
+	flag.IntVar(&cfg.videoBitrate, "video-bitrate", 500000, "產生的VP8 bitrate (bps)")
+	flag.StringVar(&cfg.videoFile, "video-file", "", "改為循環publish此IVF(VP8)檔案")
+	flag.StringVar(&cfg.audioFile, "audio-file", "", "改為循環publish此Ogg(Opus)檔案")
+	flag.BoolVar(&cfg.protobuf, "protobuf", false, "signaling使用protobuf binary message")
+	flag.StringVar(&cfg.password, "password", "", "房間的密碼或PIN")
+	flag.IntVar(&cfg.serverPID, "server-pid", 0, "同一台機器上SFU的pid，一併統計其CPU使用率(只支援Linux)")
+	flag.Parse()
+
+	if cfg.room == "" {
+		roomID, err := createRoom(cfg.server)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "create room error: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.room = roomID
+	}
+	fmt.Printf("room %s, %d participants\n", cfg.room, cfg.n)
+
+	wsURL := fmt.Sprintf("ws%s/room/%s/webSocket", strings.TrimPrefix(cfg.server, "http"), cfg.room)
+
+	stats := newStats()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	stop := make(chan struct{})
+	reporterDone := make(chan struct{})
+	go func() {
+		defer close(reporterDone)
+		stats.report(cfg.interval, cfg.serverPID, stop)
+	}()
+
+	participants := make([]*participant, 0, cfg.n)
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+
+ramp:
+	for i := 0; i < cfg.n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			p, err := joinParticipant(fmt.Sprintf("bot-%d", i), wsURL, &cfg, stats)
+			if err != nil {
+				stats.joinFailed()
+				fmt.Fprintf(os.Stderr, "bot-%d join error: %v\n", i, err)
+				return
+			}
+			mu.Lock()
+			participants = append(participants, p)
+			mu.Unlock()
+		}(i)
+
+		select {
+		case <-time.After(cfg.ramp):
+		case <-interrupt:
+			break ramp
+		}
+	}
+	wg.Wait()
+
+	select {
+	case <-time.After(cfg.duration):
+	case <-interrupt:
+	}
+
+	close(stop)
+	<-reporterDone
+
+	for _, p := range participants {
+		p.close()
+	}
+
+	stats.summary()
+}
+
+// createRoom 呼叫建立房間API
+func createRoom(server string) (string, error) {
+	resp, err := http.Post(server+"/create/room", "application/json", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("create room status %s", resp.Status)
+	}
+
+	info := struct {
+		RoomID string `json:"roomID"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	return info.RoomID, nil
+}
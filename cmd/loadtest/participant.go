@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"time"
+	"webrtc_sfu_conference/client"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+)
+
+const (
+	videoFPS            = 30
+	videoKeyFrameFrames = 60
+	opusFrameDuration   = 20 * time.Millisecond
+)
+
+// opusSilence 20ms的Opus靜音frame
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+// participant 單一模擬參與者
+type participant struct {
+	name   string
+	client *client.Client
+	stop   chan struct{}
+}
+
+func joinParticipant(name, wsURL string, cfg *config, stats *stats) (*participant, error) {
+	p := &participant{
+		name: name,
+		stop: make(chan struct{}),
+	}
+
+	// 只要求實際會publish的transceiver
+	publish := []webrtc.RTPCodecType{}
+	if cfg.video {
+		publish = append(publish, webrtc.RTPCodecTypeVideo)
+	}
+	if cfg.audio {
+		publish = append(publish, webrtc.RTPCodecTypeAudio)
+	}
+
+	start := time.Now()
+	connected := make(chan struct{})
+	c, err := client.Join(wsURL, client.Options{
+		Protobuf: cfg.protobuf,
+		Password: cfg.password,
+		Publish:  publish,
+		OnTrack: func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			stats.trackReceived(t.ID(), start)
+			readTrack(t, stats)
+		},
+		OnConnectionStateChange: func(s webrtc.PeerConnectionState) {
+			switch s {
+			case webrtc.PeerConnectionStateConnected:
+				select {
+				case <-connected:
+				default:
+					close(connected)
+					stats.joined(time.Since(start))
+				}
+			case webrtc.PeerConnectionStateFailed:
+				stats.connectionFailed()
+			}
+		},
+		OnError: func(code, message, id string) {
+			if code == client.ErrCodeNegotiation {
+				stats.negotiationError()
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.client = c
+
+	if cfg.video {
+		track, err := webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			"video-"+name, name,
+		)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		if _, err := c.Publish(track); err != nil {
+			p.close()
+			return nil, err
+		}
+		stats.published(track.ID())
+
+		if cfg.videoFile != "" {
+			go p.writeIVF(track, cfg.videoFile, stats)
+		} else {
+			go p.writeGeneratedVP8(track, cfg.videoBitrate, stats)
+		}
+	}
+
+	if cfg.audio {
+		track, err := webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+			"audio-"+name, name,
+		)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		if _, err := c.Publish(track); err != nil {
+			p.close()
+			return nil, err
+		}
+		stats.published(track.ID())
+
+		if cfg.audioFile != "" {
+			go p.writeOgg(track, cfg.audioFile, stats)
+		} else {
+			go p.writeGeneratedOpus(track, stats)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *participant) close() {
+	close(p.stop)
+	_ = p.client.Close()
+}
+
+// readTrack 讀取RTP直到track結束，依sequence number統計遺失
+func readTrack(t *webrtc.TrackRemote, stats *stats) {
+	var (
+		started  bool
+		lastSeq  uint16
+		received uint64
+		expected uint64
+	)
+
+	for {
+		pkt, _, err := t.ReadRTP()
+		if err != nil {
+			stats.packets(received, expected)
+			return
+		}
+
+		stats.bytesIn(len(pkt.Payload))
+		received++
+
+		if !started {
+			started = true
+			lastSeq = pkt.SequenceNumber
+			expected++
+		} else if diff := pkt.SequenceNumber - lastSeq; diff != 0 && diff < 0x8000 {
+			// 亂序或重複的packet不計入expected
+			expected += uint64(diff)
+			lastSeq = pkt.SequenceNumber
+		}
+
+		// 定期回報，避免track到結束前都沒有統計
+		if received%500 == 0 {
+			stats.packets(received, expected)
+			received, expected = 0, 0
+		}
+	}
+}
+
+// writeGeneratedVP8 產生固定bitrate的VP8 frame，內容為亂數，SFU只轉送不解碼
+func (p *participant) writeGeneratedVP8(track *webrtc.TrackLocalStaticSample, bitrate int, stats *stats) {
+	frameSize := bitrate / 8 / videoFPS
+	if frameSize < 16 {
+		frameSize = 16
+	}
+	frame := make([]byte, frameSize)
+	duration := time.Second / videoFPS
+
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
+	for i := 0; ; i++ {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, _ = rand.Read(frame)
+		if i%videoKeyFrameFrames == 0 {
+			// keyframe: frame tag bit0為0，start code 9d 01 2a，640x480
+			copy(frame, []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01})
+		} else {
+			frame[0] |= 0x01
+		}
+
+		if err := track.WriteSample(media.Sample{Data: frame, Duration: duration}); err != nil {
+			return
+		}
+		stats.bytesOut(len(frame))
+	}
+}
+
+func (p *participant) writeGeneratedOpus(track *webrtc.TrackLocalStaticSample, stats *stats) {
+	ticker := time.NewTicker(opusFrameDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := track.WriteSample(media.Sample{Data: opusSilence, Duration: opusFrameDuration}); err != nil {
+			return
+		}
+		stats.bytesOut(len(opusSilence))
+	}
+}
+
+// writeIVF 循環publish IVF檔案中的VP8 frame
+func (p *participant) writeIVF(track *webrtc.TrackLocalStaticSample, path string, stats *stats) {
+	for {
+		if err := p.writeIVFOnce(track, path, stats); err != nil {
+			if !errors.Is(err, io.EOF) {
+				stats.mediaError(err)
+				return
+			}
+		}
+
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (p *participant) writeIVFOnce(track *webrtc.TrackLocalStaticSample, path string, stats *stats) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		return err
+	}
+
+	duration := time.Duration(float64(header.TimebaseNumerator) / float64(header.TimebaseDenominator) * float64(time.Second))
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		frame, _, err := reader.ParseNextFrame()
+		if err != nil {
+			return err
+		}
+
+		if err := track.WriteSample(media.Sample{Data: frame, Duration: duration}); err != nil {
+			return err
+		}
+		stats.bytesOut(len(frame))
+	}
+}
+
+// writeOgg 循環publish Ogg檔案中的Opus page
+func (p *participant) writeOgg(track *webrtc.TrackLocalStaticSample, path string, stats *stats) {
+	for {
+		if err := p.writeOggOnce(track, path, stats); err != nil {
+			if !errors.Is(err, io.EOF) {
+				stats.mediaError(err)
+				return
+			}
+		}
+
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (p *participant) writeOggOnce(track *webrtc.TrackLocalStaticSample, path string, stats *stats) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, _, err := oggreader.NewWith(file)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(opusFrameDuration)
+	defer ticker.Stop()
+
+	var lastGranule uint64
+	for {
+		select {
+		case <-p.stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		page, header, err := reader.ParseNextPage()
+		if err != nil {
+			return err
+		}
+
+		// granule position為48kHz的sample數
+		samples := header.GranulePosition - lastGranule
+		lastGranule = header.GranulePosition
+		duration := time.Duration(float64(samples) / 48000 * float64(time.Second))
+
+		if err := track.WriteSample(media.Sample{Data: page, Duration: duration}); err != nil {
+			return err
+		}
+		stats.bytesOut(len(page))
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// procClockTicks /proc/<pid>/stat中utime、stime的單位(USER_HZ)
+const procClockTicks = 100
+
+// errCPUUnsupported 非Linux平台不統計CPU時間
+var errCPUUnsupported = errors.New("cpu time is only supported on linux")
+
+// stats 所有參與者共用的統計
+type stats struct {
+	start time.Time
+
+	joinLatencies []time.Duration
+	// renegotiations 先加入的參與者收到之後publish的track所需時間
+	renegotiations []time.Duration
+	// publishedAt key: track ID
+	publishedAt map[string]time.Time
+
+	joinFailures        int
+	connectionFailures  int
+	negotiationFailures int
+	mediaErrors         int
+	tracksReceived      int
+
+	packetsReceived uint64
+	packetsExpected uint64
+
+	// in, out 上次report之後的payload bytes
+	in, out                 uint64
+	totalIn, totalOut       uint64
+	totalReceived, totalExp uint64
+
+	sync.Mutex
+}
+
+func newStats() *stats {
+	return &stats{
+		start:       time.Now(),
+		publishedAt: make(map[string]time.Time),
+	}
+}
+
+func (s *stats) joined(latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.joinLatencies = append(s.joinLatencies, latency)
+}
+
+func (s *stats) joinFailed() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.joinFailures++
+}
+
+func (s *stats) connectionFailed() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.connectionFailures++
+}
+
+func (s *stats) negotiationError() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.negotiationFailures++
+}
+
+func (s *stats) mediaError(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.mediaErrors == 0 {
+		fmt.Fprintf(os.Stderr, "media source error: %v\n", err)
+	}
+	s.mediaErrors++
+}
+
+func (s *stats) published(trackID string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.publishedAt[trackID] = time.Now()
+}
+
+// trackReceived receiverStart為接收者開始加入的時間，只有在track publish之前就加入的接收者才計入renegotiation時間
+func (s *stats) trackReceived(trackID string, receiverStart time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.tracksReceived++
+	if publishedAt, ok := s.publishedAt[trackID]; ok && receiverStart.Before(publishedAt) {
+		s.renegotiations = append(s.renegotiations, time.Since(publishedAt))
+	}
+}
+
+func (s *stats) packets(received, expected uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.packetsReceived += received
+	s.packetsExpected += expected
+}
+
+func (s *stats) bytesIn(n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.in += uint64(n)
+}
+
+func (s *stats) bytesOut(n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.out += uint64(n)
+}
+
+// report 每interval輸出一次統計直到stop
+func (s *stats) report(interval time.Duration, serverPID int, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastSelf, _ := selfCPUTime()
+	lastServer, _ := processCPUTime(serverPID)
+	last := time.Now()
+
+	fmt.Println("elapsed  joined  tracks  in_kbps  out_kbps  loss%  cpu%  server_cpu%")
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		elapsed := now.Sub(last).Seconds()
+		last = now
+
+		// 不支援的平台CPU欄位顯示"-"
+		selfCPU := "-"
+		if self, err := selfCPUTime(); err == nil {
+			selfCPU = fmt.Sprintf("%.0f", (self-lastSelf).Seconds()/elapsed*100)
+			lastSelf = self
+		}
+
+		serverCPU := "-"
+		if serverPID > 0 {
+			if cpu, err := processCPUTime(serverPID); err == nil {
+				serverCPU = fmt.Sprintf("%.1f", (cpu-lastServer).Seconds()/elapsed*100)
+				lastServer = cpu
+			}
+		}
+
+		s.Lock()
+		in, out := s.in, s.out
+		s.totalIn += in
+		s.totalOut += out
+		s.in, s.out = 0, 0
+		received, expected := s.packetsReceived, s.packetsExpected
+		s.totalReceived += received
+		s.totalExp += expected
+		s.packetsReceived, s.packetsExpected = 0, 0
+		joined, tracks := len(s.joinLatencies), s.tracksReceived
+		s.Unlock()
+
+		fmt.Printf("%7s  %6d  %6d  %7.0f  %8.0f  %5.2f  %4s  %11s\n",
+			time.Since(s.start).Round(time.Second),
+			joined, tracks,
+			float64(in*8)/elapsed/1000, float64(out*8)/elapsed/1000,
+			lossPercent(received, expected), selfCPU, serverCPU)
+	}
+}
+
+func (s *stats) summary() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.totalReceived += s.packetsReceived
+	s.totalExp += s.packetsExpected
+
+	fmt.Println()
+	fmt.Printf("participants joined:   %d (join failures %d, connection failures %d)\n",
+		len(s.joinLatencies), s.joinFailures, s.connectionFailures)
+	fmt.Printf("join latency:          %s\n", percentiles(s.joinLatencies))
+	fmt.Printf("renegotiation time:    %s\n", percentiles(s.renegotiations))
+	fmt.Printf("negotiation errors:    %d\n", s.negotiationFailures)
+	fmt.Printf("tracks received:       %d\n", s.tracksReceived)
+	fmt.Printf("packet loss:           %.2f%% (%d/%d)\n", lossPercent(s.totalReceived, s.totalExp), s.totalExp-min64(s.totalReceived, s.totalExp), s.totalExp)
+	fmt.Printf("payload in / out:      %.1f MB / %.1f MB\n", float64(s.totalIn)/1e6, float64(s.totalOut)/1e6)
+	if s.mediaErrors > 0 {
+		fmt.Printf("media source errors:   %d\n", s.mediaErrors)
+	}
+}
+
+func lossPercent(received, expected uint64) float64 {
+	if expected == 0 || received >= expected {
+		return 0
+	}
+	return float64(expected-received) / float64(expected) * 100
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// percentiles p50/p95/max
+func percentiles(d []time.Duration) string {
+	if len(d) == 0 {
+		return "-"
+	}
+
+	sorted := append([]time.Duration(nil), d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))].Round(time.Millisecond)
+	}
+	return fmt.Sprintf("p50 %v  p95 %v  max %v  (n=%d)", at(0.5), at(0.95), sorted[len(sorted)-1].Round(time.Millisecond), len(sorted))
+}
+
+// parseProcStat /proc/<pid>/stat的utime+stime
+func parseProcStat(stat string) (time.Duration, error) {
+	// comm欄位可能包含空白，從最後一個')'之後開始切
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected stat format")
+	}
+
+	// fields[0]為state(第3欄)，utime、stime為第14、15欄
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(utime+stime) * time.Second / procClockTicks, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentiles(t *testing.T) {
+	ms := func(v ...int) []time.Duration {
+		d := make([]time.Duration, len(v))
+		for i := range v {
+			d[i] = time.Duration(v[i]) * time.Millisecond
+		}
+		return d
+	}
+
+	tests := []struct {
+		name string
+		d    []time.Duration
+		want string
+	}{
+		{name: "empty", d: nil, want: "-"},
+		{name: "single", d: ms(42), want: "p50 42ms  p95 42ms  max 42ms  (n=1)"},
+		{name: "unsorted", d: ms(30, 10, 20), want: "p50 20ms  p95 20ms  max 30ms  (n=3)"},
+		{name: "hundred", d: ms(seq(1, 100)...), want: "p50 50ms  p95 95ms  max 100ms  (n=100)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := percentiles(test.d); got != test.want {
+				t.Errorf("percentiles = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func seq(from, to int) []int {
+	v := []int{}
+	for i := from; i <= to; i++ {
+		v = append(v, i)
+	}
+	return v
+}
+
+func TestLossPercent(t *testing.T) {
+	tests := []struct {
+		received, expected uint64
+		want               float64
+	}{
+		{received: 0, expected: 0, want: 0},
+		{received: 100, expected: 100, want: 0},
+		{received: 90, expected: 100, want: 10},
+		{received: 0, expected: 50, want: 100},
+		// 重複的packet使received大於expected
+		{received: 110, expected: 100, want: 0},
+	}
+
+	for _, test := range tests {
+		if got := lossPercent(test.received, test.expected); got != test.want {
+			t.Errorf("lossPercent(%d, %d) = %v, want %v", test.received, test.expected, got, test.want)
+		}
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		name    string
+		stat    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name: "plain comm",
+			stat: "1234 (sfu) S 1 1234 1234 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 12 0 100 1000 200",
+			want: 3 * time.Second,
+		},
+		{
+			// comm可以包含空白與')'
+			name: "comm with spaces",
+			stat: "1234 (my sfu) x) R 1 1234 1234 0 -1 4194560 100 0 0 0 7 3 0 0 20 0 12 0 100 1000 200",
+			want: 100 * time.Millisecond,
+		},
+		{name: "truncated", stat: "1234 (sfu) S 1 1234", wantErr: true},
+		{name: "invalid utime", stat: "1234 (sfu) S 1 1234 1234 0 -1 4194560 100 0 0 0 x 50 0", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseProcStat(test.stat)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseProcStat err = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parseProcStat = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
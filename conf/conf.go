@@ -1,5 +1,105 @@
 package conf
 
+import "time"
+
 var Domain = "edgarchang.net"
 
 var Addr = "0.0.0.0:8080"
+
+// PreferH264Video video transceiver優先使用H264，HLS egress只支援H264
+var PreferH264Video = false
+
+// HLSSegmentDuration HLS egress segment目標長度，同時也是向發言者要求keyframe的間隔
+var HLSSegmentDuration = 2 * time.Second
+
+// HLSPlaylistSize HLS live playlist中保留的segment數量
+var HLSPlaylistSize = 6
+
+// MixedAudioBitrate 混音輸出(MCU mode)的Opus bitrate
+// 混音需要libopus，以 go build -tags opus 建置，否則?audio=mixed的參與者退回一般模式
+var MixedAudioBitrate = 32000
+
+// SIPAddr SIP gateway UDP listen address，空字串不啟動
+// 有密碼、PIN或lobby的房間不接受來電，只能由host撥出
+// 未以 -tags opus 建置時電話只能以G.711送出聲音，聽不到WebRTC參與者(房間混音需要opus decoder)
+var SIPAddr = ""
+
+// SIPPublicIP SIP & SDP中對外公布的IP，電話會將RTP送至此IP
+var SIPPublicIP = "127.0.0.1"
+
+// SIPRTPTimeout 電話端超過此時間沒有送RTP視為斷線
+var SIPRTPTimeout = 30 * time.Second
+
+// NodeURL 此node供其他node連線的base URL(例如 http://10.0.0.1:8080)，空字串時不啟用cluster
+// lobby房間只在origin node加入，client會被轉到origin的NodeURL，因此NodeURL也需要client可以連線
+var NodeURL = ""
+
+// ClusterNodes cluster中所有node的base URL，可包含NodeURL本身
+var ClusterNodes = []string{}
+
+// ClusterSecret node之間呼叫/cluster API時帶在X-Cluster-Secret header的共用密鑰，設定NodeURL時必須設定
+var ClusterSecret = ""
+
+// RedisAddr 房間metadata改存於Redis，需設定NodeURL，空字串使用process內的memory store
+var RedisAddr = ""
+
+// RedisPassword Redis AUTH密碼
+var RedisPassword = ""
+
+// RedisDB Redis database index
+var RedisDB = 0
+
+// RoomStoreTTL 房間metadata在store中的保存時間，owner node停止或重啟後沒有再使用的房間在此時間後刪除，0為不過期
+var RoomStoreTTL = 10 * time.Minute
+
+// ResumeGracePeriod 參與者websocket斷線後保留peerConnection與track的時間，期間內可帶resume token重新連線，0為不保留
+var ResumeGracePeriod = 30 * time.Second
+
+// NegotiationTimeout server送出offer後等待client answer的時間，超時會通知client並重送offer
+var NegotiationTimeout = 10 * time.Second
+
+// MaxRoomParticipants 單一房間的參與者上限(包含電話)，0為不限制
+var MaxRoomParticipants = 0
+
+// MaxRoomPublishers 單一房間中同時publish track的參與者(包含電話)上限，0為不限制
+var MaxRoomPublishers = 0
+
+// MaxRoomVideoTracks 單一房間的camera video track上限，screen share不計入，0為不限制
+var MaxRoomVideoTracks = 0
+
+// MaxPeerConnections 整個server的參與者peerConnection上限，電話也計入，node之間的relay不計入，0為不限制
+var MaxPeerConnections = 0
+
+// MaxForwardedBitrate 整個server轉送給參與者的bitrate上限(bps)，超過時拒絕新的參與者與track，0為不限制
+var MaxForwardedBitrate = 0
+
+// EmptyRoomTimeout 最後一個參與者離開後保留房間的時間，排程房間從開始時間起算，0為不刪除
+var EmptyRoomTimeout = 10 * time.Minute
+
+// MaxRoomDuration 會議從第一個參與者加入起的最長時間，到達時結束會議，0為不限制
+var MaxRoomDuration = time.Duration(0)
+
+// RoomEndWarning 會議結束前送出roomEnding event的時間
+var RoomEndWarning = time.Minute
+
+// PasswordMaxAttempts 同一個IP在PasswordAttemptWindow內密碼錯誤的上限，查詢不存在的room alias也使用此上限，0為不限制
+var PasswordMaxAttempts = 5
+
+// PasswordAttemptWindow 密碼錯誤次數的計算區間
+var PasswordAttemptWindow = time.Minute
+
+// TrustedProxies 前端TLS反向代理的IP或CIDR，只有來自這些位址的request才採用X-Forwarded-For與X-Real-IP作為client IP
+// 空白時使用連線的IP，放在反向代理之後卻未設定時，所有client共用代理的IP與密碼錯誤次數
+var TrustedProxies = []string{}
+
+// ExclusiveScreenShare 房間中同時只允許一個參與者分享畫面
+var ExclusiveScreenShare = false
+
+// LastN 每個連線最多轉送的video track數，screen share優先，其餘為最近開始送出RTP的track，0為不限制
+var LastN = 0
+
+// MaxPublishTracks 單一參與者可以publish的track(接收用transceiver)上限，0為不限制
+var MaxPublishTracks = 8
+
+// KeyFrameRequestInterval 向同一個publisher track要求keyframe的最短間隔，間隔內的要求合併為一次
+var KeyFrameRequestInterval = 500 * time.Millisecond
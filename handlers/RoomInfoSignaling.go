@@ -6,13 +6,105 @@ import (
 	"net/http"
 	"sync"
 	"time"
+	"webrtc_sfu_conference/signalingpb"
 
 	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
 )
 
+// roomsInfoUpgrader rooms info websocket，client要求subprotocol "sfu.roomsinfo.proto"時改用protobuf binary message
+var roomsInfoUpgrader = websocket.Upgrader{
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{signalingpb.RoomsInfoSubprotocol},
+}
+
+// roomsInfo getIoomsInfo的結果，key為room ID
+type roomsInfo map[string][]participantState
+
+// participantState rooms info中單一參與者的狀態，store中其他instance的參與者只有kind、node
+type participantState struct {
+	No                  int    `json:"No"`
+	ID                  string `json:"id"`
+	Kind                string `json:"kind,omitempty"`
+	Node                string `json:"node,omitempty"`
+	SignalingState      string `json:"signaling_state,omitempty"`
+	PeerConnectionState string `json:"peerConnectio_state,omitempty"`
+	ReceiveTrackNum     int    `json:"receive_track_num"`
+	SendTrackNum        int    `json:"send_track_num"`
+}
+
+// roomsInfoConn 依協商的encoding送出rooms info
+type roomsInfoConn struct {
+	*threadSafeWebSocketWriter
+	binary bool
+}
+
+// send info為nil時只送出event
+func (c *roomsInfoConn) send(event string, info roomsInfo) error {
+	if c.binary {
+		msg := &signalingpb.RoomsInfoMessage{Event: event}
+		if info != nil {
+			msg.Rooms = make(map[string]*signalingpb.RoomState, len(info))
+			for roomID, participants := range info {
+				states := make([]*signalingpb.ParticipantState, len(participants))
+				for i, p := range participants {
+					states[i] = &signalingpb.ParticipantState{
+						No:                  uint32(p.No),
+						Id:                  p.ID,
+						Kind:                p.Kind,
+						Node:                p.Node,
+						SignalingState:      p.SignalingState,
+						PeerConnectionState: p.PeerConnectionState,
+						ReceiveTrackNum:     uint32(p.ReceiveTrackNum),
+						SendTrackNum:        uint32(p.SendTrackNum),
+					}
+				}
+				msg.Rooms[roomID] = &signalingpb.RoomState{Participants: states}
+			}
+		}
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return c.WriteBinary(b)
+	}
+
+	data := ""
+	if info != nil {
+		infoStr, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		data = string(infoStr)
+	}
+	return c.WriteJSON(&websocketwebRTCMessage{
+		Event: event,
+		Data:  data,
+	})
+}
+
+// readEvent 讀取client送出的event
+func (c *roomsInfoConn) readEvent(data []byte) (string, error) {
+	if c.binary {
+		msg := &signalingpb.RoomsInfoMessage{}
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return "", err
+		}
+		return msg.Event, nil
+	}
+
+	message := &websocketwebRTCMessage{}
+	if err := json.Unmarshal(data, message); err != nil {
+		return "", err
+	}
+	return message.Event, nil
+}
+
 type roomsInfoSignalingServer struct {
+	sfu *SFU
+
 	// 所有連線，尚未處理斷線client移除自slice
-	Clients []*threadSafeWebSocketWriter
+	Clients []*roomsInfoConn
 
 	// use rooms info as update signal, data make from getIoomsInfo()
 	UpdateSignal chan string
@@ -24,37 +116,36 @@ type roomsInfoSignalingServer struct {
 func (s *roomsInfoSignalingServer) run() {
 	for {
 		select {
+		case <-s.sfu.closed:
+			return
+
 		case msg := <-s.UpdateSignal:
-			Infof(msg)
+			s.sfu.log.Infof(msg)
 
-			roomsInfo := getIoomsInfo()
-			infoStr, err := json.Marshal(roomsInfo)
-			if err != nil {
-				Errorf(err.Error())
-				return
-			}
+			roomsInfo := s.sfu.getIoomsInfo()
 
-			for i, client := range s.Clients {
-				if err := client.WriteJSON(
-					&websocketwebRTCMessage{
-						Event: "info",
-						Data:  string(infoStr),
-					},
-				); err != nil {
+			// 寫入失敗的client移除
+			s.Lock()
+			clients := s.Clients[:0]
+			for _, client := range s.Clients {
+				if err := client.send("info", roomsInfo); err != nil {
 					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						Errorf("web socket keep alive Unexpected Close Error: %v", err)
+						s.sfu.log.Errorf("web socket keep alive Unexpected Close Error: %v", err)
 					}
-
-					s.Clients = append(s.Clients[:i], s.Clients[i+1:]...)
+					continue
 				}
+				clients = append(clients, client)
 			}
+			s.Clients = clients
+			s.Unlock()
 		}
 	}
 }
 
-func newSignalingServer() *roomsInfoSignalingServer {
+func newSignalingServer(sfu *SFU) *roomsInfoSignalingServer {
 	s := &roomsInfoSignalingServer{
-		Clients:      make([]*threadSafeWebSocketWriter, 0, 10),
+		sfu:          sfu,
+		Clients:      make([]*roomsInfoConn, 0, 10),
 		UpdateSignal: make(chan string, 10),
 	}
 
@@ -63,26 +154,35 @@ func newSignalingServer() *roomsInfoSignalingServer {
 	return s
 }
 
-var signalingServer = newSignalingServer()
+// update 通知rooms info feed，SFU Close後不再阻塞
+func (s *roomsInfoSignalingServer) update(msg string) {
+	select {
+	case s.UpdateSignal <- msg:
+	case <-s.sfu.closed:
+	}
+}
 
-func RoomInfoSignaling(w http.ResponseWriter, r *http.Request) {
+func (s *SFU) RoomInfoSignaling(w http.ResponseWriter, r *http.Request) {
 	// Upgrade HTTP request to Websocket
-	unsafeConn, err := webSocketUpgrader.Upgrade(w, r, nil)
+	unsafeConn, err := roomsInfoUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("webSocket Error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	wsc := &threadSafeWebSocketWriter{
-		unsafeConn,
-		sync.Mutex{},
+	wsc := &roomsInfoConn{
+		threadSafeWebSocketWriter: &threadSafeWebSocketWriter{
+			unsafeConn,
+			sync.Mutex{},
+		},
+		binary: unsafeConn.Subprotocol() == signalingpb.RoomsInfoSubprotocol,
 	}
 
 	// When this frame returns close the Websocket
 	defer func() {
 		if cErr := wsc.Close(); cErr != nil {
 			if websocket.IsUnexpectedCloseError(cErr, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				Errorf("web socket read message Unexpected Close Error: %v", cErr)
+				s.log.Errorf("web socket read message Unexpected Close Error: %v", cErr)
 				return
 			}
 		}
@@ -95,7 +195,7 @@ func RoomInfoSignaling(w http.ResponseWriter, r *http.Request) {
 			_, rawData, err := wsc.ReadMessage()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					Errorf("web socket read message unexpected close error: %v", err)
+					s.log.Errorf("web socket read message unexpected close error: %v", err)
 				}
 				close(stop)
 				break
@@ -104,24 +204,19 @@ func RoomInfoSignaling(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	signalingServer.Lock()
-	signalingServer.Clients = append(signalingServer.Clients, wsc)
-	signalingServer.Unlock()
+	s.signaling.Lock()
+	s.signaling.Clients = append(s.signaling.Clients, wsc)
+	s.signaling.Unlock()
 
 	// stop := make(chan struct{})
 	keepAliveTicker := time.NewTicker(10 * time.Second)
-	message := &websocketwebRTCMessage{}
 	for {
 		select {
 		case <-keepAliveTicker.C:
-			if err := wsc.WriteJSON(
-				&websocketwebRTCMessage{
-					Event: "keepalive",
-				},
-			); err != nil {
+			if err := wsc.send("keepalive", nil); err != nil {
 				keepAliveTicker.Stop()
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					Errorf("web socket keep alive Unexpected Close Error: %v", err)
+					s.log.Errorf("web socket keep alive Unexpected Close Error: %v", err)
 				}
 				return
 			}
@@ -130,30 +225,17 @@ func RoomInfoSignaling(w http.ResponseWriter, r *http.Request) {
 			return
 
 		case data := <-webSocketData:
-			err := json.Unmarshal(data, &message)
+			event, err := wsc.readEvent(data)
 			if err != nil {
-				Errorf("web socket message json parse error: %v", err)
+				s.log.Errorf("web socket message parse error: %v", err)
 				return
 			}
-			switch message.Event {
+			switch event {
 			case "update":
-				roomsInfo := getIoomsInfo()
-
-				infoStr, err := json.Marshal(roomsInfo)
-				if err != nil {
-					Errorf(err.Error())
-					return
-				}
-
-				if err := wsc.WriteJSON(
-					&websocketwebRTCMessage{
-						Event: "info",
-						Data:  string(infoStr),
-					},
-				); err != nil {
+				if err := wsc.send("info", s.getIoomsInfo()); err != nil {
 					keepAliveTicker.Stop()
 					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						Errorf("web socket keep alive Unexpected Close Error: %v", err)
+						s.log.Errorf("web socket keep alive Unexpected Close Error: %v", err)
 					}
 					return
 				}
@@ -163,25 +245,53 @@ func RoomInfoSignaling(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getIoomsInfo() map[string]interface{} {
-	roomsInfo := make(map[string]interface{})
+// getIoomsInfo 此node上的房間回傳每個peerConnection的狀態，其他instance的房間只有store中的參與者
+func (s *SFU) getIoomsInfo() roomsInfo {
+	info := make(roomsInfo)
 
-	for k, room := range webrtcSrv.Rooms {
-		state := make([]map[string]interface{}, len(webrtcSrv.Rooms[k].conns))
+	rooms, err := s.store.ListRooms()
+	if err != nil {
+		s.log.Errorf("rooms info list rooms error: %v", err)
+	}
+	for _, meta := range rooms {
+		participants, err := s.store.ListParticipants(meta.RoomID)
+		if err != nil {
+			s.log.Errorf("rooms info list room %v participants error: %v", meta.RoomID, err)
+			continue
+		}
 
-		for i, client := range room.conns {
-			info := map[string]interface{}{
-				"No":                  i,
-				"signaling_state":     client.peerConnection.SignalingState().String(),
-				"peerConnectio_state": client.peerConnection.ConnectionState().String(),
-				"receive_track_num":   len(client.peerConnection.GetReceivers()),
-				"send_track_num":      len(client.peerConnection.GetSenders()),
+		state := make([]participantState, len(participants))
+		for i, p := range participants {
+			state[i] = participantState{
+				No:   i,
+				ID:   p.ID,
+				Kind: p.Kind,
+				Node: p.Node,
 			}
+		}
+		info[meta.RoomID.String()] = state
+	}
+
+	s.RLock()
+	defer s.RUnlock()
 
-			state[i] = info
+	for k, room := range s.rooms {
+		room.RLock()
+		state := make([]participantState, len(room.conns))
+
+		for i, client := range room.conns {
+			state[i] = participantState{
+				No:                  i,
+				ID:                  client.participantID,
+				SignalingState:      client.peerConnection.SignalingState().String(),
+				PeerConnectionState: client.peerConnection.ConnectionState().String(),
+				ReceiveTrackNum:     len(client.peerConnection.GetReceivers()),
+				SendTrackNum:        len(client.peerConnection.GetSenders()),
+			}
 		}
-		roomsInfo[k.String()] = state
+		room.RUnlock()
+		info[k.String()] = state
 	}
 
-	return roomsInfo
+	return info
 }
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// 超過容量時回覆client的error code
+const (
+	admissionRoomFull   = "roomFull"
+	admissionServerBusy = "serverBusy"
+)
+
+// closeRoomFull websocket close code，v1 client沒有error event，從close frame得知原因
+// serverBusy使用標準的1013 Try Again Later
+const closeRoomFull = 4001
+
+// bitrateWindow forwarded bitrate的計算區間
+const bitrateWindow = time.Second
+
+// admissionError 超過房間或server容量
+type admissionError struct {
+	code   string
+	reason string
+}
+
+func (e *admissionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.reason)
+}
+
+func roomFull(format string, v ...interface{}) *admissionError {
+	return &admissionError{code: admissionRoomFull, reason: fmt.Sprintf(format, v...)}
+}
+
+func serverBusy(format string, v ...interface{}) *admissionError {
+	return &admissionError{code: admissionServerBusy, reason: fmt.Sprintf(format, v...)}
+}
+
+// serverLoad server-wide的peerConnection數與forwarded bitrate
+type serverLoad struct {
+	peerConnections int64
+
+	// forwardedBytes 目前區間送出的bytes，bitrate為上一個完整區間的值
+	forwardedBytes int64
+	bitrate        int64
+}
+
+// run 每個bitrateWindow更新forwarded bitrate直到SFU Close
+func (l *serverLoad) run(closed <-chan struct{}) {
+	ticker := time.NewTicker(bitrateWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		bytes := atomic.SwapInt64(&l.forwardedBytes, 0)
+		atomic.StoreInt64(&l.bitrate, int64(float64(bytes*8)/bitrateWindow.Seconds()))
+	}
+}
+
+// forwarded 記錄轉送給subscribers個peerConnection的RTP payload
+func (l *serverLoad) forwarded(bytes, subscribers int) {
+	if subscribers > 0 {
+		atomic.AddInt64(&l.forwardedBytes, int64(bytes*subscribers))
+	}
+}
+
+// checkBitrate 超過MaxForwardedBitrate時回傳serverBusy
+func (s *SFU) checkBitrate() *admissionError {
+	if s.config.MaxForwardedBitrate <= 0 {
+		return nil
+	}
+	if bitrate := atomic.LoadInt64(&s.load.bitrate); bitrate >= int64(s.config.MaxForwardedBitrate) {
+		return serverBusy("forwarded bitrate %d bps reached limit %d bps", bitrate, s.config.MaxForwardedBitrate)
+	}
+	return nil
+}
+
+// admitPeerConnection 保留一個server-wide的peerConnection名額，成功時結束連線需呼叫release
+func (s *SFU) admitPeerConnection() (release func(), err *admissionError) {
+	if err := s.checkBitrate(); err != nil {
+		return nil, err
+	}
+
+	count := atomic.AddInt64(&s.load.peerConnections, 1)
+	if max := s.config.MaxPeerConnections; max > 0 && count > int64(max) {
+		atomic.AddInt64(&s.load.peerConnections, -1)
+		return nil, serverBusy("%d peer connections reached limit", max)
+	}
+
+	return func() {
+		atomic.AddInt64(&s.load.peerConnections, -1)
+	}, nil
+}
+
+// admitParticipant 保留房間與server的名額，在serveConnection將連線加入room.conns之前呼叫
+// 電話同樣經過此檢查(見admitSIPParticipant)，成功時結束連線或通話需呼叫release，relay連線不經過此檢查，見ClusterRelay
+func (r *ConferenceRoom) admitParticipant() (release func(), err *admissionError) {
+	releasePC, err := r.sfu.admitPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Lock()
+	if max := r.sfu.config.MaxRoomParticipants; max > 0 && r.admitted >= max {
+		r.Unlock()
+		releasePC()
+		return nil, roomFull("room %v has %d participants", r.RoomID, max)
+	}
+	r.admitted++
+	r.Unlock()
+
+	return func() {
+		r.Lock()
+		r.admitted--
+		r.Unlock()
+		releasePC()
+	}, nil
+}
+
+// admitSIPParticipant 電話參與者撥出或接聽前檢查排程，並與websocket參與者相同保留房間與server的名額
+// 尚未接通的電話也佔用名額，成功時通話結束(包含撥出失敗)需呼叫release
+func (r *ConferenceRoom) admitSIPParticipant() (release func(), err *admissionError) {
+	if err := r.checkStarted(); err != nil {
+		return nil, err
+	}
+	return r.admitParticipant()
+}
+
+// checkPublish publisher新增track前檢查房間publisher數、video track數與server bitrate，呼叫者需持有room lock
+// screen share不計入video track上限，也不因server bitrate拒絕；轉送給各連線時的優先順序見limitVideoTracks
+func (r *ConferenceRoom) checkPublish(publisher string, kind webrtc.RTPCodecType, label string) *admissionError {
+	config := r.sfu.config
+
+	publishers := map[string]bool{}
+	videoTracks := 0
+	for id, p := range r.trackPublishers {
+		publishers[p] = true
+		if track, ok := r.clientTracks[id]; ok && track.Kind() == webrtc.RTPCodecTypeVideo && !isScreenLabel(r.trackLabelOf(id, track.Kind())) {
+			videoTracks++
+		}
+	}
+
+	if max := config.MaxRoomPublishers; max > 0 && !publishers[publisher] && len(publishers) >= max {
+		return roomFull("room %v has %d publishers", r.RoomID, max)
+	}
+	if isScreenLabel(label) {
+		return r.checkScreenShare(publisher)
+	}
+	if max := config.MaxRoomVideoTracks; max > 0 && kind == webrtc.RTPCodecTypeVideo && videoTracks >= max {
+		return roomFull("room %v has %d video tracks", r.RoomID, max)
+	}
+	return r.sfu.checkBitrate()
+}
+
+// rejectConnection 通知client超過容量並關閉websocket
+func rejectConnection(wsc *signalingConn, err *admissionError) {
+	_ = wsc.sendError("", err.code, err.reason)
+
+	code := closeRoomFull
+	switch err.code {
+	case admissionServerBusy:
+		code = websocket.CloseTryAgainLater
+	case admissionNotStarted:
+		code = closeRoomNotStarted
+	case passwordErrRequired, passwordErrInvalid:
+		code = closeInvalidPassword
+	case passwordErrTooManyAttempts:
+		code = closeTooManyAttempts
+	case roomErrNotFound:
+		code = closeRoomNotFound
+	case roomErrOnOrigin:
+		code = closeRoomOnOrigin
+	}
+	_ = wsc.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, err.code),
+		time.Now().Add(time.Second))
+}
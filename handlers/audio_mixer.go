@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mixerSampleRate = 48000
+	mixerChannels   = 1
+
+	// 每20ms輸出一個frame
+	mixerFrameDuration = 20 * time.Millisecond
+	mixerFrameSamples  = mixerSampleRate / 1000 * 20 * mixerChannels
+
+	// 單一source最多緩衝100ms，超過丟棄最舊的sample，避免延遲累積
+	mixerMaxBufferedSamples = mixerFrameSamples * 5
+
+	// source超過此時間沒有收到packet視為已離開
+	mixerSourceTimeout = 5 * time.Second
+
+	// opus單一packet最長120ms
+	mixerMaxDecodeSamples = mixerSampleRate / 1000 * 120 * mixerChannels
+	mixerMaxPacketSize    = 1500
+)
+
+type opusDecoder interface {
+	// decode 回傳寫入pcm的sample數量
+	decode(packet []byte, pcm []int16) (int, error)
+	close()
+}
+
+type opusEncoder interface {
+	// encode pcm為一個完整frame，回傳寫入packet的byte數
+	encode(pcm []int16, packet []byte) (int, error)
+	close()
+}
+
+// mixerSource 單一publisher的audio，decode後的PCM暫存於pcm，直接寫入PCM的source(SIP...)沒有decoder
+type mixerSource struct {
+	decoder    opusDecoder
+	pcm        []int16
+	frame      []int16
+	lastPacket time.Time
+}
+
+// mixerOutput 一個混音輸出，pc所publish的audio以及ownSources不會被混入(聽不到自己的聲音)
+// encoder為nil時輸出未編碼的PCM至writePCM
+type mixerOutput struct {
+	pc          *webrtc.PeerConnection
+	ownSources  []string
+	encoder     opusEncoder
+	writeSample func(data []byte, duration time.Duration) error
+	writePCM    func(pcm []int16)
+
+	// excluded 不混入的source track ID
+	excluded map[string]bool
+	pcm      []int16
+	packet   []byte
+}
+
+// audioMixer 房間的混音器(MCU mode)，從OnTrack read loop收到所有Opus audio，decode -> mix -> 對每個輸出encode
+// 只有在有輸出(混音參與者、egress...)時才會啟動
+type audioMixer struct {
+	room *ConferenceRoom
+
+	// sources key: track ID
+	sources map[string]*mixerSource
+	outputs []*mixerOutput
+
+	// sourcesChanged source新增或移除，需重新計算每個輸出的excluded
+	sourcesChanged bool
+
+	decodeBuffer []int16
+
+	// decoderWarned 已提示過無法建立decoder
+	decoderWarned bool
+
+	stop chan struct{}
+
+	sync.Mutex
+}
+
+func newAudioMixer(room *ConferenceRoom) *audioMixer {
+	return &audioMixer{
+		room:         room,
+		sources:      make(map[string]*mixerSource),
+		decodeBuffer: make([]int16, mixerMaxDecodeSamples),
+		stop:         make(chan struct{}),
+	}
+}
+
+// addMixerOutput 新增混音輸出，房間第一個輸出時啟動混音器
+func (r *ConferenceRoom) addMixerOutput(pc *webrtc.PeerConnection, writeSample func(data []byte, duration time.Duration) error) (*mixerOutput, error) {
+	encoder, err := newOpusEncoder(r.sfu.config.MixedAudioBitrate)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &mixerOutput{
+		pc:          pc,
+		encoder:     encoder,
+		writeSample: writeSample,
+		excluded:    make(map[string]bool),
+		pcm:         make([]int16, mixerFrameSamples),
+		packet:      make([]byte, mixerMaxPacketSize),
+	}
+
+	return output, r.attachMixerOutput(output)
+}
+
+// addMixerPCMOutput 新增輸出48kHz PCM的混音輸出，ownSources為不混入的source ID
+// source中的WebRTC參與者仍需要opus decoder，沒有opus支援時只會混入PCM source
+func (r *ConferenceRoom) addMixerPCMOutput(ownSources []string, writePCM func(pcm []int16)) (*mixerOutput, error) {
+	output := &mixerOutput{
+		ownSources: ownSources,
+		writePCM:   writePCM,
+		excluded:   make(map[string]bool),
+		pcm:        make([]int16, mixerFrameSamples),
+	}
+
+	return output, r.attachMixerOutput(output)
+}
+
+// attachMixerOutput 房間第一個輸出時啟動混音器
+func (r *ConferenceRoom) attachMixerOutput(output *mixerOutput) error {
+	r.Lock()
+	m := r.mixer
+	started := m == nil
+	if started {
+		m = newAudioMixer(r)
+		r.mixer = m
+	}
+	r.Unlock()
+
+	m.Lock()
+	m.outputs = append(m.outputs, output)
+	m.sourcesChanged = true
+	m.Unlock()
+
+	if started {
+		r.addSink(m)
+		go m.run()
+		r.sfu.log.Infof("room %v audio mixer started", r.RoomID)
+	}
+
+	return nil
+}
+
+// getMixer 房間目前的混音器，沒有混音輸出時為nil
+func (r *ConferenceRoom) getMixer() *audioMixer {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.mixer
+}
+
+// removeMixerOutput 移除混音輸出，沒有任何輸出時停止混音器
+func (r *ConferenceRoom) removeMixerOutput(output *mixerOutput) {
+	r.Lock()
+	m := r.mixer
+	if m == nil {
+		r.Unlock()
+		return
+	}
+
+	m.Lock()
+	for i := range m.outputs {
+		if m.outputs[i] == output {
+			m.outputs = append(m.outputs[:i], m.outputs[i+1:]...)
+			break
+		}
+	}
+	empty := len(m.outputs) == 0
+	// encode只在mixer lock中執行，此處close不會與encode同時發生
+	if output.encoder != nil {
+		output.encoder.close()
+	}
+	m.Unlock()
+
+	if empty {
+		r.mixer = nil
+	}
+	r.Unlock()
+
+	if empty {
+		r.removeSink(m)
+		close(m.stop)
+		r.sfu.log.Infof("room %v audio mixer stopped", r.RoomID)
+	}
+}
+
+// writeRTP implements rtpSink
+func (m *audioMixer) writeRTP(t *webrtc.TrackRemote, pkt *rtp.Packet, _ *senderClock) {
+	if t.Kind() != webrtc.RTPCodecTypeAudio || !strings.EqualFold(t.Codec().MimeType, webrtc.MimeTypeOpus) {
+		return
+	}
+
+	m.writeOpus(t.ID(), pkt.Payload)
+}
+
+// writeOpus 寫入source的Opus packet
+func (m *audioMixer) writeOpus(sourceID string, payload []byte) {
+	m.Lock()
+	defer m.Unlock()
+
+	src, ok := m.sources[sourceID]
+	if !ok {
+		src = m.newSource(sourceID)
+
+		decoder, err := newOpusDecoder()
+		if err != nil && !m.decoderWarned {
+			// 沒有opus支援時只提示一次，此source保持靜音
+			m.decoderWarned = true
+			m.room.sfu.log.Errorf("room %v audio mixer create decoder error: %v", m.room.RoomID, err)
+		}
+		src.decoder = decoder
+	}
+
+	if src.decoder == nil {
+		src.lastPacket = time.Now()
+		return
+	}
+
+	n, err := src.decoder.decode(payload, m.decodeBuffer)
+	if err != nil {
+		m.room.sfu.log.Debugf("room %v audio mixer source %s decode error: %v", m.room.RoomID, sourceID, err)
+		return
+	}
+
+	src.appendPCM(m.decodeBuffer[:n])
+}
+
+// writePCM 寫入source的48kHz PCM，用於非Opus的參與者
+func (m *audioMixer) writePCM(sourceID string, pcm []int16) {
+	m.Lock()
+	defer m.Unlock()
+
+	src, ok := m.sources[sourceID]
+	if !ok {
+		src = m.newSource(sourceID)
+	}
+
+	src.appendPCM(pcm)
+}
+
+func (m *audioMixer) newSource(sourceID string) *mixerSource {
+	src := &mixerSource{
+		frame: make([]int16, mixerFrameSamples),
+	}
+	m.sources[sourceID] = src
+	m.sourcesChanged = true
+
+	return src
+}
+
+func (s *mixerSource) appendPCM(pcm []int16) {
+	s.lastPacket = time.Now()
+
+	s.pcm = append(s.pcm, pcm...)
+	if over := len(s.pcm) - mixerMaxBufferedSamples; over > 0 {
+		s.pcm = append(s.pcm[:0], s.pcm[over:]...)
+	}
+}
+
+func (s *mixerSource) close() {
+	if s.decoder != nil {
+		s.decoder.close()
+	}
+}
+
+func (m *audioMixer) run() {
+	ticker := time.NewTicker(mixerFrameDuration)
+	defer ticker.Stop()
+
+	total := make([]int32, mixerFrameSamples)
+
+	for {
+		select {
+		case <-m.stop:
+			m.Lock()
+			for _, src := range m.sources {
+				src.close()
+			}
+			m.sources = map[string]*mixerSource{}
+			m.Unlock()
+			return
+
+		case <-ticker.C:
+		}
+
+		// 寫出不持有mixer lock，避免egress等輸出卡住RTP read loop
+		for _, frame := range m.mixFrame(total) {
+			if frame.output.encoder == nil {
+				frame.output.writePCM(frame.output.pcm)
+				continue
+			}
+
+			if err := frame.output.writeSample(frame.data, mixerFrameDuration); err != nil {
+				m.room.sfu.log.Debugf("room %v audio mixer write sample error: %v", m.room.RoomID, err)
+			}
+		}
+	}
+}
+
+// mixedFrame 一個輸出這次encode的結果，data & output.pcm在下一次mixFrame前有效
+type mixedFrame struct {
+	output *mixerOutput
+	data   []byte
+}
+
+// mixFrame 從每個source取出一個frame加總，再替每個輸出扣掉excluded source後encode
+func (m *audioMixer) mixFrame(total []int32) []mixedFrame {
+	m.Lock()
+	defer m.Unlock()
+
+	for i := range total {
+		total[i] = 0
+	}
+
+	for id, src := range m.sources {
+		if time.Since(src.lastPacket) > mixerSourceTimeout {
+			src.close()
+			delete(m.sources, id)
+			m.sourcesChanged = true
+			continue
+		}
+
+		n := copy(src.frame, src.pcm)
+		for i := n; i < len(src.frame); i++ {
+			src.frame[i] = 0
+		}
+		src.pcm = append(src.pcm[:0], src.pcm[n:]...)
+
+		for i, v := range src.frame {
+			total[i] += int32(v)
+		}
+	}
+
+	if m.sourcesChanged {
+		m.sourcesChanged = false
+		for _, output := range m.outputs {
+			output.excluded = make(map[string]bool)
+			for _, id := range output.ownSources {
+				if _, ok := m.sources[id]; ok {
+					output.excluded[id] = true
+				}
+			}
+			if output.pc == nil {
+				continue
+			}
+			for _, receiver := range output.pc.GetReceivers() {
+				if track := receiver.Track(); track != nil {
+					if _, ok := m.sources[track.ID()]; ok {
+						output.excluded[track.ID()] = true
+					}
+				}
+			}
+		}
+	}
+
+	frames := make([]mixedFrame, 0, len(m.outputs))
+	for _, output := range m.outputs {
+		for i := range output.pcm {
+			v := total[i]
+			for id := range output.excluded {
+				if src, ok := m.sources[id]; ok {
+					v -= int32(src.frame[i])
+				}
+			}
+			output.pcm[i] = clipInt16(v)
+		}
+
+		if output.encoder == nil {
+			frames = append(frames, mixedFrame{output: output})
+			continue
+		}
+
+		n, err := output.encoder.encode(output.pcm, output.packet)
+		if err != nil {
+			m.room.sfu.log.Errorf("room %v audio mixer encode error: %v", m.room.RoomID, err)
+			continue
+		}
+		frames = append(frames, mixedFrame{output: output, data: output.packet[:n]})
+	}
+
+	return frames
+}
+
+func clipInt16(v int32) int16 {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
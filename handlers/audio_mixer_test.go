@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fakeOpusDecoder 每個packet decode為一個固定值的frame，不需要cgo
+type fakeOpusDecoder struct {
+	value  int16
+	closed bool
+}
+
+func (d *fakeOpusDecoder) decode(packet []byte, pcm []int16) (int, error) {
+	for i := 0; i < mixerFrameSamples; i++ {
+		pcm[i] = d.value
+	}
+	return mixerFrameSamples, nil
+}
+
+func (d *fakeOpusDecoder) close() {
+	d.closed = true
+}
+
+// fakeOpusEncoder 只寫入frame的第一個sample
+type fakeOpusEncoder struct {
+	frames int
+}
+
+func (e *fakeOpusEncoder) encode(pcm []int16, packet []byte) (int, error) {
+	e.frames++
+	binary.BigEndian.PutUint16(packet, uint16(pcm[0]))
+	return 2, nil
+}
+
+func (e *fakeOpusEncoder) close() {}
+
+func TestAudioMixerMixFrame(t *testing.T) {
+	type source struct {
+		id    string
+		value int16
+		// pcm 以writePCM寫入，否則以fake decoder decode
+		pcm bool
+		// idle 距離最後一個packet的時間
+		idle time.Duration
+	}
+
+	tests := []struct {
+		name       string
+		sources    []source
+		ownSources []string
+		want       int16
+		removed    []string
+	}{
+		{
+			name:    "mix all sources",
+			sources: []source{{id: "a", value: 100}, {id: "b", value: 200}, {id: "sip", value: -50, pcm: true}},
+			want:    250,
+		},
+		{
+			name:       "exclude own source",
+			sources:    []source{{id: "a", value: 100}, {id: "b", value: 200}},
+			ownSources: []string{"a"},
+			want:       200,
+		},
+		{
+			name:       "exclude own pcm source",
+			sources:    []source{{id: "a", value: 100}, {id: "sip", value: 300, pcm: true}},
+			ownSources: []string{"sip"},
+			want:       100,
+		},
+		{
+			name:    "clip",
+			sources: []source{{id: "a", value: 30000}, {id: "b", value: 10000}},
+			want:    32767,
+		},
+		{
+			name:    "source timeout",
+			sources: []source{{id: "a", value: 100}, {id: "gone", value: 200, idle: mixerSourceTimeout + time.Second}},
+			want:    100,
+			removed: []string{"gone"},
+		},
+		{
+			name:    "no sources",
+			sources: []source{},
+			want:    0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := NewSFU()
+			if err != nil {
+				t.Fatalf("new sfu: %v", err)
+			}
+			defer s.Close()
+
+			m := newAudioMixer(&ConferenceRoom{RoomID: uuid.New(), sfu: s})
+			decoders := map[string]*fakeOpusDecoder{}
+			for _, src := range test.sources {
+				if src.pcm {
+					pcm := make([]int16, mixerFrameSamples)
+					for i := range pcm {
+						pcm[i] = src.value
+					}
+					m.writePCM(src.id, pcm)
+				} else {
+					// 預先建立source，writeOpus不會再建立cgo decoder
+					decoders[src.id] = &fakeOpusDecoder{value: src.value}
+					m.newSource(src.id).decoder = decoders[src.id]
+					m.writeOpus(src.id, []byte{0})
+				}
+				m.sources[src.id].lastPacket = time.Now().Add(-src.idle)
+			}
+
+			encoder := &fakeOpusEncoder{}
+			output := &mixerOutput{
+				ownSources: test.ownSources,
+				encoder:    encoder,
+				excluded:   make(map[string]bool),
+				pcm:        make([]int16, mixerFrameSamples),
+				packet:     make([]byte, mixerMaxPacketSize),
+			}
+			m.outputs = append(m.outputs, output)
+
+			total := make([]int32, mixerFrameSamples)
+			frames := m.mixFrame(total)
+			if len(frames) != 1 || frames[0].output != output {
+				t.Fatalf("mixFrame returned %d frames, want 1", len(frames))
+			}
+			for i, v := range output.pcm {
+				if v != test.want {
+					t.Fatalf("pcm[%d] = %d, want %d", i, v, test.want)
+				}
+			}
+			if got := int16(binary.BigEndian.Uint16(frames[0].data)); got != test.want || encoder.frames != 1 {
+				t.Errorf("encoded %d in %d frames, want %d in 1 frame", got, encoder.frames, test.want)
+			}
+
+			for _, id := range test.removed {
+				if _, ok := m.sources[id]; ok {
+					t.Errorf("source %s not removed", id)
+				}
+				if d := decoders[id]; d != nil && !d.closed {
+					t.Errorf("source %s decoder not closed", id)
+				}
+			}
+
+			// 緩衝的sample已取出，下一個frame為靜音
+			m.mixFrame(total)
+			for i, v := range output.pcm {
+				if v != 0 {
+					t.Fatalf("next frame pcm[%d] = %d, want 0", i, v)
+				}
+			}
+		})
+	}
+}
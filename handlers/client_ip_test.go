@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIP(t *testing.T) {
+	config := DefaultConfig()
+	config.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16"}
+	s, err := NewSFU(WithConfig(config))
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.5:4321", want: "203.0.113.5"},
+		{name: "untrusted forwarded", remoteAddr: "203.0.113.5:4321", forwarded: []string{"198.51.100.7"}, realIP: "198.51.100.8", want: "203.0.113.5"},
+		{name: "trusted forwarded", remoteAddr: "10.0.0.1:4321", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "spoofed first hop", remoteAddr: "10.0.0.1:4321", forwarded: []string{"1.2.3.4, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "proxy chain", remoteAddr: "10.0.0.1:4321", forwarded: []string{"198.51.100.7", "192.168.1.2"}, want: "198.51.100.7"},
+		{name: "all proxies", remoteAddr: "10.0.0.1:4321", forwarded: []string{"192.168.1.2"}, want: "192.168.1.2"},
+		{name: "malformed hop", remoteAddr: "10.0.0.1:4321", forwarded: []string{"198.51.100.7, bogus, 192.168.1.2"}, want: "192.168.1.2"},
+		{name: "real ip", remoteAddr: "192.168.3.4:4321", realIP: "198.51.100.9", want: "198.51.100.9"},
+		{name: "invalid real ip", remoteAddr: "192.168.3.4:4321", realIP: "bogus", want: "192.168.3.4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, v := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if test.realIP != "" {
+				r.Header.Set("X-Real-IP", test.realIP)
+			}
+			if got := s.requestIP(r); got != test.want {
+				t.Errorf("requestIP = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.1", "::1", "fd00::/8"}); err != nil {
+		t.Errorf("parse trusted proxies: %v", err)
+	}
+	for _, proxy := range []string{"bogus", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("parse trusted proxy %q succeeded", proxy)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// cluster: 房間建立在某一個node上(origin)，其他node上的參與者加入時，該node建立同ID的edge room
+// edge與origin之間以兩條websocket signaling的relay peerConnection交換track
+// downstream: origin -> edge，origin以serveConnection發送房間內的track，edge以runRelayClient接收
+// upstream:   edge -> origin，edge以serveConnection發送edge參與者的track，origin以runRelayClient接收
+
+const (
+	clusterSecretHeader = "X-Cluster-Secret"
+
+	// relay斷線後重新連線的間隔
+	clusterRelayRetryInterval = 3 * time.Second
+
+	clusterLookupTimeout = 3 * time.Second
+)
+
+var errClusterDisabled = errors.New("cluster disabled")
+
+// roomErrOnOrigin 房間需要在origin node加入時回覆client的error code，message為origin的base URL
+const roomErrOnOrigin = "roomOnOrigin"
+
+// closeRoomOnOrigin 房間需要在origin node加入時的websocket close code
+const closeRoomOnOrigin = 4307
+
+// roomOriginError lobby房間不建立edge room，lobby與host都在origin上，參與者需改連線到origin
+type roomOriginError struct {
+	roomID uuid.UUID
+	origin string
+}
+
+func (e *roomOriginError) Error() string {
+	return fmt.Sprintf("room %v has lobby enabled, join on origin node %s", e.roomID, e.origin)
+}
+
+// clusterRoomInfo /cluster/rooms/{roomid}的response
+// settings為origin房間的設定(密碼、host token只有hash)，edge room以相同設定檢查密碼、lobby與host
+type clusterRoomInfo struct {
+	RoomID      uuid.UUID         `json:"roomID"`
+	Node        string            `json:"node"`
+	CreatedTime time.Time         `json:"createdTime"`
+	Settings    map[string]string `json:"settings"`
+}
+
+// roomRegistry 查詢不在RoomStore中的房間位於哪個node
+type roomRegistry interface {
+	// lookup 回傳房間在origin node上的metadata，找不到時回傳ErrRoomNotFound
+	lookup(roomID uuid.UUID) (*RoomMetadata, error)
+}
+
+// peerRegistry 不需要共用儲存的registry，lookup時逐一詢問Config.ClusterNodes中的其他node
+type peerRegistry struct {
+	sfu    *SFU
+	client *http.Client
+}
+
+func newPeerRegistry(sfu *SFU) *peerRegistry {
+	return &peerRegistry{
+		sfu:    sfu,
+		client: &http.Client{Timeout: clusterLookupTimeout},
+	}
+}
+
+func (p *peerRegistry) lookup(roomID uuid.UUID) (*RoomMetadata, error) {
+	for _, node := range p.sfu.config.ClusterNodes {
+		if node == p.sfu.config.NodeURL {
+			continue
+		}
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/cluster/rooms/%s", node, roomID), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(clusterSecretHeader, p.sfu.config.ClusterSecret)
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			p.sfu.log.Warnf("cluster node %s room lookup error: %v", node, err)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+
+		// 沒有origin的設定時不能建立edge room，否則會略過密碼、lobby等檢查
+		info := clusterRoomInfo{}
+		err = json.NewDecoder(resp.Body).Decode(&info)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cluster node %s room %v info: %w", node, roomID, err)
+		}
+		if info.RoomID != roomID || info.Settings == nil {
+			return nil, fmt.Errorf("cluster node %s room %v info has no settings", node, roomID)
+		}
+		return &RoomMetadata{RoomID: roomID, CreatedTime: info.CreatedTime, Settings: info.Settings, Node: node}, nil
+	}
+
+	return nil, ErrRoomNotFound
+}
+
+// getOrRelayRoom 取得此node上的房間
+// 房間只存在於RoomStore且屬於此node時(例如process重啟)，以原本的metadata重建房間
+// 房間在其他node時建立edge room並開始relay
+func (s *SFU) getOrRelayRoom(roomID uuid.UUID) (*ConferenceRoom, error) {
+	if room, ok := s.getRoom(roomID); ok {
+		return room, nil
+	}
+
+	meta, err := s.store.GetRoom(roomID)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrRoomNotFound) && s.config.NodeURL != "":
+		if meta, err = s.registry.lookup(roomID); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	origin := ""
+	if meta.Node != s.config.NodeURL {
+		if s.config.NodeURL == "" {
+			return nil, fmt.Errorf("room %v origin is %s: %w", roomID, meta.Node, errClusterDisabled)
+		}
+		origin = meta.Node
+	}
+	if origin != "" && meta.Settings[roomSettingLobby] == "true" {
+		return nil, &roomOriginError{roomID: roomID, origin: origin}
+	}
+
+	s.Lock()
+	// 查詢期間可能已有其他連線建立了房間
+	if room, ok := s.rooms[roomID]; ok {
+		s.Unlock()
+		return room, nil
+	}
+	room := s.initConferenceRoom(roomID, origin)
+	room.createdTime = meta.CreatedTime
+	for k, v := range meta.Settings {
+		room.settings[k] = v
+	}
+	s.rooms[roomID] = room
+	s.Unlock()
+
+	go room.runLifecycle()
+	if s.config.LastN > 0 {
+		go room.watchVideoActivity()
+	}
+	if origin != "" {
+		go room.runRelay()
+		s.log.Infof("room %v edge created, origin node: %s", roomID, origin)
+	} else {
+		s.log.Infof("room %v restored from room store", roomID)
+	}
+
+	s.roomCreated(roomID)
+
+	return room, nil
+}
+
+// runRelay edge room與origin之間的relay，斷線時重新連線直到房間刪除
+func (r *ConferenceRoom) runRelay() {
+	for {
+		if err := r.relayOnce(); err != nil {
+			r.sfu.log.Warnf("room %v relay to %s error: %v", r.RoomID, r.origin, err)
+		}
+
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(clusterRelayRetryInterval):
+		}
+	}
+}
+
+func (r *ConferenceRoom) relayOnce() error {
+	downstream, err := r.sfu.dialRelay(r.origin, r.RoomID, "downstream")
+	if err != nil {
+		return err
+	}
+
+	upstream, err := r.sfu.dialRelay(r.origin, r.RoomID, "upstream")
+	if err != nil {
+		downstream.Close()
+		return err
+	}
+
+	r.sfu.log.Infof("room %v relay to %s connected", r.RoomID, r.origin)
+
+	// 任一方向斷線時關閉兩條websocket，整組重新連線
+	done := make(chan struct{}, 2)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.runRelayClient(downstream, r.origin)
+		done <- struct{}{}
+	}()
+	go func() {
+		defer wg.Done()
+		r.serveConnection(upstream, connectionOptions{relayNode: r.origin})
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-r.closed:
+	}
+
+	downstream.Close()
+	upstream.Close()
+	wg.Wait()
+
+	return fmt.Errorf("relay disconnected")
+}
+
+// dialRelay 連線至origin node的relay websocket endpoint
+func (s *SFU) dialRelay(node string, roomID uuid.UUID, direction string) (*signalingConn, error) {
+	// http -> ws, https -> wss
+	u := fmt.Sprintf("ws%s/cluster/relay/%s/%s?node=%s",
+		strings.TrimPrefix(node, "http"), roomID, direction, url.QueryEscape(s.config.NodeURL))
+
+	header := http.Header{}
+	header.Set(clusterSecretHeader, s.config.ClusterSecret)
+
+	dialer := *websocket.DefaultDialer
+	// relay的message以JSON解析data
+	dialer.Subprotocols = []string{signalingV2Subprotocol}
+	unsafeConn, _, err := dialer.Dial(u, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSignalingConn(&threadSafeWebSocketWriter{
+		unsafeConn,
+		sync.Mutex{},
+	}), nil
+}
+
+// runRelayClient 以answerer的角色接收另一個node發送的track，加入房間並標記來源node，避免relay回去
+func (r *ConferenceRoom) runRelayClient(wsc *signalingConn, node string) {
+	pc, err := newPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}, r.sfu.downTrackSenders)
+	if err != nil {
+		r.sfu.log.Errorf("relay peerConnection create err: %v", err)
+		return
+	}
+
+	defer func() {
+		if cErr := pc.Close(); cErr != nil {
+			r.sfu.log.Errorf("cannot close relay peerConnection: %v", cErr)
+		}
+	}()
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		if err := wsc.send("candidate", "", candidate.ToJSON()); err != nil {
+			r.sfu.log.Errorf("relay webSocket write Json error: %v", err)
+		}
+	})
+
+	// peerConnection失敗時關閉websocket，結束read loop
+	pc.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
+		if p == webrtc.PeerConnectionStateFailed {
+			wsc.Close()
+		}
+	})
+
+	// labels 對方node在offer之前送出的tracks event，沿用track的用途
+	labels := newPendingLabels()
+
+	pc.OnTrack(func(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		r.sfu.log.Infof("room %v relay track %v from %s", r.RoomID, t.ID(), node)
+
+		label := labels.take(t.ID(), t.Kind())
+		r.forwardRemoteTrack(t, receiver, r.addLocalTrack(t.Codec().RTPCodecCapability, t.ID(), t.StreamID(), node, label))
+	})
+
+	for {
+		message, parseErr, err := wsc.read()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				r.sfu.log.Errorf("relay web socket read message unexpected close error: %v", err)
+			}
+			return
+		}
+		if parseErr != nil {
+			r.sfu.log.Errorf("relay web socket message json parse error: %v", parseErr)
+			continue
+		}
+
+		switch message.Event {
+		case "tracks":
+			list := trackList{}
+			if err := json.Unmarshal(message.Data, &list); err != nil {
+				r.sfu.log.Errorf("relay tracks message error: %v", err)
+				continue
+			}
+			for _, t := range list.Tracks {
+				labels.set(t.TrackID, t.Label)
+			}
+		case "candidate":
+			candidate, err := message.decodeCandidate()
+			if err != nil {
+				r.sfu.log.Errorf("relay candidate message error: %v", err)
+				continue
+			}
+
+			if err := pc.AddICECandidate(candidate); err != nil {
+				r.sfu.log.Errorf("relay peerConnection AddICECandidate error: %v", err)
+				return
+			}
+		case "offer":
+			offer, err := message.decodeDescription(webrtc.SDPTypeOffer)
+			if err != nil {
+				r.sfu.log.Errorf("relay offer message error: %v", err)
+				continue
+			}
+
+			if err := pc.SetRemoteDescription(offer); err != nil {
+				r.sfu.log.Errorf("relay peerConnection SetRemoteDescription error: %v", err)
+				return
+			}
+
+			answer, err := pc.CreateAnswer(nil)
+			if err != nil {
+				r.sfu.log.Errorf("relay peerConnection CreateAnswer error: %v", err)
+				return
+			}
+
+			if err := pc.SetLocalDescription(answer); err != nil {
+				r.sfu.log.Errorf("relay peerConnection SetLocalDescription error: %v", err)
+				return
+			}
+
+			if err := wsc.send("answer", message.ID, answer); err != nil {
+				r.sfu.log.Errorf("relay answer write json error: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// checkClusterSecret cluster API只接受帶有正確X-Cluster-Secret的node，沒有設定ClusterSecret時拒絕所有request
+func (s *SFU) checkClusterSecret(w http.ResponseWriter, r *http.Request) bool {
+	if s.config.NodeURL == "" || s.config.ClusterSecret == "" {
+		http.Error(w, errClusterDisabled.Error(), http.StatusNotFound)
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), []byte(s.config.ClusterSecret)) != 1 {
+		http.Error(w, "invalid cluster secret", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// getOriginRoomFromRequest 只回傳origin在此node的房間，edge room不能再被relay
+func (s *SFU) getOriginRoomFromRequest(r *http.Request) (*ConferenceRoom, error) {
+	room, err := s.getRoomFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if room.origin != "" {
+		return nil, fmt.Errorf("room %v origin is %s", room.RoomID, room.origin)
+	}
+	return room, nil
+}
+
+// ClusterRoomOwner 其他node查詢房間是否在此node，並取得建立edge room所需的設定
+func (s *SFU) ClusterRoomOwner(w http.ResponseWriter, r *http.Request) {
+	if !s.checkClusterSecret(w, r) {
+		return
+	}
+
+	room, err := s.getOriginRoomFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	room.RLock()
+	info := clusterRoomInfo{
+		RoomID:      room.RoomID,
+		Node:        s.config.NodeURL,
+		CreatedTime: room.createdTime,
+		Settings:    make(map[string]string, len(room.settings)),
+	}
+	for k, v := range room.settings {
+		info.Settings[k] = v
+	}
+	room.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&info); err != nil {
+		s.log.Errorf("cluster room owner json encode err: %v", err)
+	}
+}
+
+// ClusterRelay edge node的relay websocket endpoint，/cluster/relay/{roomid}/{direction}?node=
+// relay的peerConnection不計入MaxPeerConnections：edge上的參與者已通過該node的容量檢查，
+// 每個房間每個node最多一組relay，數量受cluster node數限制，拒絕relay只會讓已加入的參與者收不到media
+func (s *SFU) ClusterRelay(w http.ResponseWriter, r *http.Request) {
+	if !s.checkClusterSecret(w, r) {
+		return
+	}
+
+	room, err := s.getOriginRoomFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	node := r.URL.Query().Get("node")
+	if node == "" {
+		http.Error(w, "node query parameter required", http.StatusBadRequest)
+		return
+	}
+
+	direction := mux.Vars(r)["direction"]
+	if direction != "downstream" && direction != "upstream" {
+		http.Error(w, fmt.Sprintf("unknown relay direction %s", direction), http.StatusNotFound)
+		return
+	}
+
+	unsafeConn, err := webSocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Errorf("relay upgrade err: %v", err)
+		return
+	}
+
+	wsc := newSignalingConn(&threadSafeWebSocketWriter{
+		unsafeConn,
+		sync.Mutex{},
+	})
+	defer wsc.Close()
+
+	s.log.Infof("room %v %s relay from %s connected", room.RoomID, direction, node)
+
+	if direction == "downstream" {
+		room.serveConnection(wsc, connectionOptions{relayNode: node})
+	} else {
+		room.runRelayClient(wsc, node)
+	}
+
+	s.log.Infof("room %v %s relay from %s disconnected", room.RoomID, direction, node)
+}
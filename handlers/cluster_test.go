@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewSFUClusterSecretRequired(t *testing.T) {
+	config := DefaultConfig()
+	config.NodeURL = "http://10.0.0.1:8080"
+	config.ClusterSecret = ""
+	if _, err := NewSFU(WithConfig(config)); !errors.Is(err, errClusterSecretRequired) {
+		t.Errorf("new sfu without cluster secret err = %v, want %v", err, errClusterSecretRequired)
+	}
+}
+
+func TestCheckClusterSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodeURL string
+		secret  string
+		header  string
+		ok      bool
+		status  int
+	}{
+		{name: "cluster disabled", secret: "secret", header: "secret", status: http.StatusNotFound},
+		{name: "empty secret without header", nodeURL: "http://node", status: http.StatusNotFound},
+		{name: "empty secret with header", nodeURL: "http://node", header: "anything", status: http.StatusNotFound},
+		{name: "missing header", nodeURL: "http://node", secret: "secret", status: http.StatusForbidden},
+		{name: "wrong secret", nodeURL: "http://node", secret: "secret", header: "wrong", status: http.StatusForbidden},
+		{name: "correct secret", nodeURL: "http://node", secret: "secret", header: "secret", ok: true, status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &SFU{config: Config{NodeURL: test.nodeURL, ClusterSecret: test.secret}}
+
+			r := httptest.NewRequest(http.MethodGet, "/cluster/rooms/id", nil)
+			if test.header != "" {
+				r.Header.Set(clusterSecretHeader, test.header)
+			}
+			w := httptest.NewRecorder()
+			if ok := s.checkClusterSecret(w, r); ok != test.ok || w.Code != test.status {
+				t.Errorf("checkClusterSecret = %v status %d, want %v status %d", ok, w.Code, test.ok, test.status)
+			}
+		})
+	}
+}
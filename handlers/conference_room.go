@@ -1,15 +1,12 @@
 package handlers
 
 import (
-	"encoding/json"
-	"fmt"
 	"sync"
 	"time"
-	"webrtc_sfu_conference/conf"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -32,6 +29,14 @@ func (t *threadSafeWebSocketWriter) WriteJSON(v interface{}) error {
 	return t.Conn.WriteJSON(v)
 }
 
+// WriteBinary web Socket 回傳 binary message
+func (t *threadSafeWebSocketWriter) WriteBinary(data []byte) error {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.Conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
 // WriteString web Socket 回傳 String
 func (t *threadSafeWebSocketWriter) WriteString(message string) error {
 	t.Mutex.Lock()
@@ -40,9 +45,79 @@ func (t *threadSafeWebSocketWriter) WriteString(message string) error {
 	return t.Conn.WriteMessage(websocket.TextMessage, []byte(message))
 }
 
+// rtpSink 接收room中publisher的RTP packet，pkt只能讀取不可修改，clock為此track的sender report
+type rtpSink interface {
+	writeRTP(t *webrtc.TrackRemote, pkt *rtp.Packet, clock *senderClock)
+}
+
 type clientConnectionState struct {
 	peerConnection *webrtc.PeerConnection
-	websocket      *threadSafeWebSocketWriter
+
+	// negotiator 此連線的renegotiation，持有目前的websocket
+	negotiator *negotiator
+
+	// mixedAudio 混音模式的參與者只會收到這一個audio track，不會收到其他人各自的audio track
+	mixedAudio *webrtc.TrackLocalStaticSample
+
+	// participantID 參與者ID，relay連線為空字串
+	participantID string
+
+	// relayNode 非空時此連線為其他node的relay，不會收到從該node relay過來的track
+	relayNode string
+
+	// host 以host token加入，會收到lobby通知並可以admit、deny
+	host bool
+
+	// subscription 此連線訂閱的track，只在持有room lock時讀寫
+	subscription *subscription
+
+	// downTracks 送給此連線的publisher track，key: track ID，只在持有room lock時讀寫
+	downTracks map[string]*downTrack
+}
+
+// availableTracks 此連線可以訂閱的tracks，不包含自己publish的track，呼叫者需持有room lock
+func (c *clientConnectionState) availableTracks(r *ConferenceRoom) map[string]localTrack {
+	tracks := make(map[string]localTrack, len(r.clientTracks)+1)
+	for id, track := range r.clientTracks {
+		if c.mixedAudio != nil && track.Kind() == webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		if c.relayNode != "" && r.trackNodes[id] == c.relayNode {
+			continue
+		}
+		if c.participantID != "" && r.trackPublishers[id] == c.participantID {
+			continue
+		}
+		tracks[id] = track
+	}
+
+	if c.mixedAudio != nil {
+		tracks[c.mixedAudio.ID()] = c.mixedAudio
+	}
+
+	return tracks
+}
+
+// expectedTracks available中此連線訂閱的tracks，混音track一律送出，video track數受LastN限制，呼叫者需持有room lock
+func (c *clientConnectionState) expectedTracks(r *ConferenceRoom, available map[string]localTrack) map[string]localTrack {
+	tracks := make(map[string]localTrack, len(available))
+	for id, track := range available {
+		if c.subscription == nil || (c.mixedAudio != nil && id == c.mixedAudio.ID()) || c.subscription.wants(id, r.trackPublishers[id]) {
+			tracks[id] = track
+		}
+	}
+	c.limitVideoTracks(r, tracks)
+	return tracks
+}
+
+// senderTrack 加入peerConnection的track，publisher的track為此連線專用的downTrack，呼叫者需持有room lock
+func (c *clientConnectionState) senderTrack(r *ConferenceRoom, track localTrack) webrtc.TrackLocal {
+	if t, ok := track.(*forwardedTrack); ok {
+		d := t.newDownTrack(c.peerConnection, r.sfu.downTrackSenders)
+		c.downTracks[t.ID()] = d
+		return d
+	}
+	return track.(webrtc.TrackLocal)
 }
 
 // ConferenceRoom 帶有所有連線成員、所有成員的track，避免signaling時發生race condition，使用RWMutex
@@ -54,89 +129,190 @@ type ConferenceRoom struct {
 	conns []clientConnectionState
 
 	// clientTracks 所有client端track會被加入至此map
-	clientTracks map[string]*webrtc.TrackLocalStaticRTP
+	clientTracks map[string]*forwardedTrack
 
 	// Room建立時間，原使用用途為便於get rooms ID時排序，可棄用
 	createdTime time.Time
 
+	// settings 房間設定，與metadata一起存於RoomStore
+	settings map[string]string
+
+	// sinks 非peerConnection的track訂閱者，例如HLS egress，由OnTrack read loop寫入RTP packet
+	// 寫入頻率為每個RTP packet，因此不使用room lock，避免被signal時的lock卡住
+	sinks     []rtpSink
+	sinksLock sync.RWMutex
+
+	// hls 房間的HLS egress，未啟動時為nil
+	hls *hlsEgress
+
+	// mixer 房間的混音器，只有在有混音輸出時才存在
+	mixer *audioMixer
+
+	// sipCalls 透過SIP gateway加入的電話參與者，key: Call-ID
+	sipCalls map[string]*sipCall
+
+	// origin 房間所在的node URL，非空時此房間為edge room，track經由relay與origin交換
+	origin string
+
+	// trackNodes 從其他node relay過來的track，key: track ID，value: 來源node URL
+	trackNodes map[string]string
+
+	// closed 房間刪除時關閉，停止relay、lifecycle等goroutine
+	closed chan struct{}
+
+	// lifecycleWake 參與者人數變化時通知runLifecycle
+	lifecycleWake chan struct{}
+
+	// sessions 可以resume的參與者，key: resume token
+	sessions map[string]*participantSession
+
+	// admitted 已通過admission control的參與者連線數，包含尚未加入conns的連線與尚未接通的電話
+	admitted int
+
+	// trackPublishers 參與者publish的track，key: track ID，value: participant ID，用於publisher與video track上限
+	trackPublishers map[string]string
+
+	// trackLabels track的用途，key: track ID，未標示的track不在map中
+	trackLabels map[string]string
+
+	// lobby 等待host允許的參與者，key: participant ID
+	lobby map[string]*lobbyEntry
+
+	// sfu 房間所屬的SFU instance
+	sfu *SFU
+
 	// lock 多人讀取，但只有單一寫入
 	sync.RWMutex
 }
 
-func newConferenceRoom() *ConferenceRoom {
-	newRoomID := uuid.New()
-
-	// init map
-	newRoomLocalTracks := make(map[string]*webrtc.TrackLocalStaticRTP)
-
-	room := &ConferenceRoom{
-		RoomID:       newRoomID,
-		clientTracks: newRoomLocalTracks,
-		createdTime:  time.Now(),
+// newConferenceRoom settings需在saveMetadata之前設定，edge room才會取得相同設定
+func (s *SFU) newConferenceRoom(newRoomID uuid.UUID, settings map[string]string) *ConferenceRoom {
+	room := s.initConferenceRoom(newRoomID, "")
+	for k, v := range settings {
+		room.settings[k] = v
 	}
 
-	webrtcSrv.Lock()
-	webrtcSrv.Rooms[newRoomID] = room
-	webrtcSrv.Unlock()
+	s.Lock()
+	s.rooms[newRoomID] = room
+	s.Unlock()
+
+	room.saveMetadata()
 
-	// check peerConnection num
-	go room.connectionsNumberCheck()
-	// Infof("room ID %s created.", newRoomID)
-	signalStr := fmt.Sprintf("room ID %s created.", newRoomID.String())
+	go room.runLifecycle()
+	if s.config.LastN > 0 {
+		go room.watchVideoActivity()
+	}
 
 	// new room created signal
-	signalingServer.UpdateSignal <- signalStr
+	s.roomCreated(newRoomID)
 
 	return room
 }
 
-// connectionsNumberCheck gc機制?會導致建立過久conference room無法使用
-func (r *ConferenceRoom) connectionsNumberCheck() {
-	for {
-		time.Sleep(10 * time.Minute)
-		if len(r.conns) == 0 {
-
-			webrtcSrv.Lock()
-			delete(webrtcSrv.Rooms, r.RoomID)
-			webrtcSrv.Unlock()
+// initConferenceRoom origin為空字串時表示房間在此node
+func (s *SFU) initConferenceRoom(roomID uuid.UUID, origin string) *ConferenceRoom {
+	return &ConferenceRoom{
+		RoomID:       roomID,
+		clientTracks: make(map[string]*forwardedTrack),
+		createdTime:  time.Now(),
+		settings:     make(map[string]string),
+		sipCalls:     make(map[string]*sipCall),
+		origin:       origin,
+		trackNodes:   make(map[string]string),
+		closed:       make(chan struct{}),
+		sessions:     make(map[string]*participantSession),
+		sfu:          s,
+
+		trackPublishers: make(map[string]string),
+		trackLabels:     make(map[string]string),
+		lobby:           make(map[string]*lobbyEntry),
+		lifecycleWake:   make(chan struct{}, 1),
+	}
+}
 
-			// Infof("delete room ID: %v", r.RoomID)
-			signalStr := fmt.Sprintf("room ID %s deleted", r.RoomID.String())
+// participantCount 房間中的參與者數量，edge room連往origin的relay不算參與者
+func (r *ConferenceRoom) participantCount() int {
+	r.RLock()
+	defer r.RUnlock()
 
-			signalingServer.UpdateSignal <- signalStr
+	count := len(r.sipCalls)
+	for i := range r.conns {
+		if r.conns[i].relayNode == "" || r.conns[i].relayNode != r.origin {
+			count++
 		}
 	}
+	return count
 }
 
-// dispatchKeyFrame sends a keyframe to all PeerConnections, used everytime a new user joins the call
-func (r *ConferenceRoom) dispatchKeyFrame() {
-	// 檢查此room是否還儲存於全局變數rooms中
-	if _, ok := webrtcSrv.Rooms[r.RoomID]; !ok {
-		return
+// requestStreamKeyFrame 要求發送此stream ID的publisher送出keyframe
+func (r *ConferenceRoom) requestStreamKeyFrame(streamID string) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, track := range r.clientTracks {
+		if track.StreamID() == streamID {
+			track.requestKeyFrame()
+		}
 	}
+}
 
-	r.Lock()
-	defer r.Unlock()
+func (r *ConferenceRoom) addSink(s rtpSink) {
+	r.sinksLock.Lock()
+	defer r.sinksLock.Unlock()
 
-	for i := range r.conns {
-		for _, receiver := range r.conns[i].peerConnection.GetReceivers() {
-			if receiver.Track() == nil {
-				continue
-			}
+	r.sinks = append(r.sinks, s)
+}
+
+func (r *ConferenceRoom) removeSink(s rtpSink) {
+	r.sinksLock.Lock()
+	defer r.sinksLock.Unlock()
 
-			_ = r.conns[i].peerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{
-					MediaSSRC: uint32(receiver.Track().SSRC()),
-				},
-			})
+	for i := range r.sinks {
+		if r.sinks[i] == s {
+			r.sinks = append(r.sinks[:i], r.sinks[i+1:]...)
+			return
 		}
 	}
 }
 
+// writeToSinks 將publisher的RTP packet交給所有sink
+func (r *ConferenceRoom) writeToSinks(t *webrtc.TrackRemote, pkt *rtp.Packet, clock *senderClock) {
+	r.sinksLock.RLock()
+	defer r.sinksLock.RUnlock()
+
+	for _, s := range r.sinks {
+		s.writeRTP(t, pkt, clock)
+	}
+}
+
 // Add to list of tracks and fire renegotation for all PeerConnections
-func (r *ConferenceRoom) addTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
-	// 檢查此room是否還儲存於全局變數rooms中
-	if _, ok := webrtcSrv.Rooms[r.RoomID]; !ok {
+// publisher為參與者ID，超過房間publisher、video track或server bitrate上限時回傳admissionError，relay的publisher為空字串不檢查
+// label為publisher標示的用途(camera、screen等)
+func (r *ConferenceRoom) addTrack(t *webrtc.TrackRemote, publisher, label string) (*forwardedTrack, *admissionError) {
+	if publisher != "" {
+		r.Lock()
+		err := r.checkPublish(publisher, t.Kind(), label)
+		if err == nil {
+			r.trackPublishers[t.ID()] = publisher
+			// 與檢查在同一個lock中記錄，ExclusiveScreenShare時同時到達的screen track才不會都通過
+			if label != "" {
+				r.trackLabels[t.ID()] = label
+			}
+		}
+		r.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r.addLocalTrack(t.Codec().RTPCodecCapability, t.ID(), t.StreamID(), "", label), nil
+}
+
+// addLocalTrack 新增非peerConnection來源的track，例如SIP電話
+// node為relay來源的node URL，此track不會再relay回該node，label為空字串時依kind決定
+func (r *ConferenceRoom) addLocalTrack(codec webrtc.RTPCodecCapability, id, streamID, node, label string) *forwardedTrack {
+	// 檢查此room是否還儲存於SFU的rooms中
+	if !r.sfu.hasRoom(r) {
 		return nil
 	}
 
@@ -146,20 +322,23 @@ func (r *ConferenceRoom) addTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStati
 		r.signalPeerConnections()
 	}()
 
-	// Create a new TrackLocal with the same codec as our incoming
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
-	if err != nil {
-		panic(err)
-	}
+	// 每個訂閱者bind各自的downTrack
+	trackLocal := newForwardedTrack(codec, id, streamID)
 
-	r.clientTracks[t.ID()] = trackLocal
+	r.clientTracks[id] = trackLocal
+	if node != "" {
+		r.trackNodes[id] = node
+	}
+	if label != "" {
+		r.trackLabels[id] = label
+	}
 	return trackLocal
 }
 
 // Remove from list of tracks and fire renegotation for all PeerConnections
-func (r *ConferenceRoom) removeTrack(t *webrtc.TrackLocalStaticRTP) {
-	// 檢查此room是否還儲存於全局變數rooms中
-	if _, ok := webrtcSrv.Rooms[r.RoomID]; !ok {
+func (r *ConferenceRoom) removeTrack(t *forwardedTrack) {
+	// 檢查此room是否還儲存於SFU的rooms中
+	if !r.sfu.hasRoom(r) {
 		return
 	}
 
@@ -170,6 +349,9 @@ func (r *ConferenceRoom) removeTrack(t *webrtc.TrackLocalStaticRTP) {
 	}()
 
 	delete(r.clientTracks, t.ID())
+	delete(r.trackNodes, t.ID())
+	delete(r.trackPublishers, t.ID())
+	delete(r.trackLabels, t.ID())
 }
 
 // signalPeerConnections updates each PeerConnection so that it is getting all the expected media tracks
@@ -179,42 +361,46 @@ func (r *ConferenceRoom) removeTrack(t *webrtc.TrackLocalStaticRTP) {
 // 2. 檢查peer connection的RTP sender，以及是否有正確放置在會議室中的localTracks map中，使用existingSenders map紀錄，避免重複建立local track發送RTP
 // 3. 檢查peer connection的RTP receiver，以及是否有正確放置在會議室中的localTracks map中，使用existingSenders map紀錄，避免建立local track發送給server本身
 // 4. for loop檢查trackLocals map，透過existingSenders map比對，existingSenders map中若是沒有trackLocals map的track，則替此peer connection新增此local Track，用於發送影像or音訊
-// 5. create & set local offer SDP，然後透過websocket發送至client端。
+// 5. track有變動(或尚未協商過)時交由negotiator合併後create & set local offer SDP，然後透過websocket發送至client端。
 func (r *ConferenceRoom) signalPeerConnections() {
-	// 檢查此room是否還儲存於全局變數rooms中
-	if _, ok := webrtcSrv.Rooms[r.RoomID]; !ok {
+	// 檢查此room是否還儲存於SFU的rooms中
+	if !r.sfu.hasRoom(r) {
 		return
 	}
 
 	r.Lock()
-	defer func() {
-		r.Unlock()
-		r.dispatchKeyFrame()
-	}()
+	defer r.Unlock()
 
 	attemptSync := func() (tryAgain bool) {
 		for i := range r.conns {
 			if r.conns[i].peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
 				r.conns = append(r.conns[:i], r.conns[i+1:]...)
+				r.wakeLifecycle()
 				return true // We modified the slice, start from the beginning
 			}
 
 			// map of sender we already are seanding, so we don't double send
 			existingSenders := map[string]bool{}
+			changed := r.conns[i].peerConnection.LocalDescription() == nil
+
+			availableTracks := r.conns[i].availableTracks(r)
+			expectedTracks := r.conns[i].expectedTracks(r, availableTracks)
 
 			for _, sender := range r.conns[i].peerConnection.GetSenders() {
 				if sender.Track() == nil {
 					continue
 				}
 
-				existingSenders[sender.Track().ID()] = true
+				trackID := sender.Track().ID()
+				existingSenders[trackID] = true
 
 				// If we have a RTPSender that doesn't map to a existing track remove and signal
-				if _, ok := r.clientTracks[sender.Track().ID()]; !ok {
-					signalingStateCheck(r.conns[i].peerConnection, fmt.Sprintf("pc %v remove track", i))
+				if _, ok := expectedTracks[trackID]; !ok {
 					if err := r.conns[i].peerConnection.RemoveTrack(sender); err != nil {
 						return true
 					}
+					delete(r.conns[i].downTracks, trackID)
+					changed = true
 				}
 			}
 
@@ -228,33 +414,25 @@ func (r *ConferenceRoom) signalPeerConnections() {
 			}
 
 			// Add all track we aren't sending yet to the PeerConnection
-			for trackID := range r.clientTracks {
+			for trackID := range expectedTracks {
 				if _, ok := existingSenders[trackID]; !ok {
-					if _, err := r.conns[i].peerConnection.AddTrack(r.clientTracks[trackID]); err != nil {
+					sender, err := r.conns[i].peerConnection.AddTrack(r.conns[i].senderTrack(r, expectedTracks[trackID]))
+					if err != nil {
 						return true
 					}
+					if d, ok := sender.Track().(*downTrack); ok {
+						go d.readRTCP(sender)
+					}
+					changed = true
 				}
 			}
 
-			offer, err := r.conns[i].peerConnection.CreateOffer(nil)
-			if err != nil {
-				return true
-			}
-
-			if err = r.conns[i].peerConnection.SetLocalDescription(offer); err != nil {
-				return true
-			}
+			// 未訂閱的track變動時只送出tracks event
+			r.conns[i].negotiator.setTracks(r.conns[i].trackList(r, availableTracks, expectedTracks))
 
-			offerString, err := json.Marshal(offer)
-			if err != nil {
-				return true
-			}
-
-			if err = r.conns[i].websocket.WriteJSON(&websocketwebRTCMessage{
-				Event: "offer",
-				Data:  string(offerString),
-			}); err != nil {
-				return true
+			// offer由negotiator合併後送出，等待answer中的連線會在answer後再送出
+			if changed {
+				r.conns[i].negotiator.requestOffer()
 			}
 		}
 
@@ -277,33 +455,19 @@ func (r *ConferenceRoom) signalPeerConnections() {
 	}
 }
 
-// 避免在have local offer的情況下，執行room signal，set local description會失敗
-func signalingStateCheck(pc *webrtc.PeerConnection, status string) {
-	if pc.SignalingState() != webrtc.SignalingStateStable {
-		for {
-			// pkg.Debugf("status: %s, non-stable waiting for signaling state stable", status)
-			time.Sleep(100 * time.Millisecond)
-			if pc.SignalingState() == webrtc.SignalingStateStable || pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
-				// pkg.Debugf("Signaling state: %v, pc state: %v, finish signaling state check", pc.SignalingState().String(), pc.ConnectionState().String())
-				break
-			}
-		}
-	}
-}
-
 func (r *ConferenceRoom) makeRoomInfoResponse() roomInfomation {
-	return roomInfomation{
-		RoomID:           r.RoomID,
-		RoomURL:          fmt.Sprintf("https://%s/room/%s", conf.Domain, r.RoomID.String()),
-		RoomWebSocketURL: fmt.Sprintf("wss://%s/room/%s/webSocket", conf.Domain, r.RoomID.String()),
-		CreatedTime:      r.createdTime,
-	}
+	return r.metadata().roomInfo(r.sfu.config.Domain)
 }
 
 // roomInfomation use with room create api & get rooms ID webScoket
 type roomInfomation struct {
 	RoomID           uuid.UUID `json:"roomID"`
+	Alias            string    `json:"alias,omitempty"`
 	RoomURL          string    `json:"roomURL"`
 	RoomWebSocketURL string    `json:"roomWebsocketURL"`
 	CreatedTime      time.Time `json:"created_time"`
+
+	// StartTime、EndTime 排程房間的時間
+	StartTime *time.Time `json:"startTime,omitempty"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
 }
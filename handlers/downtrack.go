@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// localTrack 可以送給訂閱者的track，publisher的forwardedTrack或混音track
+type localTrack interface {
+	ID() string
+	StreamID() string
+	Kind() webrtc.RTPCodecType
+}
+
+// forwardedTrack 房間中一個publisher的track，RTP經由每個訂閱者各自的downTrack送出
+type forwardedTrack struct {
+	id       string
+	streamID string
+	kind     webrtc.RTPCodecType
+	codec    webrtc.RTPCodecCapability
+
+	// clock publisher的sender report，SIP等沒有SR的來源維持無效
+	clock senderClock
+
+	// keyFrames 向publisher要求keyframe，訂閱者加入、恢復與PLI時使用
+	keyFrames keyFrameRequester
+
+	// activity 收到RTP的時間，LastN依此選擇轉送的video track
+	activity trackActivity
+
+	// downTracks 已bind(negotiation完成)的downTrack
+	downTracks []*downTrack
+	sync.RWMutex
+}
+
+func newForwardedTrack(codec webrtc.RTPCodecCapability, id, streamID string) *forwardedTrack {
+	kind := webrtc.RTPCodecTypeVideo
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+		kind = webrtc.RTPCodecTypeAudio
+	}
+	return &forwardedTrack{id: id, streamID: streamID, kind: kind, codec: codec}
+}
+
+func (t *forwardedTrack) ID() string {
+	return t.id
+}
+
+func (t *forwardedTrack) StreamID() string {
+	return t.streamID
+}
+
+func (t *forwardedTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+func (t *forwardedTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+// rtcpWriter 送出downTrack的sender report，為訂閱者的peerConnection
+type rtcpWriter interface {
+	WriteRTCP([]rtcp.Packet) error
+}
+
+// newDownTrack 為一個訂閱者建立downTrack，AddTrack後在negotiation完成時bind
+// senders需與建立訂閱者peerConnection時的downTrackSenders相同
+func (t *forwardedTrack) newDownTrack(rtcp rtcpWriter, senders *downTrackSenders) *downTrack {
+	return &downTrack{track: t, rtcp: rtcp, senders: senders, resync: t.kind == webrtc.RTPCodecTypeVideo}
+}
+
+// forward 將publisher的RTP packet寫入所有downTrack，回傳實際送出的訂閱者數，pkt不會被修改
+func (t *forwardedTrack) forward(pkt *rtp.Packet) int {
+	t.activity.packet(time.Now())
+
+	t.RLock()
+	defer t.RUnlock()
+
+	if len(t.downTracks) == 0 {
+		return 0
+	}
+
+	keyFrame := t.kind == webrtc.RTPCodecTypeVideo && isKeyFrame(t.codec.MimeType, pkt.Payload)
+	sent := 0
+	for _, d := range t.downTracks {
+		if d.write(pkt, keyFrame) {
+			sent++
+		}
+	}
+	return sent
+}
+
+func (t *forwardedTrack) bind(d *downTrack) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.downTracks = append(t.downTracks, d)
+}
+
+func (t *forwardedTrack) unbind(d *downTrack) {
+	t.Lock()
+	defer t.Unlock()
+
+	for i := range t.downTracks {
+		if t.downTracks[i] == d {
+			t.downTracks = append(t.downTracks[:i], t.downTracks[i+1:]...)
+			return
+		}
+	}
+}
+
+// downTrack 單一訂閱者的forwarded track，改寫SSRC、payload type、sequence number與timestamp
+// 暫停或丟棄packet之後重新計算offset，讓訂閱者的decoder看到連續的stream
+type downTrack struct {
+	track   *forwardedTrack
+	rtcp    rtcpWriter
+	senders *downTrackSenders
+
+	// bind時由peerConnection決定
+	bound       bool
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	clockRate   uint32
+	writeStream webrtc.TrackLocalWriter
+
+	paused bool
+
+	// resync 下一個送出的packet重新計算offset，video需等到keyframe
+	resync    bool
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+
+	// 最後送出的sequence number、timestamp與時間
+	lastSeq  uint16
+	lastTS   uint32
+	lastSent time.Time
+
+	// sender report的統計
+	packets    uint32
+	octets     uint32
+	lastReport time.Time
+
+	sync.Mutex
+}
+
+// Bind 選擇與publisher相同的codec，fmtp不同時退回只比對MimeType
+func (d *downTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(d.track.codec, ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	// Bind在interceptor的BindLocalStream之前呼叫，sender report由downTrack送出
+	d.senders.Store(ctx.ID(), struct{}{})
+
+	d.Lock()
+	d.bound = true
+	d.ssrc = ctx.SSRC()
+	d.payloadType = codec.PayloadType
+	d.clockRate = codec.ClockRate
+	d.writeStream = ctx.WriteStream()
+	d.Unlock()
+
+	d.track.bind(d)
+	// 新的訂閱者需等到keyframe才開始送出
+	d.track.requestKeyFrame()
+	return codec, nil
+}
+
+func (d *downTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	d.track.unbind(d)
+	d.senders.Delete(ctx.ID())
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.bound = false
+	d.writeStream = nil
+	return nil
+}
+
+func (d *downTrack) ID() string {
+	return d.track.ID()
+}
+
+func (d *downTrack) RID() string {
+	return ""
+}
+
+func (d *downTrack) StreamID() string {
+	return d.track.StreamID()
+}
+
+func (d *downTrack) Kind() webrtc.RTPCodecType {
+	return d.track.Kind()
+}
+
+// setPaused 回傳狀態是否改變，恢復後從下一個keyframe開始送出
+func (d *downTrack) setPaused(paused bool) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.paused == paused {
+		return false
+	}
+	d.paused = paused
+	if !paused {
+		d.resync = true
+	}
+	return true
+}
+
+// write 改寫header後送出，回傳是否送出
+func (d *downTrack) write(pkt *rtp.Packet, keyFrame bool) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.bound || d.paused {
+		return false
+	}
+
+	if d.resync {
+		if d.track.kind == webrtc.RTPCodecTypeVideo && !keyFrame {
+			return false
+		}
+		if d.started {
+			// sequence number接續上一個送出的packet，timestamp依經過的時間推進
+			elapsed := uint32(time.Since(d.lastSent).Seconds() * float64(d.clockRate))
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			d.seqOffset = pkt.SequenceNumber - d.lastSeq - 1
+			d.tsOffset = pkt.Timestamp - d.lastTS - elapsed
+		}
+		d.resync = false
+	}
+
+	header := pkt.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	header.SequenceNumber = pkt.SequenceNumber - d.seqOffset
+	header.Timestamp = pkt.Timestamp - d.tsOffset
+
+	// 亂序到達的舊packet照常送出，但不作為之後resync的基準
+	if !d.started || int16(header.SequenceNumber-d.lastSeq) > 0 {
+		d.started = true
+		d.lastSeq = header.SequenceNumber
+		d.lastTS = header.Timestamp
+		d.lastSent = time.Now()
+	}
+
+	if _, err := d.writeStream.WriteRTP(&header, pkt.Payload); err != nil {
+		return false
+	}
+
+	d.packets++
+	d.octets += uint32(len(pkt.Payload))
+	if time.Since(d.lastReport) >= senderReportInterval {
+		d.sendReport()
+	}
+	return true
+}
+
+// sendReport 將publisher SR的RTP timestamp換算為此downTrack的timestamp後送出，publisher沒有SR時不送出，呼叫者需持有lock
+func (d *downTrack) sendReport() {
+	ntp, rtpTimestamp, ok := d.track.clock.now()
+	if !ok || d.rtcp == nil {
+		return
+	}
+
+	d.lastReport = time.Now()
+	_ = d.rtcp.WriteRTCP([]rtcp.Packet{&rtcp.SenderReport{
+		SSRC:        uint32(d.ssrc),
+		NTPTime:     timeToNTP(ntp),
+		RTPTime:     rtpTimestamp - d.tsOffset,
+		PacketCount: d.packets,
+		OctetCount:  d.octets,
+	}})
+}
+
+// matchCodec 先比對MimeType與fmtp，再只比對MimeType
+func matchCodec(codec webrtc.RTPCodecCapability, parameters []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	for _, c := range parameters {
+		if strings.EqualFold(c.MimeType, codec.MimeType) && c.SDPFmtpLine == codec.SDPFmtpLine {
+			return c, true
+		}
+	}
+	for _, c := range parameters {
+		if strings.EqualFold(c.MimeType, codec.MimeType) {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// isKeyFrame packet是否為keyframe的開頭，無法解析的codec一律視為keyframe
+func isKeyFrame(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8KeyFrame(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264KeyFrame(payload)
+	}
+	return true
+}
+
+// isVP8KeyFrame RFC 7741 payload descriptor之後，partition開頭的P bit為0
+func isVP8KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// S bit且partition index為0
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		x := payload[1]
+		i++
+		if x&0x80 != 0 { // I: picture ID
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if x&0x40 != 0 { // L: TL0PICIDX
+			i++
+		}
+		if x&0x30 != 0 { // T或K: TID/KEYIDX
+			i++
+		}
+	}
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// isH264KeyFrame RFC 6184，IDR或SPS，包含STAP-A與FU-A的開頭
+func isH264KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 5, 7:
+		return true
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+	}
+	return false
+}
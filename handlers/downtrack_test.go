@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// recordingWriteStream 記錄downTrack送出的RTP header
+type recordingWriteStream struct {
+	headers []rtp.Header
+}
+
+func (w *recordingWriteStream) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.headers = append(w.headers, *header)
+	return len(payload), nil
+}
+
+func (w *recordingWriteStream) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// downTrackStep 寫入一個publisher packet，pause、resume在寫入前設定
+// idle為resync前距離上一個送出packet的時間，timestamp應依此推進
+type downTrackStep struct {
+	pause, resume bool
+	idle          time.Duration
+
+	seq      uint16
+	ts       uint32
+	keyFrame bool
+
+	sent    bool
+	wantSeq uint16
+	wantTS  uint32
+}
+
+func TestDownTrackWrite(t *testing.T) {
+	const (
+		publisherSSRC = 1111
+		publisherPT   = 96
+		ssrc          = 5555
+		payloadType   = 100
+	)
+
+	tests := []struct {
+		name  string
+		codec webrtc.RTPCodecCapability
+		steps []downTrackStep
+	}{
+		{
+			name:  "audio rewrites header",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000},
+			steps: []downTrackStep{
+				{seq: 100, ts: 48000, sent: true, wantSeq: 100, wantTS: 48000},
+				{seq: 101, ts: 48960, sent: true, wantSeq: 101, wantTS: 48960},
+			},
+		},
+		{
+			name:  "video waits for first keyframe",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			steps: []downTrackStep{
+				{seq: 10, ts: 3000},
+				{seq: 11, ts: 6000},
+				{seq: 12, ts: 9000, keyFrame: true, sent: true, wantSeq: 12, wantTS: 9000},
+				{seq: 13, ts: 12000, sent: true, wantSeq: 13, wantTS: 12000},
+			},
+		},
+		{
+			name:  "video pause and resume on keyframe",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			steps: []downTrackStep{
+				{seq: 1, ts: 3000, keyFrame: true, sent: true, wantSeq: 1, wantTS: 3000},
+				{seq: 2, ts: 6000, sent: true, wantSeq: 2, wantTS: 6000},
+				{pause: true, seq: 3, ts: 9000},
+				{seq: 4, ts: 12000, keyFrame: true},
+				{resume: true, seq: 5, ts: 15000},
+				{seq: 6, ts: 18000},
+				{idle: time.Second, seq: 7, ts: 21000, keyFrame: true, sent: true, wantSeq: 3, wantTS: 6000 + 90000},
+				{seq: 8, ts: 24000, sent: true, wantSeq: 4, wantTS: 6000 + 90000 + 3000},
+			},
+		},
+		{
+			name:  "audio resumes without keyframe",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000},
+			steps: []downTrackStep{
+				{seq: 50, ts: 960, sent: true, wantSeq: 50, wantTS: 960},
+				{pause: true, seq: 51, ts: 1920},
+				{seq: 52, ts: 2880},
+				{resume: true, idle: 500 * time.Millisecond, seq: 53, ts: 3840, sent: true, wantSeq: 51, wantTS: 960 + 24000},
+				{seq: 54, ts: 4800, sent: true, wantSeq: 52, wantTS: 960 + 24000 + 960},
+			},
+		},
+		{
+			name:  "sequence number wraps around",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000},
+			steps: []downTrackStep{
+				{seq: 65534, ts: 960, sent: true, wantSeq: 65534, wantTS: 960},
+				{seq: 65535, ts: 1920, sent: true, wantSeq: 65535, wantTS: 1920},
+				{seq: 0, ts: 2880, sent: true, wantSeq: 0, wantTS: 2880},
+				{seq: 1, ts: 3840, sent: true, wantSeq: 1, wantTS: 3840},
+			},
+		},
+		{
+			name:  "rewritten sequence number wraps around after resume",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			steps: []downTrackStep{
+				{seq: 65534, ts: 3000, keyFrame: true, sent: true, wantSeq: 65534, wantTS: 3000},
+				{pause: true, seq: 65535, ts: 6000},
+				{resume: true, idle: time.Second, seq: 200, ts: 9000, keyFrame: true, sent: true, wantSeq: 65535, wantTS: 3000 + 90000},
+				{seq: 201, ts: 12000, sent: true, wantSeq: 0, wantTS: 3000 + 90000 + 3000},
+				{seq: 202, ts: 15000, sent: true, wantSeq: 1, wantTS: 3000 + 90000 + 6000},
+			},
+		},
+		{
+			name:  "timestamp wraps around",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000},
+			steps: []downTrackStep{
+				{seq: 1, ts: 0xfffffc40, sent: true, wantSeq: 1, wantTS: 0xfffffc40},
+				{seq: 2, ts: 0, sent: true, wantSeq: 2, wantTS: 0},
+				{pause: true, seq: 3, ts: 960},
+				{resume: true, idle: time.Second, seq: 4, ts: 1920, sent: true, wantSeq: 3, wantTS: 48000},
+				{seq: 5, ts: 2880, sent: true, wantSeq: 4, wantTS: 48960},
+			},
+		},
+		{
+			name:  "out of order and duplicate packets",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000},
+			steps: []downTrackStep{
+				{seq: 10, ts: 960, sent: true, wantSeq: 10, wantTS: 960},
+				{seq: 12, ts: 2880, sent: true, wantSeq: 12, wantTS: 2880},
+				{seq: 11, ts: 1920, sent: true, wantSeq: 11, wantTS: 1920},
+				{seq: 12, ts: 2880, sent: true, wantSeq: 12, wantTS: 2880},
+				// 亂序與重複的packet不改變resync的基準，恢復後接續最大的sequence number
+				{pause: true, seq: 13, ts: 3840},
+				{resume: true, idle: time.Second, seq: 30, ts: 20160, sent: true, wantSeq: 13, wantTS: 2880 + 48000},
+			},
+		},
+		{
+			name:  "late packet after resume",
+			codec: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000},
+			steps: []downTrackStep{
+				{seq: 10, ts: 960, sent: true, wantSeq: 10, wantTS: 960},
+				{pause: true, seq: 11, ts: 1920},
+				{resume: true, idle: time.Second, seq: 20, ts: 10560, sent: true, wantSeq: 11, wantTS: 960 + 48000},
+				// resume之前的packet晚到，以相同的offset改寫
+				{seq: 19, ts: 9600, sent: true, wantSeq: 10, wantTS: 48000},
+				{seq: 21, ts: 11520, sent: true, wantSeq: 12, wantTS: 960 + 48000 + 960},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := &recordingWriteStream{}
+			d := newForwardedTrack(test.codec, "track", "stream").newDownTrack(nil, &downTrackSenders{})
+			d.bound = true
+			d.ssrc = ssrc
+			d.payloadType = payloadType
+			d.clockRate = test.codec.ClockRate
+			d.writeStream = stream
+
+			// resync時以實際經過時間推進timestamp，容許測試執行本身花費的時間
+			slack := test.codec.ClockRate / 20
+			resynced := false
+			for i, step := range test.steps {
+				if step.pause {
+					d.setPaused(true)
+				}
+				if step.resume {
+					d.setPaused(false)
+				}
+				if step.idle > 0 {
+					d.lastSent = d.lastSent.Add(-step.idle)
+					resynced = true
+				}
+
+				written := len(stream.headers)
+				pkt := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, SSRC: publisherSSRC, PayloadType: publisherPT, SequenceNumber: step.seq, Timestamp: step.ts},
+					Payload: []byte{0x01},
+				}
+				if sent := d.write(pkt, step.keyFrame); sent != step.sent {
+					t.Fatalf("step %d seq %d sent = %v, want %v", i, step.seq, sent, step.sent)
+				}
+				if pkt.SSRC != publisherSSRC || pkt.SequenceNumber != step.seq || pkt.Timestamp != step.ts {
+					t.Errorf("step %d publisher packet modified: %+v", i, pkt.Header)
+				}
+				if !step.sent {
+					if len(stream.headers) != written {
+						t.Errorf("step %d dropped packet was written", i)
+					}
+					continue
+				}
+
+				header := stream.headers[len(stream.headers)-1]
+				if header.SSRC != ssrc || header.PayloadType != payloadType {
+					t.Errorf("step %d SSRC, payload type = %d, %d, want %d, %d", i, header.SSRC, header.PayloadType, ssrc, payloadType)
+				}
+				if header.SequenceNumber != step.wantSeq {
+					t.Errorf("step %d sequence number = %d, want %d", i, header.SequenceNumber, step.wantSeq)
+				}
+				if diff := header.Timestamp - step.wantTS; !resynced && diff != 0 || resynced && diff > slack {
+					t.Errorf("step %d timestamp = %d, want %d", i, header.Timestamp, step.wantTS)
+				}
+			}
+		})
+	}
+
+	d := newForwardedTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000}, "track", "stream").newDownTrack(nil, &downTrackSenders{})
+	if d.write(&rtp.Packet{}, true) {
+		t.Errorf("unbound downTrack sent packet")
+	}
+}
+
+func TestIsKeyFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		{name: "vp8 keyframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}, want: true},
+		{name: "vp8 interframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x10, 0x01}},
+		{name: "vp8 continuation", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x00, 0x00}},
+		{name: "vp8 picture ID keyframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80, 0x81, 0x02, 0x00}, want: true},
+		{name: "vp8 empty", mimeType: webrtc.MimeTypeVP8},
+		{name: "h264 idr", mimeType: webrtc.MimeTypeH264, payload: []byte{0x65, 0x88}, want: true},
+		{name: "h264 sps", mimeType: webrtc.MimeTypeH264, payload: []byte{0x67, 0x42}, want: true},
+		{name: "h264 non idr", mimeType: webrtc.MimeTypeH264, payload: []byte{0x41, 0x9a}},
+		{name: "h264 stap-a with sps", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, want: true},
+		{name: "h264 stap-a without idr", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x02, 0x41, 0x9a}},
+		{name: "h264 fu-a idr start", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7c, 0x85, 0x88}, want: true},
+		{name: "h264 fu-a idr middle", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7c, 0x05, 0x88}},
+		{name: "unknown codec", mimeType: "video/AV1", payload: []byte{0x00}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isKeyFrame(test.mimeType, test.payload); got != test.want {
+				t.Errorf("isKeyFrame(%s, %x) = %v, want %v", test.mimeType, test.payload, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,658 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+var (
+	errHLSEgressRunning    = errors.New("hls egress already running")
+	errHLSEgressNotRunning = errors.New("hls egress not running")
+	// errHLSNoH264Track HLS egress只支援H264，VP8等其他codec的房間需設定PreferH264Video
+	errHLSNoH264Track = errors.New("room has no H264 video track to egress, set PreferH264Video")
+)
+
+// hlsSegment 已完成的fMP4 media segment，init為此segment使用的init segment版本
+type hlsSegment struct {
+	sequence uint32
+	duration time.Duration
+	init     uint32
+	data     []byte
+}
+
+// hlsTimeline 將RTP timestamp展開為從egress開始起算的decode time
+// start為第一個sample的時間，startNTP為其publisher時間，publisher沒有SR時為zero
+type hlsTimeline struct {
+	started bool
+	lastRTP uint32
+	dts     uint64
+
+	start    time.Duration
+	startNTP time.Time
+}
+
+func (t *hlsTimeline) toDTS(rtpTimestamp uint32, base uint64) uint64 {
+	if !t.started {
+		t.started = true
+		t.lastRTP = rtpTimestamp
+		t.dts = base
+		return t.dts
+	}
+
+	// int32處理timestamp wrap around，samplebuilder已排序過，負值只可能是異常的timestamp
+	diff := int32(rtpTimestamp - t.lastRTP)
+	t.lastRTP = rtpTimestamp
+	if diff > 0 {
+		t.dts += uint64(diff)
+	}
+	return t.dts
+}
+
+// hlsPendingSample 等待下一個sample才能算出duration
+type hlsPendingSample struct {
+	sample fmp4Sample
+	dts    uint64
+}
+
+// hlsEgress 訂閱房間中單一發言者(stream ID)的H264 video以及房間混音，輸出fMP4 HLS
+// 觀看者只需要HTTP讀取playlist & segments，不會成為room.conns中的peerConnection
+// 沒有opus支援無法混音時，audio使用發言者自己的Opus track
+type hlsEgress struct {
+	room     *ConferenceRoom
+	streamID string
+	// token 讀取playlist & segments時的?token=，有密碼的房間不需把密碼交給player
+	token string
+
+	// mixerOutput 房間混音輸出，nil表示使用發言者的audio track
+	mixerOutput *mixerOutput
+	// mixedTimestamp 混音沒有RTP timestamp，以sample數累加
+	mixedTimestamp uint32
+
+	startTime time.Time
+
+	videoBuilder *samplebuilder.SampleBuilder
+	audioBuilder *samplebuilder.SampleBuilder
+	videoTime    hlsTimeline
+	audioTime    hlsTimeline
+
+	sps, pps []byte
+
+	// inits 仍被保留的segment使用的init segment，key: 版本
+	// publisher中途改變解析度或profile(SPS/PPS改變)時產生新版本，playlist在版本之間加上EXT-X-DISCONTINUITY
+	// initVersion 目前的版本，initSPS、initPPS為其內容
+	inits            map[uint32][]byte
+	initVersion      uint32
+	initSPS, initPPS []byte
+
+	pendingVideo *hlsPendingSample
+	pendingAudio *hlsPendingSample
+
+	// fragment 目前累積中的segment內容，segmentStart為此segment第一個video sample的dts
+	fragment     fmp4Fragment
+	segmentStart uint64
+
+	sequence uint32
+	segments []hlsSegment
+
+	// 不支援的codec只提示一次
+	codecWarned map[string]bool
+
+	stop chan struct{}
+
+	sync.RWMutex
+}
+
+func newHLSEgress(room *ConferenceRoom, streamID string) *hlsEgress {
+	return &hlsEgress{
+		room:         room,
+		streamID:     streamID,
+		token:        uuid.NewString(),
+		startTime:    time.Now(),
+		videoBuilder: samplebuilder.New(128, &codecs.H264Packet{}, fmp4VideoTimescale),
+		audioBuilder: samplebuilder.New(16, &codecs.OpusPacket{}, fmp4AudioTimescale),
+		codecWarned:  make(map[string]bool),
+		stop:         make(chan struct{}),
+	}
+}
+
+// startHLSEgress 啟動房間的HLS egress，streamID為空時選擇房間中任一H264 video track的stream
+// 指定的stream或房間中沒有H264 video時回傳errHLSNoH264Track，不輸出只有audio的HLS
+func (r *ConferenceRoom) startHLSEgress(streamID string) (*hlsEgress, error) {
+	r.Lock()
+	if r.hls != nil {
+		r.Unlock()
+		return nil, errHLSEgressRunning
+	}
+
+	found := ""
+	for _, track := range r.clientTracks {
+		if track.Kind() != webrtc.RTPCodecTypeVideo || !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264) {
+			continue
+		}
+		if streamID == "" || track.StreamID() == streamID {
+			found = track.StreamID()
+			break
+		}
+	}
+	if found == "" {
+		r.Unlock()
+		return nil, errHLSNoH264Track
+	}
+	streamID = found
+
+	e := newHLSEgress(r, streamID)
+	r.hls = e
+	r.Unlock()
+
+	output, err := r.addMixerOutput(nil, e.writeMixedAudio)
+	if err != nil {
+		r.sfu.log.Warnf("room %v hls egress mixed audio unavailable, use speaker audio: %v", r.RoomID, err)
+	} else {
+		e.Lock()
+		e.mixerOutput = output
+		e.Unlock()
+	}
+
+	r.addSink(e)
+	go e.keyFrameLoop()
+
+	r.sfu.log.Infof("room %v hls egress started, stream ID: %s", r.RoomID, streamID)
+	return e, nil
+}
+
+func (r *ConferenceRoom) stopHLSEgress() {
+	r.Lock()
+	e := r.hls
+	r.hls = nil
+	r.Unlock()
+
+	if e == nil {
+		return
+	}
+
+	r.removeSink(e)
+	close(e.stop)
+
+	e.RLock()
+	output := e.mixerOutput
+	e.RUnlock()
+	if output != nil {
+		r.removeMixerOutput(output)
+	}
+
+	r.sfu.log.Infof("room %v hls egress stopped", r.RoomID)
+}
+
+func (r *ConferenceRoom) getHLSEgress() *hlsEgress {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.hls
+}
+
+// keyFrameLoop browser只有在收到PLI時才會送keyframe，segment只能在keyframe切割，因此定期發送PLI
+func (e *hlsEgress) keyFrameLoop() {
+	ticker := time.NewTicker(e.room.sfu.config.HLSSegmentDuration)
+	defer ticker.Stop()
+
+	e.room.requestStreamKeyFrame(e.streamID)
+	for {
+		select {
+		case <-ticker.C:
+			e.room.requestStreamKeyFrame(e.streamID)
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// writeRTP implements rtpSink
+func (e *hlsEgress) writeRTP(t *webrtc.TrackRemote, pkt *rtp.Packet, clock *senderClock) {
+	if t.StreamID() != e.streamID {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	mimeType := t.Codec().MimeType
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		e.videoBuilder.Push(pkt)
+		for s := e.videoBuilder.Pop(); s != nil; s = e.videoBuilder.Pop() {
+			e.handleVideoSample(s, clock)
+		}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		if e.mixerOutput != nil {
+			return
+		}
+		e.audioBuilder.Push(pkt)
+		for s := e.audioBuilder.Pop(); s != nil; s = e.audioBuilder.Pop() {
+			e.handleAudioSample(s.Data, s.PacketTimestamp, clock)
+		}
+	default:
+		if !e.codecWarned[mimeType] {
+			e.codecWarned[mimeType] = true
+			e.room.sfu.log.Warnf("room %v hls egress unsupported codec %s, track %s ignored", e.room.RoomID, mimeType, t.ID())
+		}
+	}
+}
+
+// baseTime timeline第一個sample的dts，換算為timescale單位
+// 另一個timeline已開始且兩者的publisher都有SR時，依publisher時間的差距對齊，否則使用egress開始至今的時間
+func (e *hlsEgress) baseTime(timeline, other *hlsTimeline, timescale uint64, clock *senderClock, rtpTimestamp uint32) uint64 {
+	if !timeline.started {
+		timeline.start = time.Since(e.startTime)
+		timeline.startNTP, _ = clock.ntpTime(rtpTimestamp)
+		if other.started && !other.startNTP.IsZero() && !timeline.startNTP.IsZero() {
+			timeline.start = other.start + timeline.startNTP.Sub(other.startNTP)
+			if timeline.start < 0 {
+				timeline.start = 0
+			}
+		}
+	}
+	return uint64(timeline.start) * timescale / uint64(time.Second)
+}
+
+func (e *hlsEgress) handleVideoSample(s *media.Sample, clock *senderClock) {
+	// H264 depacketizer輸出為Annex-B格式，轉為MP4使用的length prefixed格式
+	avcc := &bytes.Buffer{}
+	keyFrame := false
+	for _, nalu := range splitAnnexB(s.Data) {
+		switch nalu[0] & 0x1f {
+		case 7:
+			e.sps = append([]byte{}, nalu...)
+			continue
+		case 8:
+			e.pps = append([]byte{}, nalu...)
+			continue
+		case 9:
+			// access unit delimiter
+			continue
+		case 5:
+			keyFrame = true
+		}
+		writeUint32(avcc, uint32(len(nalu)))
+		avcc.Write(nalu)
+	}
+	if avcc.Len() == 0 {
+		return
+	}
+
+	// 第一個帶有SPS/PPS的keyframe，或SPS/PPS改變後的keyframe，需要新的init segment
+	var init []byte
+	if keyFrame && e.sps != nil && e.pps != nil &&
+		(e.inits == nil || !bytes.Equal(e.sps, e.initSPS) || !bytes.Equal(e.pps, e.initPPS)) {
+		var err error
+		if init, err = fmp4InitSegment(e.sps, e.pps); err != nil {
+			e.room.sfu.log.Errorf("room %v hls egress init segment error: %v", e.room.RoomID, err)
+			return
+		}
+	}
+	if e.inits == nil {
+		if init == nil {
+			return
+		}
+		e.inits = map[uint32][]byte{e.initVersion: init}
+		e.initSPS, e.initPPS = e.sps, e.pps
+		init = nil
+	}
+
+	dts := e.videoTime.toDTS(s.PacketTimestamp, e.baseTime(&e.videoTime, &e.audioTime, fmp4VideoTimescale, clock, s.PacketTimestamp))
+
+	if e.pendingVideo != nil {
+		e.pendingVideo.sample.duration = uint32(dts - e.pendingVideo.dts)
+		if len(e.fragment.videoSamples) == 0 {
+			e.fragment.videoBaseTime = e.pendingVideo.dts
+			e.segmentStart = e.pendingVideo.dts
+		}
+		e.fragment.videoSamples = append(e.fragment.videoSamples, e.pendingVideo.sample)
+
+		// 舊的samples只能以舊的init segment解碼，SPS/PPS改變時不論長度都在此keyframe切割
+		if keyFrame && (init != nil || dts-e.segmentStart >= uint64(e.room.sfu.config.HLSSegmentDuration.Seconds()*fmp4VideoTimescale)) {
+			e.cutSegment(dts)
+		}
+	}
+
+	if init != nil {
+		e.initVersion++
+		e.inits[e.initVersion] = init
+		e.initSPS, e.initPPS = e.sps, e.pps
+		e.room.sfu.log.Infof("room %v hls egress sps/pps changed, init segment version %d", e.room.RoomID, e.initVersion)
+	}
+
+	e.pendingVideo = &hlsPendingSample{
+		sample: fmp4Sample{data: avcc.Bytes(), sync: keyFrame},
+		dts:    dts,
+	}
+}
+
+// writeMixedAudio 房間混音輸出的Opus frame
+func (e *hlsEgress) writeMixedAudio(data []byte, duration time.Duration) error {
+	e.Lock()
+	defer e.Unlock()
+
+	e.handleAudioSample(data, e.mixedTimestamp, nil)
+	e.mixedTimestamp += uint32(duration * fmp4AudioTimescale / time.Second)
+	return nil
+}
+
+// handleAudioSample clock為nil時(混音)以到達時間對齊
+func (e *hlsEgress) handleAudioSample(data []byte, rtpTimestamp uint32, clock *senderClock) {
+	// video尚未開始前的audio直接丟棄，segment需要以video keyframe開頭
+	if e.inits == nil {
+		return
+	}
+
+	dts := e.audioTime.toDTS(rtpTimestamp, e.baseTime(&e.audioTime, &e.videoTime, fmp4AudioTimescale, clock, rtpTimestamp))
+
+	if e.pendingAudio != nil {
+		e.pendingAudio.sample.duration = uint32(dts - e.pendingAudio.dts)
+		if len(e.fragment.audioSamples) == 0 {
+			e.fragment.audioBaseTime = e.pendingAudio.dts
+		}
+		e.fragment.audioSamples = append(e.fragment.audioSamples, e.pendingAudio.sample)
+	}
+
+	e.pendingAudio = &hlsPendingSample{
+		sample: fmp4Sample{data: append([]byte{}, data...), sync: true},
+		dts:    dts,
+	}
+}
+
+// cutSegment 將目前累積的samples輸出為一個segment，nextStart為下一個segment第一個keyframe的dts
+func (e *hlsEgress) cutSegment(nextStart uint64) {
+	e.sequence++
+	segment := hlsSegment{
+		sequence: e.sequence,
+		duration: time.Duration(float64(nextStart-e.segmentStart) / fmp4VideoTimescale * float64(time.Second)),
+		init:     e.initVersion,
+		data:     fmp4MediaSegment(e.sequence, &e.fragment),
+	}
+
+	e.segments = append(e.segments, segment)
+	// 多保留幾個已離開playlist的segment，給較慢的player下載
+	if keep := e.room.sfu.config.HLSPlaylistSize + 3; len(e.segments) > keep {
+		e.segments = e.segments[len(e.segments)-keep:]
+	}
+	// 不再被segment使用的舊init segment
+	for version := range e.inits {
+		if version < e.segments[0].init {
+			delete(e.inits, version)
+		}
+	}
+
+	e.fragment = fmp4Fragment{}
+	e.segmentStart = nextStart
+}
+
+// hlsInitName init segment版本的檔名，版本0為init.mp4
+func hlsInitName(version uint32) string {
+	if version == 0 {
+		return "init.mp4"
+	}
+	return fmt.Sprintf("init%d.mp4", version)
+}
+
+// playlist live sliding window playlist
+// init segment改變的segment之前加上EXT-X-DISCONTINUITY與新的EXT-X-MAP
+// 每個新版本是一次discontinuity，因此第一個segment的init版本即為EXT-X-DISCONTINUITY-SEQUENCE
+func (e *hlsEgress) playlist() string {
+	e.RLock()
+	defer e.RUnlock()
+
+	segments := e.segments
+	if size := e.room.sfu.config.HLSPlaylistSize; len(segments) > size {
+		segments = segments[len(segments)-size:]
+	}
+
+	targetDuration := math.Ceil(e.room.sfu.config.HLSSegmentDuration.Seconds())
+	for _, s := range segments {
+		targetDuration = math.Max(targetDuration, math.Ceil(s.duration.Seconds()))
+	}
+
+	var mediaSequence uint32 = 1
+	init := e.initVersion
+	if len(segments) > 0 {
+		mediaSequence = segments[0].sequence
+		init = segments[0].init
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(targetDuration))
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	if init > 0 {
+		fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", init)
+	}
+	fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s?token=%s\"\n", hlsInitName(init), e.token)
+	for _, s := range segments {
+		if s.init != init {
+			init = s.init
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s?token=%s\"\n", hlsInitName(init), e.token)
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\nseg%d.m4s?token=%s\n", s.duration.Seconds(), s.sequence, e.token)
+	}
+
+	return b.String()
+}
+
+func (e *hlsEgress) getInitSegment(version uint32) []byte {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.inits[version]
+}
+
+func (e *hlsEgress) getSegment(sequence uint32) []byte {
+	e.RLock()
+	defer e.RUnlock()
+
+	for _, s := range e.segments {
+		if s.sequence == sequence {
+			return s.data
+		}
+	}
+	return nil
+}
+
+// splitAnnexB 以start code切割NALU
+func splitAnnexB(data []byte) [][]byte {
+	nalus := [][]byte{}
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, data[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+
+	if start < 0 {
+		// 沒有start code，整段視為單一NALU
+		if len(data) > 0 {
+			nalus = append(nalus, data)
+		}
+	} else if start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+
+	return nalus
+}
+
+// hlsEgressInfo start hls egress API response
+type hlsEgressInfo struct {
+	RoomID      uuid.UUID `json:"roomID"`
+	StreamID    string    `json:"streamID"`
+	PlaylistURL string    `json:"playlistURL"`
+}
+
+// getRoomFromRequest 從URL的roomid取得room
+func (s *SFU) getRoomFromRequest(r *http.Request) (*ConferenceRoom, error) {
+	roomID, err := s.resolveRoomID(mux.Vars(r)["roomid"], s.requestIP(r))
+	if err != nil {
+		return nil, fmt.Errorf("URL room error: %v", err)
+	}
+
+	room, ok := s.getRoom(roomID)
+	if !ok {
+		return nil, fmt.Errorf("room %v doesn't exist", roomID)
+	}
+	return room, nil
+}
+
+// StartRoomHLS 啟動房間的HLS egress，需帶X-Host-Token，body可選擇帶入 {"streamID": "..."} 指定發言者
+func (s *SFU) StartRoomHLS(w http.ResponseWriter, r *http.Request) {
+	room, err := s.getRoomFromRequest(r)
+	if err != nil {
+		s.log.Errorf("start hls egress error: %v", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !s.checkHost(w, r, room) {
+		return
+	}
+
+	req := struct {
+		StreamID string `json:"streamID"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("request body json decode error: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	e, err := room.startHLSEgress(req.StreamID)
+	if err != nil {
+		s.log.Errorf("room %v start hls egress error: %v", room.RoomID, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hlsEgressInfo{
+		RoomID:      room.RoomID,
+		StreamID:    e.streamID,
+		PlaylistURL: fmt.Sprintf("https://%s/room/%s/hls/index.m3u8?token=%s", s.config.Domain, room.RoomID.String(), e.token),
+	}); err != nil {
+		s.log.Errorf("json encode err: %v", err)
+		return
+	}
+}
+
+// StopRoomHLS 停止房間的HLS egress，需帶X-Host-Token
+func (s *SFU) StopRoomHLS(w http.ResponseWriter, r *http.Request) {
+	room, err := s.getRoomFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !s.checkHost(w, r, room) {
+		return
+	}
+
+	if room.getHLSEgress() == nil {
+		http.Error(w, errHLSEgressNotRunning.Error(), http.StatusNotFound)
+		return
+	}
+
+	room.stopHLSEgress()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RoomHLSFile 提供 index.m3u8、init.mp4(init{N}.mp4)、seg{N}.m4s，需帶StartRoomHLS回傳的?token=，或與加入房間相同的密碼/host token
+func (s *SFU) RoomHLSFile(w http.ResponseWriter, r *http.Request) {
+	room, err := s.getRoomFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	e := room.getHLSEgress()
+	if e == nil {
+		http.Error(w, errHLSEgressNotRunning.Error(), http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(e.token)) != 1 &&
+		!isHostRequest(room, r) {
+		if err := s.checkRoomAccess(room, r); err != nil {
+			s.log.Infof("room %v reject hls file: %v", room.RoomID, err)
+			http.Error(w, err.reason, http.StatusForbidden)
+			return
+		}
+	}
+
+	// player通常不在同一個domain
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	file := mux.Vars(r)["file"]
+	switch {
+	case file == "index.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write([]byte(e.playlist()))
+
+	case strings.HasPrefix(file, "init") && strings.HasSuffix(file, ".mp4"):
+		// init.mp4為版本0，SPS/PPS改變後為init{N}.mp4
+		var version uint64
+		if v := strings.TrimSuffix(strings.TrimPrefix(file, "init"), ".mp4"); v != "" {
+			if version, err = strconv.ParseUint(v, 10, 32); err != nil || version == 0 {
+				http.Error(w, "init segment not found", http.StatusNotFound)
+				return
+			}
+		}
+		init := e.getInitSegment(uint32(version))
+		if init == nil {
+			http.Error(w, "init segment not ready", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		_, _ = w.Write(init)
+
+	case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".m4s"):
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "seg"), ".m4s"), 10, 32)
+		if err != nil {
+			http.Error(w, "segment not found", http.StatusNotFound)
+			return
+		}
+		segment := e.getSegment(uint32(sequence))
+		if segment == nil {
+			http.Error(w, "segment not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+		_, _ = w.Write(segment)
+
+	default:
+		http.Error(w, "file not found", http.StatusNotFound)
+	}
+}
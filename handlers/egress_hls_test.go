@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+func TestSplitAnnexB(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	}{
+		{
+			name: "4 byte start codes",
+			data: []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88},
+			want: [][]byte{{0x67, 0x42}, {0x68, 0xce}, {0x65, 0x88}},
+		},
+		{
+			name: "3 byte start codes",
+			data: []byte{0, 0, 1, 0x09, 0xf0, 0, 0, 1, 0x41, 0x9a},
+			want: [][]byte{{0x09, 0xf0}, {0x41, 0x9a}},
+		},
+		{
+			name: "mixed start codes",
+			data: []byte{0, 0, 0, 1, 0x67, 0, 0, 1, 0x68, 0, 0, 0, 1, 0x65},
+			want: [][]byte{{0x67}, {0x68}, {0x65}},
+		},
+		{
+			name: "empty nalu between start codes",
+			data: []byte{0, 0, 1, 0, 0, 1, 0x65, 0x01},
+			want: [][]byte{{0x65, 0x01}},
+		},
+		{
+			name: "no start code",
+			data: []byte{0x65, 0x88, 0x84},
+			want: [][]byte{{0x65, 0x88, 0x84}},
+		},
+		{
+			name: "trailing start code",
+			data: []byte{0, 0, 1, 0x65, 0, 0, 1},
+			want: [][]byte{{0x65}},
+		},
+		{
+			name: "empty",
+			data: []byte{},
+			want: [][]byte{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitAnnexB(test.data); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("splitAnnexB(%x) = %x, want %x", test.data, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHLSPlaylist(t *testing.T) {
+	segments := func(durations ...time.Duration) []hlsSegment {
+		s := []hlsSegment{}
+		for i, d := range durations {
+			s = append(s, hlsSegment{sequence: uint32(i + 1), duration: d})
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		segments []hlsSegment
+		want     string
+	}{
+		{
+			name: "no segments",
+			want: "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+				"#EXT-X-MAP:URI=\"init.mp4?token=tok\"\n",
+		},
+		{
+			name:     "sliding window",
+			segments: segments(2*time.Second, 2*time.Second, 2*time.Second, 1500*time.Millisecond, 2*time.Second),
+			want: "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:3\n" +
+				"#EXT-X-MAP:URI=\"init.mp4?token=tok\"\n" +
+				"#EXTINF:2.000,\nseg3.m4s?token=tok\n" +
+				"#EXTINF:1.500,\nseg4.m4s?token=tok\n" +
+				"#EXTINF:2.000,\nseg5.m4s?token=tok\n",
+		},
+		{
+			name: "init segment changes",
+			segments: []hlsSegment{
+				{sequence: 1, duration: 2 * time.Second},
+				{sequence: 2, duration: 2 * time.Second},
+				{sequence: 3, duration: 2 * time.Second, init: 1},
+				{sequence: 4, duration: 500 * time.Millisecond, init: 1},
+				{sequence: 5, duration: 2 * time.Second, init: 2},
+			},
+			want: "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:3\n" +
+				"#EXT-X-DISCONTINUITY-SEQUENCE:1\n" +
+				"#EXT-X-MAP:URI=\"init1.mp4?token=tok\"\n" +
+				"#EXTINF:2.000,\nseg3.m4s?token=tok\n" +
+				"#EXTINF:0.500,\nseg4.m4s?token=tok\n" +
+				"#EXT-X-DISCONTINUITY\n" +
+				"#EXT-X-MAP:URI=\"init2.mp4?token=tok\"\n" +
+				"#EXTINF:2.000,\nseg5.m4s?token=tok\n",
+		},
+		{
+			name:     "segment longer than target",
+			segments: segments(2*time.Second, 3200*time.Millisecond),
+			want: "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+				"#EXT-X-MAP:URI=\"init.mp4?token=tok\"\n" +
+				"#EXTINF:2.000,\nseg1.m4s?token=tok\n" +
+				"#EXTINF:3.200,\nseg2.m4s?token=tok\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := &hlsEgress{
+				room: &ConferenceRoom{sfu: &SFU{config: Config{
+					HLSSegmentDuration: 2 * time.Second,
+					HLSPlaylistSize:    3,
+				}}},
+				token:    "tok",
+				segments: test.segments,
+			}
+			if got := e.playlist(); got != test.want {
+				t.Errorf("playlist =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHLSTimelineToDTS(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []uint32
+		want       []uint64
+	}{
+		{
+			name:       "increasing",
+			timestamps: []uint32{1000, 4000, 7000},
+			want:       []uint64{100, 3100, 6100},
+		},
+		{
+			name:       "wrap around",
+			timestamps: []uint32{0xffffff00, 0x00000100},
+			want:       []uint64{100, 612},
+		},
+		{
+			name:       "timestamp going backwards",
+			timestamps: []uint32{5000, 4000, 8000},
+			want:       []uint64{100, 100, 4100},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeline := &hlsTimeline{}
+			for i, ts := range test.timestamps {
+				if got := timeline.toDTS(ts, 100); got != test.want[i] {
+					t.Errorf("toDTS(%d) = %d, want %d", ts, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestHLSInitSegmentChange publisher中途改變解析度時在keyframe切割segment並產生新的init segment
+func TestHLSInitSegmentChange(t *testing.T) {
+	room := &ConferenceRoom{sfu: &SFU{log: defaultLogger{}, config: Config{
+		HLSSegmentDuration: 2 * time.Second,
+		HLSPlaylistSize:    3,
+	}}}
+	e := newHLSEgress(room, "stream")
+
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	small := testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 20, heightInMbs: 15, frameMbsOnly: true}.build()
+	large := testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 80, heightInMbs: 45, frameMbsOnly: true}.build()
+
+	startCode := []byte{0, 0, 0, 1}
+	keyFrame := func(sps []byte) []byte {
+		return bytes.Join([][]byte{nil, sps, pps, {0x65, 0x88, 0x84}}, startCode)
+	}
+	frame := append(append([]byte{}, startCode...), 0x41, 0x9a)
+
+	// 30fps，第10個frame改為較大的解析度，之後每2秒一個相同SPS的keyframe
+	frames := [][]byte{keyFrame(small)}
+	for i := 1; i < 10; i++ {
+		frames = append(frames, frame)
+	}
+	for i := 10; i < 80; i++ {
+		if (i-10)%60 == 0 {
+			frames = append(frames, keyFrame(large))
+			continue
+		}
+		frames = append(frames, frame)
+	}
+	for i, data := range frames {
+		e.handleVideoSample(&media.Sample{Data: data, PacketTimestamp: uint32(i * 3000)}, nil)
+	}
+
+	if len(e.segments) != 2 {
+		t.Fatalf("segments = %d, want 2", len(e.segments))
+	}
+	if e.segments[0].init != 0 || e.segments[1].init != 1 || e.initVersion != 1 {
+		t.Errorf("segment init versions = %d, %d, current %d, want 0, 1, 1", e.segments[0].init, e.segments[1].init, e.initVersion)
+	}
+	if e.segments[0].duration != 10*time.Second/30 {
+		t.Errorf("segment before sps change duration = %v, want %v", e.segments[0].duration, 10*time.Second/30)
+	}
+
+	for version, sps := range map[uint32][]byte{0: small, 1: large} {
+		want, err := fmp4InitSegment(sps, pps)
+		if err != nil {
+			t.Fatalf("init segment: %v", err)
+		}
+		if got := e.getInitSegment(version); !bytes.Equal(got, want) {
+			t.Errorf("init segment version %d does not match its sps", version)
+		}
+	}
+
+	playlist := e.playlist()
+	if !strings.Contains(playlist, "#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init1.mp4?token="+e.token+"\"\n#EXTINF") {
+		t.Errorf("playlist missing discontinuity before init1.mp4:\n%s", playlist)
+	}
+}
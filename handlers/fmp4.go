@@ -0,0 +1,571 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// fragmented MP4 (CMAF) muxer，只實作HLS egress需要的部分：H264 video + Opus audio
+
+const (
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+
+	fmp4VideoTimescale = 90000
+	fmp4AudioTimescale = 48000
+
+	// sample_depends_on = 2 (不依賴其他frame，keyframe)
+	fmp4SampleFlagsSync = 0x02000000
+	// sample_depends_on = 1 & sample_is_non_sync_sample
+	fmp4SampleFlagsNonSync = 0x01010000
+)
+
+type fmp4Sample struct {
+	data     []byte
+	duration uint32
+	sync     bool
+}
+
+// fmp4Fragment 單一moof+mdat所包含的samples，baseTime為各track timescale下的decode time
+type fmp4Fragment struct {
+	videoBaseTime uint64
+	videoSamples  []fmp4Sample
+
+	audioBaseTime uint64
+	audioSamples  []fmp4Sample
+}
+
+// writeBox 寫入size + type，body寫完之後回填size
+func writeBox(b *bytes.Buffer, typ string, body func(b *bytes.Buffer)) {
+	start := b.Len()
+	b.Write([]byte{0, 0, 0, 0})
+	b.WriteString(typ)
+	body(b)
+	binary.BigEndian.PutUint32(b.Bytes()[start:], uint32(b.Len()-start))
+}
+
+// writeFullBox 多了version & flags的box
+func writeFullBox(b *bytes.Buffer, typ string, version uint8, flags uint32, body func(b *bytes.Buffer)) {
+	writeBox(b, typ, func(b *bytes.Buffer) {
+		writeUint32(b, uint32(version)<<24|flags&0x00ffffff)
+		body(b)
+	})
+}
+
+func writeUint16(b *bytes.Buffer, v uint16) {
+	_ = binary.Write(b, binary.BigEndian, v)
+}
+
+func writeUint32(b *bytes.Buffer, v uint32) {
+	_ = binary.Write(b, binary.BigEndian, v)
+}
+
+func writeUint64(b *bytes.Buffer, v uint64) {
+	_ = binary.Write(b, binary.BigEndian, v)
+}
+
+func writeZeros(b *bytes.Buffer, n int) {
+	b.Write(make([]byte, n))
+}
+
+// unity matrix
+func writeMatrix(b *bytes.Buffer) {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		writeUint32(b, v)
+	}
+}
+
+// fmp4InitSegment 建立 ftyp + moov，sps/pps為nil時只有audio track
+func fmp4InitSegment(sps, pps []byte) ([]byte, error) {
+	var width, height int
+	hasVideo := sps != nil && pps != nil
+	if hasVideo {
+		var err error
+		if width, height, err = h264SPSResolution(sps); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &bytes.Buffer{}
+	writeBox(b, "ftyp", func(b *bytes.Buffer) {
+		b.WriteString("iso5")
+		writeUint32(b, 512)
+		b.WriteString("iso5iso6mp41")
+	})
+
+	writeBox(b, "moov", func(b *bytes.Buffer) {
+		writeFullBox(b, "mvhd", 0, 0, func(b *bytes.Buffer) {
+			writeUint32(b, 0)    // creation_time
+			writeUint32(b, 0)    // modification_time
+			writeUint32(b, 1000) // timescale
+			writeUint32(b, 0)    // duration
+			writeUint32(b, 0x00010000)
+			writeUint16(b, 0x0100)
+			writeZeros(b, 10)
+			writeMatrix(b)
+			writeZeros(b, 24)
+			writeUint32(b, fmp4AudioTrackID+1) // next_track_ID
+		})
+
+		if hasVideo {
+			writeFmp4Trak(b, fmp4VideoTrackID, width, height, func(b *bytes.Buffer) {
+				writeAvc1SampleEntry(b, sps, pps, width, height)
+			})
+		}
+		writeFmp4Trak(b, fmp4AudioTrackID, 0, 0, writeOpusSampleEntry)
+
+		writeBox(b, "mvex", func(b *bytes.Buffer) {
+			trackIDs := []uint32{fmp4AudioTrackID}
+			if hasVideo {
+				trackIDs = []uint32{fmp4VideoTrackID, fmp4AudioTrackID}
+			}
+			for _, id := range trackIDs {
+				writeFullBox(b, "trex", 0, 0, func(b *bytes.Buffer) {
+					writeUint32(b, id)
+					writeUint32(b, 1) // default_sample_description_index
+					writeUint32(b, 0)
+					writeUint32(b, 0)
+					writeUint32(b, 0)
+				})
+			}
+		})
+	})
+
+	return b.Bytes(), nil
+}
+
+func writeFmp4Trak(b *bytes.Buffer, trackID uint32, width, height int, sampleEntry func(b *bytes.Buffer)) {
+	isVideo := trackID == fmp4VideoTrackID
+	timescale := uint32(fmp4AudioTimescale)
+	if isVideo {
+		timescale = fmp4VideoTimescale
+	}
+
+	writeBox(b, "trak", func(b *bytes.Buffer) {
+		// flags: track_enabled | track_in_movie
+		writeFullBox(b, "tkhd", 0, 3, func(b *bytes.Buffer) {
+			writeUint32(b, 0)
+			writeUint32(b, 0)
+			writeUint32(b, trackID)
+			writeUint32(b, 0)
+			writeUint32(b, 0) // duration
+			writeZeros(b, 8)
+			writeUint16(b, 0) // layer
+			writeUint16(b, 0) // alternate_group
+			if isVideo {
+				writeUint16(b, 0)
+			} else {
+				writeUint16(b, 0x0100)
+			}
+			writeUint16(b, 0)
+			writeMatrix(b)
+			writeUint32(b, uint32(width)<<16)
+			writeUint32(b, uint32(height)<<16)
+		})
+
+		writeBox(b, "mdia", func(b *bytes.Buffer) {
+			writeFullBox(b, "mdhd", 0, 0, func(b *bytes.Buffer) {
+				writeUint32(b, 0)
+				writeUint32(b, 0)
+				writeUint32(b, timescale)
+				writeUint32(b, 0)
+				writeUint16(b, 0x55c4) // language: und
+				writeUint16(b, 0)
+			})
+
+			writeFullBox(b, "hdlr", 0, 0, func(b *bytes.Buffer) {
+				writeUint32(b, 0)
+				if isVideo {
+					b.WriteString("vide")
+				} else {
+					b.WriteString("soun")
+				}
+				writeZeros(b, 12)
+				if isVideo {
+					b.WriteString("VideoHandler\x00")
+				} else {
+					b.WriteString("SoundHandler\x00")
+				}
+			})
+
+			writeBox(b, "minf", func(b *bytes.Buffer) {
+				if isVideo {
+					writeFullBox(b, "vmhd", 0, 1, func(b *bytes.Buffer) {
+						writeZeros(b, 8)
+					})
+				} else {
+					writeFullBox(b, "smhd", 0, 0, func(b *bytes.Buffer) {
+						writeZeros(b, 4)
+					})
+				}
+
+				writeBox(b, "dinf", func(b *bytes.Buffer) {
+					writeFullBox(b, "dref", 0, 0, func(b *bytes.Buffer) {
+						writeUint32(b, 1)
+						// flags 1: media data在同一個檔案中
+						writeFullBox(b, "url ", 0, 1, func(b *bytes.Buffer) {})
+					})
+				})
+
+				writeBox(b, "stbl", func(b *bytes.Buffer) {
+					writeFullBox(b, "stsd", 0, 0, func(b *bytes.Buffer) {
+						writeUint32(b, 1)
+						sampleEntry(b)
+					})
+					writeFullBox(b, "stts", 0, 0, func(b *bytes.Buffer) { writeUint32(b, 0) })
+					writeFullBox(b, "stsc", 0, 0, func(b *bytes.Buffer) { writeUint32(b, 0) })
+					writeFullBox(b, "stsz", 0, 0, func(b *bytes.Buffer) {
+						writeUint32(b, 0)
+						writeUint32(b, 0)
+					})
+					writeFullBox(b, "stco", 0, 0, func(b *bytes.Buffer) { writeUint32(b, 0) })
+				})
+			})
+		})
+	})
+}
+
+func writeAvc1SampleEntry(b *bytes.Buffer, sps, pps []byte, width, height int) {
+	writeBox(b, "avc1", func(b *bytes.Buffer) {
+		writeZeros(b, 6)
+		writeUint16(b, 1) // data_reference_index
+		writeZeros(b, 16)
+		writeUint16(b, uint16(width))
+		writeUint16(b, uint16(height))
+		writeUint32(b, 0x00480000) // 72 dpi
+		writeUint32(b, 0x00480000)
+		writeUint32(b, 0)
+		writeUint16(b, 1) // frame_count
+		writeZeros(b, 32) // compressorname
+		writeUint16(b, 0x0018)
+		writeUint16(b, 0xffff)
+
+		writeBox(b, "avcC", func(b *bytes.Buffer) {
+			b.WriteByte(1)
+			b.Write(sps[1:4]) // profile, compatibility, level
+			b.WriteByte(0xff) // NALU length size 4 bytes
+			b.WriteByte(0xe1) // 1 SPS
+			writeUint16(b, uint16(len(sps)))
+			b.Write(sps)
+			b.WriteByte(1) // 1 PPS
+			writeUint16(b, uint16(len(pps)))
+			b.Write(pps)
+		})
+	})
+}
+
+func writeOpusSampleEntry(b *bytes.Buffer) {
+	writeBox(b, "Opus", func(b *bytes.Buffer) {
+		writeZeros(b, 6)
+		writeUint16(b, 1) // data_reference_index
+		writeZeros(b, 8)
+		writeUint16(b, 2)  // channelcount
+		writeUint16(b, 16) // samplesize
+		writeZeros(b, 4)
+		writeUint32(b, fmp4AudioTimescale<<16)
+
+		writeBox(b, "dOps", func(b *bytes.Buffer) {
+			b.WriteByte(0) // version
+			b.WriteByte(2) // OutputChannelCount
+			writeUint16(b, 0)
+			writeUint32(b, fmp4AudioTimescale)
+			writeUint16(b, 0) // OutputGain
+			b.WriteByte(0)    // ChannelMappingFamily
+		})
+	})
+}
+
+// fmp4MediaSegment 建立 moof + mdat
+func fmp4MediaSegment(sequenceNumber uint32, f *fmp4Fragment) []byte {
+	writeMoof := func(videoOffset, audioOffset int32) *bytes.Buffer {
+		b := &bytes.Buffer{}
+		writeBox(b, "moof", func(b *bytes.Buffer) {
+			writeFullBox(b, "mfhd", 0, 0, func(b *bytes.Buffer) {
+				writeUint32(b, sequenceNumber)
+			})
+			if len(f.videoSamples) > 0 {
+				writeFmp4Traf(b, fmp4VideoTrackID, f.videoBaseTime, videoOffset, f.videoSamples)
+			}
+			if len(f.audioSamples) > 0 {
+				writeFmp4Traf(b, fmp4AudioTrackID, f.audioBaseTime, audioOffset, f.audioSamples)
+			}
+		})
+		return b
+	}
+
+	videoSize := 0
+	for _, s := range f.videoSamples {
+		videoSize += len(s.data)
+	}
+
+	// 第一次只為了得到moof的大小，data offset不影響box大小
+	moofSize := int32(writeMoof(0, 0).Len())
+	b := writeMoof(moofSize+8, moofSize+8+int32(videoSize))
+
+	writeBox(b, "mdat", func(b *bytes.Buffer) {
+		for _, s := range f.videoSamples {
+			b.Write(s.data)
+		}
+		for _, s := range f.audioSamples {
+			b.Write(s.data)
+		}
+	})
+
+	return b.Bytes()
+}
+
+func writeFmp4Traf(b *bytes.Buffer, trackID uint32, baseTime uint64, dataOffset int32, samples []fmp4Sample) {
+	writeBox(b, "traf", func(b *bytes.Buffer) {
+		// flags: default-base-is-moof
+		writeFullBox(b, "tfhd", 0, 0x020000, func(b *bytes.Buffer) {
+			writeUint32(b, trackID)
+		})
+		writeFullBox(b, "tfdt", 1, 0, func(b *bytes.Buffer) {
+			writeUint64(b, baseTime)
+		})
+		// flags: data-offset | sample-duration | sample-size | sample-flags
+		writeFullBox(b, "trun", 0, 0x000701, func(b *bytes.Buffer) {
+			writeUint32(b, uint32(len(samples)))
+			writeUint32(b, uint32(dataOffset))
+			for _, s := range samples {
+				writeUint32(b, s.duration)
+				writeUint32(b, uint32(len(s.data)))
+				if s.sync {
+					writeUint32(b, fmp4SampleFlagsSync)
+				} else {
+					writeUint32(b, fmp4SampleFlagsNonSync)
+				}
+			}
+		})
+	})
+}
+
+var errH264SPSTruncated = errors.New("h264 sps truncated")
+
+// bitReader 解析SPS用，Exp-Golomb
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (uint, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errH264SPSTruncated
+	}
+	bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+	r.pos++
+	return uint(bit), nil
+}
+
+func (r *bitReader) readBits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+	return v, nil
+}
+
+func (r *bitReader) readUE() (uint, error) {
+	zeros := 0
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+	}
+	v, err := r.readBits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1 << uint(zeros)) - 1 + v, nil
+}
+
+func (r *bitReader) readSE() (int, error) {
+	v, err := r.readUE()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 0 {
+		return -int(v / 2), nil
+	}
+	return int(v+1) / 2, nil
+}
+
+// h264SPSResolution 從SPS NALU(含NALU header)取得影像寬高
+func h264SPSResolution(sps []byte) (width, height int, err error) {
+	// 移除 emulation prevention bytes (0x000003)
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	if len(rbsp) < 3 {
+		return 0, 0, errH264SPSTruncated
+	}
+
+	profileIdc := rbsp[0]
+	r := &bitReader{data: rbsp[3:]}
+
+	// seq_parameter_set_id
+	if _, err = r.readUE(); err != nil {
+		return
+	}
+
+	chromaFormatIdc := uint(1)
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIdc, err = r.readUE(); err != nil {
+			return
+		}
+		if chromaFormatIdc == 3 {
+			if _, err = r.readBit(); err != nil {
+				return
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		if _, err = r.readUE(); err != nil {
+			return
+		}
+		if _, err = r.readUE(); err != nil {
+			return
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err = r.readBit(); err != nil {
+			return
+		}
+		var scalingMatrixPresent uint
+		if scalingMatrixPresent, err = r.readBit(); err != nil {
+			return
+		}
+		if scalingMatrixPresent == 1 {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				var present uint
+				if present, err = r.readBit(); err != nil {
+					return
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						var delta int
+						if delta, err = r.readSE(); err != nil {
+							return
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	if _, err = r.readUE(); err != nil {
+		return
+	}
+	var picOrderCntType uint
+	if picOrderCntType, err = r.readUE(); err != nil {
+		return
+	}
+	switch picOrderCntType {
+	case 0:
+		if _, err = r.readUE(); err != nil {
+			return
+		}
+	case 1:
+		if _, err = r.readBit(); err != nil {
+			return
+		}
+		if _, err = r.readSE(); err != nil {
+			return
+		}
+		if _, err = r.readSE(); err != nil {
+			return
+		}
+		var cycle uint
+		if cycle, err = r.readUE(); err != nil {
+			return
+		}
+		for i := uint(0); i < cycle; i++ {
+			if _, err = r.readSE(); err != nil {
+				return
+			}
+		}
+	}
+
+	// max_num_ref_frames, gaps_in_frame_num_value_allowed_flag
+	if _, err = r.readUE(); err != nil {
+		return
+	}
+	if _, err = r.readBit(); err != nil {
+		return
+	}
+
+	var widthInMbs, heightInMapUnits, frameMbsOnly uint
+	if widthInMbs, err = r.readUE(); err != nil {
+		return
+	}
+	if heightInMapUnits, err = r.readUE(); err != nil {
+		return
+	}
+	if frameMbsOnly, err = r.readBit(); err != nil {
+		return
+	}
+	if frameMbsOnly == 0 {
+		// mb_adaptive_frame_field_flag
+		if _, err = r.readBit(); err != nil {
+			return
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err = r.readBit(); err != nil {
+		return
+	}
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	var cropping uint
+	if cropping, err = r.readBit(); err != nil {
+		return
+	}
+	if cropping == 1 {
+		for _, v := range []*uint{&cropLeft, &cropRight, &cropTop, &cropBottom} {
+			if *v, err = r.readUE(); err != nil {
+				return
+			}
+		}
+	}
+
+	cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+	if chromaFormatIdc == 1 {
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	} else if chromaFormatIdc == 2 {
+		cropUnitX, cropUnitY = 2, 2-frameMbsOnly
+	}
+
+	width = int((widthInMbs+1)*16 - (cropLeft+cropRight)*cropUnitX)
+	height = int((2-frameMbsOnly)*(heightInMapUnits+1)*16 - (cropTop+cropBottom)*cropUnitY)
+	return width, height, nil
+}
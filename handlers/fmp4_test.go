@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// testBitWriter 產生測試用SPS
+type testBitWriter struct {
+	bits []byte
+}
+
+func (w *testBitWriter) writeBits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bits = append(w.bits, byte(v>>uint(i))&1)
+	}
+}
+
+func (w *testBitWriter) writeUE(v uint) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.writeBits(0, n)
+	w.writeBits(v, n+1)
+}
+
+// bytes 加上rbsp_stop_one_bit，補齊byte後插入emulation prevention bytes
+func (w *testBitWriter) bytes() []byte {
+	bits := append(append([]byte{}, w.bits...), 1)
+	for len(bits)%8 != 0 {
+		bits = append(bits, 0)
+	}
+
+	out := []byte{}
+	zeros := 0
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b = b<<1 | bit
+		}
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+type testSPS struct {
+	profile         byte
+	maxRefFrames    uint
+	widthInMbs      uint
+	heightInMbs     uint
+	cropRight       uint
+	cropBottom      uint
+	frameMbsOnly    bool
+	pocType1Offsets int
+}
+
+// build 產生含NALU header的SPS
+func (s testSPS) build() []byte {
+	w := &testBitWriter{}
+	w.writeUE(0) // seq_parameter_set_id
+	if s.profile == 100 {
+		w.writeUE(1)      // chroma_format_idc
+		w.writeUE(0)      // bit_depth_luma_minus8
+		w.writeUE(0)      // bit_depth_chroma_minus8
+		w.writeBits(0, 1) // qpprime_y_zero_transform_bypass_flag
+		w.writeBits(0, 1) // seq_scaling_matrix_present_flag
+	}
+	w.writeUE(0) // log2_max_frame_num_minus4
+	if s.pocType1Offsets > 0 {
+		w.writeUE(1)
+		w.writeBits(0, 1) // delta_pic_order_always_zero_flag
+		w.writeUE(0)      // offset_for_non_ref_pic (se)
+		w.writeUE(0)      // offset_for_top_to_bottom_field (se)
+		w.writeUE(uint(s.pocType1Offsets))
+		for i := 0; i < s.pocType1Offsets; i++ {
+			w.writeUE(1) // offset_for_ref_frame = 1 (se)
+		}
+	} else {
+		w.writeUE(0)
+		w.writeUE(0) // log2_max_pic_order_cnt_lsb_minus4
+	}
+	w.writeUE(s.maxRefFrames)
+	w.writeBits(0, 1) // gaps_in_frame_num_value_allowed_flag
+	w.writeUE(s.widthInMbs - 1)
+	w.writeUE(s.heightInMbs - 1)
+	if s.frameMbsOnly {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+		w.writeBits(0, 1) // mb_adaptive_frame_field_flag
+	}
+	w.writeBits(1, 1) // direct_8x8_inference_flag
+	if s.cropRight > 0 || s.cropBottom > 0 {
+		w.writeBits(1, 1)
+		w.writeUE(0)
+		w.writeUE(s.cropRight)
+		w.writeUE(0)
+		w.writeUE(s.cropBottom)
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 1) // vui_parameters_present_flag
+
+	return append([]byte{0x67, s.profile, 0xc0, 0x1e}, w.bytes()...)
+}
+
+func TestH264SPSResolution(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           []byte
+		width, height int
+		err           error
+	}{
+		{
+			name:   "baseline",
+			sps:    testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 20, heightInMbs: 15, frameMbsOnly: true}.build(),
+			width:  320,
+			height: 240,
+		},
+		{
+			name:   "cropped 1080p",
+			sps:    testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 120, heightInMbs: 68, cropBottom: 4, frameMbsOnly: true}.build(),
+			width:  1920,
+			height: 1080,
+		},
+		{
+			name:   "high profile",
+			sps:    testSPS{profile: 100, maxRefFrames: 4, widthInMbs: 80, heightInMbs: 45, frameMbsOnly: true}.build(),
+			width:  1280,
+			height: 720,
+		},
+		{
+			name:   "interlaced",
+			sps:    testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 45, heightInMbs: 18, cropRight: 4}.build(),
+			width:  712,
+			height: 576,
+		},
+		{
+			name:   "pic order cnt type 1",
+			sps:    testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 40, heightInMbs: 30, frameMbsOnly: true, pocType1Offsets: 3}.build(),
+			width:  640,
+			height: 480,
+		},
+		{
+			name:   "emulation prevention",
+			sps:    testSPS{profile: 66, maxRefFrames: 1<<26 - 1, widthInMbs: 20, heightInMbs: 15, frameMbsOnly: true}.build(),
+			width:  320,
+			height: 240,
+		},
+		{
+			name: "header only",
+			sps:  []byte{0x67, 0x42},
+			err:  errH264SPSTruncated,
+		},
+		{
+			name: "truncated",
+			sps:  testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 120, heightInMbs: 68, frameMbsOnly: true}.build()[:6],
+			err:  errH264SPSTruncated,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := h264SPSResolution(test.sps)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err = %v, want %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if width != test.width || height != test.height {
+				t.Errorf("resolution = %dx%d, want %dx%d", width, height, test.width, test.height)
+			}
+		})
+	}
+
+	if sps := (testSPS{profile: 66, maxRefFrames: 1<<26 - 1, widthInMbs: 20, heightInMbs: 15, frameMbsOnly: true}.build()); !bytes.Contains(sps, []byte{0, 0, 3}) {
+		t.Errorf("emulation prevention sps %x has no 0x000003", sps)
+	}
+}
+
+// testBox 測試用解析出的MP4 box，body不含size & type
+type testBox struct {
+	typ  string
+	body []byte
+}
+
+func parseTestBoxes(t *testing.T, data []byte) []testBox {
+	t.Helper()
+
+	boxes := []testBox{}
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 8 {
+			t.Fatalf("box header truncated at %d", offset)
+		}
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || offset+size > len(data) {
+			t.Fatalf("box %q size %d out of range at %d", data[offset+4:offset+8], size, offset)
+		}
+		boxes = append(boxes, testBox{typ: string(data[offset+4 : offset+8]), body: data[offset+8 : offset+size]})
+		offset += size
+	}
+	return boxes
+}
+
+// findTestBoxes 依path取得box，container box直接以body解析下一層
+func findTestBoxes(t *testing.T, data []byte, path ...string) []testBox {
+	t.Helper()
+
+	found := []testBox{}
+	for _, box := range parseTestBoxes(t, data) {
+		if box.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			found = append(found, box)
+			continue
+		}
+		found = append(found, findTestBoxes(t, box.body, path[1:]...)...)
+	}
+	return found
+}
+
+func TestFmp4InitSegment(t *testing.T) {
+	sps := testSPS{profile: 66, maxRefFrames: 1, widthInMbs: 20, heightInMbs: 15, frameMbsOnly: true}.build()
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+
+	tests := []struct {
+		name     string
+		sps, pps []byte
+		handlers []string
+	}{
+		{name: "video and audio", sps: sps, pps: pps, handlers: []string{"vide", "soun"}},
+		{name: "audio only", handlers: []string{"soun"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			init, err := fmp4InitSegment(test.sps, test.pps)
+			if err != nil {
+				t.Fatalf("init segment: %v", err)
+			}
+
+			top := parseTestBoxes(t, init)
+			if len(top) != 2 || top[0].typ != "ftyp" || top[1].typ != "moov" {
+				t.Fatalf("top level boxes = %v, want ftyp, moov", top)
+			}
+
+			hdlrs := findTestBoxes(t, init, "moov", "trak", "mdia", "hdlr")
+			if len(hdlrs) != len(test.handlers) {
+				t.Fatalf("%d tracks, want %d", len(hdlrs), len(test.handlers))
+			}
+			for i, hdlr := range hdlrs {
+				// version & flags, pre_defined
+				if got := string(hdlr.body[8:12]); got != test.handlers[i] {
+					t.Errorf("track %d handler = %q, want %q", i, got, test.handlers[i])
+				}
+			}
+			if trex := findTestBoxes(t, init, "moov", "mvex", "trex"); len(trex) != len(test.handlers) {
+				t.Errorf("%d trex, want %d", len(trex), len(test.handlers))
+			}
+
+			if test.sps == nil {
+				stsd := findTestBoxes(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd")[0]
+				if entry := parseTestBoxes(t, stsd.body[8:])[0]; entry.typ != "Opus" {
+					t.Errorf("sample entry = %q, want Opus", entry.typ)
+				}
+				return
+			}
+
+			tkhd := findTestBoxes(t, init, "moov", "trak", "tkhd")[0]
+			width, height := binary.BigEndian.Uint32(tkhd.body[76:]), binary.BigEndian.Uint32(tkhd.body[80:])
+			if width != 320<<16 || height != 240<<16 {
+				t.Errorf("tkhd size = %dx%d, want 320x240", width>>16, height>>16)
+			}
+
+			// stsd: version & flags + entry_count後為avc1，avc1 sample entry固定78 bytes後為avcC
+			stsd := findTestBoxes(t, init, "moov", "trak", "mdia", "minf", "stbl", "stsd")[0]
+			avc1 := parseTestBoxes(t, stsd.body[8:])[0]
+			if avc1.typ != "avc1" {
+				t.Fatalf("sample entry = %q, want avc1", avc1.typ)
+			}
+			avcC := parseTestBoxes(t, avc1.body[78:])[0]
+			want := append([]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1, 0, byte(len(sps))}, sps...)
+			want = append(append(want, 1, 0, byte(len(pps))), pps...)
+			if avcC.typ != "avcC" || !bytes.Equal(avcC.body, want) {
+				t.Errorf("avcC = %q %x, want %x", avcC.typ, avcC.body, want)
+			}
+		})
+	}
+
+	if _, err := fmp4InitSegment([]byte{0x67, 0x42}, pps); !errors.Is(err, errH264SPSTruncated) {
+		t.Errorf("invalid sps err = %v, want %v", err, errH264SPSTruncated)
+	}
+}
+
+func TestFmp4MediaSegment(t *testing.T) {
+	tests := []struct {
+		name     string
+		fragment fmp4Fragment
+	}{
+		{
+			name: "video and audio",
+			fragment: fmp4Fragment{
+				videoBaseTime: 90000,
+				videoSamples: []fmp4Sample{
+					{data: []byte{0, 0, 0, 2, 0x65, 0x01}, duration: 3000, sync: true},
+					{data: []byte{0, 0, 0, 1, 0x41}, duration: 3000},
+				},
+				audioBaseTime: 48000,
+				audioSamples: []fmp4Sample{
+					{data: []byte{0xfc, 0x01, 0x02}, duration: 960, sync: true},
+				},
+			},
+		},
+		{
+			name: "audio only",
+			fragment: fmp4Fragment{
+				audioBaseTime: 960,
+				audioSamples: []fmp4Sample{
+					{data: []byte{0xfc, 0x01}, duration: 960, sync: true},
+					{data: []byte{0xfc, 0x02}, duration: 960, sync: true},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segment := fmp4MediaSegment(7, &test.fragment)
+
+			top := parseTestBoxes(t, segment)
+			if len(top) != 2 || top[0].typ != "moof" || top[1].typ != "mdat" {
+				t.Fatalf("top level boxes = %v, want moof, mdat", top)
+			}
+			if sequence := binary.BigEndian.Uint32(findTestBoxes(t, segment, "moof", "mfhd")[0].body[4:]); sequence != 7 {
+				t.Errorf("mfhd sequence = %d, want 7", sequence)
+			}
+
+			type track struct {
+				id       uint32
+				baseTime uint64
+				samples  []fmp4Sample
+			}
+			want := []track{}
+			if len(test.fragment.videoSamples) > 0 {
+				want = append(want, track{fmp4VideoTrackID, test.fragment.videoBaseTime, test.fragment.videoSamples})
+			}
+			want = append(want, track{fmp4AudioTrackID, test.fragment.audioBaseTime, test.fragment.audioSamples})
+
+			trafs := findTestBoxes(t, segment, "moof", "traf")
+			if len(trafs) != len(want) {
+				t.Fatalf("%d traf, want %d", len(trafs), len(want))
+			}
+			for i, traf := range trafs {
+				tfhd := findTestBoxes(t, traf.body, "tfhd")[0]
+				if id := binary.BigEndian.Uint32(tfhd.body[4:]); id != want[i].id {
+					t.Errorf("traf %d track ID = %d, want %d", i, id, want[i].id)
+				}
+				tfdt := findTestBoxes(t, traf.body, "tfdt")[0]
+				if baseTime := binary.BigEndian.Uint64(tfdt.body[4:]); baseTime != want[i].baseTime {
+					t.Errorf("traf %d base time = %d, want %d", i, baseTime, want[i].baseTime)
+				}
+
+				// data offset相對於moof開頭(default-base-is-moof)，sample依序排列
+				trun := findTestBoxes(t, traf.body, "trun")[0].body
+				count := binary.BigEndian.Uint32(trun[4:])
+				if int(count) != len(want[i].samples) {
+					t.Fatalf("traf %d sample count = %d, want %d", i, count, len(want[i].samples))
+				}
+				offset := int(binary.BigEndian.Uint32(trun[8:]))
+				for j, sample := range want[i].samples {
+					entry := trun[12+j*12:]
+					duration, size, flags := binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+					wantFlags := uint32(fmp4SampleFlagsNonSync)
+					if sample.sync {
+						wantFlags = fmp4SampleFlagsSync
+					}
+					if duration != sample.duration || int(size) != len(sample.data) || flags != wantFlags {
+						t.Errorf("traf %d sample %d = (%d, %d, %#x), want (%d, %d, %#x)", i, j, duration, size, flags, sample.duration, len(sample.data), wantFlags)
+					}
+					if offset+int(size) > len(segment) || !bytes.Equal(segment[offset:offset+int(size)], sample.data) {
+						t.Errorf("traf %d sample %d data at offset %d doesn't match", i, j, offset)
+					}
+					offset += int(size)
+				}
+			}
+		})
+	}
+}
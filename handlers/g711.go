@@ -0,0 +1,129 @@
+package handlers
+
+// G.711 μ-law / A-law，SIP電話最常用的codec，以及8kHz與混音器48kHz之間的轉換
+
+const (
+	g711SampleRate = 8000
+
+	// 48kHz -> 8kHz
+	g711ResampleRatio = mixerSampleRate / g711SampleRate
+
+	mulawBias = 0x84
+	mulawClip = 32635
+)
+
+func mulawEncode(sample int16) byte {
+	s := int(sample)
+	sign := 0
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > mulawClip {
+		s = mulawClip
+	}
+	s += mulawBias
+
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> uint(exponent+3)) & 0x0f
+
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+func mulawDecode(b byte) int16 {
+	b = ^b
+	sign := b & 0x80
+	exponent := int(b>>4) & 0x07
+	mantissa := int(b & 0x0f)
+
+	s := ((mantissa << 3) + mulawBias) << uint(exponent)
+	s -= mulawBias
+	if sign != 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
+
+func alawEncode(sample int16) byte {
+	s := int(sample)
+	sign := 0x80
+	if s < 0 {
+		s = -s - 1
+		sign = 0
+	}
+	if s > 32767 {
+		s = 32767
+	}
+
+	var b int
+	if s < 256 {
+		b = s >> 4
+	} else {
+		exponent := 7
+		for mask := 0x4000; s&mask == 0 && exponent > 1; mask >>= 1 {
+			exponent--
+		}
+		b = exponent<<4 | (s>>uint(exponent+3))&0x0f
+	}
+
+	return byte(b|sign) ^ 0x55
+}
+
+func alawDecode(b byte) int16 {
+	b ^= 0x55
+	exponent := int(b>>4) & 0x07
+	mantissa := int(b & 0x0f)
+
+	var s int
+	if exponent == 0 {
+		s = mantissa<<4 + 8
+	} else {
+		s = (mantissa<<4 + 0x108) << uint(exponent-1)
+	}
+
+	if b&0x80 == 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
+
+// g711Decode 解碼並升頻至48kHz (linear interpolation)
+func g711Decode(payload []byte, alaw bool, last *int16) []int16 {
+	pcm := make([]int16, 0, len(payload)*g711ResampleRatio)
+	for _, b := range payload {
+		var s int16
+		if alaw {
+			s = alawDecode(b)
+		} else {
+			s = mulawDecode(b)
+		}
+
+		for i := 1; i <= g711ResampleRatio; i++ {
+			pcm = append(pcm, int16(int(*last)+(int(s)-int(*last))*i/g711ResampleRatio))
+		}
+		*last = s
+	}
+	return pcm
+}
+
+// g711Encode 48kHz降頻至8kHz(取平均，同時作為簡單的low pass)並編碼
+func g711Encode(pcm []int16, alaw bool) []byte {
+	payload := make([]byte, 0, len(pcm)/g711ResampleRatio)
+	for i := 0; i+g711ResampleRatio <= len(pcm); i += g711ResampleRatio {
+		sum := 0
+		for _, s := range pcm[i : i+g711ResampleRatio] {
+			sum += int(s)
+		}
+		s := int16(sum / g711ResampleRatio)
+
+		if alaw {
+			payload = append(payload, alawEncode(s))
+		} else {
+			payload = append(payload, mulawEncode(s))
+		}
+	}
+	return payload
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import "testing"
+
+func TestG711KnownValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		alaw   bool
+		sample int16
+		code   byte
+		// decoded code解碼後的值
+		decoded int16
+	}{
+		{name: "mulaw zero", sample: 0, code: 0xff, decoded: 0},
+		{name: "mulaw max", sample: 32767, code: 0x80, decoded: 32124},
+		{name: "mulaw min", sample: -32768, code: 0x00, decoded: -32124},
+		{name: "mulaw small positive", sample: 100, code: 0xf2, decoded: 104},
+		{name: "alaw zero", alaw: true, sample: 0, code: 0xd5, decoded: 8},
+		{name: "alaw max", alaw: true, sample: 32767, code: 0xaa, decoded: 32256},
+		{name: "alaw min", alaw: true, sample: -32768, code: 0x2a, decoded: -32256},
+		{name: "alaw small negative", alaw: true, sample: -8, code: 0x55, decoded: -8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encode, decode := mulawEncode, mulawDecode
+			if test.alaw {
+				encode, decode = alawEncode, alawDecode
+			}
+
+			if got := encode(test.sample); got != test.code {
+				t.Errorf("encode(%d) = %#02x, want %#02x", test.sample, got, test.code)
+			}
+			if got := decode(test.code); got != test.decoded {
+				t.Errorf("decode(%#02x) = %d, want %d", test.code, got, test.decoded)
+			}
+		})
+	}
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(int16) byte
+		decode func(byte) int16
+		// negativeZero 解碼為0的另一個code，重新編碼為正的0
+		negativeZero int
+	}{
+		{name: "mulaw", encode: mulawEncode, decode: mulawDecode, negativeZero: 0x7f},
+		{name: "alaw", encode: alawEncode, decode: alawDecode, negativeZero: -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// 每個code解碼後重新編碼得到相同的code
+			for code := 0; code < 256; code++ {
+				if code == test.negativeZero {
+					continue
+				}
+				if got := test.encode(test.decode(byte(code))); got != byte(code) {
+					t.Errorf("encode(decode(%#02x)) = %#02x", code, got)
+				}
+			}
+
+			// 量化誤差不超過該段的step(大於輸入的1/16)
+			for sample := -32768; sample <= 32767; sample += 7 {
+				got := int(test.decode(test.encode(int16(sample))))
+				diff, limit := got-sample, abs(sample)/16+16
+				if diff < -limit || diff > limit {
+					t.Fatalf("decode(encode(%d)) = %d, error %d over %d", sample, got, diff, limit)
+				}
+			}
+		})
+	}
+}
+
+func TestG711Resample(t *testing.T) {
+	// 20ms的48kHz固定值
+	pcm := make([]int16, mixerSampleRate/50)
+	for i := range pcm {
+		pcm[i] = 1000
+	}
+
+	for _, alaw := range []bool{false, true} {
+		payload := g711Encode(pcm, alaw)
+		if len(payload) != g711SampleRate/50 {
+			t.Fatalf("alaw %v payload length = %d, want %d", alaw, len(payload), g711SampleRate/50)
+		}
+
+		last := int16(0)
+		decoded := g711Decode(payload, alaw, &last)
+		if len(decoded) != len(pcm) {
+			t.Fatalf("alaw %v decoded length = %d, want %d", alaw, len(decoded), len(pcm))
+		}
+
+		// 第一個sample從last內插，之後維持固定值
+		for i, s := range decoded[g711ResampleRatio:] {
+			if s != last || s < 960 || s > 1040 {
+				t.Errorf("alaw %v sample %d = %d, want %d near 1000", alaw, i+g711ResampleRatio, s, last)
+				break
+			}
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
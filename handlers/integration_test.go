@@ -0,0 +1,2288 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"webrtc_sfu_conference/client"
+	"webrtc_sfu_conference/handlers"
+	"webrtc_sfu_conference/signalingpb"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"google.golang.org/protobuf/proto"
+)
+
+const testTimeout = 15 * time.Second
+
+const testClusterSecret = "cluster-secret"
+
+// testServer 以httptest在process內啟動SFU的router
+type testServer struct {
+	sfu *handlers.SFU
+	srv *httptest.Server
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	return newTestServerWith(t, nil)
+}
+
+// newTestServerWith configure可修改測試用的Config
+func newTestServerWith(t *testing.T, configure func(*handlers.Config)) *testServer {
+	t.Helper()
+
+	return startTestServer(t, httptest.NewUnstartedServer(nil), testConfig(configure))
+}
+
+// testConfig 測試用的Config，configure可修改
+func testConfig(configure func(*handlers.Config)) handlers.Config {
+	config := handlers.DefaultConfig()
+	config.Domain = "sfu.test"
+	config.NodeURL = ""
+	// 離開的參與者立即移除，不等待resume
+	config.ResumeGracePeriod = 0
+	config.NegotiationTimeout = 5 * time.Second
+	if configure != nil {
+		configure(&config)
+	}
+	return config
+}
+
+// startTestServer 以config建立SFU並啟動尚未啟動的srv
+func startTestServer(t *testing.T, srv *httptest.Server, config handlers.Config, opts ...handlers.Option) *testServer {
+	t.Helper()
+
+	sfu, err := handlers.NewSFU(append([]handlers.Option{handlers.WithConfig(config)}, opts...)...)
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	srv.Config.Handler = sfu.Handler()
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+		sfu.Close()
+	})
+
+	return &testServer{sfu: sfu, srv: srv}
+}
+
+// newTestCluster origin與edge兩個node，各自使用memory store，edge以/cluster API向origin查詢房間
+// edgeOpts只用於edge node
+func newTestCluster(t *testing.T, configure func(*handlers.Config), edgeOpts ...handlers.Option) (origin, edge *testServer) {
+	t.Helper()
+
+	originSrv, edgeSrv := httptest.NewUnstartedServer(nil), httptest.NewUnstartedServer(nil)
+	nodes := []string{"http://" + originSrv.Listener.Addr().String(), "http://" + edgeSrv.Listener.Addr().String()}
+	nodeConfig := func(node string) handlers.Config {
+		config := testConfig(configure)
+		config.NodeURL = node
+		config.ClusterNodes = nodes
+		config.ClusterSecret = testClusterSecret
+		return config
+	}
+
+	origin = startTestServer(t, originSrv, nodeConfig(nodes[0]))
+	edge = startTestServer(t, edgeSrv, nodeConfig(nodes[1]), edgeOpts...)
+	return origin, edge
+}
+
+func (s *testServer) createRoom(t *testing.T) string {
+	t.Helper()
+
+	roomID, _ := s.createRoomWith(t, "")
+	return roomID
+}
+
+// createRoomWith body為建立房間的JSON選項，回傳room ID與host token
+func (s *testServer) createRoomWith(t *testing.T, body string) (string, string) {
+	t.Helper()
+
+	resp, err := http.Post(s.srv.URL+"/create/room", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	defer resp.Body.Close()
+
+	info := struct {
+		RoomID    string `json:"roomID"`
+		HostToken string `json:"hostToken"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("create room decode: %v", err)
+	}
+	return info.RoomID, info.HostToken
+}
+
+func (s *testServer) roomURL(roomID string) string {
+	return "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/room/" + roomID + "/webSocket"
+}
+
+// testPeer 以client SDK加入房間並publish一個Opus track的peer
+type testPeer struct {
+	name   string
+	client *client.Client
+	stop   chan struct{}
+
+	// received 收到的remote track ID，packets為各track收到的RTP packet數
+	// gaps為sequence number不連續的次數
+	received map[string]bool
+	packets  map[string]int
+	gaps     map[string]int
+
+	// last 各track最後收到的RTP timestamp與時間，drifts為每個sender report與收到的RTP之間的時間差
+	last    map[string]rtpArrival
+	drifts  map[string][]time.Duration
+	changed chan struct{}
+	sync.Mutex
+}
+
+func joinPeer(t *testing.T, s *testServer, roomID, name string) *testPeer {
+	t.Helper()
+
+	return joinPeerWith(t, s, roomID, name, client.Options{})
+}
+
+// joinPeerWith opts的OnTrack由testPeer設定
+func joinPeerWith(t *testing.T, s *testServer, roomID, name string, opts client.Options) *testPeer {
+	t.Helper()
+
+	p := &testPeer{
+		name:     name,
+		stop:     make(chan struct{}),
+		received: make(map[string]bool),
+		packets:  make(map[string]int),
+		gaps:     make(map[string]int),
+		last:     make(map[string]rtpArrival),
+		drifts:   make(map[string][]time.Duration),
+		changed:  make(chan struct{}, 1),
+	}
+
+	opts.OnTrack = func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		go p.readSenderReports(track, receiver)
+
+		// 收到RTP才算真的收到track
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		p.Lock()
+		p.received[track.ID()] = true
+		p.Unlock()
+		p.notify()
+
+		for last := pkt.SequenceNumber; ; last = pkt.SequenceNumber {
+			if pkt, _, err = track.ReadRTP(); err != nil {
+				return
+			}
+			p.Lock()
+			p.packets[track.ID()]++
+			if pkt.SequenceNumber != last+1 {
+				p.gaps[track.ID()]++
+			}
+			p.last[track.ID()] = rtpArrival{timestamp: pkt.Timestamp, at: time.Now()}
+			p.Unlock()
+		}
+	}
+
+	c, err := client.Join(s.roomURL(roomID), opts)
+	if err != nil {
+		t.Fatalf("%s join: %v", name, err)
+	}
+	p.client = c
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		p.trackID(), "stream-"+name,
+	)
+	if err != nil {
+		t.Fatalf("%s new track: %v", name, err)
+	}
+	if _, err := c.Publish(track); err != nil {
+		t.Fatalf("%s publish: %v", name, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+			_ = track.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+		}
+	}()
+
+	t.Cleanup(p.leave)
+	return p
+}
+
+func (p *testPeer) trackID() string {
+	return "audio-" + p.name
+}
+
+func (p *testPeer) notify() {
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (p *testPeer) leave() {
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	close(p.stop)
+	_ = p.client.Close()
+}
+
+// waitReceived 等待收到所有trackIDs
+func (p *testPeer) waitReceived(t *testing.T, trackIDs ...string) {
+	t.Helper()
+
+	deadline := time.After(testTimeout)
+	for {
+		p.Lock()
+		missing := ""
+		for _, id := range trackIDs {
+			if !p.received[id] {
+				missing = id
+				break
+			}
+		}
+		p.Unlock()
+		if missing == "" {
+			return
+		}
+
+		select {
+		case <-p.changed:
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("%s did not receive track %s", p.name, missing)
+		}
+	}
+}
+
+type rtpArrival struct {
+	timestamp uint32
+	at        time.Time
+}
+
+// readSenderReports 比對sender report與最後收到的RTP，NTP時間與RTP timestamp應對應到同一個時間
+func (p *testPeer) readSenderReports(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			sr, ok := packet.(*rtcp.SenderReport)
+			if !ok || sr.SSRC != uint32(track.SSRC()) {
+				continue
+			}
+
+			ntp := time.Unix(int64(sr.NTPTime>>32)-2208988800, int64((sr.NTPTime&0xffffffff)*uint64(time.Second)>>32))
+			p.Lock()
+			if last, ok := p.last[track.ID()]; ok {
+				elapsed := time.Duration(int32(sr.RTPTime-last.timestamp)) * time.Second / time.Duration(track.Codec().ClockRate)
+				p.drifts[track.ID()] = append(p.drifts[track.ID()], elapsed-ntp.Sub(last.at))
+			}
+			p.Unlock()
+		}
+	}
+}
+
+func (p *testPeer) senderReports(trackID string) []time.Duration {
+	p.Lock()
+	defer p.Unlock()
+
+	return append([]time.Duration(nil), p.drifts[trackID]...)
+}
+
+func (p *testPeer) packetCount(trackID string) int {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.packets[trackID]
+}
+
+// remoteHasTrack server最新的offer中是否仍送出此track
+func (p *testPeer) remoteHasTrack(trackID string) bool {
+	desc := p.client.PeerConnection().RemoteDescription()
+	return desc != nil && strings.Contains(desc.SDP, " "+trackID+"\r\n")
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPeersReceiveEachOthersTracks(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	peers := []*testPeer{
+		joinPeer(t, s, roomID, "a"),
+		joinPeer(t, s, roomID, "b"),
+		joinPeer(t, s, roomID, "c"),
+	}
+
+	for _, p := range peers {
+		others := []string{}
+		for _, other := range peers {
+			if other != p {
+				others = append(others, other.trackID())
+			}
+		}
+		p.waitReceived(t, others...)
+
+		p.Lock()
+		loopback := p.received[p.trackID()]
+		p.Unlock()
+		if loopback {
+			t.Errorf("%s received its own track", p.name)
+		}
+	}
+}
+
+func TestLeaveRemovesTrack(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	a.waitReceived(t, b.trackID())
+
+	if !a.remoteHasTrack(b.trackID()) {
+		t.Fatalf("a remote description has no track %s", b.trackID())
+	}
+
+	b.leave()
+
+	waitFor(t, "track removal renegotiation", func() bool {
+		return !a.remoteHasTrack(b.trackID())
+	})
+
+	// 後加入的peer不應該再收到已離開的track
+	c := joinPeer(t, s, roomID, "c")
+	c.waitReceived(t, a.trackID())
+	if c.remoteHasTrack(b.trackID()) {
+		t.Errorf("c received track %s of a peer that already left", b.trackID())
+	}
+}
+
+func TestGetRoomIDArray(t *testing.T) {
+	s := newTestServer(t)
+	first := s.createRoom(t)
+	second := s.createRoom(t)
+
+	resp, err := http.Get(s.srv.URL + "/getRoomsID")
+	if err != nil {
+		t.Fatalf("get rooms: %v", err)
+	}
+	defer resp.Body.Close()
+
+	rooms := []struct {
+		RoomID           string `json:"roomID"`
+		RoomURL          string `json:"roomURL"`
+		RoomWebsocketURL string `json:"roomWebsocketURL"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		t.Fatalf("get rooms decode: %v", err)
+	}
+
+	if len(rooms) != 2 || rooms[0].RoomID != first || rooms[1].RoomID != second {
+		t.Fatalf("rooms = %+v, want [%s %s] sorted by created time", rooms, first, second)
+	}
+	if want := "wss://sfu.test/room/" + first + "/webSocket"; rooms[0].RoomWebsocketURL != want {
+		t.Errorf("roomWebsocketURL = %s, want %s", rooms[0].RoomWebsocketURL, want)
+	}
+}
+
+func TestRoomsInfo(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	a.waitReceived(t, b.trackID())
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.srv.URL, "http")+"/roomsinfo/webSocket", nil)
+	if err != nil {
+		t.Fatalf("rooms info dial: %v", err)
+	}
+	defer ws.Close()
+
+	participants := func() []map[string]interface{} {
+		if err := ws.WriteJSON(map[string]string{"event": "update"}); err != nil {
+			t.Fatalf("rooms info update: %v", err)
+		}
+
+		_ = ws.SetReadDeadline(time.Now().Add(testTimeout))
+		for {
+			msg := struct {
+				Event string `json:"event"`
+				Data  string `json:"data"`
+			}{}
+			if err := ws.ReadJSON(&msg); err != nil {
+				t.Fatalf("rooms info read: %v", err)
+			}
+			if msg.Event != "info" {
+				continue
+			}
+
+			info := map[string][]map[string]interface{}{}
+			if err := json.Unmarshal([]byte(msg.Data), &info); err != nil {
+				t.Fatalf("rooms info decode: %v", err)
+			}
+			return info[roomID]
+		}
+	}
+
+	if got := participants(); len(got) != 2 {
+		t.Fatalf("rooms info participants = %v, want 2", got)
+	}
+
+	b.leave()
+	waitFor(t, "rooms info participant removal", func() bool {
+		return len(participants()) == 1
+	})
+}
+
+func TestIsolatedInstances(t *testing.T) {
+	s1 := newTestServer(t)
+	s2 := newTestServer(t)
+	roomID := s1.createRoom(t)
+
+	resp, err := http.Get(s2.srv.URL + "/getRoomsID")
+	if err != nil {
+		t.Fatalf("get rooms: %v", err)
+	}
+	defer resp.Body.Close()
+
+	rooms := []json.RawMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		t.Fatalf("get rooms decode: %v", err)
+	}
+	if len(rooms) != 0 {
+		t.Fatalf("second instance sees %d rooms created on the first (%s)", len(rooms), roomID)
+	}
+
+	// 房間不存在時server關閉websocket
+	c, err := client.Join(s2.roomURL(roomID), client.Options{})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("joined room %s on an instance that does not own it", roomID)
+	}
+}
+
+// signalingMessage signaling協定v2的message
+type signalingMessage struct {
+	Version int             `json:"v"`
+	Event   string          `json:"event"`
+	ID      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// readEvent 讀取message直到收到event
+func readEvent(t *testing.T, ws *websocket.Conn, event string) *signalingMessage {
+	t.Helper()
+
+	_ = ws.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		msg := &signalingMessage{}
+		if err := ws.ReadJSON(msg); err != nil {
+			t.Fatalf("read %s: %v", event, err)
+		}
+		if msg.Event == event {
+			return msg
+		}
+	}
+}
+
+func TestSignalingV2ToleratesBadMessages(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{"sfu.v2"}
+	ws, _, err := dialer.Dial(s.roomURL(roomID), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	if ws.Subprotocol() != "sfu.v2" {
+		t.Fatalf("subprotocol = %q, want sfu.v2", ws.Subprotocol())
+	}
+
+	offer := readEvent(t, ws, "offer")
+	if offer.Version != 2 || offer.ID == "" {
+		t.Fatalf("offer = %+v, want v2 with request id", offer)
+	}
+	desc := webrtc.SessionDescription{}
+	if err := json.Unmarshal(offer.Data, &desc); err != nil || desc.Type != webrtc.SDPTypeOffer {
+		t.Fatalf("offer data is not a typed session description: %s", offer.Data)
+	}
+
+	cases := []struct {
+		name string
+		raw  string
+		id   string
+		code string
+	}{
+		{"malformed", `{"event": "candidate",`, "", "malformedMessage"},
+		{"unknown event", `{"v": 2, "id": "7", "event": "raiseHand"}`, "7", "unknownEvent"},
+		{"invalid payload", `{"v": 2, "id": "8", "event": "answer", "data": {"type": "offer", "sdp": ""}}`, "8", "invalidPayload"},
+		{"stale answer", `{"v": 2, "id": "offer-0", "event": "answer", "data": {"type": "answer", "sdp": "v=0"}}`, "offer-0", "negotiationFailed"},
+		// server的offer尚未收到answer
+		{"glare", `{"v": 2, "id": "9", "event": "offer", "data": {"type": "offer", "sdp": "v=0"}}`, "9", "glare"},
+	}
+	for _, c := range cases {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(c.raw)); err != nil {
+			t.Fatalf("%s write: %v", c.name, err)
+		}
+
+		msg := readEvent(t, ws, "error")
+		e := struct {
+			Code string `json:"code"`
+		}{}
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			t.Fatalf("%s error decode: %v", c.name, err)
+		}
+		if e.Code != c.code || msg.ID != c.id {
+			t.Errorf("%s: error code %q id %q, want %q %q", c.name, e.Code, msg.ID, c.code, c.id)
+		}
+	}
+
+	// 錯誤的message之後連線仍可使用
+	if err := ws.WriteJSON(&signalingMessage{Version: 2, Event: "keepalive"}); err != nil {
+		t.Fatalf("write after errors: %v", err)
+	}
+	readEvent(t, ws, "keepalive")
+}
+
+func TestSignalingV1StillSupported(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	ws, _, err := websocket.DefaultDialer.Dial(s.roomURL(roomID), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteJSON(map[string]string{"event": "raiseHand", "data": ""}); err != nil {
+		t.Fatalf("write unknown event: %v", err)
+	}
+
+	_ = ws.SetReadDeadline(time.Now().Add(testTimeout))
+	msg := struct {
+		Event string `json:"event"`
+		Data  string `json:"data"`
+	}{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("read offer: %v", err)
+	}
+	if msg.Event != "offer" {
+		t.Fatalf("event = %s, want offer", msg.Event)
+	}
+
+	desc := webrtc.SessionDescription{}
+	if err := json.Unmarshal([]byte(msg.Data), &desc); err != nil || desc.Type != webrtc.SDPTypeOffer {
+		t.Fatalf("v1 offer data should be a JSON string: %v", err)
+	}
+}
+
+func TestProtobufAndJSONPeersInSameRoom(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	a := joinPeerWith(t, s, roomID, "a", client.Options{Protobuf: true, Publish: []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}})
+	b := joinPeer(t, s, roomID, "b")
+
+	if got := a.client.Subprotocol(); got != signalingpb.Subprotocol {
+		t.Fatalf("a subprotocol = %q, want %s", got, signalingpb.Subprotocol)
+	}
+
+	a.waitReceived(t, b.trackID())
+	b.waitReceived(t, a.trackID())
+
+	// 沒有宣告的video以protobuf的publish event向server要求transceiver
+	publishVideo(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	b.waitReceived(t, "camera-a")
+}
+
+func TestRoomsInfoProtobuf(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	a.waitReceived(t, b.trackID())
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{signalingpb.RoomsInfoSubprotocol}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.srv.URL, "http")+"/roomsinfo/webSocket", nil)
+	if err != nil {
+		t.Fatalf("rooms info dial: %v", err)
+	}
+	defer ws.Close()
+
+	if ws.Subprotocol() != signalingpb.RoomsInfoSubprotocol {
+		t.Fatalf("subprotocol = %q, want %s", ws.Subprotocol(), signalingpb.RoomsInfoSubprotocol)
+	}
+
+	update, err := proto.Marshal(&signalingpb.RoomsInfoMessage{Event: "update"})
+	if err != nil {
+		t.Fatalf("rooms info marshal: %v", err)
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, update); err != nil {
+		t.Fatalf("rooms info update: %v", err)
+	}
+
+	_ = ws.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("rooms info read: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("rooms info message type = %d, want binary", messageType)
+		}
+
+		info := &signalingpb.RoomsInfoMessage{}
+		if err := proto.Unmarshal(data, info); err != nil {
+			t.Fatalf("rooms info decode: %v", err)
+		}
+		if info.Event != "info" {
+			continue
+		}
+
+		participants := info.Rooms[roomID].GetParticipants()
+		if len(participants) != 2 {
+			t.Fatalf("rooms info participants = %d, want 2", len(participants))
+		}
+		for _, p := range participants {
+			if p.Id == "" || p.PeerConnectionState == "" {
+				t.Errorf("participant state incomplete: %+v", p)
+			}
+		}
+		return
+	}
+}
+
+func TestRoomParticipantLimit(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.MaxRoomParticipants = 1
+	})
+	roomID := s.createRoom(t)
+
+	joinPeer(t, s, roomID, "a")
+
+	c, err := client.Join(s.roomURL(roomID), client.Options{})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("second participant admitted to a full room")
+	}
+	if !errors.Is(c.Err(), client.ErrRoomFull) {
+		t.Errorf("err = %v, want %v", c.Err(), client.ErrRoomFull)
+	}
+
+	// 其他房間不受影響
+	joinPeer(t, s, s.createRoom(t), "b")
+}
+
+func TestServerPeerConnectionLimit(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.MaxPeerConnections = 1
+	})
+
+	joinPeer(t, s, s.createRoom(t), "a")
+
+	c, err := client.Join(s.roomURL(s.createRoom(t)), client.Options{})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("participant admitted beyond server limit")
+	}
+	if !errors.Is(c.Err(), client.ErrServerBusy) {
+		t.Errorf("err = %v, want %v", c.Err(), client.ErrServerBusy)
+	}
+}
+
+func TestRoomPublisherLimit(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.MaxRoomPublishers = 1
+	})
+	roomID := s.createRoom(t)
+
+	// 先到達server的track取得publisher名額，a的RTP不一定比b先到
+	rejected := make(chan string, 2)
+	onError := func(name string) func(code, message, id string) {
+		return func(code, message, id string) {
+			if code != client.ErrCodeRoomFull {
+				t.Errorf("%s error code = %s, want %s", name, code, client.ErrCodeRoomFull)
+			}
+			select {
+			case rejected <- name:
+			default:
+			}
+		}
+	}
+	a := joinPeerWith(t, s, roomID, "a", client.Options{OnError: onError("a")})
+	b := joinPeerWith(t, s, roomID, "b", client.Options{OnError: onError("b")})
+
+	var publisher, loser *testPeer
+	select {
+	case name := <-rejected:
+		publisher, loser = a, b
+		if name == "a" {
+			publisher, loser = b, a
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("second publisher was not rejected")
+	}
+
+	// 被拒絕publish的參與者仍然收得到房間的track
+	loser.waitReceived(t, publisher.trackID())
+	if publisher.remoteHasTrack(loser.trackID()) {
+		t.Errorf("rejected track %s forwarded", loser.trackID())
+	}
+	select {
+	case name := <-rejected:
+		t.Errorf("both publishers rejected, second: %s", name)
+	default:
+	}
+}
+
+func TestLobbyAdmit(t *testing.T) {
+	s := newTestServer(t)
+	roomID, hostToken := s.createRoomWith(t, `{"lobby": true}`)
+	if hostToken == "" {
+		t.Fatalf("lobby room created without host token")
+	}
+
+	joins := make(chan client.LobbyParticipant, 1)
+	host := joinPeerWith(t, s, roomID, "host", client.Options{
+		HostToken: hostToken,
+		OnLobbyJoin: func(p client.LobbyParticipant) {
+			joins <- p
+		},
+	})
+
+	go func() {
+		p := <-joins
+		if p.Name != "guest" {
+			t.Errorf("lobby name = %q, want guest", p.Name)
+		}
+		if err := host.client.Admit(p.ParticipantID); err != nil {
+			t.Errorf("admit: %v", err)
+		}
+	}()
+
+	var waited int32
+	errs := make(chan string, 1)
+	guest := joinPeerWith(t, s, roomID, "guest", client.Options{
+		Name: "guest",
+		OnWaitingInLobby: func() {
+			atomic.StoreInt32(&waited, 1)
+		},
+		OnError: func(code, message, id string) {
+			select {
+			case errs <- code:
+			default:
+			}
+		},
+	})
+	if atomic.LoadInt32(&waited) == 0 {
+		t.Errorf("guest joined without waiting in lobby")
+	}
+
+	guest.waitReceived(t, host.trackID())
+	host.waitReceived(t, guest.trackID())
+
+	// 只有host可以admit
+	if err := guest.client.Admit("someone"); err != nil {
+		t.Fatalf("admit: %v", err)
+	}
+	select {
+	case code := <-errs:
+		if code != client.ErrCodeForbidden {
+			t.Errorf("error code = %s, want %s", code, client.ErrCodeForbidden)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("non-host admit was not rejected")
+	}
+}
+
+func TestLobbyDeny(t *testing.T) {
+	s := newTestServer(t)
+	roomID, hostToken := s.createRoomWith(t, `{"lobby": true}`)
+
+	joins := make(chan client.LobbyParticipant, 1)
+	host := joinPeerWith(t, s, roomID, "host", client.Options{
+		HostToken: hostToken,
+		OnLobbyJoin: func(p client.LobbyParticipant) {
+			joins <- p
+		},
+	})
+
+	c, err := client.Join(s.roomURL(roomID), client.Options{Name: "guest"})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c.Close()
+
+	select {
+	case p := <-joins:
+		if err := host.client.Deny(p.ParticipantID); err != nil {
+			t.Fatalf("deny: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("host was not notified of lobby join")
+	}
+
+	select {
+	case <-c.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("denied participant still connected")
+	}
+	if !errors.Is(c.Err(), client.ErrLobbyDenied) {
+		t.Errorf("err = %v, want %v", c.Err(), client.ErrLobbyDenied)
+	}
+}
+
+// roomListed /getRoomsID是否包含roomID
+func (s *testServer) roomListed(t *testing.T, roomID string) bool {
+	t.Helper()
+
+	resp, err := http.Get(s.srv.URL + "/getRoomsID")
+	if err != nil {
+		t.Fatalf("get rooms: %v", err)
+	}
+	defer resp.Body.Close()
+
+	rooms := []struct {
+		RoomID string `json:"roomID"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		t.Fatalf("get rooms decode: %v", err)
+	}
+	for _, room := range rooms {
+		if room.RoomID == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEmptyRoomTimeout(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.EmptyRoomTimeout = 300 * time.Millisecond
+	})
+	roomID := s.createRoom(t)
+
+	// 有參與者時不刪除
+	p := joinPeer(t, s, roomID, "a")
+	time.Sleep(600 * time.Millisecond)
+	if !s.roomListed(t, roomID) {
+		t.Fatalf("room deleted while participant connected")
+	}
+
+	p.leave()
+	waitFor(t, "empty room deleted", func() bool {
+		return !s.roomListed(t, roomID)
+	})
+}
+
+func TestScheduledRoomNotStarted(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.EmptyRoomTimeout = 100 * time.Millisecond
+	})
+
+	resp, err := http.Post(s.srv.URL+"/create/room", "application/json",
+		strings.NewReader(`{"endTime": "2001-01-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("past endTime status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	start := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	roomID, _ := s.createRoomWith(t, `{"startTime": "`+start+`"}`)
+
+	c, err := client.Join(s.roomURL(roomID), client.Options{})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("participant joined before start time")
+	}
+	if !errors.Is(c.Err(), client.ErrRoomNotStarted) {
+		t.Errorf("err = %v, want %v", c.Err(), client.ErrRoomNotStarted)
+	}
+
+	// 空房間的timeout從開始時間起算
+	time.Sleep(300 * time.Millisecond)
+	if !s.roomListed(t, roomID) {
+		t.Errorf("scheduled room deleted before start time")
+	}
+}
+
+func TestMaxRoomDuration(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.MaxRoomDuration = 2 * time.Second
+		c.RoomEndWarning = time.Second
+	})
+	roomID := s.createRoom(t)
+
+	warned := make(chan string, 1)
+	p := joinPeerWith(t, s, roomID, "a", client.Options{
+		OnRoomEnding: func(endTime time.Time, reason string) {
+			warned <- reason
+		},
+	})
+
+	select {
+	case reason := <-warned:
+		if reason != "maxDuration" {
+			t.Errorf("roomEnding reason = %s, want maxDuration", reason)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("no roomEnding warning")
+	}
+
+	select {
+	case <-p.client.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("meeting not ended")
+	}
+	if !errors.Is(p.client.Err(), client.ErrRoomEnded) {
+		t.Errorf("err = %v, want %v", p.client.Err(), client.ErrRoomEnded)
+	}
+	waitFor(t, "ended room deleted", func() bool {
+		return !s.roomListed(t, roomID)
+	})
+}
+
+func TestRoomAlias(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.EmptyRoomTimeout = 500 * time.Millisecond
+	})
+
+	create := func(body string) (int, map[string]string) {
+		resp, err := http.Post(s.srv.URL+"/create/room", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("create room: %v", err)
+		}
+		defer resp.Body.Close()
+
+		info := map[string]string{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+				t.Fatalf("create room decode: %v", err)
+			}
+		}
+		return resp.StatusCode, info
+	}
+
+	status, info := create(`{"alias": "Team-Sync"}`)
+	if status != http.StatusOK || info["alias"] != "team-sync" {
+		t.Fatalf("create alias = %d %v", status, info)
+	}
+	if want := "wss://sfu.test/room/team-sync/webSocket"; info["roomWebsocketURL"] != want {
+		t.Errorf("roomWebsocketURL = %s, want %s", info["roomWebsocketURL"], want)
+	}
+
+	if status, _ := create(`{"alias": "team-sync"}`); status != http.StatusConflict {
+		t.Errorf("duplicate alias status = %d, want %d", status, http.StatusConflict)
+	}
+	for _, alias := range []string{"a", "-bad-", "has space", "123e4567-e89b-12d3-a456-426614174000"} {
+		if status, _ := create(`{"alias": "` + alias + `"}`); status != http.StatusBadRequest {
+			t.Errorf("alias %q status = %d, want %d", alias, status, http.StatusBadRequest)
+		}
+	}
+
+	status, readable := create(`{"readableAlias": true}`)
+	if status != http.StatusOK || strings.Count(readable["alias"], "-") != 2 {
+		t.Errorf("readable alias = %d %v", status, readable)
+	}
+
+	// alias與UUID加入同一個房間
+	a := joinPeer(t, s, "team-sync", "a")
+	b := joinPeer(t, s, info["roomID"], "b")
+	a.waitReceived(t, b.trackID())
+	b.waitReceived(t, a.trackID())
+
+	// 房間刪除後alias可以再使用
+	a.leave()
+	b.leave()
+	waitFor(t, "alias released", func() bool {
+		status, _ := create(`{"alias": "team-sync"}`)
+		return status == http.StatusOK
+	})
+}
+
+func TestRoomLookupErrors(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.PasswordMaxAttempts = 2
+		c.PasswordAttemptWindow = time.Minute
+	})
+
+	resp, err := http.Post(s.srv.URL+"/create/room", "application/json", strings.NewReader(`{"alias": "team-sync"}`))
+	if err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+	resp.Body.Close()
+
+	joinErr := func(room string) error {
+		t.Helper()
+
+		c, err := client.Join(s.roomURL(room), client.Options{})
+		if err != nil {
+			t.Fatalf("join: %v", err)
+		}
+		defer c.Close()
+
+		select {
+		case <-c.Done():
+		case <-time.After(testTimeout):
+			t.Fatalf("participant joined room %s", room)
+		}
+		return c.Err()
+	}
+	pageStatus := func(room string) int {
+		t.Helper()
+
+		resp, err := http.Get(s.srv.URL + "/room/" + room)
+		if err != nil {
+			t.Fatalf("get room page: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// websocket已upgrade，以close code通知client房間不存在
+	if err := joinErr(uuid.NewString()); !errors.Is(err, client.ErrRoomNotFound) {
+		t.Errorf("unknown room err = %v, want %v", err, client.ErrRoomNotFound)
+	}
+	if err := joinErr("brave-otter-4821"); !errors.Is(err, client.ErrRoomNotFound) {
+		t.Errorf("unknown alias err = %v, want %v", err, client.ErrRoomNotFound)
+	}
+	if status := pageStatus("quiet-heron-1234"); status != http.StatusNotFound {
+		t.Errorf("unknown alias page status = %d, want %d", status, http.StatusNotFound)
+	}
+
+	// 查詢不存在的alias達到上限後，存在的alias也無法解析
+	if err := joinErr("team-sync"); !errors.Is(err, client.ErrTooManyAttempts) {
+		t.Errorf("alias after limit err = %v, want %v", err, client.ErrTooManyAttempts)
+	}
+	if status := pageStatus("team-sync"); status != http.StatusTooManyRequests {
+		t.Errorf("alias page after limit status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestRoomPassword(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.PasswordMaxAttempts = 2
+		c.PasswordAttemptWindow = time.Minute
+	})
+
+	roomID, hostToken := s.createRoomWith(t, `{"pin": "1234"}`)
+
+	joinURLErr := func(roomURL string, opts client.Options) error {
+		t.Helper()
+
+		c, err := client.Join(roomURL, opts)
+		if err != nil {
+			t.Fatalf("join: %v", err)
+		}
+		defer c.Close()
+
+		select {
+		case <-c.Done():
+		case <-time.After(testTimeout):
+			t.Fatalf("participant joined without valid password")
+		}
+		return c.Err()
+	}
+	joinErr := func(opts client.Options) error {
+		t.Helper()
+		return joinURLErr(s.roomURL(roomID), opts)
+	}
+
+	if err := joinErr(client.Options{}); !errors.Is(err, client.ErrInvalidPassword) {
+		t.Errorf("no password err = %v, want %v", err, client.ErrInvalidPassword)
+	}
+
+	// 正確的PIN與host token都可以加入
+	a := joinPeerWith(t, s, roomID, "a", client.Options{Password: "1234"})
+	host := joinPeerWith(t, s, roomID, "host", client.Options{HostToken: hostToken})
+	a.waitReceived(t, host.trackID())
+	host.waitReceived(t, a.trackID())
+
+	// 密碼不接受放在URL，room page以POST表單驗證後設定cookie，websocket帶上cookie即可加入
+	u, err := url.Parse(s.roomURL(roomID))
+	if err != nil {
+		t.Fatalf("parse room URL: %v", err)
+	}
+	u.RawQuery = url.Values{"password": {"1234"}}.Encode()
+	if err := joinURLErr(u.String(), client.Options{}); !errors.Is(err, client.ErrInvalidPassword) {
+		t.Errorf("password in query err = %v, want %v", err, client.ErrInvalidPassword)
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.PostForm(s.srv.URL+"/room/"+roomID, url.Values{"password": {"1234"}})
+	if err != nil {
+		t.Fatalf("post password form: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 1 {
+		t.Fatalf("post password form = %d %v, want %d with cookie", resp.StatusCode, resp.Cookies(), http.StatusSeeOther)
+	}
+	cookie := resp.Cookies()[0]
+	c := joinPeerWith(t, s, roomID, "c", client.Options{Header: http.Header{"Cookie": {cookie.Name + "=" + cookie.Value}}})
+	c.waitReceived(t, a.trackID())
+
+	// host token同樣不接受放在URL，以X-Host-Token header或POST host欄位設定的cookie帶上
+	u.RawQuery = url.Values{"host": {hostToken}}.Encode()
+	if err := joinURLErr(u.String(), client.Options{}); !errors.Is(err, client.ErrInvalidPassword) {
+		t.Errorf("host token in query err = %v, want %v", err, client.ErrInvalidPassword)
+	}
+	resp, err = noRedirect.PostForm(s.srv.URL+"/room/"+roomID, url.Values{"host": {uuid.NewString()}})
+	if err != nil {
+		t.Fatalf("post host form: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || len(resp.Cookies()) != 0 {
+		t.Errorf("post wrong host token = %d %v, want %d without cookie", resp.StatusCode, resp.Cookies(), http.StatusForbidden)
+	}
+	resp, err = noRedirect.PostForm(s.srv.URL+"/room/"+roomID, url.Values{"host": {hostToken}})
+	if err != nil {
+		t.Fatalf("post host form: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 1 || !resp.Cookies()[0].HttpOnly {
+		t.Fatalf("post host form = %d %v, want %d with HttpOnly cookie", resp.StatusCode, resp.Cookies(), http.StatusSeeOther)
+	}
+	cookie = resp.Cookies()[0]
+	d := joinPeerWith(t, s, roomID, "d", client.Options{Header: http.Header{"Cookie": {cookie.Name + "=" + cookie.Value}}})
+	d.waitReceived(t, a.trackID())
+
+	// 錯誤達到上限後正確的PIN也會被拒絕
+	for i := 0; i < 2; i++ {
+		if err := joinErr(client.Options{Password: "0000"}); !errors.Is(err, client.ErrInvalidPassword) {
+			t.Errorf("wrong password err = %v, want %v", err, client.ErrInvalidPassword)
+		}
+	}
+	if err := joinErr(client.Options{Password: "1234"}); !errors.Is(err, client.ErrTooManyAttempts) {
+		t.Errorf("too many attempts err = %v, want %v", err, client.ErrTooManyAttempts)
+	}
+
+	update := func(token, body string) int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodPut, s.srv.URL+"/room/"+roomID+"/password", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Host-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("update password: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := update("", `{}`); status != http.StatusForbidden {
+		t.Errorf("update without host token status = %d, want %d", status, http.StatusForbidden)
+	}
+	if status := update(hostToken, `{"pin": "12"}`); status != http.StatusBadRequest {
+		t.Errorf("invalid pin status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := update(hostToken, `{}`); status != http.StatusNoContent {
+		t.Fatalf("remove password status = %d, want %d", status, http.StatusNoContent)
+	}
+
+	// 移除密碼後不需密碼即可加入
+	b := joinPeer(t, s, roomID, "b")
+	b.waitReceived(t, a.trackID())
+}
+
+// publishVideo 以client publish一個VP8 track，直到stop關閉
+func publishVideo(t *testing.T, c *client.Client, trackID, label string, stop <-chan struct{}) {
+	t.Helper()
+
+	publishVideoSamples(t, c, webrtc.MimeTypeVP8, []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, trackID, label, stop)
+}
+
+// testH264KeyFrame Annex-B的SPS(320x240 baseline) + PPS + IDR
+var testH264KeyFrame = []byte{
+	0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0xc0, 0x1e, 0xf4, 0x0a, 0x0f, 0xc8,
+	0x00, 0x00, 0x00, 0x01, 0x68, 0xce, 0x3c, 0x80,
+	0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84, 0x00, 0x33, 0xff,
+}
+
+// publishH264Video 以client publish一個H264 track，每個sample都是keyframe，HLS egress只接受H264
+func publishH264Video(t *testing.T, c *client.Client, trackID, label string, stop <-chan struct{}) {
+	t.Helper()
+
+	publishVideoSamples(t, c, webrtc.MimeTypeH264, testH264KeyFrame, trackID, label, stop)
+}
+
+// publishVideoSamples 以mimeType publish track，每33ms送出一次sample直到stop關閉
+func publishVideoSamples(t *testing.T, c *client.Client, mimeType string, sample []byte, trackID, label string, stop <-chan struct{}) {
+	t.Helper()
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000},
+		trackID, "stream-"+trackID,
+	)
+	if err != nil {
+		t.Fatalf("%s new track: %v", trackID, err)
+	}
+	if _, err := c.PublishLabeled(track, label); err != nil {
+		t.Fatalf("%s publish: %v", trackID, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(33 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			_ = track.WriteSample(media.Sample{Data: sample, Duration: 33 * time.Millisecond})
+		}
+	}()
+}
+
+func TestScreenShareLabels(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.ExclusiveScreenShare = true
+		c.MaxRoomVideoTracks = 1
+	})
+	roomID := s.createRoom(t)
+
+	errs := make(chan string, 4)
+	var first atomic.Value
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeerWith(t, s, roomID, "b", client.Options{
+		OnError: func(code, message, id string) {
+			errs <- code
+		},
+		OnTracks: func(tracks []client.TrackInfo) {
+			if len(tracks) > 0 {
+				first.Store(tracks[0])
+			}
+		},
+	})
+
+	// screen share不計入MaxRoomVideoTracks
+	publishVideo(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	publishVideo(t, a.client, "screen-a", client.TrackLabelScreen, a.stop)
+	b.waitReceived(t, a.trackID(), "camera-a", "screen-a")
+
+	publisher := ""
+	for id, want := range map[string]string{
+		a.trackID(): client.TrackLabelMicrophone,
+		"camera-a":  client.TrackLabelCamera,
+		"screen-a":  client.TrackLabelScreen,
+	} {
+		info, ok := b.client.TrackInfo(id)
+		if !ok || info.Label != want || info.ParticipantID == "" {
+			t.Errorf("track %s info = %+v %v, want label %s", id, info, ok, want)
+		}
+		if publisher != "" && info.ParticipantID != publisher {
+			t.Errorf("track %s participantID = %s, want %s", id, info.ParticipantID, publisher)
+		}
+		publisher = info.ParticipantID
+	}
+	if info, _ := first.Load().(client.TrackInfo); info.TrackID != "screen-a" {
+		t.Errorf("first track = %+v, want screen-a", info)
+	}
+
+	// 同時只允許一個參與者分享畫面
+	publishVideo(t, b.client, "screen-b", client.TrackLabelScreen, b.stop)
+	select {
+	case code := <-errs:
+		if code != client.ErrCodeScreenShareBusy {
+			t.Errorf("error code = %s, want %s", code, client.ErrCodeScreenShareBusy)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("second screen share was not rejected")
+	}
+	if a.remoteHasTrack("screen-b") {
+		t.Errorf("rejected screen share forwarded")
+	}
+}
+
+// TestLastNPrefersScreenShare 超過LastN時screen share取代camera轉送給訂閱者
+func TestLastNPrefersScreenShare(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.LastN = 1
+	})
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+
+	publishVideo(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	b.waitReceived(t, a.trackID(), "camera-a")
+
+	publishVideo(t, a.client, "screen-a", client.TrackLabelScreen, a.stop)
+	b.waitReceived(t, "screen-a")
+	waitFor(t, "camera removed from subscriber", func() bool {
+		return !b.remoteHasTrack("camera-a")
+	})
+	if info, ok := b.client.TrackInfo("camera-a"); !ok || info.Subscribed {
+		t.Errorf("camera-a info = %+v %v, want listed but not subscribed", info, ok)
+	}
+	if info, ok := b.client.TrackInfo(a.trackID()); !ok || !info.Subscribed {
+		t.Errorf("audio info = %+v %v, want subscribed", info, ok)
+	}
+}
+
+// TestLastNFollowsActivity 超過LastN時轉送最近開始活動的camera，停止送出後換回其他camera
+func TestLastNFollowsActivity(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.LastN = 1
+	})
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	c := joinPeer(t, s, roomID, "c")
+
+	publishVideo(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	b.waitReceived(t, "camera-a")
+
+	// camera-c在camera-a之後開始送出，取代camera-a
+	stopC := make(chan struct{})
+	publishVideo(t, c.client, "camera-c", client.TrackLabelCamera, stopC)
+	b.waitReceived(t, "camera-c")
+	waitFor(t, "camera-a replaced by newly active camera-c", func() bool {
+		return b.remoteHasTrack("camera-c") && !b.remoteHasTrack("camera-a")
+	})
+
+	// camera-c閒置後camera-a重新轉送
+	close(stopC)
+	waitFor(t, "camera-a forwarded after camera-c idle", func() bool {
+		return b.remoteHasTrack("camera-a") && !b.remoteHasTrack("camera-c")
+	})
+}
+
+func TestDynamicTransceivers(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.MaxPublishTracks = 3
+	})
+	roomID := s.createRoom(t)
+
+	// 只計算audio/video，不計server為單一m-line加入的data channel
+	mediaSections := func(sdp string) int {
+		return strings.Count(sdp, "m=audio") + strings.Count(sdp, "m=video")
+	}
+
+	// audio only的參與者只有一個接收用的transceiver
+	a := joinPeerWith(t, s, roomID, "a", client.Options{Publish: []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}})
+	if n := mediaSections(a.client.PeerConnection().RemoteDescription().SDP); n != 1 {
+		t.Errorf("audio only media sections = %d, want 1", n)
+	}
+
+	// 沒有宣告的video track在publish時向server要求transceiver
+	b := joinPeerWith(t, s, roomID, "b", client.Options{Publish: []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}})
+	publishVideo(t, b.client, "camera-b1", client.TrackLabelCamera, b.stop)
+	publishVideo(t, b.client, "camera-b2", client.TrackLabelCamera, b.stop)
+	a.waitReceived(t, b.trackID(), "camera-b1", "camera-b2")
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "camera-b3", "stream-camera-b3",
+	)
+	if err != nil {
+		t.Fatalf("new track: %v", err)
+	}
+	if _, err := b.client.Publish(track); !errors.Is(err, client.ErrNoPublishSlot) {
+		t.Errorf("publish over limit err = %v, want %v", err, client.ErrNoPublishSlot)
+	}
+
+	// 只收看的參與者
+	c, err := client.Join(s.roomURL(roomID), client.Options{Publish: []webrtc.RTPCodecType{}})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c.Close()
+	waitFor(t, "subscriber offer", func() bool {
+		desc := c.PeerConnection().RemoteDescription()
+		return desc != nil && mediaSections(desc.SDP) == 4 && !strings.Contains(desc.SDP, "a=recvonly")
+	})
+}
+
+// TestPublishWhileSubscribed 送給訂閱者的downTrack transceiver不計入MaxPublishTracks
+func TestPublishWhileSubscribed(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.MaxPublishTracks = 8
+	})
+	roomID := s.createRoom(t)
+
+	audioOnly := client.Options{Publish: []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}}
+	publishers := []*testPeer{}
+	trackIDs := []string{}
+	for i := 0; i < 8; i++ {
+		p := joinPeerWith(t, s, roomID, fmt.Sprintf("p%d", i), audioOnly)
+		publishers = append(publishers, p)
+		trackIDs = append(trackIDs, p.trackID())
+	}
+
+	c := joinPeerWith(t, s, roomID, "c", audioOnly)
+	c.waitReceived(t, trackIDs...)
+
+	// c沒有video transceiver，publish需向server要求
+	publishVideo(t, c.client, "camera-c", client.TrackLabelCamera, c.stop)
+	publishers[0].waitReceived(t, c.trackID(), "camera-c")
+}
+
+// TestClientOfferPublishLimit client自行發送的offer也受MaxPublishTracks限制
+func TestClientOfferPublishLimit(t *testing.T) {
+	const maxTracks = 2
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.MaxPublishTracks = maxTracks
+	})
+	roomID := s.createRoom(t)
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{"sfu.v2"}
+	ws, _, err := dialer.Dial(s.roomURL(roomID)+"?publish=", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peerConnection: %v", err)
+	}
+	defer pc.Close()
+
+	var writeLock sync.Mutex
+	write := func(event, id string, data interface{}) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		_ = ws.WriteJSON(map[string]interface{}{"v": 2, "event": event, "id": id, "data": data})
+	}
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			write("candidate", "", candidate.ToJSON())
+		}
+	})
+
+	// 背景讀取server的message，candidate直接加入peerConnection
+	messages := make(chan *signalingMessage, 16)
+	go func() {
+		defer close(messages)
+		for {
+			msg := &signalingMessage{}
+			if err := ws.ReadJSON(msg); err != nil {
+				return
+			}
+			if msg.Event == "candidate" {
+				candidate := webrtc.ICECandidateInit{}
+				if err := json.Unmarshal(msg.Data, &candidate); err == nil {
+					_ = pc.AddICECandidate(candidate)
+				}
+				continue
+			}
+			messages <- msg
+		}
+	}()
+	next := func(match func(msg *signalingMessage) bool) *signalingMessage {
+		t.Helper()
+
+		timeout := time.After(testTimeout)
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					t.Fatal("websocket closed")
+				}
+				if match(msg) {
+					return msg
+				}
+			case <-timeout:
+				t.Fatal("timeout waiting for server message")
+			}
+		}
+	}
+
+	// 回覆server的第一個offer並等待連線，client offer需在server的ICE transport啟動之後
+	serverOffer := webrtc.SessionDescription{}
+	if err := json.Unmarshal(next(func(msg *signalingMessage) bool { return msg.Event == "offer" }).Data, &serverOffer); err != nil {
+		t.Fatalf("offer decode: %v", err)
+	}
+	if err := pc.SetRemoteDescription(serverOffer); err != nil {
+		t.Fatalf("set server offer: %v", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("create answer: %v", err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		t.Fatalf("set answer: %v", err)
+	}
+	write("answer", "", answer)
+	waitFor(t, "peer connection", func() bool {
+		return pc.ConnectionState() == webrtc.PeerConnectionStateConnected
+	})
+
+	// sendOffer 新增video m-line到共videos個後送出offer，回傳server回覆的answer或error
+	sendOffer := func(id string, videos int) *signalingMessage {
+		t.Helper()
+
+		for len(pc.GetTransceivers()) < videos {
+			if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+				webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+				t.Fatalf("add transceiver: %v", err)
+			}
+		}
+		offer, err := pc.CreateOffer(nil)
+		if err != nil {
+			t.Fatalf("create offer: %v", err)
+		}
+		if err := pc.SetLocalDescription(offer); err != nil {
+			t.Fatalf("set offer: %v", err)
+		}
+		write("offer", id, offer)
+
+		return next(func(msg *signalingMessage) bool {
+			return msg.ID == id && (msg.Event == "answer" || msg.Event == "error")
+		})
+	}
+
+	// 上限內的offer正常回覆answer
+	reply := sendOffer("offer-at-limit", maxTracks)
+	if reply.Event != "answer" {
+		t.Fatalf("offer with %d video m-lines reply = %s %s, want answer", maxTracks, reply.Event, reply.Data)
+	}
+	serverAnswer := webrtc.SessionDescription{}
+	if err := json.Unmarshal(reply.Data, &serverAnswer); err != nil {
+		t.Fatalf("answer decode: %v", err)
+	}
+	if err := pc.SetRemoteDescription(serverAnswer); err != nil {
+		t.Fatalf("set server answer: %v", err)
+	}
+
+	// 多一個video m-line時拒絕
+	reply = sendOffer("offer-over-limit", maxTracks+1)
+	e := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.Unmarshal(reply.Data, &e); reply.Event != "error" || err != nil || e.Code != "tooManyTracks" {
+		t.Errorf("offer with %d video m-lines reply = %s, code %q, want tooManyTracks error", maxTracks+1, reply.Event, e.Code)
+	}
+}
+
+func TestSelectiveSubscription(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	c := joinPeerWith(t, s, roomID, "c", client.Options{ManualSubscribe: true})
+
+	// 未訂閱時只收到track列表，不包含自己publish的track
+	trackInfo := func(id string) (client.TrackInfo, bool) {
+		for _, info := range c.client.Tracks() {
+			if info.TrackID == id {
+				return info, true
+			}
+		}
+		return client.TrackInfo{}, false
+	}
+	waitFor(t, "track list", func() bool {
+		_, okA := trackInfo(a.trackID())
+		_, okB := trackInfo(b.trackID())
+		return okA && okB
+	})
+	if _, ok := trackInfo(c.trackID()); ok {
+		t.Errorf("own track listed")
+	}
+	for _, p := range []*testPeer{a, b} {
+		if info, _ := trackInfo(p.trackID()); info.Subscribed || c.remoteHasTrack(p.trackID()) {
+			t.Errorf("track %s sent before subscribe: %+v", p.trackID(), info)
+		}
+	}
+	a.waitReceived(t, c.trackID())
+
+	// 以participant ID訂閱
+	info, _ := trackInfo(a.trackID())
+	if err := c.client.Subscribe(client.Subscription{ParticipantIDs: []string{info.ParticipantID}}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	c.waitReceived(t, a.trackID())
+	waitFor(t, "subscribed flag", func() bool {
+		info, _ := trackInfo(a.trackID())
+		return info.Subscribed
+	})
+	if c.remoteHasTrack(b.trackID()) {
+		t.Errorf("unsubscribed track %s sent", b.trackID())
+	}
+
+	// 以track ID訂閱，取消訂閱的track從offer中移除
+	if err := c.client.Subscribe(client.Subscription{TrackIDs: []string{b.trackID()}}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	c.waitReceived(t, b.trackID())
+	if err := c.client.Unsubscribe(client.Subscription{ParticipantIDs: []string{info.ParticipantID}}); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	waitFor(t, "unsubscribed track removed", func() bool {
+		info, _ := trackInfo(a.trackID())
+		return !c.remoteHasTrack(a.trackID()) && !info.Subscribed
+	})
+	if !c.remoteHasTrack(b.trackID()) {
+		t.Errorf("track %s removed by unsubscribing another participant", b.trackID())
+	}
+}
+
+func TestPauseResumeTrack(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	publishVideo(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	b.waitReceived(t, a.trackID(), "camera-a")
+	offer := b.client.PeerConnection().RemoteDescription().SDP
+
+	// stalled 等待一段時間packet數沒有增加
+	stalled := func(trackID string) bool {
+		before := b.packetCount(trackID)
+		time.Sleep(300 * time.Millisecond)
+		return b.packetCount(trackID) == before
+	}
+
+	if err := b.client.Pause(client.Subscription{TrackIDs: []string{"camera-a"}}); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	waitFor(t, "paused track stops", func() bool { return stalled("camera-a") })
+	if stalled(a.trackID()) {
+		t.Errorf("track %s stopped by pausing another track", a.trackID())
+	}
+
+	if err := b.client.Resume(client.Subscription{TrackIDs: []string{"camera-a"}}); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	waitFor(t, "resumed track flows", func() bool { return !stalled("camera-a") })
+
+	// downTrack接續暫停前的sequence number
+	b.Lock()
+	gaps := b.gaps["camera-a"]
+	b.Unlock()
+	if gaps != 0 {
+		t.Errorf("resumed track has %d sequence gaps", gaps)
+	}
+
+	// pause、resume不會renegotiation
+	if sdp := b.client.PeerConnection().RemoteDescription().SDP; sdp != offer {
+		t.Errorf("pause renegotiated:\n%s\nwant\n%s", sdp, offer)
+	}
+}
+
+// hijackedConns 記錄upgrade為websocket的連線，由server端切斷以模擬client斷線
+type hijackedConns struct {
+	conns []net.Conn
+	sync.Mutex
+}
+
+// track 需在srv啟動前呼叫
+func (h *hijackedConns) track(srv *httptest.Server) {
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state != http.StateHijacked {
+			return
+		}
+		h.Lock()
+		h.conns = append(h.conns, c)
+		h.Unlock()
+	}
+}
+
+func (h *hijackedConns) count() int {
+	h.Lock()
+	defer h.Unlock()
+
+	return len(h.conns)
+}
+
+// drop 關閉目前所有websocket
+func (h *hijackedConns) drop() {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, c := range h.conns {
+		_ = c.Close()
+	}
+	h.conns = nil
+}
+
+// iceUfrag session description的ICE username fragment，ICE restart後會改變
+func iceUfrag(desc *webrtc.SessionDescription) string {
+	if desc == nil {
+		return ""
+	}
+	for _, line := range strings.Split(desc.SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	return ""
+}
+
+func TestResumeAfterWebsocketDrop(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	conns := &hijackedConns{}
+	conns.track(srv)
+	s := startTestServer(t, srv, testConfig(func(c *handlers.Config) {
+		c.ResumeGracePeriod = 3 * time.Second
+	}))
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	a.waitReceived(t, b.trackID())
+	b.waitReceived(t, a.trackID())
+
+	pc := a.client.PeerConnection()
+	participantID, ufrag := a.client.ParticipantID(), iceUfrag(pc.RemoteDescription())
+	if participantID == "" || ufrag == "" {
+		t.Fatalf("participant %q ufrag %q before drop", participantID, ufrag)
+	}
+
+	conns.drop()
+	waitFor(t, "websockets resumed", func() bool { return conns.count() == 2 })
+
+	// resume後server以ICE restart重新協商同一個peerConnection
+	waitFor(t, "ICE restart", func() bool {
+		return iceUfrag(pc.RemoteDescription()) != ufrag &&
+			pc.SignalingState() == webrtc.SignalingStateStable &&
+			pc.ICEConnectionState() == webrtc.ICEConnectionStateConnected
+	})
+	if got := a.client.ParticipantID(); got != participantID {
+		t.Errorf("participant ID after resume = %q, want %q", got, participantID)
+	}
+	select {
+	case <-a.client.Done():
+		t.Fatalf("client finished after resume: %v", a.client.Err())
+	default:
+	}
+
+	// 兩邊的track沒有重新加入，RTP持續送達
+	before := map[*testPeer]int{a: a.packetCount(b.trackID()), b: b.packetCount(a.trackID())}
+	waitFor(t, "tracks flow after resume", func() bool {
+		return a.packetCount(b.trackID()) > before[a] && b.packetCount(a.trackID()) > before[b]
+	})
+	if !b.remoteHasTrack(a.trackID()) {
+		t.Errorf("track %s removed by resume", a.trackID())
+	}
+}
+
+func TestResumeRejectsInvalidToken(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.ResumeGracePeriod = time.Second
+	})
+	roomID := s.createRoom(t)
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{"sfu.v2"}
+	resume := func(token string) {
+		t.Helper()
+
+		ws, _, err := dialer.Dial(s.roomURL(roomID)+"?resume="+url.QueryEscape(token), nil)
+		if err != nil {
+			t.Fatalf("resume dial: %v", err)
+		}
+		defer ws.Close()
+		readEvent(t, ws, "resumeFailed")
+	}
+
+	resume(uuid.NewString())
+
+	// grace period之後token失效
+	ws, _, err := dialer.Dial(s.roomURL(roomID), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	session := struct {
+		ResumeToken string `json:"resumeToken"`
+	}{}
+	if err := json.Unmarshal(readEvent(t, ws, "session").Data, &session); err != nil || session.ResumeToken == "" {
+		t.Fatalf("session = %+v, %v", session, err)
+	}
+	ws.Close()
+
+	time.Sleep(2 * time.Second)
+	resume(session.ResumeToken)
+}
+
+func TestForwardedSenderReports(t *testing.T) {
+	s := newTestServer(t)
+	roomID := s.createRoom(t)
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	publishVideo(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	b.waitReceived(t, a.trackID(), "camera-a")
+
+	// 暫停後downTrack的timestamp offset改變，sender report需換算為送出的timestamp
+	if err := b.client.Pause(client.Subscription{TrackIDs: []string{"camera-a"}}); err != nil {
+		t.Fatalf("pause: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := b.client.Resume(client.Subscription{TrackIDs: []string{"camera-a"}}); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+
+	for _, id := range []string{a.trackID(), "camera-a"} {
+		id, resumed := id, len(b.senderReports(id))
+		// 略過resume之前已送出的report
+		waitFor(t, "sender report "+id, func() bool { return len(b.senderReports(id)) > resumed+1 })
+		drifts := b.senderReports(id)
+		for _, drift := range drifts[resumed+1:] {
+			if drift < -200*time.Millisecond || drift > 200*time.Millisecond {
+				t.Errorf("track %s sender report drift %v", id, drift)
+			}
+		}
+	}
+}
+
+// keyFrameRequests 記錄publisher收到的keyframe request
+type keyFrameRequests struct {
+	times map[string][]time.Time
+	sync.Mutex
+}
+
+func (k *keyFrameRequests) record(trackID string) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.times[trackID] = append(k.times[trackID], time.Now())
+}
+
+func (k *keyFrameRequests) get(trackID string) []time.Time {
+	k.Lock()
+	defer k.Unlock()
+
+	return append([]time.Time(nil), k.times[trackID]...)
+}
+
+func TestKeyFrameRequests(t *testing.T) {
+	const interval = 300 * time.Millisecond
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.KeyFrameRequestInterval = interval
+	})
+	roomID := s.createRoom(t)
+
+	requests := &keyFrameRequests{times: make(map[string][]time.Time)}
+	a := joinPeerWith(t, s, roomID, "a", client.Options{OnKeyFrameRequest: requests.record})
+	b := joinPeerWith(t, s, roomID, "b", client.Options{OnKeyFrameRequest: requests.record})
+	publishVideo(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	publishVideo(t, b.client, "camera-b", client.TrackLabelCamera, b.stop)
+	b.waitReceived(t, a.trackID(), "camera-a")
+
+	// 多人同時加入時，要求合併為每個間隔最多一次
+	subscribers := []*testPeer{}
+	for _, name := range []string{"c", "d", "e", "f"} {
+		subscribers = append(subscribers, joinPeer(t, s, roomID, name))
+	}
+	for _, p := range subscribers {
+		p.waitReceived(t, "camera-a", "camera-b")
+	}
+	time.Sleep(2 * interval)
+
+	times := requests.get("camera-a")
+	if len(times) == 0 {
+		t.Fatalf("publisher received no keyframe request")
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < interval-50*time.Millisecond {
+			t.Errorf("keyframe requests %v apart, want at least %v", gap, interval)
+		}
+	}
+	if audio := requests.get(a.trackID()); len(audio) != 0 {
+		t.Errorf("audio track received %d keyframe requests", len(audio))
+	}
+
+	// 訂閱者的PLI只轉給camera-a的publisher
+	var ssrc webrtc.SSRC
+	for _, receiver := range subscribers[0].client.PeerConnection().GetReceivers() {
+		if track := receiver.Track(); track != nil && track.ID() == "camera-a" {
+			ssrc = track.SSRC()
+		}
+	}
+	before, other := len(requests.get("camera-a")), len(requests.get("camera-b"))
+	if err := subscribers[0].client.PeerConnection().WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}); err != nil {
+		t.Fatalf("write PLI: %v", err)
+	}
+	waitFor(t, "forwarded PLI", func() bool { return len(requests.get("camera-a")) > before })
+	time.Sleep(2 * interval)
+	if n := len(requests.get("camera-b")); n != other {
+		t.Errorf("PLI for camera-a sent %d keyframe requests to camera-b", n-other)
+	}
+}
+
+// hostRequest 帶X-Host-Token呼叫房間管理API，回傳status code
+func (s *testServer) hostRequest(t *testing.T, method, path, token, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, s.srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Host-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHLSEgressRequiresHost(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.PreferH264Video = true
+	})
+	roomID, hostToken := s.createRoomWith(t, "")
+
+	a := joinPeer(t, s, roomID, "a")
+	b := joinPeer(t, s, roomID, "b")
+	publishH264Video(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	b.waitReceived(t, "camera-a")
+
+	path := "/room/" + roomID + "/hls"
+	for _, token := range []string{"", "wrong"} {
+		if status := s.hostRequest(t, http.MethodPost, path, token, ""); status != http.StatusForbidden {
+			t.Errorf("start hls with token %q status = %d, want %d", token, status, http.StatusForbidden)
+		}
+	}
+	if status := s.hostRequest(t, http.MethodPost, path, hostToken, ""); status != http.StatusOK {
+		t.Fatalf("start hls status = %d, want %d", status, http.StatusOK)
+	}
+	if status := s.hostRequest(t, http.MethodDelete, path, "", ""); status != http.StatusForbidden {
+		t.Errorf("stop hls without host token status = %d, want %d", status, http.StatusForbidden)
+	}
+	if status := s.hostRequest(t, http.MethodDelete, path, hostToken, ""); status != http.StatusNoContent {
+		t.Errorf("stop hls status = %d, want %d", status, http.StatusNoContent)
+	}
+}
+
+func TestHLSFileRequiresPasswordOrToken(t *testing.T) {
+	s := newTestServerWith(t, func(c *handlers.Config) {
+		c.PreferH264Video = true
+	})
+	roomID, hostToken := s.createRoomWith(t, `{"pin": "1234"}`)
+
+	a := joinPeerWith(t, s, roomID, "a", client.Options{HostToken: hostToken})
+	b := joinPeerWith(t, s, roomID, "b", client.Options{HostToken: hostToken})
+	publishH264Video(t, a.client, "camera-a", client.TrackLabelCamera, a.stop)
+	b.waitReceived(t, "camera-a")
+
+	req, err := http.NewRequest(http.MethodPost, s.srv.URL+"/room/"+roomID+"/hls", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Host-Token", hostToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("start hls: %v", err)
+	}
+	info := struct {
+		PlaylistURL string `json:"playlistURL"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("start hls response: %v", err)
+	}
+	playlist, err := url.Parse(info.PlaylistURL)
+	if err != nil {
+		t.Fatalf("parse playlist URL: %v", err)
+	}
+	token := playlist.Query().Get("token")
+	if token == "" {
+		t.Fatalf("playlist URL %q has no token", info.PlaylistURL)
+	}
+
+	get := func(query string, header http.Header) int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, s.srv.URL+"/room/"+roomID+"/hls/index.m3u8?"+query, nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get playlist: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := get("", nil); status != http.StatusForbidden {
+		t.Errorf("playlist without token status = %d, want %d", status, http.StatusForbidden)
+	}
+	if status := get("token=wrong", nil); status != http.StatusForbidden {
+		t.Errorf("playlist with wrong token status = %d, want %d", status, http.StatusForbidden)
+	}
+	if status := get("token="+token, nil); status != http.StatusOK {
+		t.Errorf("playlist with token status = %d, want %d", status, http.StatusOK)
+	}
+	if status := get("", http.Header{"X-Room-Password": {"1234"}}); status != http.StatusOK {
+		t.Errorf("playlist with password status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestSIPRoutesRequireHost(t *testing.T) {
+	s := newTestServer(t)
+	roomID, hostToken := s.createRoomWith(t, "")
+
+	dial, hangup := "/room/"+roomID+"/sip", "/room/"+roomID+"/sip/unknown-call"
+	body := `{"uri": "sip:1000@pbx.test"}`
+	for _, token := range []string{"", "wrong"} {
+		if status := s.hostRequest(t, http.MethodPost, dial, token, body); status != http.StatusForbidden {
+			t.Errorf("dial with token %q status = %d, want %d", token, status, http.StatusForbidden)
+		}
+		if status := s.hostRequest(t, http.MethodDelete, hangup, token, ""); status != http.StatusForbidden {
+			t.Errorf("hang up with token %q status = %d, want %d", token, status, http.StatusForbidden)
+		}
+	}
+
+	// host通過驗證後才檢查gateway與call
+	if status := s.hostRequest(t, http.MethodPost, dial, hostToken, body); status != http.StatusServiceUnavailable {
+		t.Errorf("dial status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if status := s.hostRequest(t, http.MethodDelete, hangup, hostToken, ""); status != http.StatusNotFound {
+		t.Errorf("hang up status = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+// countingStore 自行實作的RoomStore，包裝memory store並記錄寫入次數
+type countingStore struct {
+	handlers.RoomStore
+	saved int32
+}
+
+func (s *countingStore) SaveRoom(meta *handlers.RoomMetadata) error {
+	atomic.AddInt32(&s.saved, 1)
+	return s.RoomStore.SaveRoom(meta)
+}
+
+func TestCustomRoomStore(t *testing.T) {
+	store := &countingStore{RoomStore: handlers.NewMemoryRoomStore()}
+	sfu, err := handlers.NewSFU(handlers.WithStore(store))
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	srv := httptest.NewServer(sfu.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		sfu.Close()
+	})
+	s := &testServer{sfu: sfu, srv: srv}
+
+	roomID := s.createRoom(t)
+	if atomic.LoadInt32(&store.saved) == 0 {
+		t.Errorf("custom store SaveRoom not called")
+	}
+	rooms, err := store.ListRooms()
+	if err != nil {
+		t.Fatalf("list rooms: %v", err)
+	}
+	if len(rooms) != 1 || rooms[0].RoomID.String() != roomID {
+		t.Errorf("rooms = %+v, want %s", rooms, roomID)
+	}
+}
+
+// clusterRoom 以X-Cluster-Secret查詢node上的房間，回傳status code與回覆的settings
+func (s *testServer) clusterRoom(t *testing.T, roomID, secret string) (int, map[string]string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, s.srv.URL+"/cluster/rooms/"+roomID, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Cluster-Secret", secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("cluster room: %v", err)
+	}
+	defer resp.Body.Close()
+
+	info := struct {
+		Settings map[string]string `json:"settings"`
+	}{}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			t.Fatalf("cluster room decode: %v", err)
+		}
+	}
+	return resp.StatusCode, info.Settings
+}
+
+func TestClusterRelay(t *testing.T) {
+	deleted := make(chan string, 1)
+	origin, edge := newTestCluster(t, func(c *handlers.Config) {
+		c.EmptyRoomTimeout = time.Second
+	}, handlers.WithHooks(handlers.Hooks{
+		OnRoomDeleted: func(roomID uuid.UUID) { deleted <- roomID.String() },
+	}))
+	roomID := origin.createRoom(t)
+
+	if status, _ := origin.clusterRoom(t, roomID, "wrong"); status != http.StatusForbidden {
+		t.Errorf("cluster room with wrong secret status = %d, want %d", status, http.StatusForbidden)
+	}
+	if status, settings := origin.clusterRoom(t, roomID, testClusterSecret); status != http.StatusOK || settings == nil {
+		t.Errorf("cluster room = %d %v, want %d with settings", status, settings, http.StatusOK)
+	}
+
+	// origin的publisher經由relay送到edge的subscriber，edge的track也送回origin
+	a := joinPeer(t, origin, roomID, "a")
+	b := joinPeer(t, edge, roomID, "b")
+	b.waitReceived(t, a.trackID())
+	a.waitReceived(t, b.trackID())
+
+	// edge沒有參與者後刪除edge room，origin的房間仍存在
+	b.leave()
+	select {
+	case id := <-deleted:
+		if id != roomID {
+			t.Errorf("edge deleted room %s, want %s", id, roomID)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("edge room was not deleted")
+	}
+	if status, _ := origin.clusterRoom(t, roomID, testClusterSecret); status != http.StatusOK {
+		t.Errorf("origin room status after edge teardown = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestClusterEdgeRoomPassword(t *testing.T) {
+	origin, edge := newTestCluster(t, nil)
+	roomID, _ := origin.createRoomWith(t, `{"pin": "1234"}`)
+
+	// edge room取得origin的密碼設定，未帶密碼時拒絕
+	c, err := client.Join(edge.roomURL(roomID), client.Options{})
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer c.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(testTimeout):
+		t.Fatalf("joined password protected room through the edge without password")
+	}
+	if err := c.Err(); !errors.Is(err, client.ErrInvalidPassword) {
+		t.Errorf("edge join without password err = %v, want %v", err, client.ErrInvalidPassword)
+	}
+
+	a := joinPeerWith(t, origin, roomID, "a", client.Options{Password: "1234"})
+	b := joinPeerWith(t, edge, roomID, "b", client.Options{Password: "1234"})
+	b.waitReceived(t, a.trackID())
+}
+
+func TestClusterLobbyRoomOnOrigin(t *testing.T) {
+	origin, edge := newTestCluster(t, nil)
+	roomID, hostToken := origin.createRoomWith(t, `{"lobby": true}`)
+
+	// edge不建立lobby房間的edge room，room page轉到origin
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(edge.srv.URL + "/room/" + roomID)
+	if err != nil {
+		t.Fatalf("edge room page: %v", err)
+	}
+	resp.Body.Close()
+	if want := origin.srv.URL + "/room/" + roomID; resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != want {
+		t.Errorf("edge room page = %d %q, want %d %q", resp.StatusCode, resp.Header.Get("Location"), http.StatusTemporaryRedirect, want)
+	}
+
+	joins := make(chan client.LobbyParticipant, 1)
+	host := joinPeerWith(t, origin, roomID, "host", client.Options{
+		HostToken: hostToken,
+		OnLobbyJoin: func(p client.LobbyParticipant) {
+			joins <- p
+		},
+	})
+	go func() {
+		p := <-joins
+		if err := host.client.Admit(p.ParticipantID); err != nil {
+			t.Errorf("admit: %v", err)
+		}
+	}()
+
+	// 連線到edge的參與者改連線到origin，在origin的lobby等待host允許
+	guest := joinPeerWith(t, edge, roomID, "guest", client.Options{Name: "guest"})
+	guest.waitReceived(t, host.trackID())
+	host.waitReceived(t, guest.trackID())
+
+	if status, _ := edge.clusterRoom(t, roomID, testClusterSecret); status != http.StatusNotFound {
+		t.Errorf("edge cluster room status = %d, want %d", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// keyFrameRequester 向單一publisher track要求keyframe，以KeyFrameRequestInterval節流
+// 間隔內的要求合併為一次，在間隔結束時送出，避免多人加入時publisher不斷產生keyframe
+type keyFrameRequester struct {
+	// transport publisher的peerConnection，track開始轉送前為nil
+	transport *webrtc.DTLSTransport
+	ssrc      uint32
+	interval  time.Duration
+
+	// fir publisher只支援FIR時以FIR取代PLI
+	fir    bool
+	firSeq uint8
+
+	last    time.Time
+	pending bool
+
+	sync.Mutex
+}
+
+// supportsFIROnly codec的RTCP feedback只有ccm fir而沒有nack pli
+func supportsFIROnly(codec webrtc.RTPCodecParameters) bool {
+	pli, fir := false, false
+	for _, fb := range codec.RTCPFeedback {
+		switch {
+		case fb.Type == webrtc.TypeRTCPFBNACK && fb.Parameter == "pli":
+			pli = true
+		case fb.Type == webrtc.TypeRTCPFBCCM && fb.Parameter == "fir":
+			fir = true
+		}
+	}
+	return fir && !pli
+}
+
+// setPublisher 開始轉送時設定publisher
+func (k *keyFrameRequester) setPublisher(transport *webrtc.DTLSTransport, ssrc webrtc.SSRC, codec webrtc.RTPCodecParameters, interval time.Duration) {
+	k.Lock()
+	defer k.Unlock()
+
+	k.transport = transport
+	k.ssrc = uint32(ssrc)
+	k.fir = supportsFIROnly(codec)
+	k.interval = interval
+}
+
+func (k *keyFrameRequester) request() {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.transport == nil || k.pending {
+		return
+	}
+
+	if wait := k.interval - time.Since(k.last); wait > 0 {
+		k.pending = true
+		time.AfterFunc(wait, func() {
+			k.Lock()
+			defer k.Unlock()
+
+			k.pending = false
+			k.send()
+		})
+		return
+	}
+	k.send()
+}
+
+// send 呼叫者需持有lock
+func (k *keyFrameRequester) send() {
+	k.last = time.Now()
+
+	var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: k.ssrc}
+	if k.fir {
+		k.firSeq++
+		pkt = &rtcp.FullIntraRequest{
+			MediaSSRC: k.ssrc,
+			FIR:       []rtcp.FIREntry{{SSRC: k.ssrc, SequenceNumber: k.firSeq}},
+		}
+	}
+	// publisher已離開時忽略
+	_, _ = k.transport.WriteRTCP([]rtcp.Packet{pkt})
+}
+
+// requestKeyFrame 要求publisher送出keyframe，audio track與沒有publisher的track(SIP)忽略
+func (t *forwardedTrack) requestKeyFrame() {
+	if t.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	t.keyFrames.request()
+}
+
+// readRTCP 讀取訂閱者對此downTrack的RTCP直到sender移除，PLI與FIR轉給publisher
+// 讀出RTCP後interceptor才會處理NACK
+func (d *downTrack) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				d.track.requestKeyFrame()
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// lastNIdleTimeout 超過此時間沒有收到RTP的video track視為閒置，之後再收到時重新成為最近活動的track
+	lastNIdleTimeout = 2 * time.Second
+
+	// lastNCheckInterval 檢查video track活動狀態的間隔，狀態改變時重新signal
+	lastNCheckInterval = 500 * time.Millisecond
+)
+
+// trackActivity publisher track的活動狀態，LastN依此決定轉送哪些video track
+type trackActivity struct {
+	// lastPacket 最後收到RTP的時間，activeSince 閒置後再次收到RTP的時間，皆為UnixNano
+	lastPacket  int64
+	activeSince int64
+}
+
+// packet 記錄收到的RTP packet，每個packet呼叫
+func (a *trackActivity) packet(now time.Time) {
+	n := now.UnixNano()
+	if last := atomic.SwapInt64(&a.lastPacket, n); last == 0 || n-last > int64(lastNIdleTimeout) {
+		atomic.StoreInt64(&a.activeSince, n)
+	}
+}
+
+// since 目前活動的開始時間，閒置時回傳0
+func (a *trackActivity) since(now time.Time) int64 {
+	if now.UnixNano()-atomic.LoadInt64(&a.lastPacket) > int64(lastNIdleTimeout) {
+		return 0
+	}
+	return atomic.LoadInt64(&a.activeSince)
+}
+
+// activeSince 非publisher的track(例如混音)沒有活動記錄，視為閒置
+func activeSince(track localTrack, now time.Time) int64 {
+	if t, ok := track.(*forwardedTrack); ok {
+		return t.activity.since(now)
+	}
+	return 0
+}
+
+// limitVideoTracks 超過LastN的video track不轉送給此連線
+// screen share優先保留，其餘依最近開始活動的順序，閒置的track排在最後
+// relay需要房間中所有的track，不受限制，呼叫者需持有room lock
+func (c *clientConnectionState) limitVideoTracks(r *ConferenceRoom, tracks map[string]localTrack) {
+	max := r.sfu.config.LastN
+	if max <= 0 || c.relayNode != "" {
+		return
+	}
+
+	type videoTrack struct {
+		id     string
+		screen bool
+		since  int64
+	}
+
+	now := time.Now()
+	videos := []videoTrack{}
+	for id, track := range tracks {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			videos = append(videos, videoTrack{
+				id:     id,
+				screen: isScreenLabel(r.trackLabelOf(id, track.Kind())),
+				since:  activeSince(track, now),
+			})
+		}
+	}
+	if len(videos) <= max {
+		return
+	}
+
+	sort.Slice(videos, func(i, j int) bool {
+		a, b := videos[i], videos[j]
+		if a.screen != b.screen {
+			return a.screen
+		}
+		if a.since != b.since {
+			return a.since > b.since
+		}
+		return a.id < b.id
+	})
+	for _, v := range videos[max:] {
+		delete(tracks, v.id)
+	}
+}
+
+// watchVideoActivity LastN啟用時定期檢查video track的活動狀態，有track開始活動或閒置時重新signal
+// 直到房間刪除或SFU Close
+func (r *ConferenceRoom) watchVideoActivity() {
+	ticker := time.NewTicker(lastNCheckInterval)
+	defer ticker.Stop()
+
+	last := map[string]int64{}
+	for {
+		select {
+		case <-r.sfu.closed:
+			return
+		case <-r.closed:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		current := map[string]int64{}
+		r.RLock()
+		for id, track := range r.clientTracks {
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				current[id] = track.activity.since(now)
+			}
+		}
+		r.RUnlock()
+
+		changed := len(current) != len(last)
+		for id, since := range current {
+			if prev, ok := last[id]; !ok || prev != since {
+				changed = true
+			}
+		}
+		last = current
+
+		if changed {
+			r.signalPeerConnections()
+		}
+	}
+}
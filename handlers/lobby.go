@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 房間設定key，存於RoomStore的settings，edge room也會取得相同設定
+const (
+	// roomSettingLobby "true"時非host的參與者需要等待host允許才會建立peerConnection
+	roomSettingLobby = "lobby"
+	// roomSettingHostTokenHash host token的SHA-256，token只在建立房間時回傳一次，store中不保存token本身
+	roomSettingHostTokenHash = "hostTokenHash"
+)
+
+// lobby相關的error code
+const (
+	lobbyErrDenied    = "lobbyDenied"
+	lobbyErrForbidden = "forbidden"
+	lobbyErrNotFound  = "notFound"
+)
+
+// closeLobbyDenied host拒絕時的websocket close code
+const closeLobbyDenied = 4003
+
+// lobbyKeepAlive lobby中不讀取websocket(之後交給runSignaling)，以keepalive寫入失敗偵測斷線
+const lobbyKeepAlive = 10 * time.Second
+
+// lobbyParticipant lobby、lobbyJoin、lobbyLeave、admit、deny event的payload
+type lobbyParticipant struct {
+	ParticipantID string `json:"participantID"`
+	Name          string `json:"name,omitempty"`
+}
+
+// lobbyEntry 等待host允許的參與者，decision為true時允許
+// lobby只存在於origin node，cluster中不為lobby房間建立edge room(見getOrRelayRoom)
+type lobbyEntry struct {
+	lobbyParticipant
+	decision chan bool
+}
+
+// lobbyEnabled 房間是否需要host允許才能加入
+func (r *ConferenceRoom) lobbyEnabled() bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.settings[roomSettingLobby] == "true"
+}
+
+// isHost token是否為房間的host token
+func (r *ConferenceRoom) isHost(token string) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	hash := r.settings[roomSettingHostTokenHash]
+	return token != "" && hash != "" && subtle.ConstantTimeCompare([]byte(hashHostToken(token)), []byte(hash)) == 1
+}
+
+// hashHostToken host token為隨機UUID，不需要bcrypt
+func hashHostToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// waitInLobby 參與者在lobby等待host允許，允許時回傳true，拒絕或斷線時回傳false
+func (r *ConferenceRoom) waitInLobby(wsc *signalingConn, p lobbyParticipant) bool {
+	entry := &lobbyEntry{
+		lobbyParticipant: p,
+		decision:         make(chan bool, 1),
+	}
+
+	r.Lock()
+	r.lobby[p.ParticipantID] = entry
+	r.Unlock()
+
+	left := true
+	defer func() {
+		r.Lock()
+		delete(r.lobby, p.ParticipantID)
+		r.Unlock()
+
+		if left {
+			r.notifyHosts("lobbyLeave", p)
+		}
+	}()
+
+	if err := wsc.send("lobby", "", &p); err != nil {
+		return false
+	}
+	r.notifyHosts("lobbyJoin", p)
+	r.sfu.log.Infof("room %v participant %s waiting in lobby", r.RoomID, p.ParticipantID)
+
+	keepAliveTicker := time.NewTicker(lobbyKeepAlive)
+	defer keepAliveTicker.Stop()
+
+	for {
+		select {
+		case admitted := <-entry.decision:
+			left = false
+			if !admitted {
+				r.sfu.log.Infof("room %v participant %s denied", r.RoomID, p.ParticipantID)
+				_ = wsc.sendError("", lobbyErrDenied, "denied by host")
+				_ = wsc.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(closeLobbyDenied, lobbyErrDenied),
+					time.Now().Add(time.Second))
+				return false
+			}
+
+			r.sfu.log.Infof("room %v participant %s admitted", r.RoomID, p.ParticipantID)
+			return wsc.send("admitted", "", &p) == nil
+
+		case <-keepAliveTicker.C:
+			if err := wsc.send("keepalive", "", nil); err != nil {
+				return false
+			}
+
+		case <-r.sfu.closed:
+			return false
+
+		case <-r.closed:
+			return false
+		}
+	}
+}
+
+// decideLobby host允許或拒絕lobby中的參與者
+func (r *ConferenceRoom) decideLobby(participantID string, admit bool) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	entry, ok := r.lobby[participantID]
+	if !ok {
+		return false
+	}
+	delete(r.lobby, participantID)
+
+	entry.decision <- admit
+	return true
+}
+
+// notifyHosts 通知此node上所有host
+func (r *ConferenceRoom) notifyHosts(event string, p lobbyParticipant) {
+	r.RLock()
+	hosts := make([]*negotiator, 0, 1)
+	for i := range r.conns {
+		if r.conns[i].host {
+			hosts = append(hosts, r.conns[i].negotiator)
+		}
+	}
+	r.RUnlock()
+
+	for _, n := range hosts {
+		if wsc := n.websocket(); wsc != nil {
+			if err := wsc.send(event, "", &p); err != nil {
+				r.sfu.log.Debugf("room %v notify host %s error: %v", r.RoomID, event, err)
+			}
+		}
+	}
+}
+
+// sendLobby host加入時送出目前在lobby中的參與者
+func (r *ConferenceRoom) sendLobby(wsc *signalingConn) {
+	r.RLock()
+	waiting := make([]lobbyParticipant, 0, len(r.lobby))
+	for _, entry := range r.lobby {
+		waiting = append(waiting, entry.lobbyParticipant)
+	}
+	r.RUnlock()
+
+	for i := range waiting {
+		if err := wsc.send("lobbyJoin", "", &waiting[i]); err != nil {
+			return
+		}
+	}
+}
+
+// lobbyEventHandler 處理host送出的admit、deny，非host回覆forbidden
+func (r *ConferenceRoom) lobbyEventHandler(host bool) func(n *negotiator, message *signalingMessage) bool {
+	return func(n *negotiator, message *signalingMessage) bool {
+		if message.Event != "admit" && message.Event != "deny" {
+			return false
+		}
+
+		if !host {
+			n.replyError(message.ID, lobbyErrForbidden, fmt.Errorf("%s requires host", message.Event))
+			return true
+		}
+
+		p := lobbyParticipant{}
+		if err := json.Unmarshal(message.Data, &p); err != nil || p.ParticipantID == "" {
+			n.replyError(message.ID, signalingErrInvalidPayload, fmt.Errorf("%w: participantID required", errInvalidPayload))
+			return true
+		}
+
+		if !r.decideLobby(p.ParticipantID, message.Event == "admit") {
+			n.replyError(message.ID, lobbyErrNotFound, fmt.Errorf("participant %s not in lobby", p.ParticipantID))
+		}
+		return true
+	}
+}
@@ -0,0 +1,481 @@
+package handlers
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// negotiator 單一peerConnection的renegotiation狀態機 (perfect negotiation)
+// server為impolite peer：pion不支援rollback，glare時忽略client的offer，由client(polite) rollback後回answer
+// 多次renegotiation需求在送出offer前合併為一次，等待answer期間的需求在answer後再送出
+type negotiator struct {
+	pc     *webrtc.PeerConnection
+	roomID string
+	log    Logger
+
+	// timeout 等待answer的時間
+	timeout time.Duration
+
+	// wsc 目前的websocket，等待resume時為nil，期間只記錄需求不送出offer
+	wsc *signalingConn
+
+	// needed 有尚未送出的renegotiation需求
+	needed bool
+	// iceRestart 下一次offer需要ICE restart
+	iceRestart bool
+	// offering 已送出offer，等待answer
+	offering bool
+
+	// scheduled 合併burst用的timer已啟動
+	scheduled bool
+	// waitingStable signaling state不是stable，回到stable時由OnSignalingStateChange再schedule
+	waitingStable bool
+	// offerTimer 等待answer超時，generation避免舊的timer誤觸發
+	offerTimer *time.Timer
+	generation int
+	retries    int
+
+	// failures CreateOffer或SetLocalDescription連續失敗的次數，以backoff重試
+	failures int
+
+	// offers 送出過的offer數，offerID為等待answer中的offer的request ID，v2 client的answer帶回此ID
+	offers  int
+	offerID string
+
+	closed bool
+
+	// tracks 下一次offer之前送出的tracks event，讓client知道每個track的用途與是否訂閱
+	// tracksChanged 列表變動但尚未送出，不需要renegotiation時單獨送出
+	tracks        *trackList
+	tracksChanged bool
+
+	// onEvent 處理negotiation以外的room event，例如lobby的admit、deny，回傳false時視為未知的event
+	onEvent func(n *negotiator, message *signalingMessage) bool
+
+	// checkOffer SetRemoteDescription前檢查client的offer，例如publish m-line數是否超過MaxPublishTracks
+	checkOffer func(offer webrtc.SessionDescription) *admissionError
+
+	sync.Mutex
+}
+
+const (
+	// negotiationDebounce 合併短時間內多次track變動
+	negotiationDebounce = 20 * time.Millisecond
+
+	// negotiationMaxRetries answer超時重送offer或建立offer失敗重試的次數，超過時關閉peerConnection
+	negotiationMaxRetries = 3
+)
+
+// negotiationError 送給v1 client的negotiationError event
+type negotiationError struct {
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newNegotiator(pc *webrtc.PeerConnection, wsc *signalingConn, room *ConferenceRoom) *negotiator {
+	n := &negotiator{
+		pc:      pc,
+		roomID:  room.RoomID.String(),
+		log:     room.sfu.log,
+		timeout: room.sfu.config.NegotiationTimeout,
+		wsc:     wsc,
+	}
+	pc.OnSignalingStateChange(n.signalingStateChange)
+	return n
+}
+
+// signalingStateChange pion在另一個goroutine呼叫，回到stable時送出等待中的offer
+func (n *negotiator) signalingStateChange(state webrtc.SignalingState) {
+	if state != webrtc.SignalingStateStable {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if n.waitingStable {
+		n.waitingStable = false
+		n.schedule()
+	}
+}
+
+// websocket 目前的websocket，等待resume時回傳nil
+func (n *negotiator) websocket() *signalingConn {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.wsc
+}
+
+// suspend websocket斷線，保留需求直到resume
+func (n *negotiator) suspend() {
+	n.Lock()
+	defer n.Unlock()
+
+	n.wsc = nil
+}
+
+// resume 換上新的websocket，需要ICE restart
+// 斷線前送出的offer可能沒有收到answer，pion無法rollback，因此重送尚未完成的offer
+func (n *negotiator) resume(wsc *signalingConn) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.wsc = wsc
+	n.needed = true
+	n.iceRestart = true
+
+	if n.offering {
+		n.retries = 0
+		n.resendOffer()
+		return
+	}
+	n.schedule()
+}
+
+// requestOffer 房間track變動時呼叫，不會阻塞，可在持有room lock時呼叫
+func (n *negotiator) requestOffer() {
+	n.Lock()
+	defer n.Unlock()
+
+	n.needed = true
+	n.schedule()
+}
+
+// setTracks 更新track列表，與上次相同時不送出，可在持有room lock時呼叫
+func (n *negotiator) setTracks(tracks *trackList) {
+	n.Lock()
+	defer n.Unlock()
+
+	if reflect.DeepEqual(n.tracks, tracks) {
+		return
+	}
+	n.tracks = tracks
+	n.tracksChanged = true
+	n.schedule()
+}
+
+// restartICE 下一次offer帶ICE restart
+func (n *negotiator) restartICE() {
+	n.Lock()
+	defer n.Unlock()
+
+	n.needed = true
+	n.iceRestart = true
+	n.schedule()
+}
+
+func (n *negotiator) close() {
+	n.Lock()
+	defer n.Unlock()
+
+	n.closed = true
+	if n.offerTimer != nil {
+		n.offerTimer.Stop()
+	}
+}
+
+// schedule 呼叫者需持有lock
+func (n *negotiator) schedule() {
+	if n.scheduled || n.offering || n.closed {
+		return
+	}
+	n.scheduled = true
+
+	time.AfterFunc(negotiationDebounce, func() {
+		n.Lock()
+		defer n.Unlock()
+
+		n.scheduled = false
+		n.negotiate()
+	})
+}
+
+// negotiate 送出offer，呼叫者需持有lock
+func (n *negotiator) negotiate() {
+	if n.offering || n.closed || n.wsc == nil {
+		return
+	}
+	if !n.needed {
+		// 只有未訂閱的track變動
+		if n.tracksChanged {
+			n.sendTracks()
+		}
+		return
+	}
+	if n.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+
+	// client的offer處理中(have-remote-offer)，回到stable時再schedule
+	if n.pc.SignalingState() != webrtc.SignalingStateStable {
+		n.waitingStable = true
+		return
+	}
+
+	var options *webrtc.OfferOptions
+	if n.iceRestart {
+		options = &webrtc.OfferOptions{ICERestart: true}
+	}
+
+	offer, err := n.pc.CreateOffer(options)
+	if err != nil {
+		n.reportError("", "create offer", err)
+		n.retry()
+		return
+	}
+
+	if err = n.pc.SetLocalDescription(offer); err != nil {
+		n.reportError("", "set local description", err)
+		n.retry()
+		return
+	}
+	n.failures = 0
+
+	n.offers++
+	n.offerID = fmt.Sprintf("offer-%d", n.offers)
+
+	n.needed = false
+	n.iceRestart = false
+	n.offering = true
+	n.retries = 0
+	n.sendOffer(offer)
+}
+
+// retry 建立offer失敗時needed仍為true，以backoff重新negotiate，呼叫者需持有lock
+func (n *negotiator) retry() {
+	n.failures++
+	if n.failures > negotiationMaxRetries {
+		n.log.Errorf("room %v create offer failed after %d retries, close peerConnection", n.roomID, negotiationMaxRetries)
+		n.fail()
+		return
+	}
+
+	n.scheduled = true
+	time.AfterFunc(negotiationDebounce<<n.failures, func() {
+		n.Lock()
+		defer n.Unlock()
+
+		n.scheduled = false
+		n.negotiate()
+	})
+}
+
+// fail 無法完成negotiation，關閉peerConnection，呼叫者需持有lock
+func (n *negotiator) fail() {
+	n.closed = true
+	go func() {
+		if err := n.pc.Close(); err != nil {
+			n.log.Errorf("PeerConnection Close error: %v", err)
+		}
+	}()
+}
+
+// sendOffer 送出offer並開始等待answer，呼叫者需持有lock
+func (n *negotiator) sendOffer(offer webrtc.SessionDescription) {
+	n.generation++
+	generation := n.generation
+	if n.offerTimer != nil {
+		n.offerTimer.Stop()
+	}
+	n.offerTimer = time.AfterFunc(n.timeout, func() {
+		n.answerTimeout(generation)
+	})
+
+	if n.wsc == nil {
+		return
+	}
+	// v1 client維持原本offer為第一個message的順序，tracks在offer之後送出
+	if n.wsc.version != signalingV1 {
+		n.sendTracks()
+	}
+	if err := n.wsc.send("offer", n.offerID, offer); err != nil {
+		n.log.Debugf("room %v offer write json error: %v", n.roomID, err)
+	}
+	if n.wsc.version == signalingV1 {
+		n.sendTracks()
+	}
+}
+
+// sendTracks 呼叫者需持有lock
+func (n *negotiator) sendTracks() {
+	if n.tracks == nil {
+		return
+	}
+	n.tracksChanged = false
+	if err := n.wsc.send("tracks", "", n.tracks); err != nil {
+		n.log.Debugf("room %v tracks write json error: %v", n.roomID, err)
+	}
+}
+
+// resendOffer 重送等待answer中的offer，呼叫者需持有lock
+func (n *negotiator) resendOffer() {
+	pending := n.pc.PendingLocalDescription()
+	if pending == nil {
+		n.offering = false
+		n.schedule()
+		return
+	}
+	n.sendOffer(*pending)
+}
+
+func (n *negotiator) answerTimeout(generation int) {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.offering || n.closed || generation != n.generation {
+		return
+	}
+
+	n.retries++
+	n.reportError(n.offerID, "answer timeout", nil)
+
+	if n.retries > negotiationMaxRetries {
+		n.log.Errorf("room %v negotiation failed after %d retries, close peerConnection", n.roomID, negotiationMaxRetries)
+		n.fail()
+		return
+	}
+
+	n.resendOffer()
+}
+
+// handleAnswer client回覆server的offer，id為answer帶回的offer request ID，v1 client沒有ID
+func (n *negotiator) handleAnswer(answer webrtc.SessionDescription, id string) {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.offering {
+		n.reportError(id, "unexpected answer", nil)
+		return
+	}
+
+	// 回覆的是已被重送或取代的offer
+	if id != "" && id != n.offerID {
+		n.reportError(id, "stale answer", fmt.Errorf("waiting for answer to %s", n.offerID))
+		return
+	}
+
+	if err := n.pc.SetRemoteDescription(answer); err != nil {
+		n.reportError(id, "set remote description", err)
+		return
+	}
+
+	n.offering = false
+	n.retries = 0
+	if n.offerTimer != nil {
+		n.offerTimer.Stop()
+	}
+	n.schedule()
+}
+
+// handleOffer client發起的renegotiation，例如新增screen share track，answer帶回offer的request ID
+func (n *negotiator) handleOffer(offer webrtc.SessionDescription, id string) {
+	n.Lock()
+	defer n.Unlock()
+
+	// glare: server為impolite peer，忽略client的offer，client rollback後會回覆server的offer並重新送出offer
+	if n.offering || n.pc.SignalingState() != webrtc.SignalingStateStable {
+		n.log.Debugf("room %v glare, ignore client offer", n.roomID)
+		n.reportGlare(id)
+		return
+	}
+
+	if n.checkOffer != nil {
+		if err := n.checkOffer(offer); err != nil {
+			n.reportRejected(id, err)
+			return
+		}
+	}
+
+	if err := n.pc.SetRemoteDescription(offer); err != nil {
+		n.reportError(id, "set remote description", err)
+		return
+	}
+
+	answer, err := n.pc.CreateAnswer(nil)
+	if err != nil {
+		n.reportError(id, "create answer", err)
+		return
+	}
+
+	if err := n.pc.SetLocalDescription(answer); err != nil {
+		n.reportError(id, "set local description", err)
+		return
+	}
+
+	if n.wsc != nil {
+		if err := n.wsc.send("answer", id, answer); err != nil {
+			n.log.Debugf("room %v answer write json error: %v", n.roomID, err)
+		}
+	}
+
+	// 等待answer期間累積的需求
+	n.schedule()
+}
+
+// reportGlare 通知client其offer因glare被忽略，client需rollback並回覆server的offer後再重新送出，呼叫者需持有lock
+func (n *negotiator) reportGlare(id string) {
+	if n.wsc == nil {
+		return
+	}
+
+	var err error
+	if n.wsc.version == signalingV1 {
+		err = n.wsc.send("negotiationError", "", &negotiationError{Reason: "glare"})
+	} else {
+		err = n.wsc.sendError(id, signalingErrGlare, "server offer pending, rollback and answer it before sending a new offer")
+	}
+	if err != nil {
+		n.log.Debugf("room %v glare error write json error: %v", n.roomID, err)
+	}
+}
+
+// reportRejected 通知client其offer超過限制未被套用，呼叫者需持有lock
+func (n *negotiator) reportRejected(id string, err *admissionError) {
+	n.log.Warnf("room %v reject client offer: %v", n.roomID, err)
+
+	if n.wsc == nil {
+		return
+	}
+
+	var wErr error
+	if n.wsc.version == signalingV1 {
+		wErr = n.wsc.send("negotiationError", "", &negotiationError{Reason: err.code, Error: err.reason})
+	} else {
+		wErr = n.wsc.sendError(id, err.code, err.reason)
+	}
+	if wErr != nil {
+		n.log.Debugf("room %v offer rejected write json error: %v", n.roomID, wErr)
+	}
+}
+
+// reportError 通知client negotiation錯誤，id為造成錯誤的request ID，呼叫者需持有lock
+func (n *negotiator) reportError(id, reason string, err error) {
+	n.log.Warnf("room %v negotiation error: %s %v", n.roomID, reason, err)
+
+	if n.wsc == nil {
+		return
+	}
+
+	var wErr error
+	if n.wsc.version == signalingV1 {
+		e := &negotiationError{Reason: reason}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		wErr = n.wsc.send("negotiationError", "", e)
+	} else {
+		message := reason
+		if err != nil {
+			message = fmt.Sprintf("%s: %v", reason, err)
+		}
+		wErr = n.wsc.sendError(id, signalingErrNegotiation, message)
+	}
+	if wErr != nil {
+		n.log.Debugf("room %v negotiation error write json error: %v", n.roomID, wErr)
+	}
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// newTestNegotiator 以真實的websocket連接negotiator，回傳client端收到的message
+// subprotocol為空字串時為v1 client
+func newTestNegotiator(t *testing.T, subprotocol string, timeout time.Duration) (*negotiator, <-chan *signalingMessage) {
+	t.Helper()
+
+	s, err := NewSFU()
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := webSocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{}
+	if subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server := <-conns
+	t.Cleanup(func() { server.Close() })
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peerConnection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatalf("add transceiver: %v", err)
+	}
+
+	room := &ConferenceRoom{RoomID: uuid.New(), sfu: s}
+	n := newNegotiator(pc, newSignalingConn(&threadSafeWebSocketWriter{Conn: server}), room)
+	n.timeout = timeout
+	t.Cleanup(n.close)
+
+	messages := make(chan *signalingMessage, 16)
+	wsc := newSignalingConn(&threadSafeWebSocketWriter{Conn: client})
+	go func() {
+		defer close(messages)
+		for {
+			message, _, err := wsc.read()
+			if err != nil {
+				return
+			}
+			if message != nil {
+				messages <- message
+			}
+		}
+	}()
+	return n, messages
+}
+
+// expectMessage 等待下一個message並確認event
+func expectMessage(t *testing.T, messages <-chan *signalingMessage, event string) *signalingMessage {
+	t.Helper()
+
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatalf("websocket closed, want %s", event)
+		}
+		if message.Event != event {
+			t.Fatalf("event = %s, want %s: %s", message.Event, event, message.Data)
+		}
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", event)
+	}
+	return nil
+}
+
+func expectNoMessage(t *testing.T, messages <-chan *signalingMessage, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case message, ok := <-messages:
+		if ok {
+			t.Fatalf("unexpected %s: %s", message.Event, message.Data)
+		}
+	case <-time.After(wait):
+	}
+}
+
+// newClientOffer client端的offer，帶一個audio track
+func newClientOffer(t *testing.T) webrtc.SessionDescription {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new peerConnection: %v", err)
+	}
+	defer pc.Close()
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatalf("add transceiver: %v", err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("create offer: %v", err)
+	}
+	return offer
+}
+
+func TestNegotiatorGlare(t *testing.T) {
+	tests := []struct {
+		name        string
+		subprotocol string
+		check       func(t *testing.T, message *signalingMessage)
+	}{
+		{
+			name:        "v1",
+			subprotocol: "",
+			check: func(t *testing.T, message *signalingMessage) {
+				if message.Event != "negotiationError" {
+					t.Fatalf("event = %s, want negotiationError", message.Event)
+				}
+				e := negotiationError{}
+				if err := json.Unmarshal(message.Data, &e); err != nil || e.Reason != "glare" {
+					t.Errorf("negotiationError = %+v, %v, want reason glare", e, err)
+				}
+			},
+		},
+		{
+			name:        "v2",
+			subprotocol: signalingV2Subprotocol,
+			check: func(t *testing.T, message *signalingMessage) {
+				if message.Event != "error" || message.ID != "client-offer" {
+					t.Fatalf("event = %s id %q, want error id client-offer", message.Event, message.ID)
+				}
+				e := signalingError{}
+				if err := json.Unmarshal(message.Data, &e); err != nil || e.Code != signalingErrGlare {
+					t.Errorf("error = %+v, %v, want code %s", e, err, signalingErrGlare)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, messages := newTestNegotiator(t, test.subprotocol, time.Minute)
+
+			n.requestOffer()
+			message := expectMessage(t, messages, "offer")
+			serverOffer, err := message.decodeDescription(webrtc.SDPTypeOffer)
+			if err != nil {
+				t.Fatalf("decode offer: %v", err)
+			}
+
+			// server在have-local-offer時收到client的offer
+			n.handleOffer(newClientOffer(t), "client-offer")
+			select {
+			case glare := <-messages:
+				test.check(t, glare)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for glare error")
+			}
+			if state := n.pc.SignalingState(); state != webrtc.SignalingStateHaveLocalOffer {
+				t.Fatalf("signaling state = %v, want have-local-offer", state)
+			}
+
+			// client rollback後回覆server的offer
+			answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatalf("new peerConnection: %v", err)
+			}
+			defer answerer.Close()
+			if err := answerer.SetRemoteDescription(serverOffer); err != nil {
+				t.Fatalf("set remote description: %v", err)
+			}
+			answer, err := answerer.CreateAnswer(nil)
+			if err != nil {
+				t.Fatalf("create answer: %v", err)
+			}
+			n.handleAnswer(answer, message.ID)
+			if state := n.pc.SignalingState(); state != webrtc.SignalingStateStable {
+				t.Errorf("signaling state after answer = %v, want stable", state)
+			}
+		})
+	}
+}
+
+func TestNegotiatorCoalesceRequests(t *testing.T) {
+	n, messages := newTestNegotiator(t, signalingV2Subprotocol, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		n.requestOffer()
+	}
+
+	message := expectMessage(t, messages, "offer")
+	if message.ID != "offer-1" {
+		t.Errorf("offer id = %q, want offer-1", message.ID)
+	}
+	expectNoMessage(t, messages, 10*negotiationDebounce)
+}
+
+func TestNegotiatorAnswerTimeout(t *testing.T) {
+	n, messages := newTestNegotiator(t, signalingV2Subprotocol, 50*time.Millisecond)
+
+	n.requestOffer()
+	for i := 0; i <= negotiationMaxRetries; i++ {
+		// 超時後重送同一個offer
+		if message := expectMessage(t, messages, "offer"); message.ID != "offer-1" {
+			t.Errorf("offer %d id = %q, want offer-1", i, message.ID)
+		}
+		message := expectMessage(t, messages, "error")
+		e := signalingError{}
+		if err := json.Unmarshal(message.Data, &e); err != nil || e.Code != signalingErrNegotiation {
+			t.Errorf("error = %+v, %v, want code %s", e, err, signalingErrNegotiation)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for n.pc.ConnectionState() != webrtc.PeerConnectionStateClosed {
+		if time.Now().After(deadline) {
+			t.Fatal("peerConnection not closed after answer timeouts")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectNoMessage(t, messages, 4*n.timeout)
+}
+
+func TestNegotiatorWaitStable(t *testing.T) {
+	n, messages := newTestNegotiator(t, signalingV2Subprotocol, time.Minute)
+
+	// client的offer處理中(have-remote-offer)，server的offer要等到回到stable
+	if err := n.pc.SetRemoteDescription(newClientOffer(t)); err != nil {
+		t.Fatalf("set remote description: %v", err)
+	}
+	n.requestOffer()
+	expectNoMessage(t, messages, 10*negotiationDebounce)
+
+	answer, err := n.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("create answer: %v", err)
+	}
+	if err := n.pc.SetLocalDescription(answer); err != nil {
+		t.Fatalf("set local description: %v", err)
+	}
+	expectMessage(t, messages, "offer")
+}
@@ -0,0 +1,109 @@
+//go:build opus
+// +build opus
+
+package handlers
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+// opus_encoder_ctl 為variadic，cgo無法直接呼叫
+static int sfu_opus_set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+	return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+}
+
+static int sfu_opus_set_dtx(OpusEncoder *enc, opus_int32 dtx) {
+	return opus_encoder_ctl(enc, OPUS_SET_DTX(dtx));
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// 使用libopus (需以 -tags opus build，並安裝libopus-dev)
+
+type cgoOpusDecoder struct {
+	dec *C.OpusDecoder
+}
+
+func newOpusDecoder() (opusDecoder, error) {
+	var cErr C.int
+	dec := C.opus_decoder_create(C.opus_int32(mixerSampleRate), C.int(mixerChannels), &cErr)
+	if cErr != C.OPUS_OK {
+		return nil, fmt.Errorf("opus decoder create error: %s", C.GoString(C.opus_strerror(cErr)))
+	}
+
+	return &cgoOpusDecoder{dec: dec}, nil
+}
+
+func (d *cgoOpusDecoder) decode(packet []byte, pcm []int16) (int, error) {
+	if len(packet) == 0 || len(pcm) == 0 {
+		return 0, nil
+	}
+
+	n := C.opus_decode(
+		d.dec,
+		(*C.uchar)(unsafe.Pointer(&packet[0])),
+		C.opus_int32(len(packet)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])),
+		C.int(len(pcm)/mixerChannels),
+		0,
+	)
+	if n < 0 {
+		return 0, fmt.Errorf("opus decode error: %s", C.GoString(C.opus_strerror(n)))
+	}
+
+	return int(n) * mixerChannels, nil
+}
+
+func (d *cgoOpusDecoder) close() {
+	C.opus_decoder_destroy(d.dec)
+}
+
+type cgoOpusEncoder struct {
+	enc *C.OpusEncoder
+}
+
+// newOpusEncoder bitrate為輸出的Opus bitrate
+func newOpusEncoder(bitrate int) (opusEncoder, error) {
+	var cErr C.int
+	enc := C.opus_encoder_create(C.opus_int32(mixerSampleRate), C.int(mixerChannels), C.OPUS_APPLICATION_VOIP, &cErr)
+	if cErr != C.OPUS_OK {
+		return nil, fmt.Errorf("opus encoder create error: %s", C.GoString(C.opus_strerror(cErr)))
+	}
+
+	if cErr = C.sfu_opus_set_bitrate(enc, C.opus_int32(bitrate)); cErr != C.OPUS_OK {
+		C.opus_encoder_destroy(enc)
+		return nil, fmt.Errorf("opus encoder set bitrate error: %s", C.GoString(C.opus_strerror(cErr)))
+	}
+
+	// 沒有人說話時降低頻寬
+	if cErr = C.sfu_opus_set_dtx(enc, 1); cErr != C.OPUS_OK {
+		C.opus_encoder_destroy(enc)
+		return nil, fmt.Errorf("opus encoder set dtx error: %s", C.GoString(C.opus_strerror(cErr)))
+	}
+
+	return &cgoOpusEncoder{enc: enc}, nil
+}
+
+func (e *cgoOpusEncoder) encode(pcm []int16, packet []byte) (int, error) {
+	n := C.opus_encode(
+		e.enc,
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])),
+		C.int(len(pcm)/mixerChannels),
+		(*C.uchar)(unsafe.Pointer(&packet[0])),
+		C.opus_int32(len(packet)),
+	)
+	if n < 0 {
+		return 0, fmt.Errorf("opus encode error: %s", C.GoString(C.opus_strerror(n)))
+	}
+
+	return int(n), nil
+}
+
+func (e *cgoOpusEncoder) close() {
+	C.opus_encoder_destroy(e.enc)
+}
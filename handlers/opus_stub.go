@@ -0,0 +1,17 @@
+//go:build !opus
+// +build !opus
+
+package handlers
+
+import "errors"
+
+// 未使用 -tags opus build時，沒有opus codec，混音功能無法使用
+var errOpusUnsupported = errors.New("server built without opus support (build with -tags opus)")
+
+func newOpusDecoder() (opusDecoder, error) {
+	return nil, errOpusUnsupported
+}
+
+func newOpusEncoder(bitrate int) (opusEncoder, error) {
+	return nil, errOpusUnsupported
+}
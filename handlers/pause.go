@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// matches track是否為pause、resume的對象
+func (req *subscriptionRequest) matches(trackID, participantID string) bool {
+	if req.All {
+		return true
+	}
+	for _, id := range req.TrackIDs {
+		if id == trackID {
+			return true
+		}
+	}
+	for _, id := range req.ParticipantIDs {
+		if participantID != "" && id == participantID {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseEventHandler 處理client的pause、resume，例如畫面外的tile或隱藏的分頁
+// 只影響目前送給此連線的track，暫停時downTrack不送出RTP，sender維持在SDP中不需要renegotiation
+// resume後向publisher要求keyframe，downTrack從keyframe開始接續sequence number與timestamp
+// downTracks 此連線的downTrack，只在持有room lock時讀寫
+func (r *ConferenceRoom) pauseEventHandler(downTracks map[string]*downTrack) func(n *negotiator, message *signalingMessage) bool {
+	return func(n *negotiator, message *signalingMessage) bool {
+		if message.Event != "pause" && message.Event != "resume" {
+			return false
+		}
+
+		req := subscriptionRequest{}
+		if err := json.Unmarshal(message.Data, &req); err != nil || (!req.All && len(req.ParticipantIDs) == 0 && len(req.TrackIDs) == 0) {
+			n.replyError(message.ID, signalingErrInvalidPayload, fmt.Errorf("%w: all, participantIDs or trackIDs required", errInvalidPayload))
+			return true
+		}
+
+		r.Lock()
+		for id, d := range downTracks {
+			if !req.matches(id, r.trackPublishers[id]) {
+				continue
+			}
+			if d.setPaused(message.Event == "pause") && message.Event == "resume" {
+				d.track.requestKeyFrame()
+			}
+		}
+		r.Unlock()
+		return true
+	}
+}
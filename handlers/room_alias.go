@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// roomSettingAlias 房間的alias，URL與SIP URI可以用alias取代room UUID
+const roomSettingAlias = "alias"
+
+// aliasGenerateAttempts 產生readable alias時遇到重複的重試次數
+const aliasGenerateAttempts = 10
+
+var errAliasInvalid = errors.New("room alias must be 3-64 characters of a-z, 0-9 and '-', not starting or ending with '-'")
+
+// errAliasTooManyLookups 同一個IP查詢不存在的alias次數過多，避免以猜測alias找到房間
+var errAliasTooManyLookups = errors.New("too many unknown room alias lookups")
+
+// roomErrNotFound URL中的room ID或alias不存在時回覆client的error code
+const roomErrNotFound = "roomNotFound"
+
+// closeRoomNotFound room不存在時的websocket close code
+const closeRoomNotFound = 4404
+
+// aliasPattern alias只允許小寫英數字與'-'，可以直接放進URL path與SIP URI
+var aliasPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}[a-z0-9]$`)
+
+// readable alias的單字，adjective-animal-NNNN，約九百萬種組合，適合口頭傳達但不適合當作房間的存取控制
+var (
+	aliasAdjectives = []string{
+		"brave", "calm", "clever", "cosy", "eager", "fancy", "gentle", "happy",
+		"jolly", "kind", "lively", "lucky", "merry", "mighty", "noble", "polite",
+		"proud", "quick", "quiet", "rapid", "shiny", "silly", "smart", "sunny",
+		"swift", "tidy", "tiny", "vivid", "warm", "wise", "witty", "zesty",
+	}
+	aliasAnimals = []string{
+		"badger", "beaver", "bison", "camel", "crane", "dingo", "eagle", "falcon",
+		"ferret", "gecko", "heron", "ibis", "koala", "lemur", "llama", "lynx",
+		"moose", "newt", "otter", "owl", "panda", "puffin", "quail", "raven",
+		"salmon", "seal", "tapir", "tiger", "toucan", "walrus", "wombat", "zebra",
+	}
+)
+
+// normalizeAlias alias不分大小寫，格式不合法或與UUID相同時回傳errAliasInvalid
+func normalizeAlias(alias string) (string, error) {
+	alias = strings.ToLower(alias)
+	if !aliasPattern.MatchString(alias) {
+		return "", errAliasInvalid
+	}
+	if _, err := uuid.Parse(alias); err == nil {
+		return "", errAliasInvalid
+	}
+	return alias, nil
+}
+
+// readableAlias 產生例如brave-otter-4821的alias
+func readableAlias() (string, error) {
+	pick := func(n int) (int, error) {
+		v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+		if err != nil {
+			return 0, err
+		}
+		return int(v.Int64()), nil
+	}
+
+	adjective, err := pick(len(aliasAdjectives))
+	if err != nil {
+		return "", err
+	}
+	animal, err := pick(len(aliasAnimals))
+	if err != nil {
+		return "", err
+	}
+	number, err := pick(9000)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%d", aliasAdjectives[adjective], aliasAnimals[animal], number+1000), nil
+}
+
+// reserveAlias 將alias指向roomID，requested為空字串時產生readable alias
+func (s *SFU) reserveAlias(requested string, roomID uuid.UUID) (string, error) {
+	if requested != "" {
+		alias, err := normalizeAlias(requested)
+		if err != nil {
+			return "", err
+		}
+		if err := s.store.SaveAlias(alias, roomID); err != nil {
+			return "", err
+		}
+		return alias, nil
+	}
+
+	for i := 0; i < aliasGenerateAttempts; i++ {
+		alias, err := readableAlias()
+		if err != nil {
+			return "", err
+		}
+
+		err = s.store.SaveAlias(alias, roomID)
+		if errors.Is(err, ErrAliasTaken) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return alias, nil
+	}
+	return "", fmt.Errorf("generate readable alias: %w", ErrAliasTaken)
+}
+
+// resolveRoomID URL或SIP URI中的room，可以是UUID或alias
+// alias存於RoomStore，cluster中的node需共用store才能解析其他node建立的alias
+// ip查詢不存在的alias達PasswordMaxAttempts次後，PasswordAttemptWindow內不再解析alias
+func (s *SFU) resolveRoomID(id, ip string) (uuid.UUID, error) {
+	if roomID, err := uuid.Parse(id); err == nil {
+		return roomID, nil
+	}
+
+	alias, err := normalizeAlias(id)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("room %q is neither UUID nor alias", id)
+	}
+
+	max, window := s.config.PasswordMaxAttempts, s.config.PasswordAttemptWindow
+	if !s.aliasLookups.attempt(ip, max, window) {
+		return uuid.Nil, fmt.Errorf("room %q from %s: %w", id, ip, errAliasTooManyLookups)
+	}
+	roomID, err := s.store.GetAlias(alias)
+	if !errors.Is(err, ErrRoomNotFound) {
+		s.aliasLookups.succeeded(ip)
+	}
+	return roomID, err
+}
+
+// roomLookupError resolveRoomID或getOrRelayRoom失敗時回覆client的錯誤與HTTP status
+// alias查詢次數過多時與密碼相同回覆tooManyAttempts，lobby房間回覆origin的URL，其餘視為房間不存在
+func roomLookupError(err error) (*admissionError, int) {
+	originErr := &roomOriginError{}
+	if errors.As(err, &originErr) {
+		return &admissionError{code: roomErrOnOrigin, reason: originErr.origin}, http.StatusTemporaryRedirect
+	}
+	if errors.Is(err, errAliasTooManyLookups) {
+		return &admissionError{code: passwordErrTooManyAttempts, reason: err.Error()}, http.StatusTooManyRequests
+	}
+	return &admissionError{code: roomErrNotFound, reason: err.Error()}, http.StatusNotFound
+}
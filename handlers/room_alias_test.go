@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReadableAlias(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z]+-[a-z]+-[1-9][0-9]{3}$`)
+	for i := 0; i < 100; i++ {
+		alias, err := readableAlias()
+		if err != nil {
+			t.Fatalf("readable alias: %v", err)
+		}
+		if !pattern.MatchString(alias) {
+			t.Fatalf("readable alias %q doesn't match %v", alias, pattern)
+		}
+		if _, err := normalizeAlias(alias); err != nil {
+			t.Fatalf("normalize readable alias %q: %v", alias, err)
+		}
+	}
+}
+
+func TestResolveAliasLookupLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.PasswordMaxAttempts = 3
+	config.PasswordAttemptWindow = time.Minute
+	s, err := NewSFU(WithConfig(config))
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	roomID := uuid.New()
+	if _, err := s.reserveAlias("team-sync", roomID); err != nil {
+		t.Fatalf("reserve alias: %v", err)
+	}
+
+	// 存在的alias不計入次數
+	for i := 0; i < config.PasswordMaxAttempts+1; i++ {
+		if id, err := s.resolveRoomID("team-sync", "10.0.0.1"); err != nil || id != roomID {
+			t.Fatalf("resolve alias = %v, %v, want %v", id, err, roomID)
+		}
+	}
+
+	for i := 0; i < config.PasswordMaxAttempts; i++ {
+		if _, err := s.resolveRoomID("brave-otter-4821", "10.0.0.1"); !errors.Is(err, ErrRoomNotFound) {
+			t.Fatalf("resolve unknown alias %d err = %v, want %v", i, err, ErrRoomNotFound)
+		}
+	}
+
+	// 達到上限後存在的alias也無法解析，UUID與其他IP不受影響
+	if _, err := s.resolveRoomID("team-sync", "10.0.0.1"); !errors.Is(err, errAliasTooManyLookups) {
+		t.Errorf("resolve alias after limit err = %v, want %v", err, errAliasTooManyLookups)
+	}
+	if id, err := s.resolveRoomID(roomID.String(), "10.0.0.1"); err != nil || id != roomID {
+		t.Errorf("resolve room ID after limit = %v, %v, want %v", id, err, roomID)
+	}
+	if id, err := s.resolveRoomID("team-sync", "10.0.0.2"); err != nil || id != roomID {
+		t.Errorf("resolve alias from other ip = %v, %v, want %v", id, err, roomID)
+	}
+}
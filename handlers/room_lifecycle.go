@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 排程房間的設定key，值為RFC3339時間
+const (
+	roomSettingStartTime = "startTime"
+	roomSettingEndTime   = "endTime"
+)
+
+// 會議結束的原因，roomEnding、roomEnded event的reason
+const (
+	roomEndScheduled   = "scheduledEnd"
+	roomEndMaxDuration = "maxDuration"
+)
+
+// admissionNotStarted 排程開始時間之前加入
+const admissionNotStarted = "roomNotStarted"
+
+const (
+	// closeRoomNotStarted 排程開始之前加入時的websocket close code
+	closeRoomNotStarted = 4004
+	// closeRoomEnded 會議結束時的websocket close code
+	closeRoomEnded = 4005
+)
+
+// roomEnding roomEnding與roomEnded event的payload
+type roomEnding struct {
+	EndTime time.Time `json:"endTime"`
+	Reason  string    `json:"reason"`
+}
+
+// roomSchedule 房間的排程，未設定時為zero time
+type roomSchedule struct {
+	start time.Time
+	end   time.Time
+}
+
+// schedule 從settings讀取排程
+func (r *ConferenceRoom) schedule() roomSchedule {
+	r.RLock()
+	defer r.RUnlock()
+
+	schedule := roomSchedule{}
+	schedule.start, _ = time.Parse(time.RFC3339Nano, r.settings[roomSettingStartTime])
+	schedule.end, _ = time.Parse(time.RFC3339Nano, r.settings[roomSettingEndTime])
+	return schedule
+}
+
+// checkStarted 排程開始時間之前回傳roomNotStarted
+func (r *ConferenceRoom) checkStarted() *admissionError {
+	if start := r.schedule().start; time.Now().Before(start) {
+		return &admissionError{
+			code:   admissionNotStarted,
+			reason: fmt.Sprintf("room %v starts at %s", r.RoomID, start.Format(time.RFC3339)),
+		}
+	}
+	return nil
+}
+
+// wakeLifecycle 參與者人數變化時重新檢查房間狀態
+func (r *ConferenceRoom) wakeLifecycle() {
+	select {
+	case r.lifecycleWake <- struct{}{}:
+	default:
+	}
+}
+
+// runLifecycle 房間的lifecycle，直到房間刪除或SFU Close
+// 沒有參與者超過EmptyRoomTimeout時刪除房間，排程開始前不計算
+// 到達排程結束時間或MaxRoomDuration時結束會議，結束前RoomEndWarning送出roomEnding
+func (r *ConferenceRoom) runLifecycle() {
+	schedule := r.schedule()
+	config := r.sfu.config
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	emptySince := time.Now()
+	var startedAt time.Time
+	warned := false
+
+	for {
+		select {
+		case <-r.sfu.closed:
+			return
+		case <-r.closed:
+			return
+		case <-r.lifecycleWake:
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		var next time.Time
+		wakeAt := func(t time.Time) {
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+
+		if r.participantCount() > 0 {
+			emptySince = time.Time{}
+			if startedAt.IsZero() {
+				startedAt = now
+			}
+		} else if emptySince.IsZero() {
+			emptySince = now
+		}
+
+		// 會議結束時間，MaxRoomDuration從第一個參與者加入開始計算
+		endAt, reason := schedule.end, roomEndScheduled
+		if max := config.MaxRoomDuration; max > 0 && !startedAt.IsZero() {
+			if limit := startedAt.Add(max); endAt.IsZero() || limit.Before(endAt) {
+				endAt, reason = limit, roomEndMaxDuration
+			}
+		}
+		if !endAt.IsZero() {
+			if !now.Before(endAt) {
+				r.sfu.log.Infof("room %v meeting ended: %s", r.RoomID, reason)
+				r.endMeeting(roomEnding{EndTime: endAt, Reason: reason})
+				return
+			}
+
+			warnAt := endAt.Add(-config.RoomEndWarning)
+			if !warned && config.RoomEndWarning > 0 {
+				if now.Before(warnAt) {
+					wakeAt(warnAt)
+				} else {
+					warned = true
+					r.broadcast("roomEnding", &roomEnding{EndTime: endAt, Reason: reason})
+				}
+			}
+			wakeAt(endAt)
+		}
+
+		if timeout := config.EmptyRoomTimeout; timeout > 0 && !emptySince.IsZero() {
+			from := emptySince
+			if schedule.start.After(from) {
+				from = schedule.start
+			}
+			expireAt := from.Add(timeout)
+			if !now.Before(expireAt) {
+				r.sfu.log.Infof("room %v empty for %v, deleted", r.RoomID, timeout)
+				r.close()
+				return
+			}
+			wakeAt(expireAt)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// broadcast 送出event給房間中所有參與者，等待resume中的參與者不會收到
+func (r *ConferenceRoom) broadcast(event string, payload interface{}) {
+	r.RLock()
+	negotiators := make([]*negotiator, 0, len(r.conns))
+	for i := range r.conns {
+		if r.conns[i].relayNode == "" {
+			negotiators = append(negotiators, r.conns[i].negotiator)
+		}
+	}
+	r.RUnlock()
+
+	for _, n := range negotiators {
+		if wsc := n.websocket(); wsc != nil {
+			if err := wsc.send(event, "", payload); err != nil {
+				r.sfu.log.Debugf("room %v broadcast %s error: %v", r.RoomID, event, err)
+			}
+		}
+	}
+}
+
+// endMeeting 通知參與者會議結束，中斷所有連線與電話後刪除房間
+func (r *ConferenceRoom) endMeeting(ending roomEnding) {
+	r.broadcast("roomEnded", &ending)
+
+	r.RLock()
+	conns := append([]clientConnectionState(nil), r.conns...)
+	calls := make([]*sipCall, 0, len(r.sipCalls))
+	for _, call := range r.sipCalls {
+		calls = append(calls, call)
+	}
+	r.RUnlock()
+
+	for i := range conns {
+		if wsc := conns[i].negotiator.websocket(); wsc != nil {
+			_ = wsc.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(closeRoomEnded, "roomEnded"),
+				time.Now().Add(time.Second))
+		}
+		if err := conns[i].peerConnection.Close(); err != nil {
+			r.sfu.log.Errorf("room %v close peerConnection error: %v", r.RoomID, err)
+		}
+	}
+	for _, call := range calls {
+		call.hangup(true)
+	}
+
+	r.close()
+}
+
+// close 從SFU移除房間並釋放資源，由runLifecycle呼叫一次
+func (r *ConferenceRoom) close() {
+	r.sfu.Lock()
+	delete(r.sfu.rooms, r.RoomID)
+	r.sfu.Unlock()
+
+	close(r.closed)
+	r.stopHLSEgress()
+
+	if r.origin == "" {
+		if err := r.sfu.store.DeleteRoom(r.RoomID); err != nil {
+			r.sfu.log.Errorf("room %v delete metadata error: %v", r.RoomID, err)
+		}
+
+		r.RLock()
+		alias := r.settings[roomSettingAlias]
+		r.RUnlock()
+		if alias != "" {
+			if err := r.sfu.store.DeleteAlias(alias); err != nil {
+				r.sfu.log.Errorf("room %v delete alias %s error: %v", r.RoomID, alias, err)
+			}
+		}
+	}
+
+	r.sfu.roomDeleted(r.RoomID)
+}
@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 房間密碼的設定key，只保存bcrypt hash
+const (
+	roomSettingPasswordHash = "passwordHash"
+	// roomSettingPasswordKind password或pin，room page顯示對應的輸入框
+	roomSettingPasswordKind = "passwordKind"
+)
+
+const (
+	passwordKindPassword = "password"
+	passwordKindPIN      = "pin"
+)
+
+// 密碼驗證失敗時回覆client的error code
+const (
+	passwordErrRequired        = "passwordRequired"
+	passwordErrInvalid         = "invalidPassword"
+	passwordErrTooManyAttempts = "tooManyAttempts"
+)
+
+const (
+	// closeInvalidPassword 未帶密碼或密碼錯誤時的websocket close code
+	closeInvalidPassword = 4006
+	// closeTooManyAttempts 同一個IP錯誤次數過多時的websocket close code
+	closeTooManyAttempts = 4029
+)
+
+// passwordMaxLength bcrypt只使用前72 bytes
+const passwordMaxLength = 72
+
+// hostTokenHeader 更新房間設定時帶上建立房間回傳的hostToken
+const hostTokenHeader = "X-Host-Token"
+
+const (
+	// roomPasswordHeader websocket帶上密碼或PIN的header，密碼不放在URL避免留在瀏覽器紀錄與access log
+	roomPasswordHeader = "X-Room-Password"
+	// roomAccessCookiePrefix 密碼表單驗證成功後設定的cookie，名稱後接room UUID
+	roomAccessCookiePrefix = "room-access-"
+	// roomHostCookiePrefix host以POST送出host token後設定的cookie，名稱後接room UUID
+	roomHostCookiePrefix = "room-host-"
+)
+
+var (
+	errPasswordInvalid = errors.New("password must be 1-72 bytes, pin must be 4-12 digits, only one of them can be set")
+	errNotHost         = errors.New("invalid host token")
+)
+
+var pinPattern = regexp.MustCompile(`^[0-9]{4,12}$`)
+
+// roomPassword 建立房間或更新密碼的body，兩者皆為空時移除密碼
+type roomPassword struct {
+	Password string `json:"password,omitempty"`
+	PIN      string `json:"pin,omitempty"`
+}
+
+// hash 回傳kind與bcrypt hash，兩者皆為空時回傳空字串
+func (p *roomPassword) hash() (kind, hash string, err error) {
+	secret := ""
+	switch {
+	case p.Password != "" && p.PIN != "":
+		return "", "", errPasswordInvalid
+	case p.Password != "":
+		if len(p.Password) > passwordMaxLength {
+			return "", "", errPasswordInvalid
+		}
+		kind, secret = passwordKindPassword, p.Password
+	case p.PIN != "":
+		if !pinPattern.MatchString(p.PIN) {
+			return "", "", errPasswordInvalid
+		}
+		kind, secret = passwordKindPIN, p.PIN
+	default:
+		return "", "", nil
+	}
+
+	b, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return kind, string(b), nil
+}
+
+// setPasswordSettings 將hash()的結果寫入settings，hash為空字串時移除密碼
+func setPasswordSettings(settings map[string]string, kind, hash string) {
+	if hash == "" {
+		delete(settings, roomSettingPasswordHash)
+		delete(settings, roomSettingPasswordKind)
+		return
+	}
+	settings[roomSettingPasswordHash] = hash
+	settings[roomSettingPasswordKind] = kind
+}
+
+// passwordKind 房間沒有密碼時回傳空字串
+func (r *ConferenceRoom) passwordKind() string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.settings[roomSettingPasswordHash] == "" {
+		return ""
+	}
+	return r.settings[roomSettingPasswordKind]
+}
+
+func (r *ConferenceRoom) matchPassword(password string) bool {
+	r.RLock()
+	hash := r.settings[roomSettingPasswordHash]
+	r.RUnlock()
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// accessToken 密碼表單驗證成功後cookie的值，以bcrypt hash為key對roomID做HMAC，密碼變更後舊cookie即失效
+func (r *ConferenceRoom) accessToken() string {
+	r.RLock()
+	hash := r.settings[roomSettingPasswordHash]
+	r.RUnlock()
+
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write([]byte(r.RoomID.String()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// passwordLimiter 每個key(房間與IP，或alias查詢的IP)在PasswordAttemptWindow內最多PasswordMaxAttempts次錯誤
+type passwordLimiter struct {
+	failures map[string]*passwordFailures
+
+	sync.Mutex
+}
+
+type passwordFailures struct {
+	count int
+	since time.Time
+}
+
+func newPasswordLimiter() *passwordLimiter {
+	return &passwordLimiter{failures: make(map[string]*passwordFailures)}
+}
+
+// attempt 在同一個lock中檢查key是否還可以嘗試並先記錄一次，超過上限時回傳false
+// 驗證前先記錄，並行的request無法在記錄錯誤之前全部通過檢查
+func (l *passwordLimiter) attempt(key string, max int, window time.Duration) bool {
+	if max <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	for k, f := range l.failures {
+		if now.Sub(f.since) >= window {
+			delete(l.failures, k)
+		}
+	}
+
+	f, ok := l.failures[key]
+	if !ok {
+		f = &passwordFailures{since: now}
+		l.failures[key] = f
+	}
+	if f.count >= max {
+		return false
+	}
+	f.count++
+	return true
+}
+
+// succeeded 驗證成功，退回attempt記錄的一次
+func (l *passwordLimiter) succeeded(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	f, ok := l.failures[key]
+	if !ok {
+		return
+	}
+	if f.count--; f.count <= 0 {
+		delete(l.failures, key)
+	}
+}
+
+// checkRoomPassword 房間有密碼時驗證password，ip用於限制錯誤次數
+func (s *SFU) checkRoomPassword(room *ConferenceRoom, ip, password string) *admissionError {
+	if room.passwordKind() == "" {
+		return nil
+	}
+	if password == "" {
+		return &admissionError{code: passwordErrRequired, reason: fmt.Sprintf("room %v requires %s", room.RoomID, room.passwordKind())}
+	}
+
+	// 以房間與IP計算，同一個IP對其他房間的錯誤不影響此房間
+	key := room.RoomID.String() + " " + ip
+	max, window := s.config.PasswordMaxAttempts, s.config.PasswordAttemptWindow
+	if !s.passwords.attempt(key, max, window) {
+		return &admissionError{code: passwordErrTooManyAttempts, reason: fmt.Sprintf("too many password attempts for room %v from %s", room.RoomID, ip)}
+	}
+	if !room.matchPassword(password) {
+		return &admissionError{code: passwordErrInvalid, reason: fmt.Sprintf("invalid %s for room %v", room.passwordKind(), room.RoomID)}
+	}
+	s.passwords.succeeded(key)
+	return nil
+}
+
+// checkRoomAccess 房間有密碼時接受密碼表單設定的cookie或X-Room-Password header
+func (s *SFU) checkRoomAccess(room *ConferenceRoom, r *http.Request) *admissionError {
+	if room.passwordKind() == "" {
+		return nil
+	}
+	if cookie, err := r.Cookie(roomAccessCookiePrefix + room.RoomID.String()); err == nil &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(room.accessToken())) == 1 {
+		return nil
+	}
+	return s.checkRoomPassword(room, s.requestIP(r), r.Header.Get(roomPasswordHeader))
+}
+
+// setRoomAccessCookie 密碼表單驗證成功後讓page與websocket不需再帶密碼
+func setRoomAccessCookie(w http.ResponseWriter, room *ConferenceRoom) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     roomAccessCookiePrefix + room.RoomID.String(),
+		Value:    room.accessToken(),
+		Path:     "/room/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// isHostRequest 帶X-Host-Token header或host cookie的request是否為房間的host
+func isHostRequest(room *ConferenceRoom, r *http.Request) bool {
+	if room.isHost(r.Header.Get(hostTokenHeader)) {
+		return true
+	}
+	cookie, err := r.Cookie(roomHostCookiePrefix + room.RoomID.String())
+	return err == nil && room.isHost(cookie.Value)
+}
+
+// setRoomHostCookie host token不放在URL，page與websocket以cookie帶上
+func setRoomHostCookie(w http.ResponseWriter, room *ConferenceRoom, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     roomHostCookiePrefix + room.RoomID.String(),
+		Value:    token,
+		Path:     "/room/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// UpdateRoomPassword 設定或移除房間密碼，需帶X-Host-Token header，body為 {"password": "..."} 或 {"pin": "1234"}，皆為空時移除
+// 只能在origin node更新，已建立的edge room沿用建立時的設定
+func (s *SFU) UpdateRoomPassword(w http.ResponseWriter, r *http.Request) {
+	room, err := s.getRoomFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if room.origin != "" {
+		http.Error(w, fmt.Sprintf("room %v origin is %s", room.RoomID, room.origin), http.StatusConflict)
+		return
+	}
+	if !s.checkHost(w, r, room) {
+		return
+	}
+
+	req := roomPassword{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("request body error: %v", err), http.StatusBadRequest)
+		return
+	}
+	kind, hash, err := req.hash()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	room.Lock()
+	setPasswordSettings(room.settings, kind, hash)
+	room.Unlock()
+	room.saveMetadata()
+
+	s.log.Infof("room %v password updated", room.RoomID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkHost 管理房間的API需帶X-Host-Token，設定ClusterSecret時也接受X-Cluster-Secret作為管理者憑證
+func (s *SFU) checkHost(w http.ResponseWriter, r *http.Request, room *ConferenceRoom) bool {
+	if room.isHost(r.Header.Get(hostTokenHeader)) {
+		return true
+	}
+	if secret := s.config.ClusterSecret; secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(clusterSecretHeader)), []byte(secret)) == 1 {
+		return true
+	}
+	http.Error(w, errNotHost.Error(), http.StatusForbidden)
+	return false
+}
+
+// passwordPage 房間需要密碼時RoomPage顯示的表單，以POST送出，驗證成功後設定cookie並重新載入
+const passwordPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Password required</title></head>
+<body>
+  <form method="POST">
+    <p>%s</p>
+    <input type="password" name="password" %s autofocus required>
+    <button type="submit">Join</button>
+  </form>
+</body>
+</html>
+`
+
+// writePasswordPage 依驗證結果回覆401或429
+func writePasswordPage(w http.ResponseWriter, kind string, err *admissionError) {
+	status, message := http.StatusUnauthorized, "This meeting requires a password."
+	switch err.code {
+	case passwordErrInvalid:
+		message = "Incorrect password, please try again."
+	case passwordErrTooManyAttempts:
+		status, message = http.StatusTooManyRequests, "Too many attempts, please try again later."
+	}
+
+	input := ""
+	if kind == passwordKindPIN {
+		input = `inputmode="numeric" pattern="[0-9]*" placeholder="PIN"`
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, passwordPage, message, input)
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckRoomPasswordConcurrentAttempts(t *testing.T) {
+	config := DefaultConfig()
+	config.PasswordMaxAttempts = 3
+	config.PasswordAttemptWindow = time.Minute
+	s, err := NewSFU(WithConfig(config))
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	room, ok := s.getRoom(createTestRoom(t, s, `{"pin": "1234"}`))
+	if !ok {
+		t.Fatalf("room not found")
+	}
+
+	// 並行送出錯誤的PIN，只有PasswordMaxAttempts個會執行bcrypt並回傳invalidPassword
+	const guesses = 20
+	codes := make(chan string, guesses)
+	wg := sync.WaitGroup{}
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.checkRoomPassword(room, "10.0.0.1", "0000"); err != nil {
+				codes <- err.code
+			}
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	count := map[string]int{}
+	for code := range codes {
+		count[code]++
+	}
+	if count[passwordErrInvalid] != config.PasswordMaxAttempts || count[passwordErrTooManyAttempts] != guesses-config.PasswordMaxAttempts {
+		t.Errorf("parallel wrong guesses = %v, want %d %s", count, config.PasswordMaxAttempts, passwordErrInvalid)
+	}
+	if err := s.checkRoomPassword(room, "10.0.0.1", "1234"); err == nil || err.code != passwordErrTooManyAttempts {
+		t.Errorf("correct pin after limit err = %v, want %s", err, passwordErrTooManyAttempts)
+	}
+
+	// 錯誤次數以房間與IP計算，同一個IP仍可以加入其他房間
+	other, ok := s.getRoom(createTestRoom(t, s, `{"pin": "5678"}`))
+	if !ok {
+		t.Fatalf("room not found")
+	}
+	if err := s.checkRoomPassword(other, "10.0.0.1", "5678"); err != nil {
+		t.Errorf("other room from limited ip err = %v", err)
+	}
+
+	// 驗證成功退回次數，正確的PIN不會用完上限
+	for i := 0; i < config.PasswordMaxAttempts+1; i++ {
+		if err := s.checkRoomPassword(room, "10.0.0.2", "1234"); err != nil {
+			t.Fatalf("correct pin %d err = %v", i, err)
+		}
+	}
+}
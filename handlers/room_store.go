@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	participantKindWebRTC = "webrtc"
+	participantKindSIP    = "sip"
+)
+
+// RoomStore回傳的error，自行實作的store需回傳相同的error
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrAliasTaken   = errors.New("room alias already taken")
+)
+
+// RoomMetadata 房間的metadata，存於RoomStore，多個instance共用store時可看到其他instance的房間
+type RoomMetadata struct {
+	RoomID      uuid.UUID         `json:"roomID"`
+	CreatedTime time.Time         `json:"createdTime"`
+	Settings    map[string]string `json:"settings,omitempty"`
+
+	// Node 房間所在(origin)的node URL，未啟用cluster時為空字串
+	Node string `json:"node,omitempty"`
+}
+
+// RoomParticipant 房間參與者，Node為參與者所連線的node，Kind為webrtc或sip
+type RoomParticipant struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	Node string `json:"node,omitempty"`
+}
+
+func (m *RoomMetadata) roomInfo(domain string) roomInfomation {
+	// 有alias時URL使用alias
+	path := m.RoomID.String()
+	if alias := m.Settings[roomSettingAlias]; alias != "" {
+		path = alias
+	}
+
+	info := roomInfomation{
+		RoomID:           m.RoomID,
+		Alias:            m.Settings[roomSettingAlias],
+		RoomURL:          fmt.Sprintf("https://%s/room/%s", domain, path),
+		RoomWebSocketURL: fmt.Sprintf("wss://%s/room/%s/webSocket", domain, path),
+		CreatedTime:      m.CreatedTime,
+	}
+	if t, err := time.Parse(time.RFC3339Nano, m.Settings[roomSettingStartTime]); err == nil {
+		info.StartTime = &t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, m.Settings[roomSettingEndTime]); err == nil {
+		info.EndTime = &t
+	}
+	return info
+}
+
+// RoomStore 房間metadata的儲存，找不到房間時回傳ErrRoomNotFound
+// 以NewMemoryRoomStore、NewRedisRoomStore建立或自行實作，交給WithStore使用，method需可同時呼叫
+type RoomStore interface {
+	SaveRoom(meta *RoomMetadata) error
+	GetRoom(roomID uuid.UUID) (*RoomMetadata, error)
+	// DeleteRoom 一併刪除房間的參與者
+	DeleteRoom(roomID uuid.UUID) error
+	// ListRooms 依建立時間排序
+	ListRooms() ([]*RoomMetadata, error)
+
+	// SaveAlias alias已被使用時回傳ErrAliasTaken
+	SaveAlias(alias string, roomID uuid.UUID) error
+	// GetAlias 找不到alias時回傳ErrRoomNotFound
+	GetAlias(alias string) (uuid.UUID, error)
+	DeleteAlias(alias string) error
+
+	AddParticipant(roomID uuid.UUID, p RoomParticipant) error
+	RemoveParticipant(roomID uuid.UUID, participantID string) error
+	ListParticipants(roomID uuid.UUID) ([]RoomParticipant, error)
+
+	// TouchRoom 房間仍在owner node上，ttl內沒有再次touch時由ExpireRooms刪除
+	TouchRoom(roomID uuid.UUID, ttl time.Duration) error
+	// ExpireRooms 刪除已過期的房間及其參與者、alias，回傳被刪除的房間
+	ExpireRooms() ([]uuid.UUID, error)
+
+	// Changes 其他instance的房間變更通知，只有本instance的store回傳nil
+	Changes() <-chan string
+	Close() error
+}
+
+// memoryRoomStore process內的store，process結束時metadata一併消失
+type memoryRoomStore struct {
+	rooms        map[uuid.UUID]*RoomMetadata
+	participants map[uuid.UUID]map[string]RoomParticipant
+	aliases      map[string]uuid.UUID
+	expires      map[uuid.UUID]time.Time
+
+	sync.RWMutex
+}
+
+// NewMemoryRoomStore process內的store
+func NewMemoryRoomStore() RoomStore {
+	return newMemoryRoomStore()
+}
+
+func newMemoryRoomStore() *memoryRoomStore {
+	return &memoryRoomStore{
+		rooms:        make(map[uuid.UUID]*RoomMetadata),
+		participants: make(map[uuid.UUID]map[string]RoomParticipant),
+		aliases:      make(map[string]uuid.UUID),
+		expires:      make(map[uuid.UUID]time.Time),
+	}
+}
+
+func (s *memoryRoomStore) SaveRoom(meta *RoomMetadata) error {
+	s.Lock()
+	defer s.Unlock()
+
+	m := *meta
+	s.rooms[meta.RoomID] = &m
+	return nil
+}
+
+func (s *memoryRoomStore) GetRoom(roomID uuid.UUID) (*RoomMetadata, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	meta, ok := s.rooms[roomID]
+	if !ok {
+		return nil, ErrRoomNotFound
+	}
+	m := *meta
+	return &m, nil
+}
+
+func (s *memoryRoomStore) DeleteRoom(roomID uuid.UUID) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.rooms, roomID)
+	delete(s.participants, roomID)
+	delete(s.expires, roomID)
+	return nil
+}
+
+func (s *memoryRoomStore) ListRooms() ([]*RoomMetadata, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	rooms := make([]*RoomMetadata, 0, len(s.rooms))
+	for _, meta := range s.rooms {
+		m := *meta
+		rooms = append(rooms, &m)
+	}
+	sortRoomMetadata(rooms)
+	return rooms, nil
+}
+
+func (s *memoryRoomStore) SaveAlias(alias string, roomID uuid.UUID) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.aliases[alias]; ok {
+		return ErrAliasTaken
+	}
+	s.aliases[alias] = roomID
+	return nil
+}
+
+func (s *memoryRoomStore) GetAlias(alias string) (uuid.UUID, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	roomID, ok := s.aliases[alias]
+	if !ok {
+		return uuid.Nil, ErrRoomNotFound
+	}
+	return roomID, nil
+}
+
+func (s *memoryRoomStore) DeleteAlias(alias string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.aliases, alias)
+	return nil
+}
+
+func (s *memoryRoomStore) AddParticipant(roomID uuid.UUID, p RoomParticipant) error {
+	s.Lock()
+	defer s.Unlock()
+
+	participants, ok := s.participants[roomID]
+	if !ok {
+		participants = make(map[string]RoomParticipant)
+		s.participants[roomID] = participants
+	}
+	participants[p.ID] = p
+	return nil
+}
+
+func (s *memoryRoomStore) RemoveParticipant(roomID uuid.UUID, participantID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.participants[roomID], participantID)
+	return nil
+}
+
+func (s *memoryRoomStore) ListParticipants(roomID uuid.UUID) ([]RoomParticipant, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	participants := make([]RoomParticipant, 0, len(s.participants[roomID]))
+	for _, p := range s.participants[roomID] {
+		participants = append(participants, p)
+	}
+	return participants, nil
+}
+
+func (s *memoryRoomStore) TouchRoom(roomID uuid.UUID, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.rooms[roomID]; ok {
+		s.expires[roomID] = time.Now().Add(ttl)
+	}
+	return nil
+}
+
+func (s *memoryRoomStore) ExpireRooms() ([]uuid.UUID, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	expired := []uuid.UUID{}
+	now := time.Now()
+	for roomID, expire := range s.expires {
+		if expire.After(now) {
+			continue
+		}
+		if meta, ok := s.rooms[roomID]; ok {
+			if alias := meta.Settings[roomSettingAlias]; alias != "" && s.aliases[alias] == roomID {
+				delete(s.aliases, alias)
+			}
+		}
+		delete(s.rooms, roomID)
+		delete(s.participants, roomID)
+		delete(s.expires, roomID)
+		expired = append(expired, roomID)
+	}
+	return expired, nil
+}
+
+func (s *memoryRoomStore) Changes() <-chan string {
+	return nil
+}
+
+func (s *memoryRoomStore) Close() error {
+	return nil
+}
+
+func sortRoomMetadata(rooms []*RoomMetadata) {
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].CreatedTime.Before(rooms[j].CreatedTime)
+	})
+}
+
+// removeStaleParticipants instance重啟後，清除store中上次執行時留下的本node參與者
+// 共用store時NodeURL不可為空字串(見NewSFU)，否則會刪除其他instance的參與者
+func (s *SFU) removeStaleParticipants() error {
+	rooms, err := s.store.ListRooms()
+	if err != nil {
+		return err
+	}
+
+	for _, meta := range rooms {
+		participants, err := s.store.ListParticipants(meta.RoomID)
+		if err != nil {
+			return err
+		}
+		for _, p := range participants {
+			if p.Node != s.config.NodeURL {
+				continue
+			}
+			if err := s.store.RemoveParticipant(meta.RoomID, p.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refreshRooms 定期touch此node的房間，並刪除owner node已停止的房間
+func (s *SFU) refreshRooms() {
+	ticker := time.NewTicker(s.config.RoomStoreTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.RLock()
+		rooms := make([]uuid.UUID, 0, len(s.rooms))
+		for id, room := range s.rooms {
+			// edge room的metadata由origin node更新
+			if room.origin == "" {
+				rooms = append(rooms, id)
+			}
+		}
+		s.RUnlock()
+
+		for _, id := range rooms {
+			if err := s.store.TouchRoom(id, s.config.RoomStoreTTL); err != nil {
+				s.log.Errorf("room %v touch metadata error: %v", id, err)
+			}
+		}
+		s.expireRooms()
+	}
+}
+
+// expireRooms 刪除store中過期的房間，通常是owner node已停止或重啟後沒有再使用的房間
+func (s *SFU) expireRooms() {
+	expired, err := s.store.ExpireRooms()
+	if err != nil {
+		s.log.Errorf("room store expire rooms error: %v", err)
+		return
+	}
+	for _, id := range expired {
+		s.log.Infof("room %v metadata expired", id)
+		s.signaling.update(fmt.Sprintf("room ID %s expired", id.String()))
+	}
+}
+
+// metadata 目前房間的metadata
+func (r *ConferenceRoom) metadata() *RoomMetadata {
+	r.RLock()
+	defer r.RUnlock()
+
+	node := r.origin
+	if node == "" {
+		node = r.sfu.config.NodeURL
+	}
+
+	settings := make(map[string]string, len(r.settings))
+	for k, v := range r.settings {
+		settings[k] = v
+	}
+
+	return &RoomMetadata{
+		RoomID:      r.RoomID,
+		CreatedTime: r.createdTime,
+		Settings:    settings,
+		Node:        node,
+	}
+}
+
+// saveMetadata 寫入store，store失敗不影響房間本身
+func (r *ConferenceRoom) saveMetadata() {
+	if err := r.sfu.store.SaveRoom(r.metadata()); err != nil {
+		r.sfu.log.Errorf("room %v save metadata error: %v", r.RoomID, err)
+		return
+	}
+
+	if ttl := r.sfu.config.RoomStoreTTL; ttl > 0 {
+		if err := r.sfu.store.TouchRoom(r.RoomID, ttl); err != nil {
+			r.sfu.log.Errorf("room %v touch metadata error: %v", r.RoomID, err)
+		}
+	}
+}
+
+func (r *ConferenceRoom) addParticipant(id, kind string) {
+	if err := r.sfu.store.AddParticipant(r.RoomID, RoomParticipant{
+		ID:   id,
+		Kind: kind,
+		Node: r.sfu.config.NodeURL,
+	}); err != nil {
+		r.sfu.log.Errorf("room %v add participant %s error: %v", r.RoomID, id, err)
+	}
+	r.wakeLifecycle()
+
+	if r.sfu.hooks.OnParticipantJoined != nil {
+		r.sfu.hooks.OnParticipantJoined(r.RoomID, id)
+	}
+}
+
+func (r *ConferenceRoom) removeParticipant(id string) {
+	if err := r.sfu.store.RemoveParticipant(r.RoomID, id); err != nil {
+		r.sfu.log.Errorf("room %v remove participant %s error: %v", r.RoomID, id, err)
+	}
+	r.wakeLifecycle()
+
+	if r.sfu.hooks.OnParticipantLeft != nil {
+		r.sfu.hooks.OnParticipantLeft(r.RoomID, id)
+	}
+}
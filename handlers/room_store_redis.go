@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	redisRoomsKey         = "sfu:rooms"
+	redisParticipantsKey  = "sfu:room:%s:participants"
+	redisAliasesKey       = "sfu:aliases"
+	redisExpiresKey       = "sfu:rooms:expires"
+	redisChangesChannel   = "sfu:rooms:changes"
+	redisOperationTimeout = 3 * time.Second
+)
+
+// redisChange pub/sub訊息，instance為發送者，用來忽略自己發出的變更
+type redisChange struct {
+	Instance string `json:"instance"`
+	Message  string `json:"message"`
+}
+
+// redisRoomStore 多個instance共用的store
+// sfu:rooms hash roomID -> metadata json，sfu:room:{id}:participants hash participantID -> participant json
+// sfu:aliases hash alias -> roomID
+// sfu:rooms:expires sorted set roomID -> 過期時間(unix ms)，hash field無法設定TTL，由ExpireRooms刪除過期的房間
+// metadata的settings只保存host token的SHA-256與密碼的bcrypt hash，能寫入Redis即可改寫房間設定，Redis只應開放給SFU instance
+type redisRoomStore struct {
+	client   *redis.Client
+	instance string
+	log      Logger
+
+	pubsub  *redis.PubSub
+	changed chan string
+}
+
+func newRedisRoomStore(addr, password string, db int, log Logger) (*redisRoomStore, error) {
+	if log == nil {
+		log = defaultLogger{}
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	s := &redisRoomStore{
+		client:   client,
+		instance: uuid.NewString(),
+		log:      log,
+		pubsub:   client.Subscribe(context.Background(), redisChangesChannel),
+		changed:  make(chan string, 10),
+	}
+	go s.receiveChanges()
+
+	return s, nil
+}
+
+func (s *redisRoomStore) receiveChanges() {
+	defer close(s.changed)
+
+	for msg := range s.pubsub.Channel() {
+		change := redisChange{}
+		if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+			s.log.Errorf("redis room store change json parse error: %v", err)
+			continue
+		}
+		if change.Instance == s.instance {
+			continue
+		}
+
+		s.changed <- change.Message
+	}
+}
+
+// publish 通知其他instance，失敗不影響store的寫入
+func (s *redisRoomStore) publish(ctx context.Context, message string) {
+	data, err := json.Marshal(&redisChange{
+		Instance: s.instance,
+		Message:  message,
+	})
+	if err != nil {
+		s.log.Errorf("redis room store change json encode error: %v", err)
+		return
+	}
+
+	if err := s.client.Publish(ctx, redisChangesChannel, data).Err(); err != nil {
+		s.log.Errorf("redis room store publish error: %v", err)
+	}
+}
+
+func (s *redisRoomStore) SaveRoom(meta *RoomMetadata) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.HSet(ctx, redisRoomsKey, meta.RoomID.String(), data).Err(); err != nil {
+		return err
+	}
+
+	s.publish(ctx, fmt.Sprintf("room ID %s saved", meta.RoomID.String()))
+	return nil
+}
+
+func (s *redisRoomStore) GetRoom(roomID uuid.UUID) (*RoomMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	data, err := s.client.HGet(ctx, redisRoomsKey, roomID.String()).Bytes()
+	if err == redis.Nil {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &RoomMetadata{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *redisRoomStore) DeleteRoom(roomID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	pipe.HDel(ctx, redisRoomsKey, roomID.String())
+	pipe.Del(ctx, fmt.Sprintf(redisParticipantsKey, roomID.String()))
+	pipe.ZRem(ctx, redisExpiresKey, roomID.String())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	s.publish(ctx, fmt.Sprintf("room ID %s deleted", roomID.String()))
+	return nil
+}
+
+func (s *redisRoomStore) ListRooms() ([]*RoomMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	values, err := s.client.HGetAll(ctx, redisRoomsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := make([]*RoomMetadata, 0, len(values))
+	for id, data := range values {
+		meta := &RoomMetadata{}
+		if err := json.Unmarshal([]byte(data), meta); err != nil {
+			s.log.Errorf("redis room store room %s metadata json parse error: %v", id, err)
+			continue
+		}
+		rooms = append(rooms, meta)
+	}
+	sortRoomMetadata(rooms)
+	return rooms, nil
+}
+
+func (s *redisRoomStore) SaveAlias(alias string, roomID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	ok, err := s.client.HSetNX(ctx, redisAliasesKey, alias, roomID.String()).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAliasTaken
+	}
+	return nil
+}
+
+func (s *redisRoomStore) GetAlias(alias string) (uuid.UUID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	id, err := s.client.HGet(ctx, redisAliasesKey, alias).Result()
+	if err == redis.Nil {
+		return uuid.Nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.Parse(id)
+}
+
+func (s *redisRoomStore) DeleteAlias(alias string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	return s.client.HDel(ctx, redisAliasesKey, alias).Err()
+}
+
+func (s *redisRoomStore) AddParticipant(roomID uuid.UUID, p RoomParticipant) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.HSet(ctx, fmt.Sprintf(redisParticipantsKey, roomID.String()), p.ID, data).Err(); err != nil {
+		return err
+	}
+
+	s.publish(ctx, fmt.Sprintf("room ID %s participant %s joined", roomID.String(), p.ID))
+	return nil
+}
+
+func (s *redisRoomStore) RemoveParticipant(roomID uuid.UUID, participantID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	if err := s.client.HDel(ctx, fmt.Sprintf(redisParticipantsKey, roomID.String()), participantID).Err(); err != nil {
+		return err
+	}
+
+	s.publish(ctx, fmt.Sprintf("room ID %s participant %s left", roomID.String(), participantID))
+	return nil
+}
+
+func (s *redisRoomStore) ListParticipants(roomID uuid.UUID) ([]RoomParticipant, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	values, err := s.client.HGetAll(ctx, fmt.Sprintf(redisParticipantsKey, roomID.String())).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make([]RoomParticipant, 0, len(values))
+	for id, data := range values {
+		p := RoomParticipant{}
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			s.log.Errorf("redis room store participant %s json parse error: %v", id, err)
+			continue
+		}
+		participants = append(participants, p)
+	}
+	return participants, nil
+}
+
+// TouchRoom 參與者key同時設定TTL，owner node停止後即使沒有instance執行ExpireRooms也會消失
+func (s *redisRoomStore) TouchRoom(roomID uuid.UUID, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	pipe.ZAdd(ctx, redisExpiresKey, &redis.Z{
+		Score:  float64(time.Now().Add(ttl).UnixMilli()),
+		Member: roomID.String(),
+	})
+	pipe.PExpire(ctx, fmt.Sprintf(redisParticipantsKey, roomID.String()), ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisRoomStore) ExpireRooms() ([]uuid.UUID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	ids, err := s.client.ZRangeByScore(ctx, redisExpiresKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	expired := []uuid.UUID{}
+	for _, id := range ids {
+		roomID, err := uuid.Parse(id)
+		if err != nil {
+			s.log.Errorf("redis room store expires invalid room ID %q", id)
+			s.client.ZRem(ctx, redisExpiresKey, id)
+			continue
+		}
+
+		ok, err := s.expireRoom(ctx, roomID)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			expired = append(expired, roomID)
+			s.publish(ctx, fmt.Sprintf("room ID %s expired", id))
+		}
+	}
+	return expired, nil
+}
+
+// expireRoom 房間仍過期時刪除，期間owner node touch或其他instance已刪除時回傳false
+func (s *redisRoomStore) expireRoom(ctx context.Context, roomID uuid.UUID) (bool, error) {
+	id := roomID.String()
+	expired := false
+
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		score, err := tx.ZScore(ctx, redisExpiresKey, id).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if int64(score) > time.Now().UnixMilli() {
+			return nil
+		}
+
+		// alias已被其他房間使用時保留
+		alias := ""
+		if data, err := tx.HGet(ctx, redisRoomsKey, id).Bytes(); err == nil {
+			meta := &RoomMetadata{}
+			if err := json.Unmarshal(data, meta); err == nil {
+				alias = meta.Settings[roomSettingAlias]
+			}
+		}
+		if alias != "" {
+			if owner, err := tx.HGet(ctx, redisAliasesKey, alias).Result(); err != nil || owner != id {
+				alias = ""
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, redisRoomsKey, id)
+			pipe.Del(ctx, fmt.Sprintf(redisParticipantsKey, id))
+			pipe.ZRem(ctx, redisExpiresKey, id)
+			if alias != "" {
+				pipe.HDel(ctx, redisAliasesKey, alias)
+			}
+			return nil
+		})
+		if err == nil {
+			expired = true
+		}
+		return err
+	}, redisExpiresKey, redisRoomsKey, redisAliasesKey)
+
+	if err == redis.TxFailedErr {
+		// 其他instance同時修改，下一次ExpireRooms再處理
+		return false, nil
+	}
+	return expired, err
+}
+
+func (s *redisRoomStore) Changes() <-chan string {
+	return s.changed
+}
+
+func (s *redisRoomStore) Close() error {
+	if err := s.pubsub.Close(); err != nil {
+		s.log.Errorf("redis room store pubsub close error: %v", err)
+	}
+	return s.client.Close()
+}
+
+// NewRedisRoomStore 房間metadata存於Redis，多個instance可以看到彼此的房間，重啟後房間metadata仍存在
+// log通常與WithLogger相同，nil時使用package的zerolog Log
+func NewRedisRoomStore(addr, password string, db int, log Logger) (RoomStore, error) {
+	return newRedisRoomStore(addr, password, db, log)
+}
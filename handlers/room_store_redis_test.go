@@ -0,0 +1,381 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+)
+
+func newTestRedisStore(t *testing.T, m *miniredis.Miniredis) *redisRoomStore {
+	t.Helper()
+
+	s, err := newRedisRoomStore(m.Addr(), "", 0, nil)
+	if err != nil {
+		t.Fatalf("new redis room store: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestRedisRoomStoreRooms(t *testing.T) {
+	s := newTestRedisStore(t, miniredis.RunT(t))
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	older := &RoomMetadata{RoomID: uuid.New(), CreatedTime: now.Add(-time.Minute), Settings: map[string]string{roomSettingLobby: "true"}, Node: "node-a"}
+	newer := &RoomMetadata{RoomID: uuid.New(), CreatedTime: now}
+	for _, meta := range []*RoomMetadata{newer, older} {
+		if err := s.SaveRoom(meta); err != nil {
+			t.Fatalf("save room: %v", err)
+		}
+	}
+
+	got, err := s.GetRoom(older.RoomID)
+	if err != nil {
+		t.Fatalf("get room: %v", err)
+	}
+	if !reflect.DeepEqual(got, older) {
+		t.Errorf("get room = %+v, want %+v", got, older)
+	}
+
+	rooms, err := s.ListRooms()
+	if err != nil {
+		t.Fatalf("list rooms: %v", err)
+	}
+	if len(rooms) != 2 || rooms[0].RoomID != older.RoomID || rooms[1].RoomID != newer.RoomID {
+		t.Errorf("list rooms not sorted by created time: %+v", rooms)
+	}
+
+	if err := s.DeleteRoom(older.RoomID); err != nil {
+		t.Fatalf("delete room: %v", err)
+	}
+	if _, err := s.GetRoom(older.RoomID); err != ErrRoomNotFound {
+		t.Errorf("get deleted room err = %v, want %v", err, ErrRoomNotFound)
+	}
+}
+
+func TestRedisRoomStoreAliases(t *testing.T) {
+	s := newTestRedisStore(t, miniredis.RunT(t))
+	first, second := uuid.New(), uuid.New()
+
+	if err := s.SaveAlias("daily-standup", first); err != nil {
+		t.Fatalf("save alias: %v", err)
+	}
+	if err := s.SaveAlias("daily-standup", second); err != ErrAliasTaken {
+		t.Errorf("save taken alias err = %v, want %v", err, ErrAliasTaken)
+	}
+	if id, err := s.GetAlias("daily-standup"); err != nil || id != first {
+		t.Errorf("get alias = %v, %v, want %v", id, err, first)
+	}
+	if _, err := s.GetAlias("unknown"); err != ErrRoomNotFound {
+		t.Errorf("get unknown alias err = %v, want %v", err, ErrRoomNotFound)
+	}
+
+	// 房間刪除後alias可以重新使用
+	if err := s.DeleteAlias("daily-standup"); err != nil {
+		t.Fatalf("delete alias: %v", err)
+	}
+	if err := s.SaveAlias("daily-standup", second); err != nil {
+		t.Errorf("save released alias: %v", err)
+	}
+}
+
+func TestRedisRoomStoreParticipants(t *testing.T) {
+	m := miniredis.RunT(t)
+	s := newTestRedisStore(t, m)
+	meta := &RoomMetadata{RoomID: uuid.New(), CreatedTime: time.Now()}
+	if err := s.SaveRoom(meta); err != nil {
+		t.Fatalf("save room: %v", err)
+	}
+
+	participants := []RoomParticipant{
+		{ID: "a", Kind: participantKindWebRTC, Node: "node-a"},
+		{ID: "b", Kind: participantKindSIP, Node: "node-b"},
+		{ID: "c", Kind: participantKindWebRTC, Node: "node-a"},
+	}
+	for _, p := range participants {
+		if err := s.AddParticipant(meta.RoomID, p); err != nil {
+			t.Fatalf("add participant: %v", err)
+		}
+	}
+	if err := s.RemoveParticipant(meta.RoomID, "c"); err != nil {
+		t.Fatalf("remove participant: %v", err)
+	}
+
+	ids := func() []string {
+		t.Helper()
+
+		list, err := s.ListParticipants(meta.RoomID)
+		if err != nil {
+			t.Fatalf("list participants: %v", err)
+		}
+		ids := []string{}
+		for _, p := range list {
+			ids = append(ids, p.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	if got := ids(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("participants = %v, want [a b]", got)
+	}
+
+	// node-a重啟後只清除node-a留下的參與者
+	config := DefaultConfig()
+	config.NodeURL = "node-a"
+	config.ClusterSecret = "cluster-secret"
+	if _, err := NewSFU(WithConfig(config), WithStore(newTestRedisStore(t, m))); err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	if got := ids(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("participants after restart = %v, want [b]", got)
+	}
+
+	if err := s.DeleteRoom(meta.RoomID); err != nil {
+		t.Fatalf("delete room: %v", err)
+	}
+	if got := ids(); len(got) != 0 {
+		t.Errorf("participants after delete = %v, want none", got)
+	}
+}
+
+func TestRedisRoomStoreChanges(t *testing.T) {
+	m := miniredis.RunT(t)
+	a, b := newTestRedisStore(t, m), newTestRedisStore(t, m)
+	roomID := uuid.New()
+
+	if err := a.SaveRoom(&RoomMetadata{RoomID: roomID, CreatedTime: time.Now()}); err != nil {
+		t.Fatalf("save room: %v", err)
+	}
+
+	select {
+	case message := <-b.Changes():
+		if !strings.Contains(message, roomID.String()) {
+			t.Errorf("change = %q, want room ID %s", message, roomID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("other instance received no change")
+	}
+
+	// 自己發出的變更不會通知自己
+	select {
+	case message := <-a.Changes():
+		t.Errorf("instance received its own change %q", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRedisRoomStoreHostToken(t *testing.T) {
+	m := miniredis.RunT(t)
+	store := newTestRedisStore(t, m)
+	config := DefaultConfig()
+	config.NodeURL = "node-a"
+	config.ClusterSecret = "cluster-secret"
+	s, err := NewSFU(WithConfig(config), WithStore(store))
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.CreateRoom(w, httptest.NewRequest(http.MethodPost, "/create/room", strings.NewReader(`{"password": "secret"}`)))
+	info := createRoomResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil || info.HostToken == "" {
+		t.Fatalf("create room: %v, %s", err, w.Body.String())
+	}
+
+	data := m.HGet(redisRoomsKey, info.RoomID.String())
+	if data == "" {
+		t.Fatalf("room %v not in redis", info.RoomID)
+	}
+	for _, secret := range []string{info.HostToken, "secret"} {
+		if strings.Contains(data, secret) {
+			t.Errorf("redis metadata contains %q: %s", secret, data)
+		}
+	}
+
+	room, ok := s.getRoom(info.RoomID)
+	if !ok {
+		t.Fatalf("room %v not found", info.RoomID)
+	}
+	if !room.isHost(info.HostToken) || room.isHost(hashHostToken(info.HostToken)) {
+		t.Errorf("host token check failed")
+	}
+}
+
+func TestRoomStoreExpireRooms(t *testing.T) {
+	stores := []struct {
+		name  string
+		store func(t *testing.T) RoomStore
+	}{
+		{name: "memory", store: func(t *testing.T) RoomStore { return newMemoryRoomStore() }},
+		{name: "redis", store: func(t *testing.T) RoomStore { return newTestRedisStore(t, miniredis.RunT(t)) }},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			s := test.store(t)
+
+			expired := &RoomMetadata{RoomID: uuid.New(), Settings: map[string]string{roomSettingAlias: "expired"}}
+			alive := &RoomMetadata{RoomID: uuid.New(), Settings: map[string]string{roomSettingAlias: "alive"}}
+			// 過期房間的alias已被alive以外的房間重新使用
+			reused := &RoomMetadata{RoomID: uuid.New(), Settings: map[string]string{roomSettingAlias: "reused"}}
+			untouched := &RoomMetadata{RoomID: uuid.New()}
+			for _, meta := range []*RoomMetadata{expired, alive, reused, untouched} {
+				if err := s.SaveRoom(meta); err != nil {
+					t.Fatalf("save room: %v", err)
+				}
+				if err := s.AddParticipant(meta.RoomID, RoomParticipant{ID: "p", Kind: participantKindWebRTC}); err != nil {
+					t.Fatalf("add participant: %v", err)
+				}
+			}
+			aliases := map[string]uuid.UUID{"expired": expired.RoomID, "alive": alive.RoomID, "reused": alive.RoomID}
+			for alias, roomID := range aliases {
+				if err := s.SaveAlias(alias, roomID); err != nil {
+					t.Fatalf("save alias: %v", err)
+				}
+			}
+
+			for _, meta := range []*RoomMetadata{expired, reused} {
+				if err := s.TouchRoom(meta.RoomID, time.Millisecond); err != nil {
+					t.Fatalf("touch room: %v", err)
+				}
+			}
+			if err := s.TouchRoom(alive.RoomID, time.Hour); err != nil {
+				t.Fatalf("touch room: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			ids, err := s.ExpireRooms()
+			if err != nil {
+				t.Fatalf("expire rooms: %v", err)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+			want := []uuid.UUID{expired.RoomID, reused.RoomID}
+			sort.Slice(want, func(i, j int) bool { return want[i].String() < want[j].String() })
+			if !reflect.DeepEqual(ids, want) {
+				t.Errorf("expired rooms = %v, want %v", ids, want)
+			}
+
+			for _, meta := range []*RoomMetadata{expired, reused} {
+				if _, err := s.GetRoom(meta.RoomID); err != ErrRoomNotFound {
+					t.Errorf("get expired room err = %v, want %v", err, ErrRoomNotFound)
+				}
+				if list, err := s.ListParticipants(meta.RoomID); err != nil || len(list) != 0 {
+					t.Errorf("expired room participants = %v, %v, want none", list, err)
+				}
+			}
+			for _, meta := range []*RoomMetadata{alive, untouched} {
+				if _, err := s.GetRoom(meta.RoomID); err != nil {
+					t.Errorf("get room %v: %v", meta.RoomID, err)
+				}
+			}
+
+			for alias, wantErr := range map[string]error{"expired": ErrRoomNotFound, "alive": nil, "reused": nil} {
+				if _, err := s.GetAlias(alias); err != wantErr {
+					t.Errorf("get alias %s err = %v, want %v", alias, err, wantErr)
+				}
+			}
+
+			if ids, err := s.ExpireRooms(); err != nil || len(ids) != 0 {
+				t.Errorf("expire rooms again = %v, %v, want none", ids, err)
+			}
+		})
+	}
+}
+
+func TestRedisRoomStoreParticipantsTTL(t *testing.T) {
+	m := miniredis.RunT(t)
+	s := newTestRedisStore(t, m)
+	roomID := uuid.New()
+
+	if err := s.AddParticipant(roomID, RoomParticipant{ID: "p", Kind: participantKindWebRTC}); err != nil {
+		t.Fatalf("add participant: %v", err)
+	}
+	if err := s.TouchRoom(roomID, time.Minute); err != nil {
+		t.Fatalf("touch room: %v", err)
+	}
+
+	// owner node停止後沒有instance執行ExpireRooms，參與者key仍會過期
+	m.FastForward(2 * time.Minute)
+	if m.Exists(fmt.Sprintf(redisParticipantsKey, roomID.String())) {
+		t.Errorf("participants key did not expire")
+	}
+}
+
+func TestNewSFUSharedStore(t *testing.T) {
+	m := miniredis.RunT(t)
+	store := newTestRedisStore(t, m)
+
+	// 兩個沒有NodeURL的instance會刪除彼此的參與者
+	if _, err := NewSFU(WithStore(store)); !errors.Is(err, errNodeURLRequired) {
+		t.Errorf("new sfu with shared store and no NodeURL err = %v, want %v", err, errNodeURLRequired)
+	}
+
+	// 啟動時刪除已停止的node留下的房間
+	dead := &RoomMetadata{RoomID: uuid.New(), Node: "node-b"}
+	if err := store.SaveRoom(dead); err != nil {
+		t.Fatalf("save room: %v", err)
+	}
+	if err := store.TouchRoom(dead.RoomID, time.Millisecond); err != nil {
+		t.Fatalf("touch room: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	config := DefaultConfig()
+	config.NodeURL = "node-a"
+	config.ClusterSecret = "cluster-secret"
+	config.RoomStoreTTL = time.Minute
+	s, err := NewSFU(WithConfig(config), WithStore(newTestRedisStore(t, m)))
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	defer s.Close()
+	if _, err := store.GetRoom(dead.RoomID); err != ErrRoomNotFound {
+		t.Errorf("dead node room err = %v, want %v", err, ErrRoomNotFound)
+	}
+}
+
+// recordingLogger 記錄Errorf的內容
+type recordingLogger struct {
+	defaultLogger
+	errors []string
+	sync.Mutex
+}
+
+func (l *recordingLogger) Errorf(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+}
+
+func TestRedisRoomStoreLogger(t *testing.T) {
+	m := miniredis.RunT(t)
+	log := &recordingLogger{}
+	s, err := newRedisRoomStore(m.Addr(), "", 0, log)
+	if err != nil {
+		t.Fatalf("new redis room store: %v", err)
+	}
+	defer s.Close()
+
+	m.HSet(redisRoomsKey, uuid.NewString(), "not json")
+	if _, err := s.ListRooms(); err != nil {
+		t.Fatalf("list rooms: %v", err)
+	}
+
+	log.Lock()
+	defer log.Unlock()
+	if len(log.errors) != 1 || !strings.Contains(log.errors[0], "json parse error") {
+		t.Errorf("logged errors = %q, want one json parse error", log.errors)
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// senderReportInterval downTrack送出sender report的間隔
+const senderReportInterval = time.Second
+
+// ntpEpochOffset 1900-01-01至1970-01-01的秒數
+const ntpEpochOffset = 2208988800
+
+func ntpToTime(ntp uint64) time.Time {
+	secs := int64(ntp>>32) - ntpEpochOffset
+	nanos := (ntp & 0xffffffff) * uint64(time.Second) >> 32
+	return time.Unix(secs, int64(nanos))
+}
+
+func timeToNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// senderClock publisher最近一次SR中NTP時間與RTP timestamp的對應，同一個publisher的audio、video以此對齊
+type senderClock struct {
+	valid     bool
+	ntp       time.Time
+	rtp       uint32
+	clockRate uint32
+	// received 收到SR的時間，用於外推目前的時間
+	received time.Time
+
+	sync.RWMutex
+}
+
+func (c *senderClock) update(sr *rtcp.SenderReport, clockRate uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.valid = true
+	c.ntp = ntpToTime(sr.NTPTime)
+	c.rtp = sr.RTPTime
+	c.clockRate = clockRate
+	c.received = time.Now()
+}
+
+// ntpTime publisher RTP timestamp對應的publisher時間，尚未收到SR時回傳false
+func (c *senderClock) ntpTime(rtpTimestamp uint32) (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	if !c.valid || c.clockRate == 0 {
+		return time.Time{}, false
+	}
+	diff := int32(rtpTimestamp - c.rtp)
+	return c.ntp.Add(time.Duration(diff) * time.Second / time.Duration(c.clockRate)), true
+}
+
+// now 以收到SR後經過的時間外推目前的publisher時間與RTP timestamp
+func (c *senderClock) now() (time.Time, uint32, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if !c.valid {
+		return time.Time{}, 0, false
+	}
+	elapsed := time.Since(c.received)
+	return c.ntp.Add(elapsed), c.rtp + uint32(elapsed.Seconds()*float64(c.clockRate)), true
+}
+
+// readSenderReports 讀取publisher的RTCP直到receiver關閉，記錄track的SR
+func readSenderReports(receiver *webrtc.RTPReceiver, ssrc webrtc.SSRC, track *forwardedTrack) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			if sr, ok := p.(*rtcp.SenderReport); ok && sr.SSRC == uint32(ssrc) {
+				track.clock.update(sr, track.codec.ClockRate)
+			}
+		}
+	}
+}
+
+// downTrackSenders downTrack bind時記錄RTPSender的ID，這些sender不使用pion的sender report interceptor
+// 每個SFU各自一份，由newPeerConnection建立的interceptor查詢
+type downTrackSenders struct {
+	sync.Map
+}
+
+// sampleSenderReports pion的sender report interceptor，只綁定downTrack以外的local track，例如混音的TrackLocalStaticSample
+type sampleSenderReports struct {
+	*report.SenderInterceptor
+	downTracks *downTrackSenders
+}
+
+func (i *sampleSenderReports) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if _, ok := i.downTracks.Load(info.ID); ok {
+		return writer
+	}
+	return i.SenderInterceptor.BindLocalStream(info, writer)
+}
+
+type sampleSenderReportsFactory struct {
+	factory    *report.SenderInterceptorFactory
+	downTracks *downTrackSenders
+}
+
+func (f *sampleSenderReportsFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	i, err := f.factory.NewInterceptor(id)
+	if err != nil {
+		return nil, err
+	}
+	return &sampleSenderReports{SenderInterceptor: i.(*report.SenderInterceptor), downTracks: f.downTracks}, nil
+}
+
+// newPeerConnection 與webrtc.NewPeerConnection相同的codec與interceptor，但pion的sender report interceptor不綁定downTrack
+// pion以server送出packet的時間產生SR，無法與publisher的audio、video對齊，轉送的track改由downTrack依publisher的SR送出
+// downTracks為SFU的downTrackSenders，此peerConnection上的downTrack bind時記錄於此
+func newPeerConnection(configuration webrtc.Configuration, downTracks *downTrackSenders) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.ConfigureNack(m, i); err != nil {
+		return nil, err
+	}
+	receiverReports, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(receiverReports)
+	senderReports, err := report.NewSenderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(&sampleSenderReportsFactory{factory: senderReports, downTracks: downTracks})
+	if err := webrtc.ConfigureTWCCSender(m, i); err != nil {
+		return nil, err
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	return api.NewPeerConnection(configuration)
+}
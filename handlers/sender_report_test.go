@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// TestSampleTrackSenderReports 混音等TrackLocalStaticSample沒有downTrack，需由pion的sender report interceptor送出SR
+func TestSampleTrackSenderReports(t *testing.T) {
+	sender, err := newPeerConnection(webrtc.Configuration{}, &downTrackSenders{})
+	if err != nil {
+		t.Fatalf("new sender peerConnection: %v", err)
+	}
+	defer sender.Close()
+	receiver, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("new receiver peerConnection: %v", err)
+	}
+	defer receiver.Close()
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: mixerSampleRate, Channels: mixerChannels},
+		"mixed-audio", "mixed-audio",
+	)
+	if err != nil {
+		t.Fatalf("new track: %v", err)
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		t.Fatalf("add track: %v", err)
+	}
+
+	reports := make(chan struct{}, 1)
+	receiver.OnTrack(func(remote *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+		go func() {
+			for {
+				if _, _, err := remote.ReadRTP(); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			packets, _, err := r.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, p := range packets {
+				if sr, ok := p.(*rtcp.SenderReport); ok && sr.SSRC == uint32(remote.SSRC()) {
+					select {
+					case reports <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	})
+
+	offer, err := sender.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("create offer: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(sender)
+	if err := sender.SetLocalDescription(offer); err != nil {
+		t.Fatalf("set offer: %v", err)
+	}
+	<-gathered
+	if err := receiver.SetRemoteDescription(*sender.LocalDescription()); err != nil {
+		t.Fatalf("set remote offer: %v", err)
+	}
+	answer, err := receiver.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("create answer: %v", err)
+	}
+	gathered = webrtc.GatheringCompletePromise(receiver)
+	if err := receiver.SetLocalDescription(answer); err != nil {
+		t.Fatalf("set answer: %v", err)
+	}
+	<-gathered
+	if err := sender.SetRemoteDescription(*receiver.LocalDescription()); err != nil {
+		t.Fatalf("set remote answer: %v", err)
+	}
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case <-reports:
+			return
+		case <-ticker.C:
+			_ = track.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+		case <-deadline:
+			t.Fatalf("no sender report for sample track")
+		}
+	}
+}
+
+// TestSenderReportsSkipDownTracks downTrack依publisher的SR自行送出，pion的interceptor只對其他sender送出SR
+func TestSenderReportsSkipDownTracks(t *testing.T) {
+	factory, err := report.NewSenderInterceptor()
+	if err != nil {
+		t.Fatalf("new sender interceptor: %v", err)
+	}
+	downTracks := &downTrackSenders{}
+	i, err := (&sampleSenderReportsFactory{factory: factory, downTracks: downTracks}).NewInterceptor("")
+	if err != nil {
+		t.Fatalf("new interceptor: %v", err)
+	}
+	defer i.Close()
+
+	reported := make(chan uint32, 10)
+	i.BindRTCPWriter(interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, _ interceptor.Attributes) (int, error) {
+		for _, p := range pkts {
+			if sr, ok := p.(*rtcp.SenderReport); ok {
+				reported <- sr.SSRC
+			}
+		}
+		return 0, nil
+	}))
+
+	downTracks.Store("down-track", struct{}{})
+
+	noop := interceptor.RTPWriterFunc(func(*rtp.Header, []byte, interceptor.Attributes) (int, error) { return 0, nil })
+	for ssrc, id := range map[uint32]string{1: "down-track", 2: "mixed-audio"} {
+		writer := i.BindLocalStream(&interceptor.StreamInfo{ID: id, SSRC: ssrc, ClockRate: mixerSampleRate}, noop)
+		if _, err := writer.Write(&rtp.Header{SSRC: ssrc}, nil, nil); err != nil {
+			t.Fatalf("write rtp: %v", err)
+		}
+	}
+
+	// interceptor每秒送出一次，等待一個interval後檢查送出的SSRC
+	time.Sleep(1500 * time.Millisecond)
+	got := map[uint32]bool{}
+	for len(reported) > 0 {
+		got[<-reported] = true
+	}
+	if got[1] || !got[2] {
+		t.Errorf("sender reports for SSRC %v, want only mixed-audio SSRC 2", got)
+	}
+}
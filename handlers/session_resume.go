@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// resumeAttachTimeout 舊的websocket被關閉後，等待serveConnection接手新websocket的時間
+const resumeAttachTimeout = 5 * time.Second
+
+// participantSession 參與者的resume session，websocket斷線後在grace period內可用token接回同一個peerConnection
+type participantSession struct {
+	room          *ConferenceRoom
+	token         string
+	participantID string
+
+	// resume 新的websocket由JoinMeeting交給serveConnection
+	resume chan *resumeRequest
+
+	// wsc 目前的websocket，resume時關閉舊的讓serveConnection進入等待
+	wsc *signalingConn
+
+	sync.Mutex
+}
+
+// resumeRequest done在serveConnection不再使用此websocket時關閉，JoinMeeting才能關閉websocket
+type resumeRequest struct {
+	wsc  *signalingConn
+	done chan struct{}
+}
+
+// sessionInfo 加入房間時以session event送給client
+type sessionInfo struct {
+	ParticipantID string `json:"participantID"`
+	ResumeToken   string `json:"resumeToken"`
+	// GracePeriod 秒
+	GracePeriod int `json:"gracePeriod"`
+}
+
+func (r *ConferenceRoom) newParticipantSession(participantID string, wsc *signalingConn) *participantSession {
+	session := &participantSession{
+		room:          r,
+		token:         uuid.NewString(),
+		participantID: participantID,
+		resume:        make(chan *resumeRequest),
+		wsc:           wsc,
+	}
+
+	r.Lock()
+	r.sessions[session.token] = session
+	r.Unlock()
+
+	return session
+}
+
+func (r *ConferenceRoom) removeParticipantSession(session *participantSession) {
+	r.Lock()
+	delete(r.sessions, session.token)
+	r.Unlock()
+}
+
+func (s *participantSession) info() *sessionInfo {
+	return &sessionInfo{
+		ParticipantID: s.participantID,
+		ResumeToken:   s.token,
+		GracePeriod:   int(s.room.sfu.config.ResumeGracePeriod / time.Second),
+	}
+}
+
+func (s *participantSession) setWebsocket(wsc *signalingConn) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.wsc = wsc
+}
+
+func (s *participantSession) closeWebsocket() {
+	s.Lock()
+	defer s.Unlock()
+
+	_ = s.wsc.Close()
+}
+
+// waitResume 等待client重新連線，超過timeout或房間刪除時回傳nil
+func (s *participantSession) waitResume(timeout time.Duration) *resumeRequest {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case req := <-s.resume:
+		return req
+	case <-timer.C:
+		return nil
+	case <-s.room.closed:
+		return nil
+	}
+}
+
+// resumeParticipant 將新的websocket接回token對應的參與者，直到此websocket結束才回傳，token無效時回傳false
+func (r *ConferenceRoom) resumeParticipant(token string, wsc *signalingConn) bool {
+	r.RLock()
+	session, ok := r.sessions[token]
+	r.RUnlock()
+	if !ok {
+		return false
+	}
+
+	// 舊的websocket可能還沒發現斷線(例如網路切換)，主動關閉讓serveConnection進入等待resume
+	session.closeWebsocket()
+
+	req := &resumeRequest{
+		wsc:  wsc,
+		done: make(chan struct{}),
+	}
+
+	select {
+	case session.resume <- req:
+	case <-time.After(resumeAttachTimeout):
+		return false
+	}
+
+	<-req.done
+	return true
+}
@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"webrtc_sfu_conference/conf"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Config SFU的設定，DefaultConfig以conf package的值為預設
+type Config struct {
+	// Domain 對外公布的room URL、websocket URL使用的domain
+	Domain string
+
+	// PreferH264Video video transceiver優先使用H264，HLS egress只支援H264
+	PreferH264Video bool
+
+	// HLSSegmentDuration HLS egress segment目標長度，同時也是向發言者要求keyframe的間隔
+	HLSSegmentDuration time.Duration
+	// HLSPlaylistSize HLS live playlist中保留的segment數量
+	HLSPlaylistSize int
+
+	// MixedAudioBitrate 混音輸出(MCU mode)的Opus bitrate
+	MixedAudioBitrate int
+
+	// SIPPublicIP SIP & SDP中對外公布的IP
+	SIPPublicIP string
+	// SIPRTPTimeout 電話端超過此時間沒有送RTP視為斷線
+	SIPRTPTimeout time.Duration
+
+	// NodeURL 此node供其他node連線的base URL，空字串時不啟用cluster
+	// lobby房間的client會被轉到origin的NodeURL
+	NodeURL string
+	// ClusterNodes cluster中所有node的base URL
+	ClusterNodes []string
+	// ClusterSecret node之間呼叫/cluster API的共用密鑰，設定NodeURL時必須設定
+	ClusterSecret string
+
+	// RoomStoreTTL 房間metadata在store中的保存時間，owner node每RoomStoreTTL/3更新，0為不過期
+	RoomStoreTTL time.Duration
+
+	// ResumeGracePeriod websocket斷線後保留peerConnection的時間，0為不保留
+	ResumeGracePeriod time.Duration
+
+	// NegotiationTimeout server送出offer後等待client answer的時間
+	NegotiationTimeout time.Duration
+
+	// MaxRoomParticipants 單一房間的參與者上限(包含電話)，0為不限制
+	MaxRoomParticipants int
+	// MaxRoomPublishers 單一房間中同時publish track的參與者(包含電話)上限，0為不限制
+	MaxRoomPublishers int
+	// MaxRoomVideoTracks 單一房間的camera video track上限，screen share不計入，0為不限制
+	MaxRoomVideoTracks int
+	// MaxPeerConnections 整個instance的參與者peerConnection上限，電話也計入，node之間的relay不計入(見ClusterRelay)，0為不限制
+	MaxPeerConnections int
+	// MaxForwardedBitrate 整個instance轉送的bitrate上限(bps)，0為不限制
+	MaxForwardedBitrate int
+
+	// EmptyRoomTimeout 最後一個參與者離開後保留房間的時間，0為不刪除
+	EmptyRoomTimeout time.Duration
+	// MaxRoomDuration 會議從第一個參與者加入起的最長時間，0為不限制
+	MaxRoomDuration time.Duration
+	// RoomEndWarning 會議結束前送出roomEnding event的時間
+	RoomEndWarning time.Duration
+
+	// PasswordMaxAttempts 同一個IP對同一個房間在PasswordAttemptWindow內密碼錯誤的上限，查詢不存在的room alias也使用此上限，0為不限制
+	PasswordMaxAttempts int
+	// PasswordAttemptWindow 密碼錯誤次數的計算區間
+	PasswordAttemptWindow time.Duration
+	// TrustedProxies 反向代理的IP或CIDR，來自這些位址的request以X-Forwarded-For或X-Real-IP作為client IP
+	TrustedProxies []string
+
+	// ExclusiveScreenShare 房間中同時只允許一個參與者分享畫面
+	ExclusiveScreenShare bool
+
+	// LastN 每個參與者連線最多轉送的video track數，screen share優先，其餘為最近開始送出RTP的track，0為不限制
+	LastN int
+
+	// MaxPublishTracks 單一參與者接收publish用的transceiver上限，0為不限制
+	MaxPublishTracks int
+
+	// KeyFrameRequestInterval 向同一個publisher track要求keyframe的最短間隔
+	KeyFrameRequestInterval time.Duration
+}
+
+// DefaultConfig 以conf package目前的值建立Config
+func DefaultConfig() Config {
+	return Config{
+		Domain:             conf.Domain,
+		PreferH264Video:    conf.PreferH264Video,
+		HLSSegmentDuration: conf.HLSSegmentDuration,
+		HLSPlaylistSize:    conf.HLSPlaylistSize,
+		MixedAudioBitrate:  conf.MixedAudioBitrate,
+		SIPPublicIP:        conf.SIPPublicIP,
+		SIPRTPTimeout:      conf.SIPRTPTimeout,
+		NodeURL:            conf.NodeURL,
+		ClusterNodes:       append([]string(nil), conf.ClusterNodes...),
+		ClusterSecret:      conf.ClusterSecret,
+		RoomStoreTTL:       conf.RoomStoreTTL,
+		ResumeGracePeriod:  conf.ResumeGracePeriod,
+		NegotiationTimeout: conf.NegotiationTimeout,
+
+		MaxRoomParticipants: conf.MaxRoomParticipants,
+		MaxRoomPublishers:   conf.MaxRoomPublishers,
+		MaxRoomVideoTracks:  conf.MaxRoomVideoTracks,
+		MaxPeerConnections:  conf.MaxPeerConnections,
+		MaxForwardedBitrate: conf.MaxForwardedBitrate,
+
+		EmptyRoomTimeout: conf.EmptyRoomTimeout,
+		MaxRoomDuration:  conf.MaxRoomDuration,
+		RoomEndWarning:   conf.RoomEndWarning,
+
+		PasswordMaxAttempts:   conf.PasswordMaxAttempts,
+		PasswordAttemptWindow: conf.PasswordAttemptWindow,
+		TrustedProxies:        append([]string(nil), conf.TrustedProxies...),
+
+		ExclusiveScreenShare: conf.ExclusiveScreenShare,
+		LastN:                conf.LastN,
+		MaxPublishTracks:     conf.MaxPublishTracks,
+
+		KeyFrameRequestInterval: conf.KeyFrameRequestInterval,
+	}
+}
+
+// Logger SFU使用的logger，預設輸出至package的zerolog Log
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Debugf(format string, v ...interface{}) { Debugf(format, v...) }
+func (defaultLogger) Infof(format string, v ...interface{})  { Infof(format, v...) }
+func (defaultLogger) Warnf(format string, v ...interface{})  { Warnf(format, v...) }
+func (defaultLogger) Errorf(format string, v ...interface{}) { Errorf(format, v...) }
+
+// Hooks 房間與參與者的事件通知，於SFU內部的goroutine中同步呼叫，不可阻塞
+type Hooks struct {
+	OnRoomCreated       func(roomID uuid.UUID)
+	OnRoomDeleted       func(roomID uuid.UUID)
+	OnParticipantJoined func(roomID uuid.UUID, participantID string)
+	OnParticipantLeft   func(roomID uuid.UUID, participantID string)
+}
+
+// Option NewSFU的選項
+type Option func(*SFU)
+
+// WithConfig 未指定時使用DefaultConfig()
+func WithConfig(c Config) Option {
+	return func(s *SFU) {
+		s.config = c
+	}
+}
+
+// WithLogger 未指定時使用package的zerolog Log
+func WithLogger(l Logger) Option {
+	return func(s *SFU) {
+		s.log = l
+	}
+}
+
+// WithStore 房間metadata的store，未指定時使用process內的memory store，SFU Close時一併關閉
+func WithStore(store RoomStore) Option {
+	return func(s *SFU) {
+		s.store = store
+	}
+}
+
+// WithHooks 房間與參與者的事件通知
+func WithHooks(h Hooks) Option {
+	return func(s *SFU) {
+		s.hooks = h
+	}
+}
+
+// SFU 會議室server，擁有此instance的所有房間，同一個process中可以建立多個互相獨立的SFU
+type SFU struct {
+	config Config
+	log    Logger
+	hooks  Hooks
+
+	rooms map[uuid.UUID]*ConferenceRoom
+
+	// store 房間metadata，預設為process內的memory store
+	store RoomStore
+
+	// signaling rooms info websocket feed
+	signaling *roomsInfoSignalingServer
+
+	// registry 查詢其他node上的房間
+	registry roomRegistry
+
+	// sip SIP gateway，未啟動時為nil
+	sip *sipUserAgent
+
+	// load admission control使用的peerConnection數與forwarded bitrate
+	load serverLoad
+
+	// passwords 房間密碼的錯誤次數限制
+	passwords *passwordLimiter
+
+	// aliasLookups 查詢不存在的alias的次數限制
+	aliasLookups *passwordLimiter
+
+	// downTrackSenders 此SFU的peerConnection上bind的downTrack，sender report interceptor不綁定這些sender
+	downTrackSenders *downTrackSenders
+
+	// trustedProxies 解析後的Config.TrustedProxies
+	trustedProxies []*net.IPNet
+
+	closed chan struct{}
+
+	sync.RWMutex
+}
+
+// errClusterSecretRequired 未設定ClusterSecret時任何人都能呼叫/cluster API取得房間設定與track
+var errClusterSecretRequired = errors.New("cluster secret is required when NodeURL is set")
+
+// errNodeURLRequired 共用store時以NodeURL區分參與者與房間屬於哪個instance
+var errNodeURLRequired = errors.New("NodeURL is required when the room store is shared")
+
+// NewSFU 建立SFU，不會開始listen，以Handler()掛上自己的HTTP server
+// 設定NodeURL卻沒有ClusterSecret時回傳錯誤，不啟用沒有驗證的cluster
+// 共用store(Changes不為nil)卻沒有NodeURL時回傳錯誤
+func NewSFU(opts ...Option) (*SFU, error) {
+	s := &SFU{
+		config: DefaultConfig(),
+		log:    defaultLogger{},
+		rooms:  make(map[uuid.UUID]*ConferenceRoom),
+		closed: make(chan struct{}),
+
+		passwords:    newPasswordLimiter(),
+		aliasLookups: newPasswordLimiter(),
+
+		downTrackSenders: &downTrackSenders{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.config.NodeURL != "" && s.config.ClusterSecret == "" {
+		return nil, errClusterSecretRequired
+	}
+	proxies, err := parseTrustedProxies(s.config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	s.trustedProxies = proxies
+
+	if s.store == nil {
+		s.store = NewMemoryRoomStore()
+	}
+	if s.store.Changes() != nil && s.config.NodeURL == "" {
+		return nil, errNodeURLRequired
+	}
+	s.registry = newPeerRegistry(s)
+	s.signaling = newSignalingServer(s)
+	go s.load.run(s.closed)
+
+	// 共用store時，上次執行留下的本node參與者已不存在
+	if err := s.removeStaleParticipants(); err != nil {
+		s.log.Warnf("room store remove stale participants error: %v", err)
+	}
+	// 刪除已停止的node留下的房間
+	if s.config.RoomStoreTTL > 0 {
+		s.expireRooms()
+		go s.refreshRooms()
+	}
+
+	// 其他instance的變更轉發至rooms info feed
+	if ch := s.store.Changes(); ch != nil {
+		go func() {
+			for msg := range ch {
+				s.signaling.update(msg)
+			}
+		}()
+	}
+
+	return s, nil
+}
+
+// Handler 所有route的http.Handler，也可以個別使用各route的handler method自行組合
+func (s *SFU) Handler() http.Handler {
+	r := mux.NewRouter()
+
+	// create room
+	r.HandleFunc("/create/room", s.CreateRoom).Methods("POST")
+	// room websocket webrtc peerConnection endpoint
+	r.HandleFunc("/room/{roomid}/webSocket", s.JoinMeeting)
+	// room page index.html handler
+	r.HandleFunc("/room/{roomid}", s.RoomPage)
+	// room password, set or remove with host token
+	r.HandleFunc("/room/{roomid}/password", s.UpdateRoomPassword).Methods("PUT")
+
+	// room HLS egress, start/stop with host token & playlist, segments
+	r.HandleFunc("/room/{roomid}/hls", s.StartRoomHLS).Methods("POST")
+	r.HandleFunc("/room/{roomid}/hls", s.StopRoomHLS).Methods("DELETE")
+	r.HandleFunc("/room/{roomid}/hls/{file}", s.RoomHLSFile).Methods("GET")
+
+	// SIP gateway, dial out & hang up phone participants with host token
+	r.HandleFunc("/room/{roomid}/sip", s.DialSIP).Methods("POST")
+	r.HandleFunc("/room/{roomid}/sip/{callid}", s.HangupSIP).Methods("DELETE")
+
+	// cluster, room owner lookup & relay between nodes
+	r.HandleFunc("/cluster/rooms/{roomid}", s.ClusterRoomOwner).Methods("GET")
+	r.HandleFunc("/cluster/relay/{roomid}/{direction}", s.ClusterRelay)
+
+	r.HandleFunc("/index", s.IndexPage)
+	r.HandleFunc("/roomsinfo/webSocket", s.RoomInfoSignaling)
+	// conference room id API
+	r.HandleFunc("/getRoomsID", s.GetRoomIDArray)
+
+	return r
+}
+
+// Close 關閉SIP gateway、rooms info feed以及store，已連線的peerConnection不會被中斷
+func (s *SFU) Close() error {
+	s.Lock()
+	select {
+	case <-s.closed:
+		s.Unlock()
+		return nil
+	default:
+	}
+	close(s.closed)
+	sip := s.sip
+	s.Unlock()
+
+	if sip != nil {
+		sip.close()
+	}
+	return s.store.Close()
+}
+
+// getRoom 此instance上的房間
+func (s *SFU) getRoom(roomID uuid.UUID) (*ConferenceRoom, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	room, ok := s.rooms[roomID]
+	return room, ok
+}
+
+// hasRoom 房間是否還在此instance上，房間刪除後不再signal
+func (s *SFU) hasRoom(r *ConferenceRoom) bool {
+	room, ok := s.getRoom(r.RoomID)
+	return ok && room == r
+}
+
+func (s *SFU) roomCreated(roomID uuid.UUID) {
+	s.signaling.update(fmt.Sprintf("room ID %s created.", roomID.String()))
+	if s.hooks.OnRoomCreated != nil {
+		s.hooks.OnRoomCreated(roomID)
+	}
+}
+
+func (s *SFU) roomDeleted(roomID uuid.UUID) {
+	s.signaling.update(fmt.Sprintf("room ID %s deleted", roomID.String()))
+	if s.hooks.OnRoomDeleted != nil {
+		s.hooks.OnRoomDeleted(roomID)
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"webrtc_sfu_conference/signalingpb"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// toProtoMessage 將送出的payload轉為protobuf message
+func toProtoMessage(event, id string, payload interface{}) (*signalingpb.SignalingMessage, error) {
+	msg := &signalingpb.SignalingMessage{
+		Version: signalingV2,
+		Event:   event,
+		Id:      id,
+	}
+
+	switch p := payload.(type) {
+	case nil:
+	case webrtc.SessionDescription:
+		msg.Payload = &signalingpb.SignalingMessage_Description{
+			Description: &signalingpb.SessionDescription{Type: p.Type.String(), Sdp: p.SDP},
+		}
+	case webrtc.ICECandidateInit:
+		candidate := &signalingpb.ICECandidate{
+			Candidate:        p.Candidate,
+			SdpMid:           p.SDPMid,
+			UsernameFragment: p.UsernameFragment,
+		}
+		if p.SDPMLineIndex != nil {
+			index := uint32(*p.SDPMLineIndex)
+			candidate.SdpMlineIndex = &index
+		}
+		msg.Payload = &signalingpb.SignalingMessage_Candidate{Candidate: candidate}
+	case *sessionInfo:
+		msg.Payload = &signalingpb.SignalingMessage_Session{Session: &signalingpb.Session{
+			ParticipantId: p.ParticipantID,
+			ResumeToken:   p.ResumeToken,
+			GracePeriod:   uint32(p.GracePeriod),
+		}}
+	case *signalingError:
+		msg.Payload = &signalingpb.SignalingMessage_Error{
+			Error: &signalingpb.Error{Code: p.Code, Message: p.Message},
+		}
+	case *lobbyParticipant:
+		msg.Payload = &signalingpb.SignalingMessage_Lobby{
+			Lobby: &signalingpb.LobbyParticipant{ParticipantId: p.ParticipantID, Name: p.Name},
+		}
+	case *roomEnding:
+		msg.Payload = &signalingpb.SignalingMessage_RoomEnding{
+			RoomEnding: &signalingpb.RoomEnding{EndTime: p.EndTime.Format(time.RFC3339Nano), Reason: p.Reason},
+		}
+	case *trackList:
+		tracks := &signalingpb.TrackList{Tracks: make([]*signalingpb.TrackInfo, 0, len(p.Tracks))}
+		for _, t := range p.Tracks {
+			tracks.Tracks = append(tracks.Tracks, &signalingpb.TrackInfo{
+				TrackId:       t.TrackID,
+				StreamId:      t.StreamID,
+				Kind:          t.Kind,
+				Label:         t.Label,
+				ParticipantId: t.ParticipantID,
+				Subscribed:    t.Subscribed,
+			})
+		}
+		msg.Payload = &signalingpb.SignalingMessage_Tracks{Tracks: tracks}
+	default:
+		return nil, fmt.Errorf("event %s payload %T has no protobuf encoding", event, payload)
+	}
+
+	return msg, nil
+}
+
+// fromProtoMessage 將收到的protobuf message轉為signalingMessage，payload轉為JSON以共用decode與驗證
+func fromProtoMessage(pb *signalingpb.SignalingMessage) (*signalingMessage, error) {
+	msg := &signalingMessage{
+		Version: int(pb.Version),
+		Event:   pb.Event,
+		ID:      pb.Id,
+	}
+
+	var payload interface{}
+	switch p := pb.Payload.(type) {
+	case *signalingpb.SignalingMessage_Description:
+		payload = &webrtc.SessionDescription{
+			Type: webrtc.NewSDPType(p.Description.GetType()),
+			SDP:  p.Description.GetSdp(),
+		}
+	case *signalingpb.SignalingMessage_Candidate:
+		candidate := &webrtc.ICECandidateInit{
+			Candidate:        p.Candidate.GetCandidate(),
+			SDPMid:           p.Candidate.SdpMid,
+			UsernameFragment: p.Candidate.UsernameFragment,
+		}
+		if p.Candidate.SdpMlineIndex != nil {
+			index := uint16(*p.Candidate.SdpMlineIndex)
+			candidate.SDPMLineIndex = &index
+		}
+		payload = candidate
+	case *signalingpb.SignalingMessage_Lobby:
+		payload = &lobbyParticipant{ParticipantID: p.Lobby.GetParticipantId(), Name: p.Lobby.GetName()}
+	case *signalingpb.SignalingMessage_TrackLabel:
+		payload = &trackLabel{TrackID: p.TrackLabel.GetTrackId(), Label: p.TrackLabel.GetLabel()}
+	case *signalingpb.SignalingMessage_Tracks:
+		// relay連線中對方node送出的tracks
+		list := &trackList{Tracks: make([]trackInfo, 0, len(p.Tracks.GetTracks()))}
+		for _, t := range p.Tracks.GetTracks() {
+			list.Tracks = append(list.Tracks, trackInfo{
+				TrackID:       t.GetTrackId(),
+				StreamID:      t.GetStreamId(),
+				Kind:          t.GetKind(),
+				Label:         t.GetLabel(),
+				ParticipantID: t.GetParticipantId(),
+				Subscribed:    t.GetSubscribed(),
+			})
+		}
+		payload = list
+	case *signalingpb.SignalingMessage_Subscription:
+		payload = &subscriptionRequest{
+			All:            p.Subscription.GetAll(),
+			ParticipantIDs: p.Subscription.GetParticipantIds(),
+			TrackIDs:       p.Subscription.GetTrackIds(),
+		}
+	case *signalingpb.SignalingMessage_Publish:
+		payload = &publishRequest{Kind: p.Publish.GetKind()}
+	default:
+		// client只送出description、candidate、lobby、trackLabel、subscription(subscribe、pause等)與publish payload
+		return msg, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.Data = data
+	return msg, nil
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+	"webrtc_sfu_conference/signalingpb"
+
+	"github.com/pion/webrtc/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProtoMessageRoundTrip(t *testing.T) {
+	mid, index := "0", uint16(1)
+	tests := []struct {
+		event   string
+		payload interface{}
+	}{
+		{event: "offer", payload: webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\n"}},
+		{event: "candidate", payload: webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 1 127.0.0.1 5000 typ host", SDPMid: &mid, SDPMLineIndex: &index}},
+		{event: "lobbyJoin", payload: &lobbyParticipant{ParticipantID: "a", Name: "Alice"}},
+		{event: "tracks", payload: &trackList{Tracks: []trackInfo{
+			{TrackID: "camera-a", StreamID: "a", Kind: "video", Label: trackLabelCamera, ParticipantID: "a", Subscribed: true},
+			{TrackID: "mic-b", StreamID: "b", Kind: "audio", Label: trackLabelMicrophone},
+		}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.event, func(t *testing.T) {
+			pb, err := toProtoMessage(test.event, "1", test.payload)
+			if err != nil {
+				t.Fatalf("to proto: %v", err)
+			}
+			b, err := proto.Marshal(pb)
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			decoded := &signalingpb.SignalingMessage{}
+			if err := proto.Unmarshal(b, decoded); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+
+			msg, err := fromProtoMessage(decoded)
+			if err != nil {
+				t.Fatalf("from proto: %v", err)
+			}
+			want, _ := json.Marshal(test.payload)
+			if msg.Version != signalingV2 || msg.Event != test.event || msg.ID != "1" || string(msg.Data) != string(want) {
+				t.Errorf("round trip = %d %s %s %s, want %s", msg.Version, msg.Event, msg.ID, msg.Data, want)
+			}
+		})
+	}
+}
+
+func TestFromProtoMessageClientPayloads(t *testing.T) {
+	tests := []struct {
+		payload *signalingpb.SignalingMessage
+		want    interface{}
+	}{
+		{
+			payload: &signalingpb.SignalingMessage{Event: "trackLabel", Payload: &signalingpb.SignalingMessage_TrackLabel{
+				TrackLabel: &signalingpb.TrackLabel{TrackId: "screen-a", Label: trackLabelScreen},
+			}},
+			want: &trackLabel{TrackID: "screen-a", Label: trackLabelScreen},
+		},
+		{
+			payload: &signalingpb.SignalingMessage{Event: "subscribe", Payload: &signalingpb.SignalingMessage_Subscription{
+				Subscription: &signalingpb.Subscription{ParticipantIds: []string{"a"}, TrackIds: []string{"camera-b"}},
+			}},
+			want: &subscriptionRequest{ParticipantIDs: []string{"a"}, TrackIDs: []string{"camera-b"}},
+		},
+		{
+			payload: &signalingpb.SignalingMessage{Event: "publish", Payload: &signalingpb.SignalingMessage_Publish{
+				Publish: &signalingpb.PublishRequest{Kind: "video"},
+			}},
+			want: &publishRequest{Kind: "video"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.payload.Event, func(t *testing.T) {
+			msg, err := fromProtoMessage(test.payload)
+			if err != nil {
+				t.Fatalf("from proto: %v", err)
+			}
+			want, _ := json.Marshal(test.want)
+			if string(msg.Data) != string(want) {
+				t.Errorf("data = %s, want %s", msg.Data, want)
+			}
+		})
+	}
+
+	if _, err := toProtoMessage("unknown", "", struct{}{}); err == nil {
+		t.Errorf("payload without protobuf encoding succeeded")
+	}
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"webrtc_sfu_conference/signalingpb"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// room websocket signaling協定
+// v1 (legacy): {"event": "...", "data": "<JSON字串>"}，沒有版本、request ID與錯誤回應
+// v2: websocket subprotocol "sfu.v2"，{"v": 2, "event": "...", "id": "...", "data": {...}}
+//   - data為各event的typed payload，不再是JSON中的JSON字串
+//   - id為request ID，回應(answer、error)帶上對應request的id
+//   - 格式錯誤、payload不合法、未知的event回覆error，不會中斷連線
+// v2 protobuf: websocket subprotocol "sfu.v2.proto"，binary frame，schema見signalingpb/signaling.proto
+// 沒有要求subprotocol的client視為v1，不同版本的client可以同時在同一個房間
+
+const (
+	signalingV1 = 1
+	signalingV2 = 2
+
+	signalingV2Subprotocol = "sfu.v2"
+)
+
+// signalingSubprotocols server支援的subprotocol，依偏好排序
+// gorilla依server的順序選擇，client要求protobuf時(同時要求JSON作為fallback)使用protobuf
+var signalingSubprotocols = []string{signalingpb.Subprotocol, signalingV2Subprotocol}
+
+// error code，v2 error event的code
+const (
+	signalingErrMalformed      = "malformedMessage"
+	signalingErrUnknownEvent   = "unknownEvent"
+	signalingErrInvalidPayload = "invalidPayload"
+	signalingErrNegotiation    = "negotiationFailed"
+	// signalingErrGlare client的offer與server的offer衝突被忽略
+	signalingErrGlare = "glare"
+)
+
+var errInvalidPayload = errors.New("invalid payload")
+
+// signalingMessage v2 message，v1 message讀取後也轉為此格式，Data為payload JSON
+type signalingMessage struct {
+	Version int             `json:"v"`
+	Event   string          `json:"event"`
+	ID      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// signalingError v2 error event的payload
+type signalingError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// signalingConn 依協商的版本讀寫signaling message
+type signalingConn struct {
+	*threadSafeWebSocketWriter
+	version int
+
+	// binary 以protobuf binary frame傳送
+	binary bool
+}
+
+// newSignalingConn 依upgrade時協商的subprotocol決定版本
+func newSignalingConn(wsc *threadSafeWebSocketWriter) *signalingConn {
+	c := &signalingConn{
+		threadSafeWebSocketWriter: wsc,
+		version:                   signalingV1,
+	}
+
+	switch wsc.Subprotocol() {
+	case signalingV2Subprotocol:
+		c.version = signalingV2
+	case signalingpb.Subprotocol:
+		c.version = signalingV2
+		c.binary = true
+	}
+	return c
+}
+
+// send 送出event，payload為nil時沒有data
+func (c *signalingConn) send(event, id string, payload interface{}) error {
+	if c.binary {
+		msg, err := toProtoMessage(event, id, payload)
+		if err != nil {
+			return err
+		}
+		b, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return c.WriteBinary(b)
+	}
+
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+
+	if c.version == signalingV1 {
+		return c.WriteJSON(&websocketwebRTCMessage{
+			Event: event,
+			Data:  string(data),
+		})
+	}
+
+	return c.WriteJSON(&signalingMessage{
+		Version: signalingV2,
+		Event:   event,
+		ID:      id,
+		Data:    data,
+	})
+}
+
+// sendError 回覆request錯誤，v1沒有error event，只記錄不送出
+func (c *signalingConn) sendError(id, code, message string) error {
+	if c.version == signalingV1 {
+		return nil
+	}
+
+	return c.send("error", id, &signalingError{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// read 讀取下一個message，websocket錯誤回傳readErr，message格式錯誤回傳parseErr，連線仍可繼續使用
+func (c *signalingConn) read() (msg *signalingMessage, parseErr error, readErr error) {
+	messageType, raw, err := c.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.binary {
+		if messageType != websocket.BinaryMessage {
+			return nil, fmt.Errorf("text message on protobuf connection"), nil
+		}
+
+		pb := &signalingpb.SignalingMessage{}
+		if err := proto.Unmarshal(raw, pb); err != nil {
+			return nil, err, nil
+		}
+		if pb.Event == "" {
+			return nil, fmt.Errorf("missing event"), nil
+		}
+		if msg, err = fromProtoMessage(pb); err != nil {
+			return nil, err, nil
+		}
+		return msg, nil, nil
+	}
+
+	if c.version == signalingV1 {
+		legacy := websocketwebRTCMessage{}
+		if err := json.Unmarshal(raw, &legacy); err != nil {
+			return nil, err, nil
+		}
+
+		msg = &signalingMessage{Version: signalingV1, Event: legacy.Event}
+		if legacy.Data != "" {
+			msg.Data = json.RawMessage(legacy.Data)
+		}
+		return msg, nil, nil
+	}
+
+	msg = &signalingMessage{}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return nil, err, nil
+	}
+	if msg.Event == "" {
+		return nil, fmt.Errorf("missing event"), nil
+	}
+	return msg, nil, nil
+}
+
+// decodeDescription offer/answer的payload，type必須與event相同且SDP不為空
+func (m *signalingMessage) decodeDescription(want webrtc.SDPType) (webrtc.SessionDescription, error) {
+	desc := webrtc.SessionDescription{}
+	if err := json.Unmarshal(m.Data, &desc); err != nil {
+		return desc, fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	if desc.Type != want {
+		return desc, fmt.Errorf("%w: %s type %s", errInvalidPayload, m.Event, desc.Type)
+	}
+	if desc.SDP == "" {
+		return desc, fmt.Errorf("%w: %s without sdp", errInvalidPayload, m.Event)
+	}
+	return desc, nil
+}
+
+// decodeCandidate candidate的payload，candidate不可為空
+func (m *signalingMessage) decodeCandidate() (webrtc.ICECandidateInit, error) {
+	candidate := webrtc.ICECandidateInit{}
+	if err := json.Unmarshal(m.Data, &candidate); err != nil {
+		return candidate, fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	if candidate.Candidate == "" {
+		return candidate, fmt.Errorf("%w: empty candidate", errInvalidPayload)
+	}
+	return candidate, nil
+}
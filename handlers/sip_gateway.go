@@ -0,0 +1,1141 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	sipUserAgentName = "webrtc_sfu_conference"
+
+	// RFC 3261 timer
+	sipT1 = 500 * time.Millisecond
+	sipT2 = 4 * time.Second
+	// 64*T1
+	sipTransactionTimeout = 32 * time.Second
+
+	sipPayloadTypePCMU = 0
+	sipPayloadTypePCMA = 8
+	// 我們offer時使用的opus payload type
+	sipPayloadTypeOpus = 111
+
+	sipMaxMessageSize = 65535
+)
+
+var (
+	errSIPGatewayNotRunning = errors.New("sip gateway not running")
+	errSIPNoCommonCodec     = errors.New("no common audio codec")
+	errSIPCallNotFound      = errors.New("sip call not found")
+)
+
+// sipUserAgent SIP gateway，接受 INVITE sip:<roomID或alias>@host 的來電，或由API撥出，將電話的audio橋接進房間
+type sipUserAgent struct {
+	sfu  *SFU
+	conn *net.UDPConn
+
+	// calls key: Call-ID
+	calls map[string]*sipCall
+
+	sync.Mutex
+}
+
+// StartSIPGateway 啟動SIP UDP listener
+func (s *SFU) StartSIPGateway(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+
+	ua := &sipUserAgent{
+		sfu:   s,
+		conn:  conn,
+		calls: make(map[string]*sipCall),
+	}
+
+	s.Lock()
+	s.sip = ua
+	s.Unlock()
+
+	go ua.run()
+
+	s.log.Infof("sip gateway listen on %s", conn.LocalAddr())
+	// 房間混音需要解碼WebRTC參與者的opus，未以 -tags opus 建置時只有電話到房間的單向聲音
+	if !sipOpusAvailable() {
+		s.log.Warnf("sip gateway: server built without opus support (build with -tags opus), phone callers will not hear WebRTC participants")
+	}
+	return nil
+}
+
+// sipCall 單一通電話，同時是一個SIP dialog以及房間中的一個參與者
+type sipCall struct {
+	ua       *sipUserAgent
+	callID   string
+	room     *ConferenceRoom
+	outbound bool
+
+	// dialog
+	localHeader  string // 我方的From/To header(含tag)
+	remoteHeader string // 對方的From/To header(含tag)
+	remoteTarget string // 對方Contact，in-dialog request的request URI
+	sipAddr      *net.UDPAddr
+	cseq         uint32
+
+	// invite 對方送來的INVITE，或我方送出的INVITE
+	invite *sipMessage
+	// remoteInvite 對方最後一個INVITE(來電或re-INVITE)，finalResponse為送出的final response，INVITE重送時直接回送
+	remoteInvite  *sipMessage
+	finalResponse *sipMessage
+	// remoteCSeq 對方最後一個INVITE的CSeq序號，re-INVITE需大於此值
+	remoteCSeq uint32
+	// localSDP 我方目前的session description，offer/answer完成後設定，re-INVITE時回覆
+	// sdpSession、sdpVersion 為o= line的session ID與版本
+	localSDP   []byte
+	sdpSession uint32
+	sdpVersion uint32
+	acked      chan struct{}
+	answered   chan struct{}
+
+	// media
+	rtpConn       *net.UDPConn
+	remoteRTPAddr *net.UDPAddr
+	// rtpLatched 已收到第一個RTP，之後只接受remoteRTPAddr送來的RTP
+	rtpLatched  bool
+	codec       string
+	payloadType uint8
+	track       *forwardedTrack
+	mixerOutput *mixerOutput
+	opusEncoder opusEncoder
+	ssrc        uint32
+	sequence    uint16
+	timestamp   uint32
+	lastSample  int16
+
+	// release 釋放admitSIPParticipant保留的名額，hangup時呼叫
+	release func()
+
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	sync.Mutex
+}
+
+func (ua *sipUserAgent) run() {
+	buf := make([]byte, sipMaxMessageSize)
+	for {
+		n, addr, err := ua.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			ua.sfu.log.Errorf("sip gateway read error: %v", err)
+			return
+		}
+
+		// keepalive CRLF
+		if strings.TrimSpace(string(buf[:n])) == "" {
+			continue
+		}
+
+		msg, err := parseSIPMessage(buf[:n])
+		if err != nil {
+			ua.sfu.log.Debugf("sip gateway parse message from %v error: %v", addr, err)
+			continue
+		}
+
+		if msg.isRequest() {
+			ua.handleRequest(msg, addr)
+		} else {
+			ua.handleResponse(msg)
+		}
+	}
+}
+
+// close 掛斷所有電話並停止listener
+func (ua *sipUserAgent) close() {
+	ua.Lock()
+	calls := make([]*sipCall, 0, len(ua.calls))
+	for _, call := range ua.calls {
+		calls = append(calls, call)
+	}
+	ua.Unlock()
+
+	for _, call := range calls {
+		call.hangup(true)
+	}
+
+	if err := ua.conn.Close(); err != nil {
+		ua.sfu.log.Errorf("sip gateway close error: %v", err)
+	}
+}
+
+func (ua *sipUserAgent) send(msg *sipMessage, addr *net.UDPAddr) {
+	if _, err := ua.conn.WriteToUDP(msg.marshal(), addr); err != nil {
+		ua.sfu.log.Errorf("sip gateway send to %v error: %v", addr, err)
+	}
+}
+
+func (ua *sipUserAgent) getCall(callID string) *sipCall {
+	ua.Lock()
+	defer ua.Unlock()
+
+	return ua.calls[callID]
+}
+
+func (ua *sipUserAgent) localAddress() string {
+	port := ua.conn.LocalAddr().(*net.UDPAddr).Port
+	return net.JoinHostPort(ua.sfu.config.SIPPublicIP, strconv.Itoa(port))
+}
+
+// newResponse 依照request建立response，To tag由呼叫端加上
+func (ua *sipUserAgent) newResponse(req *sipMessage, code int, reason string) *sipMessage {
+	res := &sipMessage{statusCode: code, reason: reason}
+	for _, via := range req.getAll("Via") {
+		res.add("Via", via)
+	}
+	res.add("From", req.get("From"))
+	res.add("To", req.get("To"))
+	res.add("Call-ID", req.get("Call-ID"))
+	res.add("CSeq", req.get("CSeq"))
+	res.add("User-Agent", sipUserAgentName)
+	return res
+}
+
+func (ua *sipUserAgent) handleRequest(req *sipMessage, addr *net.UDPAddr) {
+	call := ua.getCall(req.get("Call-ID"))
+
+	switch req.method {
+	case "INVITE":
+		if call != nil {
+			ua.handleReinvite(call, req, addr)
+			return
+		}
+		ua.handleInvite(req, addr)
+
+	case "ACK":
+		if call != nil {
+			call.ack()
+		}
+
+	case "BYE", "CANCEL":
+		// 只知道Call-ID不能掛斷電話，BYE需符合dialog的tag，CANCEL需符合來電INVITE的transaction，且來自同一個SIP位址
+		if call == nil || (req.method == "BYE" && !call.matchesDialog(req, addr)) || (req.method == "CANCEL" && !call.matchesInvite(req, addr)) {
+			ua.send(ua.newResponse(req, 481, "Call/Transaction Does Not Exist"), addr)
+			return
+		}
+		ua.send(ua.newResponse(req, 200, "OK"), addr)
+		call.hangup(false)
+
+	case "OPTIONS":
+		res := ua.newResponse(req, 200, "OK")
+		res.add("Allow", "INVITE, ACK, BYE, CANCEL, OPTIONS")
+		ua.send(res, addr)
+
+	default:
+		ua.send(ua.newResponse(req, 501, "Not Implemented"), addr)
+	}
+}
+
+// handleInvite 來電，request URI的user(或X-Room-ID header)為room ID
+func (ua *sipUserAgent) handleInvite(req *sipMessage, addr *net.UDPAddr) {
+	roomKey := req.get("X-Room-ID")
+	if roomKey == "" {
+		roomKey = sipURIUser(req.requestURI)
+	}
+
+	room, err := ua.sfu.getRoomByID(roomKey, addr.IP.String())
+	if err != nil {
+		ua.sfu.log.Warnf("sip gateway invite from %v: %v", addr, err)
+		ua.send(ua.newResponse(req, 404, "Not Found"), addr)
+		return
+	}
+
+	// 一般電話無法帶上密碼，有密碼或PIN的房間不接受來電，只能由host以DialSIP撥出
+	// 不在UDP read loop中執行bcrypt，錯誤的來電不會延遲其他通話的BYE、ACK與重送
+	if kind := room.passwordKind(); kind != "" {
+		ua.sfu.log.Warnf("sip gateway invite from %v: room %v requires %s", addr, room.RoomID, kind)
+		ua.send(ua.newResponse(req, 403, "Forbidden"), addr)
+		return
+	}
+
+	// 電話無法在lobby中等待host允許，lobby房間只能由host以DialSIP撥出
+	if room.lobbyEnabled() {
+		ua.sfu.log.Warnf("sip gateway invite from %v: room %v requires host admission", addr, room.RoomID)
+		ua.send(ua.newResponse(req, 403, "Forbidden"), addr)
+		return
+	}
+
+	codec, payloadType, remoteRTPAddr, err := parseSIPAudioSDP(req.body, true)
+	if err != nil {
+		ua.sfu.log.Warnf("sip gateway invite from %v sdp error: %v", addr, err)
+		ua.send(ua.newResponse(req, 488, "Not Acceptable Here"), addr)
+		return
+	}
+
+	release, admitErr := room.admitSIPParticipant()
+	if admitErr != nil {
+		ua.sfu.log.Warnf("sip gateway invite from %v: %v", addr, admitErr)
+		ua.send(ua.newResponse(req, 486, "Busy Here"), addr)
+		return
+	}
+
+	ua.send(ua.newResponse(req, 100, "Trying"), addr)
+
+	localTag := sipRandomToken()
+	call, err := ua.newCall(req.get("Call-ID"), room, false, release)
+	if err != nil {
+		release()
+		ua.sfu.log.Errorf("sip gateway create call error: %v", err)
+		ua.send(ua.newResponse(req, 500, "Server Internal Error"), addr)
+		return
+	}
+
+	call.Lock()
+	call.invite = req
+	call.remoteInvite = req
+	call.remoteCSeq, _ = req.cseq()
+	call.localHeader = req.get("To") + ";tag=" + localTag
+	call.remoteHeader = req.get("From")
+	call.remoteTarget = req.get("Contact")
+	call.sipAddr = addr
+	call.codec, call.payloadType, call.remoteRTPAddr = codec, payloadType, remoteRTPAddr
+
+	res := ua.newResponse(req, 200, "OK")
+	res.set("To", call.localHeader)
+	res.add("Contact", fmt.Sprintf("<sip:%s@%s>", room.RoomID, ua.localAddress()))
+	res.add("Content-Type", "application/sdp")
+	res.body = call.sdp([]uint8{payloadType})
+	call.localSDP = res.body
+	call.finalResponse = res
+	call.Unlock()
+
+	if err := call.start(); err != nil {
+		ua.sfu.log.Errorf("sip gateway call %s start error: %v", call.callID, err)
+		call.hangup(false)
+		var admitErr *admissionError
+		if errors.As(err, &admitErr) {
+			ua.send(ua.newResponse(req, 486, "Busy Here"), addr)
+			return
+		}
+		ua.send(ua.newResponse(req, 500, "Server Internal Error"), addr)
+		return
+	}
+
+	ua.send(res, addr)
+	go call.retransmitUntilAcked(res)
+
+	ua.sfu.log.Infof("sip gateway call %s from %s joined room %v, codec %s", call.callID, req.get("From"), room.RoomID, codec)
+}
+
+// handleReinvite 已存在的Call-ID送來INVITE
+// 相同CSeq與Via branch為INVITE重送，回送相同的final response
+// dialog中的re-INVITE(例如session refresh、hold)以目前的SDP回覆200，RTP仍送往latch的來源
+// offer不再提供目前的codec時回覆488，session維持原狀
+func (ua *sipUserAgent) handleReinvite(call *sipCall, req *sipMessage, addr *net.UDPAddr) {
+	seq, _ := req.cseq()
+
+	call.Lock()
+	if prev := call.remoteInvite; prev != nil {
+		prevSeq, _ := prev.cseq()
+		if seq == prevSeq && sipHeaderParam(req.get("Via"), "branch") == sipHeaderParam(prev.get("Via"), "branch") {
+			res := call.finalResponse
+			call.Unlock()
+			if res != nil {
+				ua.send(res, addr)
+			}
+			return
+		}
+	}
+	call.Unlock()
+
+	if !call.matchesDialog(req, addr) {
+		ua.send(ua.newResponse(req, 481, "Call/Transaction Does Not Exist"), addr)
+		return
+	}
+
+	call.Lock()
+	var res *sipMessage
+	switch {
+	case seq <= call.remoteCSeq:
+		res = ua.newResponse(req, 500, "Server Internal Error")
+	case call.localSDP == nil:
+		// 最初的offer/answer尚未完成
+		res = ua.newResponse(req, 491, "Request Pending")
+	case len(req.body) > 0 && !sipOffersCodec(req.body, call.codec, call.payloadType):
+		res = ua.newResponse(req, 488, "Not Acceptable Here")
+	default:
+		res = ua.newResponse(req, 200, "OK")
+		res.add("Contact", fmt.Sprintf("<sip:%s@%s>", call.room.RoomID, ua.localAddress()))
+		res.add("Content-Type", "application/sdp")
+		res.body = call.localSDP
+		if contact := req.get("Contact"); contact != "" {
+			call.remoteTarget = contact
+		}
+	}
+	if seq > call.remoteCSeq {
+		call.remoteCSeq = seq
+	}
+	call.remoteInvite = req
+	call.finalResponse = res
+	call.Unlock()
+
+	ua.send(res, addr)
+	ua.sfu.log.Debugf("sip gateway call %s re-INVITE answered %d", call.callID, res.statusCode)
+}
+
+func (ua *sipUserAgent) handleResponse(res *sipMessage) {
+	call := ua.getCall(res.get("Call-ID"))
+	if call == nil {
+		return
+	}
+
+	if _, method := res.cseq(); method != "INVITE" {
+		return
+	}
+
+	switch {
+	case res.statusCode < 200:
+		call.answer()
+
+	case res.statusCode < 300:
+		call.answer()
+
+		call.Lock()
+		call.remoteHeader = res.get("To")
+		if contact := res.get("Contact"); contact != "" {
+			call.remoteTarget = contact
+		}
+		// 每個2xx(包含重送)都需要ACK，CSeq與INVITE相同
+		ack := call.newRequest("ACK")
+		seq, _ := call.invite.cseq()
+		ack.set("CSeq", fmt.Sprintf("%d ACK", seq))
+		started := call.codec != ""
+		if !started {
+			codec, payloadType, remoteRTPAddr, err := parseSIPAudioSDP(res.body, false)
+			if err != nil {
+				call.Unlock()
+				ua.sfu.log.Warnf("sip gateway call %s answer sdp error: %v", call.callID, err)
+				ua.send(ack, call.sipAddr)
+				call.hangup(true)
+				return
+			}
+			call.codec, call.payloadType, call.remoteRTPAddr = codec, payloadType, remoteRTPAddr
+			// 我方的offer有多個codec，之後的re-INVITE以選定的codec回覆
+			call.localSDP = call.sdp([]uint8{payloadType})
+		}
+		sipAddr := call.sipAddr
+		call.Unlock()
+
+		ua.send(ack, sipAddr)
+
+		if !started {
+			if err := call.start(); err != nil {
+				ua.sfu.log.Errorf("sip gateway call %s start error: %v", call.callID, err)
+				call.hangup(true)
+				return
+			}
+			ua.sfu.log.Infof("sip gateway call %s answered, joined room %v", call.callID, call.room.RoomID)
+		}
+
+	default:
+		call.answer()
+
+		// non-2xx final response的ACK屬於同一個transaction，使用INVITE的Via
+		call.Lock()
+		ack := &sipMessage{method: "ACK", requestURI: call.invite.requestURI}
+		ack.add("Via", call.invite.get("Via"))
+		ack.add("Max-Forwards", "70")
+		ack.add("From", call.localHeader)
+		ack.add("To", res.get("To"))
+		ack.add("Call-ID", call.callID)
+		seq, _ := call.invite.cseq()
+		ack.add("CSeq", fmt.Sprintf("%d ACK", seq))
+		sipAddr := call.sipAddr
+		call.Unlock()
+
+		ua.send(ack, sipAddr)
+		ua.sfu.log.Warnf("sip gateway call %s rejected: %d %s", call.callID, res.statusCode, res.reason)
+		call.hangup(false)
+	}
+}
+
+// dial 由房間撥出電話，release為admitSIPParticipant保留的名額，回傳錯誤時由呼叫端釋放
+func (ua *sipUserAgent) dial(room *ConferenceRoom, uri string, release func()) (*sipCall, error) {
+	addr, err := net.ResolveUDPAddr("udp", sipURIAddress(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	call, err := ua.newCall(uuid.NewString(), room, true, release)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadTypes := []uint8{sipPayloadTypePCMU, sipPayloadTypePCMA}
+	if sipOpusAvailable() {
+		payloadTypes = append([]uint8{sipPayloadTypeOpus}, payloadTypes...)
+	}
+
+	call.Lock()
+	call.sipAddr = addr
+	call.localHeader = fmt.Sprintf("<sip:%s@%s>;tag=%s", room.RoomID, ua.localAddress(), sipRandomToken())
+	call.remoteHeader = fmt.Sprintf("<%s>", uri)
+	call.remoteTarget = uri
+
+	invite := call.newRequest("INVITE")
+	invite.add("Contact", fmt.Sprintf("<sip:%s@%s>", room.RoomID, ua.localAddress()))
+	invite.add("Content-Type", "application/sdp")
+	invite.body = call.sdp(payloadTypes)
+	call.invite = invite
+	call.Unlock()
+
+	ua.send(invite, addr)
+	go call.retransmitUntilAnswered(invite)
+
+	ua.sfu.log.Infof("sip gateway room %v dial %s, call ID %s", room.RoomID, uri, call.callID)
+	return call, nil
+}
+
+// newCall release在hangup時呼叫，回傳錯誤時由呼叫端釋放
+func (ua *sipUserAgent) newCall(callID string, room *ConferenceRoom, outbound bool, release func()) (*sipCall, error) {
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+
+	call := &sipCall{
+		ua:       ua,
+		callID:   callID,
+		room:     room,
+		outbound: outbound,
+		rtpConn:  rtpConn,
+		release:  release,
+		ssrc:     sipRandomUint32(),
+		sequence: uint16(sipRandomUint32()),
+		acked:    make(chan struct{}),
+		answered: make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+
+	ua.Lock()
+	ua.calls[callID] = call
+	ua.Unlock()
+
+	return call, nil
+}
+
+// newRequest in-dialog request，呼叫端需持有call lock
+func (c *sipCall) newRequest(method string) *sipMessage {
+	if method != "ACK" {
+		c.cseq++
+	}
+
+	target := c.remoteTarget
+	if start := strings.IndexByte(target, '<'); start >= 0 {
+		if end := strings.IndexByte(target[start:], '>'); end >= 0 {
+			target = target[start+1 : start+end]
+		}
+	}
+
+	req := &sipMessage{method: method, requestURI: target}
+	req.add("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=z9hG4bK%s;rport", c.ua.localAddress(), sipRandomToken()))
+	req.add("Max-Forwards", "70")
+	req.add("From", c.localHeader)
+	req.add("To", c.remoteHeader)
+	req.add("Call-ID", c.callID)
+	req.add("User-Agent", sipUserAgentName)
+	req.add("CSeq", fmt.Sprintf("%d %s", c.cseq, method))
+	return req
+}
+
+// sdp 建立offer/answer，只有一個audio m line，呼叫端需持有call lock
+func (c *sipCall) sdp(payloadTypes []uint8) []byte {
+	port := c.rtpConn.LocalAddr().(*net.UDPAddr).Port
+	if c.sdpSession == 0 {
+		c.sdpSession = sipRandomUint32()
+	}
+	c.sdpVersion++
+
+	formats := make([]string, len(payloadTypes))
+	rtpmaps := &strings.Builder{}
+	for i, pt := range payloadTypes {
+		formats[i] = strconv.Itoa(int(pt))
+		switch pt {
+		case sipPayloadTypePCMU:
+			fmt.Fprintf(rtpmaps, "a=rtpmap:%d PCMU/8000\r\n", pt)
+		case sipPayloadTypePCMA:
+			fmt.Fprintf(rtpmaps, "a=rtpmap:%d PCMA/8000\r\n", pt)
+		default:
+			fmt.Fprintf(rtpmaps, "a=rtpmap:%d opus/48000/2\r\n", pt)
+		}
+	}
+
+	return []byte(fmt.Sprintf("v=0\r\n"+
+		"o=- %d %d IN IP4 %s\r\n"+
+		"s=%s\r\n"+
+		"c=IN IP4 %s\r\n"+
+		"t=0 0\r\n"+
+		"m=audio %d RTP/AVP %s\r\n"+
+		"%s"+
+		"a=ptime:20\r\n"+
+		"a=sendrecv\r\n",
+		c.sdpSession, c.sdpVersion, c.ua.sfu.config.SIPPublicIP, sipUserAgentName, c.ua.sfu.config.SIPPublicIP,
+		port, strings.Join(formats, " "), rtpmaps.String()))
+}
+
+// matchesDialog in-dialog request的From tag為對方的tag、To tag為我方的tag，且來自dialog的SIP位址
+func (c *sipCall) matchesDialog(req *sipMessage, addr *net.UDPAddr) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	remoteTag := sipHeaderParam(c.remoteHeader, "tag")
+	return remoteTag != "" && sameUDPAddr(addr, c.sipAddr) &&
+		sipHeaderParam(req.get("From"), "tag") == remoteTag &&
+		sipHeaderParam(req.get("To"), "tag") == sipHeaderParam(c.localHeader, "tag")
+}
+
+// matchesInvite CANCEL與來電的INVITE屬於同一個transaction：相同的Via branch、From tag、CSeq序號，且來自同一個SIP位址
+// 撥出的電話只有我方可以CANCEL
+func (c *sipCall) matchesInvite(req *sipMessage, addr *net.UDPAddr) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.outbound || c.invite == nil || !sameUDPAddr(addr, c.sipAddr) {
+		return false
+	}
+
+	branch := sipHeaderParam(c.invite.get("Via"), "branch")
+	seq, _ := c.invite.cseq()
+	reqSeq, _ := req.cseq()
+	return branch != "" && sipHeaderParam(req.get("Via"), "branch") == branch &&
+		sipHeaderParam(req.get("From"), "tag") == sipHeaderParam(c.invite.get("From"), "tag") &&
+		reqSeq == seq
+}
+
+// sameUDPAddr IP與port皆相同
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func (c *sipCall) ack() {
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case <-c.acked:
+	default:
+		close(c.acked)
+	}
+}
+
+func (c *sipCall) answer() {
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case <-c.answered:
+	default:
+		close(c.answered)
+	}
+}
+
+// retransmitUntilAcked UDP上的2xx需要重送直到收到ACK
+func (c *sipCall) retransmitUntilAcked(res *sipMessage) {
+	interval := sipT1
+	timeout := time.NewTimer(sipTransactionTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-c.acked:
+			return
+		case <-c.stop:
+			return
+		case <-timeout.C:
+			c.ua.sfu.log.Warnf("sip gateway call %s no ACK received", c.callID)
+			c.hangup(true)
+			return
+		case <-time.After(interval):
+			c.Lock()
+			addr := c.sipAddr
+			c.Unlock()
+			c.ua.send(res, addr)
+			if interval *= 2; interval > sipT2 {
+				interval = sipT2
+			}
+		}
+	}
+}
+
+// retransmitUntilAnswered UDP上的INVITE需要重送直到收到任何response
+func (c *sipCall) retransmitUntilAnswered(invite *sipMessage) {
+	interval := sipT1
+	timeout := time.NewTimer(sipTransactionTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-c.answered:
+			return
+		case <-c.stop:
+			return
+		case <-timeout.C:
+			c.ua.sfu.log.Warnf("sip gateway call %s invite timeout", c.callID)
+			c.hangup(false)
+			return
+		case <-time.After(interval):
+			c.Lock()
+			addr := c.sipAddr
+			c.Unlock()
+			c.ua.send(invite, addr)
+			interval *= 2
+		}
+	}
+}
+
+// start 將電話橋接進房間：電話的RTP成為房間中的track，房間混音送回電話
+func (c *sipCall) start() error {
+	c.Lock()
+	codec := c.codec
+	c.Unlock()
+
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: g711SampleRate}
+	switch codec {
+	case webrtc.MimeTypePCMA:
+		capability.MimeType = webrtc.MimeTypePCMA
+	case webrtc.MimeTypeOpus:
+		capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+		encoder, err := newOpusEncoder(c.ua.sfu.config.MixedAudioBitrate)
+		if err != nil {
+			return err
+		}
+		c.opusEncoder = encoder
+	}
+
+	// 電話的聲音與websocket參與者的track相同受MaxRoomPublishers與server bitrate限制
+	sourceID := "sip-" + c.callID
+	c.room.Lock()
+	if err := c.room.checkPublish(c.callID, webrtc.RTPCodecTypeAudio, trackLabelMicrophone); err != nil {
+		c.room.Unlock()
+		return err
+	}
+	c.room.sipCalls[c.callID] = c
+	c.room.trackPublishers[sourceID] = c.callID
+	c.room.Unlock()
+	c.room.addParticipant(c.callID, participantKindSIP)
+
+	track := c.room.addLocalTrack(capability, sourceID, sourceID, "", trackLabelMicrophone)
+	if track == nil {
+		return fmt.Errorf("room %v doesn't exist", c.room.RoomID)
+	}
+
+	output, err := c.room.addMixerPCMOutput([]string{sourceID}, c.writeRoomAudio)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.track = track
+	c.mixerOutput = output
+	c.Unlock()
+
+	go c.readRTP(sourceID)
+	return nil
+}
+
+// readRTP 電話送來的RTP寫入房間track以及混音器
+func (c *sipCall) readRTP(sourceID string) {
+	buf := make([]byte, 1500)
+	for {
+		if err := c.rtpConn.SetReadDeadline(time.Now().Add(c.ua.sfu.config.SIPRTPTimeout)); err != nil {
+			return
+		}
+
+		n, addr, err := c.rtpConn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				c.ua.sfu.log.Warnf("sip gateway call %s rtp timeout", c.callID)
+				c.hangup(true)
+			}
+			return
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte{}, buf[:n]...)); err != nil {
+			continue
+		}
+
+		if !c.acceptRTPSource(addr) {
+			continue
+		}
+
+		c.Lock()
+		payloadType, codec, track := c.payloadType, c.codec, c.track
+		c.Unlock()
+
+		// telephone-event (DTMF) 等其他payload忽略
+		if pkt.PayloadType != payloadType {
+			continue
+		}
+
+		track.forward(pkt)
+
+		mixer := c.room.getMixer()
+		if mixer == nil {
+			continue
+		}
+		switch codec {
+		case webrtc.MimeTypeOpus:
+			mixer.writeOpus(sourceID, pkt.Payload)
+		default:
+			mixer.writePCM(sourceID, g711Decode(pkt.Payload, codec == webrtc.MimeTypePCMA, &c.lastSample))
+		}
+	}
+}
+
+// acceptRTPSource symmetric RTP，NAT後的電話以第一個RTP的實際來源為準，之後其他來源的RTP丟棄，避免被改送到別的位址
+func (c *sipCall) acceptRTPSource(addr *net.UDPAddr) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.rtpLatched {
+		c.rtpLatched = true
+		c.remoteRTPAddr = addr
+		return true
+	}
+	return sameUDPAddr(addr, c.remoteRTPAddr)
+}
+
+// writeRoomAudio 混音器每20ms的輸出，編碼後送給電話
+func (c *sipCall) writeRoomAudio(pcm []int16) {
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case <-c.stop:
+		return
+	default:
+	}
+
+	if c.remoteRTPAddr == nil {
+		return
+	}
+
+	var payload []byte
+	samples := uint32(len(pcm) / g711ResampleRatio)
+	switch c.codec {
+	case webrtc.MimeTypeOpus:
+		packet := make([]byte, mixerMaxPacketSize)
+		n, err := c.opusEncoder.encode(pcm, packet)
+		if err != nil {
+			c.ua.sfu.log.Errorf("sip gateway call %s opus encode error: %v", c.callID, err)
+			return
+		}
+		payload = packet[:n]
+		samples = uint32(len(pcm))
+	default:
+		payload = g711Encode(pcm, c.codec == webrtc.MimeTypePCMA)
+	}
+
+	c.sequence++
+	c.timestamp += samples
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    c.payloadType,
+			SequenceNumber: c.sequence,
+			Timestamp:      c.timestamp,
+			SSRC:           c.ssrc,
+		},
+		Payload: payload,
+	}
+
+	raw, err := pkt.Marshal()
+	if err != nil {
+		return
+	}
+	if _, err := c.rtpConn.WriteToUDP(raw, c.remoteRTPAddr); err != nil {
+		c.ua.sfu.log.Debugf("sip gateway call %s rtp write error: %v", c.callID, err)
+	}
+}
+
+// hangup 結束通話並離開房間，sendBye為true時通知對方
+func (c *sipCall) hangup(sendBye bool) {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		_ = c.rtpConn.Close()
+
+		c.ua.Lock()
+		delete(c.ua.calls, c.callID)
+		c.ua.Unlock()
+
+		c.Lock()
+		track, output, encoder := c.track, c.mixerOutput, c.opusEncoder
+		var bye *sipMessage
+		if sendBye && c.sipAddr != nil {
+			bye = c.newRequest("BYE")
+		}
+		sipAddr := c.sipAddr
+		c.Unlock()
+
+		if bye != nil {
+			c.ua.send(bye, sipAddr)
+		}
+
+		if output != nil {
+			c.room.removeMixerOutput(output)
+		}
+
+		c.room.Lock()
+		delete(c.room.sipCalls, c.callID)
+		delete(c.room.trackPublishers, "sip-"+c.callID)
+		c.room.Unlock()
+		c.room.removeParticipant(c.callID)
+
+		if track != nil {
+			c.room.removeTrack(track)
+		}
+		c.release()
+
+		if encoder != nil {
+			// 已經close(c.stop)，之後的writeRoomAudio不會再使用encoder
+			c.Lock()
+			encoder.close()
+			c.opusEncoder = nil
+			c.Unlock()
+		}
+
+		c.ua.sfu.log.Infof("sip gateway call %s ended", c.callID)
+	})
+}
+
+// parseSIPAudioSDP 選擇audio codec，回傳codec mime type、payload type、RTP位址
+// 有opus支援時優先使用opus，否則PCMU、PCMA
+func parseSIPAudioSDP(body []byte, isOffer bool) (string, uint8, *net.UDPAddr, error) {
+	sd := &sdp.SessionDescription{}
+	if err := sd.Unmarshal(body); err != nil {
+		return "", 0, nil, err
+	}
+
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "audio" || md.MediaName.Port.Value == 0 {
+			continue
+		}
+
+		connection := sd.ConnectionInformation
+		if md.ConnectionInformation != nil {
+			connection = md.ConnectionInformation
+		}
+		if connection == nil || connection.Address == nil {
+			return "", 0, nil, errors.New("sdp missing connection address")
+		}
+
+		rtpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(connection.Address.Address, strconv.Itoa(md.MediaName.Port.Value)))
+		if err != nil {
+			return "", 0, nil, err
+		}
+
+		offered := sipAudioFormats(md)
+
+		preference := []string{webrtc.MimeTypePCMU, webrtc.MimeTypePCMA}
+		if sipOpusAvailable() {
+			preference = append([]string{webrtc.MimeTypeOpus}, preference...)
+		}
+		// answer中對方已經選定codec，依照對方的順序
+		if !isOffer && len(md.MediaName.Formats) > 0 {
+			for _, codec := range preference {
+				if pt, ok := offered[codec]; ok && strconv.Itoa(int(pt)) == md.MediaName.Formats[0] {
+					return codec, pt, rtpAddr, nil
+				}
+			}
+		}
+		for _, codec := range preference {
+			if pt, ok := offered[codec]; ok {
+				return codec, pt, rtpAddr, nil
+			}
+		}
+
+		return "", 0, nil, errSIPNoCommonCodec
+	}
+
+	return "", 0, nil, errSIPNoCommonCodec
+}
+
+// sipAudioFormats audio m line中支援的codec，key: codec mime type，value: payload type
+func sipAudioFormats(md *sdp.MediaDescription) map[string]uint8 {
+	offered := map[string]uint8{}
+	for _, format := range md.MediaName.Formats {
+		pt, err := strconv.Atoi(format)
+		if err != nil {
+			continue
+		}
+		switch pt {
+		case sipPayloadTypePCMU:
+			offered[webrtc.MimeTypePCMU] = uint8(pt)
+		case sipPayloadTypePCMA:
+			offered[webrtc.MimeTypePCMA] = uint8(pt)
+		}
+	}
+	for _, attr := range md.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		fields := strings.Fields(attr.Value)
+		if len(fields) != 2 || !strings.HasPrefix(strings.ToLower(fields[1]), "opus/48000") {
+			continue
+		}
+		if pt, err := strconv.Atoi(fields[0]); err == nil {
+			offered[webrtc.MimeTypeOpus] = uint8(pt)
+		}
+	}
+	return offered
+}
+
+// sipOffersCodec re-INVITE的offer中第一個audio m line是否仍提供目前使用的codec與payload type
+func sipOffersCodec(body []byte, codec string, payloadType uint8) bool {
+	sd := &sdp.SessionDescription{}
+	if err := sd.Unmarshal(body); err != nil {
+		return false
+	}
+
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "audio" || md.MediaName.Port.Value == 0 {
+			continue
+		}
+		pt, ok := sipAudioFormats(md)[codec]
+		return ok && pt == payloadType
+	}
+	return false
+}
+
+// sipOpusAvailable 有opus支援才能將房間混音以opus送回電話
+func sipOpusAvailable() bool {
+	// 只檢查是否能建立encoder，bitrate不影響結果
+	encoder, err := newOpusEncoder(32000)
+	if err != nil {
+		return false
+	}
+	encoder.close()
+	return true
+}
+
+func sipRandomToken() string {
+	return strings.ReplaceAll(uuid.NewString(), "-", "")[:16]
+}
+
+func sipRandomUint32() uint32 {
+	id := uuid.New()
+	return binary.BigEndian.Uint32(id[:4])
+}
+
+// getRoomByID 以room ID或alias字串取得room，ip用於限制查詢不存在alias的次數
+func (s *SFU) getRoomByID(id, ip string) (*ConferenceRoom, error) {
+	roomID, err := s.resolveRoomID(id, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	room, ok := s.getRoom(roomID)
+	if !ok {
+		return nil, fmt.Errorf("room %v doesn't exist", roomID)
+	}
+	return room, nil
+}
+
+// sipCallInfo dial API response
+type sipCallInfo struct {
+	RoomID uuid.UUID `json:"roomID"`
+	CallID string    `json:"callID"`
+}
+
+// DialSIP 由房間撥出電話，需帶X-Host-Token，body: {"uri": "sip:1000@pbx.example.com"}
+// lobby房間由host撥出的電話視同host已允許，不需要在lobby等待
+func (s *SFU) DialSIP(w http.ResponseWriter, r *http.Request) {
+	room, err := s.getRoomFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !s.checkHost(w, r, room) {
+		return
+	}
+
+	s.RLock()
+	ua := s.sip
+	s.RUnlock()
+	if ua == nil {
+		http.Error(w, errSIPGatewayNotRunning.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	req := struct {
+		URI string `json:"uri"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.URI, "sip:") {
+		http.Error(w, "request body must be {\"uri\": \"sip:...\"}", http.StatusBadRequest)
+		return
+	}
+
+	release, admitErr := room.admitSIPParticipant()
+	if admitErr != nil {
+		http.Error(w, admitErr.Error(), http.StatusConflict)
+		return
+	}
+
+	call, err := ua.dial(room, req.URI, release)
+	if err != nil {
+		release()
+		s.log.Errorf("room %v sip dial %s error: %v", room.RoomID, req.URI, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(sipCallInfo{RoomID: room.RoomID, CallID: call.callID}); err != nil {
+		s.log.Errorf("json encode err: %v", err)
+		return
+	}
+}
+
+// HangupSIP 掛斷房間中的電話，需帶X-Host-Token
+func (s *SFU) HangupSIP(w http.ResponseWriter, r *http.Request) {
+	room, err := s.getRoomFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !s.checkHost(w, r, room) {
+		return
+	}
+
+	room.RLock()
+	call, ok := room.sipCalls[mux.Vars(r)["callid"]]
+	room.RUnlock()
+	if !ok {
+		http.Error(w, errSIPCallNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	call.hangup(true)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTestSIPGateway 啟動在127.0.0.1隨機port的SIP gateway
+func newTestSIPGateway(t *testing.T, opts ...Option) (*SFU, *net.UDPAddr) {
+	t.Helper()
+
+	s, err := NewSFU(opts...)
+	if err != nil {
+		t.Fatalf("new sfu: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.StartSIPGateway("127.0.0.1:0"); err != nil {
+		t.Fatalf("start sip gateway: %v", err)
+	}
+	return s, s.sip.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// createTestRoom body為建立房間的JSON選項
+func createTestRoom(t *testing.T, s *SFU, body string) uuid.UUID {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.CreateRoom(w, httptest.NewRequest(http.MethodPost, "/create/room", strings.NewReader(body)))
+	info := createRoomResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("create room: %v, %s", err, w.Body.String())
+	}
+	return info.RoomID
+}
+
+// sipInvite 從phone送出INVITE，回傳final response的status code
+func sipInvite(t *testing.T, phone *net.UDPConn, gateway *net.UDPAddr, roomID uuid.UUID) int {
+	t.Helper()
+
+	_, res := sipInviteCall(t, phone, gateway, roomID)
+	return res.statusCode
+}
+
+// sipInviteCall 從phone送出INVITE，回傳INVITE與final response
+func sipInviteCall(t *testing.T, phone *net.UDPConn, gateway *net.UDPAddr, roomID uuid.UUID) (*sipMessage, *sipMessage) {
+	t.Helper()
+
+	local := phone.LocalAddr().(*net.UDPAddr)
+	invite := &sipMessage{method: "INVITE", requestURI: fmt.Sprintf("sip:%s@%s", roomID, gateway)}
+	invite.add("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=z9hG4bK%s", local, sipRandomToken()))
+	invite.add("From", fmt.Sprintf("<sip:phone@%s>;tag=%s", local, sipRandomToken()))
+	invite.add("To", fmt.Sprintf("<sip:%s@%s>", roomID, gateway))
+	invite.add("Call-ID", uuid.NewString())
+	invite.add("CSeq", "1 INVITE")
+	invite.add("Contact", fmt.Sprintf("<sip:phone@%s>", local))
+	invite.add("Content-Type", "application/sdp")
+	invite.body = []byte(fmt.Sprintf("v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n"+
+		"m=audio %d RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n", local.Port+1))
+
+	return invite, sipRequest(t, phone, gateway, invite)
+}
+
+// sipRequest 從phone送出request，回傳final response
+func sipRequest(t *testing.T, phone *net.UDPConn, gateway *net.UDPAddr, req *sipMessage) *sipMessage {
+	t.Helper()
+
+	if _, err := phone.WriteToUDP(req.marshal(), gateway); err != nil {
+		t.Fatalf("send %s: %v", req.method, err)
+	}
+
+	seq, _ := req.cseq()
+	buf := make([]byte, sipMaxMessageSize)
+	for {
+		if err := phone.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("set read deadline: %v", err)
+		}
+		n, _, err := phone.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("read %s response: %v", req.method, err)
+		}
+		res, err := parseSIPMessage(buf[:n])
+		if err != nil {
+			t.Fatalf("parse response: %v", err)
+		}
+		// 略過前一個request的2xx重送
+		if resSeq, method := res.cseq(); res.statusCode >= 200 && resSeq == seq && method == req.method {
+			return res
+		}
+	}
+}
+
+func TestSIPInviteLobbyRoom(t *testing.T) {
+	s, gateway := newTestSIPGateway(t)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "lobby room", body: `{"lobby": true}`, want: 403},
+		// 電話無法帶上密碼，有密碼或PIN的房間不接受來電
+		{name: "password room", body: `{"password": "secret"}`, want: 403},
+		{name: "pin room", body: `{"pin": "1234"}`, want: 403},
+		{name: "open room", body: `{}`, want: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			roomID := createTestRoom(t, s, test.body)
+
+			phone, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer phone.Close()
+
+			if code := sipInvite(t, phone, gateway, roomID); code != test.want {
+				t.Errorf("invite status = %d, want %d", code, test.want)
+			}
+		})
+	}
+}
+
+func TestSIPCallAcceptRTPSource(t *testing.T) {
+	phone := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	tests := []struct {
+		name    string
+		sources []*net.UDPAddr
+		want    []bool
+	}{
+		{
+			name:    "latch first source",
+			sources: []*net.UDPAddr{phone, {IP: net.IPv4(10, 0, 0, 1), Port: 4000}},
+			want:    []bool{true, true},
+		},
+		{
+			name:    "reject other port",
+			sources: []*net.UDPAddr{phone, {IP: net.IPv4(10, 0, 0, 1), Port: 4002}},
+			want:    []bool{true, false},
+		},
+		{
+			name:    "reject other host after latch",
+			sources: []*net.UDPAddr{phone, {IP: net.IPv4(192, 0, 2, 9), Port: 4000}, phone},
+			want:    []bool{true, false, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// SDP中的位址，NAT後的電話第一個RTP可能來自其他位址
+			c := &sipCall{remoteRTPAddr: &net.UDPAddr{IP: net.IPv4(172, 16, 0, 1), Port: 5000}}
+			for i, addr := range test.sources {
+				if got := c.acceptRTPSource(addr); got != test.want[i] {
+					t.Errorf("packet %d from %v accepted = %v, want %v", i, addr, got, test.want[i])
+				}
+			}
+			if c.remoteRTPAddr.String() != phone.String() {
+				t.Errorf("remote RTP address = %v, want %v", c.remoteRTPAddr, phone)
+			}
+		})
+	}
+}
+
+// listenTestPhone 在127.0.0.1隨機port模擬電話
+func listenTestPhone(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	phone, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { phone.Close() })
+	return phone
+}
+
+func TestSIPByeAndCancelMatchDialog(t *testing.T) {
+	s, gateway := newTestSIPGateway(t)
+	roomID := createTestRoom(t, s, `{}`)
+
+	phone := listenTestPhone(t)
+	invite, answer := sipInviteCall(t, phone, gateway, roomID)
+	if answer.statusCode != 200 {
+		t.Fatalf("invite status = %d, want 200", answer.statusCode)
+	}
+	local := phone.LocalAddr().(*net.UDPAddr)
+
+	// request 以dialog的header建立in-dialog request，modify改寫header
+	request := func(method string, modify func(req *sipMessage)) *sipMessage {
+		req := &sipMessage{method: method, requestURI: fmt.Sprintf("sip:%s@%s", roomID, gateway)}
+		req.add("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=z9hG4bK%s", local, sipRandomToken()))
+		req.add("From", invite.get("From"))
+		req.add("To", answer.get("To"))
+		req.add("Call-ID", invite.get("Call-ID"))
+		req.add("CSeq", "2 "+method)
+		if modify != nil {
+			modify(req)
+		}
+		return req
+	}
+
+	tests := []struct {
+		name  string
+		phone *net.UDPConn
+		req   *sipMessage
+		want  int
+	}{
+		{
+			name:  "bye with other from tag",
+			phone: phone,
+			req:   request("BYE", func(req *sipMessage) { req.set("From", fmt.Sprintf("<sip:phone@%s>;tag=guessed", local)) }),
+			want:  481,
+		},
+		{
+			name:  "bye with other to tag",
+			phone: phone,
+			req:   request("BYE", func(req *sipMessage) { req.set("To", fmt.Sprintf("<sip:%s@%s>;tag=guessed", roomID, gateway)) }),
+			want:  481,
+		},
+		{
+			name:  "bye from other address",
+			phone: listenTestPhone(t),
+			req:   request("BYE", nil),
+			want:  481,
+		},
+		{
+			name:  "cancel with other branch",
+			phone: phone,
+			req: request("CANCEL", func(req *sipMessage) {
+				req.set("To", invite.get("To"))
+				req.set("CSeq", "1 CANCEL")
+			}),
+			want: 481,
+		},
+		{
+			name:  "bye in dialog",
+			phone: phone,
+			req:   request("BYE", nil),
+			want:  200,
+		},
+	}
+
+	for _, test := range tests {
+		if res := sipRequest(t, test.phone, gateway, test.req); res.statusCode != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, res.statusCode, test.want)
+		}
+		if ended := s.sip.getCall(invite.get("Call-ID")) == nil; ended != (test.want == 200) {
+			t.Errorf("%s: call ended = %v, want %v", test.name, ended, test.want == 200)
+		}
+	}
+}
+
+func TestSIPCancelMatchesInvite(t *testing.T) {
+	s, gateway := newTestSIPGateway(t)
+	roomID := createTestRoom(t, s, `{}`)
+
+	phone := listenTestPhone(t)
+	invite, answer := sipInviteCall(t, phone, gateway, roomID)
+	if answer.statusCode != 200 {
+		t.Fatalf("invite status = %d, want 200", answer.statusCode)
+	}
+
+	// CANCEL與INVITE使用相同的Via、From、To、Call-ID與CSeq序號
+	cancel := &sipMessage{method: "CANCEL", requestURI: invite.requestURI}
+	for _, name := range []string{"Via", "From", "To", "Call-ID"} {
+		cancel.add(name, invite.get(name))
+	}
+	cancel.add("CSeq", "1 CANCEL")
+
+	if res := sipRequest(t, phone, gateway, cancel); res.statusCode != 200 {
+		t.Errorf("cancel status = %d, want 200", res.statusCode)
+	}
+	if s.sip.getCall(invite.get("Call-ID")) != nil {
+		t.Error("call still exists after cancel")
+	}
+}
+
+func TestSIPReinvite(t *testing.T) {
+	s, gateway := newTestSIPGateway(t)
+	roomID := createTestRoom(t, s, `{}`)
+
+	phone := listenTestPhone(t)
+	invite, answer := sipInviteCall(t, phone, gateway, roomID)
+	if answer.statusCode != 200 {
+		t.Fatalf("invite status = %d, want 200", answer.statusCode)
+	}
+	local := phone.LocalAddr().(*net.UDPAddr)
+
+	// reinvite dialog中的INVITE，codec為offer的rtpmap
+	reinvite := func(seq int, rtpmap string) *sipMessage {
+		req := &sipMessage{method: "INVITE", requestURI: fmt.Sprintf("sip:%s@%s", roomID, gateway)}
+		req.add("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=z9hG4bK%s", local, sipRandomToken()))
+		req.add("From", invite.get("From"))
+		req.add("To", answer.get("To"))
+		req.add("Call-ID", invite.get("Call-ID"))
+		req.add("CSeq", fmt.Sprintf("%d INVITE", seq))
+		req.add("Contact", invite.get("Contact"))
+		req.add("Content-Type", "application/sdp")
+		req.body = []byte(fmt.Sprintf("v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n"+
+			"m=audio %d RTP/AVP %s\r\n", local.Port+1, rtpmap))
+		return req
+	}
+
+	tests := []struct {
+		name string
+		req  *sipMessage
+		want int
+		// sameBody 回覆的SDP與最初的answer相同
+		sameBody bool
+	}{
+		{name: "invite retransmission", req: invite, want: 200, sameBody: true},
+		{name: "session refresh", req: reinvite(2, "0\r\na=rtpmap:0 PCMU/8000"), want: 200, sameBody: true},
+		{name: "codec change", req: reinvite(3, "8\r\na=rtpmap:8 PCMA/8000"), want: 488},
+		{name: "stale cseq", req: reinvite(3, "0\r\na=rtpmap:0 PCMU/8000"), want: 500},
+	}
+
+	for _, test := range tests {
+		res := sipRequest(t, phone, gateway, test.req)
+		if res.statusCode != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, res.statusCode, test.want)
+		}
+		if res.get("CSeq") != test.req.get("CSeq") {
+			t.Errorf("%s: CSeq = %q, want %q", test.name, res.get("CSeq"), test.req.get("CSeq"))
+		}
+		if test.sameBody && string(res.body) != string(answer.body) {
+			t.Errorf("%s: sdp = %q, want %q", test.name, res.body, answer.body)
+		}
+	}
+
+	if s.sip.getCall(invite.get("Call-ID")) == nil {
+		t.Error("call ended after re-INVITE")
+	}
+}
+
+func TestSIPAdmission(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+	}{
+		{name: "room participants", configure: func(c *Config) { c.MaxRoomParticipants = 1 }},
+		{name: "room publishers", configure: func(c *Config) { c.MaxRoomPublishers = 1 }},
+		{name: "server peer connections", configure: func(c *Config) { c.MaxPeerConnections = 1 }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			test.configure(&config)
+			s, gateway := newTestSIPGateway(t, WithConfig(config))
+			roomID := createTestRoom(t, s, `{}`)
+
+			if code := sipInvite(t, listenTestPhone(t), gateway, roomID); code != 200 {
+				t.Fatalf("first invite status = %d, want 200", code)
+			}
+			if code := sipInvite(t, listenTestPhone(t), gateway, roomID); code != 486 {
+				t.Errorf("second invite status = %d, want 486", code)
+			}
+		})
+	}
+}
+
+func TestSIPDialReservesParticipant(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxRoomParticipants = 1
+	s, gateway := newTestSIPGateway(t, WithConfig(config))
+
+	w := httptest.NewRecorder()
+	s.CreateRoom(w, httptest.NewRequest(http.MethodPost, "/create/room", strings.NewReader(`{}`)))
+	info := createRoomResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("create room: %v", err)
+	}
+
+	dial := func() *httptest.ResponseRecorder {
+		t.Helper()
+
+		// 撥往不會接聽的電話，通話維持在等待回應的狀態
+		body := fmt.Sprintf(`{"uri": "sip:phone@%s"}`, listenTestPhone(t).LocalAddr())
+		r := httptest.NewRequest(http.MethodPost, "/room/"+info.RoomID.String()+"/sip", strings.NewReader(body))
+		r.Header.Set(hostTokenHeader, info.HostToken)
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	res := dial()
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("dial status = %d %s, want %d", res.Code, res.Body.String(), http.StatusAccepted)
+	}
+	call := sipCallInfo{}
+	if err := json.NewDecoder(res.Body).Decode(&call); err != nil {
+		t.Fatalf("decode dial response: %v", err)
+	}
+
+	// 尚未接通的電話已佔用名額
+	if res := dial(); res.Code != http.StatusConflict {
+		t.Errorf("second dial status = %d, want %d", res.Code, http.StatusConflict)
+	}
+	if code := sipInvite(t, listenTestPhone(t), gateway, info.RoomID); code != 486 {
+		t.Errorf("invite while dialing status = %d, want 486", code)
+	}
+
+	// 掛斷後釋放名額
+	pending := s.sip.getCall(call.CallID)
+	if pending == nil {
+		t.Fatalf("call %s not found", call.CallID)
+	}
+	pending.hangup(false)
+	if code := sipInvite(t, listenTestPhone(t), gateway, info.RoomID); code != 200 {
+		t.Errorf("invite after hangup status = %d, want 200", code)
+	}
+}
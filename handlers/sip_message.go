@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errSIPMalformed = errors.New("malformed sip message")
+
+// sip header compact form (RFC 3261 7.3.3)
+var sipCompactHeaders = map[string]string{
+	"v": "Via",
+	"f": "From",
+	"t": "To",
+	"i": "Call-ID",
+	"m": "Contact",
+	"l": "Content-Length",
+	"c": "Content-Type",
+}
+
+type sipHeader struct {
+	name  string
+	value string
+}
+
+// sipMessage SIP request或response，只實作gateway需要的部分
+type sipMessage struct {
+	// request
+	method     string
+	requestURI string
+
+	// response
+	statusCode int
+	reason     string
+
+	headers []sipHeader
+	body    []byte
+}
+
+func (m *sipMessage) isRequest() bool {
+	return m.method != ""
+}
+
+// get 取得第一個同名header，名稱不分大小寫
+func (m *sipMessage) get(name string) string {
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, name) {
+			return h.value
+		}
+	}
+	return ""
+}
+
+// getAll 取得所有同名header，例如多個Via
+func (m *sipMessage) getAll(name string) []string {
+	values := []string{}
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, name) {
+			values = append(values, h.value)
+		}
+	}
+	return values
+}
+
+func (m *sipMessage) set(name, value string) {
+	for i := range m.headers {
+		if strings.EqualFold(m.headers[i].name, name) {
+			m.headers[i].value = value
+			return
+		}
+	}
+	m.add(name, value)
+}
+
+func (m *sipMessage) add(name, value string) {
+	m.headers = append(m.headers, sipHeader{name: name, value: value})
+}
+
+// cseq 回傳CSeq的序號與method
+func (m *sipMessage) cseq() (uint32, string) {
+	fields := strings.Fields(m.get("CSeq"))
+	if len(fields) != 2 {
+		return 0, ""
+	}
+	seq, _ := strconv.ParseUint(fields[0], 10, 32)
+	return uint32(seq), fields[1]
+}
+
+func (m *sipMessage) marshal() []byte {
+	b := &bytes.Buffer{}
+	if m.isRequest() {
+		fmt.Fprintf(b, "%s %s SIP/2.0\r\n", m.method, m.requestURI)
+	} else {
+		fmt.Fprintf(b, "SIP/2.0 %d %s\r\n", m.statusCode, m.reason)
+	}
+
+	for _, h := range m.headers {
+		if strings.EqualFold(h.name, "Content-Length") {
+			continue
+		}
+		fmt.Fprintf(b, "%s: %s\r\n", h.name, h.value)
+	}
+	fmt.Fprintf(b, "Content-Length: %d\r\n\r\n", len(m.body))
+	b.Write(m.body)
+
+	return b.Bytes()
+}
+
+func parseSIPMessage(data []byte) (*sipMessage, error) {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, errSIPMalformed
+	}
+
+	lines := strings.Split(string(data[:headerEnd]), "\r\n")
+	m := &sipMessage{}
+
+	startLine := strings.SplitN(lines[0], " ", 3)
+	if len(startLine) != 3 {
+		return nil, errSIPMalformed
+	}
+	if startLine[0] == "SIP/2.0" {
+		code, err := strconv.Atoi(startLine[1])
+		if err != nil {
+			return nil, errSIPMalformed
+		}
+		m.statusCode = code
+		m.reason = startLine[2]
+	} else {
+		if startLine[2] != "SIP/2.0" {
+			return nil, errSIPMalformed
+		}
+		m.method = startLine[0]
+		m.requestURI = startLine[1]
+	}
+
+	for _, line := range lines[1:] {
+		// header folding
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(m.headers) > 0 {
+			m.headers[len(m.headers)-1].value += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			return nil, errSIPMalformed
+		}
+		name := strings.TrimSpace(line[:colon])
+		if full, ok := sipCompactHeaders[strings.ToLower(name)]; ok {
+			name = full
+		}
+		m.add(name, strings.TrimSpace(line[colon+1:]))
+	}
+
+	body := data[headerEnd+4:]
+	if l := m.get("Content-Length"); l != "" {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 || length > len(body) {
+			return nil, errSIPMalformed
+		}
+		body = body[:length]
+	}
+	m.body = append([]byte{}, body...)
+
+	return m, nil
+}
+
+// sipHeaderParam 取得header中 ;name=value 參數，例如 To的tag
+func sipHeaderParam(value, name string) string {
+	// 只看 > 之後的參數，避免取到URI中的參數
+	if i := strings.LastIndexByte(value, '>'); i >= 0 {
+		value = value[i+1:]
+	}
+
+	for _, param := range strings.Split(value, ";")[1:] {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if strings.EqualFold(kv[0], name) {
+			if len(kv) == 2 {
+				return kv[1]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// sipURIUser 取得 sip:user@host 中的user
+func sipURIUser(value string) string {
+	if start := strings.IndexByte(value, '<'); start >= 0 {
+		if end := strings.IndexByte(value[start:], '>'); end >= 0 {
+			value = value[start+1 : start+end]
+		}
+	}
+
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "sips:"), "sip:")
+	at := strings.IndexByte(value, '@')
+	if at < 0 {
+		return ""
+	}
+	return value[:at]
+}
+
+// sipURIAddress 取得 sip:user@host:port 中的host:port，沒有port時使用5060
+func sipURIAddress(value string) string {
+	if start := strings.IndexByte(value, '<'); start >= 0 {
+		if end := strings.IndexByte(value[start:], '>'); end >= 0 {
+			value = value[start+1 : start+end]
+		}
+	}
+
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "sips:"), "sip:")
+	if at := strings.IndexByte(value, '@'); at >= 0 {
+		value = value[at+1:]
+	}
+	if semicolon := strings.IndexByte(value, ';'); semicolon >= 0 {
+		value = value[:semicolon]
+	}
+	if !strings.Contains(value, ":") {
+		value += ":5060"
+	}
+	return value
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSIPMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want *sipMessage
+	}{
+		{
+			name: "request",
+			data: "INVITE sip:room@sfu.test SIP/2.0\r\nVia: SIP/2.0/UDP 10.0.0.1:5060\r\nCall-ID: abc\r\nContent-Length: 4\r\n\r\nv=0\n",
+			want: &sipMessage{
+				method:     "INVITE",
+				requestURI: "sip:room@sfu.test",
+				headers: []sipHeader{
+					{name: "Via", value: "SIP/2.0/UDP 10.0.0.1:5060"},
+					{name: "Call-ID", value: "abc"},
+					{name: "Content-Length", value: "4"},
+				},
+				body: []byte("v=0\n"),
+			},
+		},
+		{
+			name: "response",
+			data: "SIP/2.0 180 Ringing\r\nCSeq: 1 INVITE\r\n\r\n",
+			want: &sipMessage{
+				statusCode: 180,
+				reason:     "Ringing",
+				headers:    []sipHeader{{name: "CSeq", value: "1 INVITE"}},
+				body:       []byte{},
+			},
+		},
+		{
+			name: "compact headers and folding",
+			data: "BYE sip:a@b SIP/2.0\r\ni: abc\r\nf: <sip:a@b>\r\n ;tag=1\r\nl: 0\r\n\r\n",
+			want: &sipMessage{
+				method:     "BYE",
+				requestURI: "sip:a@b",
+				headers: []sipHeader{
+					{name: "Call-ID", value: "abc"},
+					{name: "From", value: "<sip:a@b> ;tag=1"},
+					{name: "Content-Length", value: "0"},
+				},
+				body: []byte{},
+			},
+		},
+		{
+			name: "body longer than content length",
+			data: "ACK sip:a@b SIP/2.0\r\nContent-Length: 2\r\n\r\nabcd",
+			want: &sipMessage{
+				method:     "ACK",
+				requestURI: "sip:a@b",
+				headers:    []sipHeader{{name: "Content-Length", value: "2"}},
+				body:       []byte("ab"),
+			},
+		},
+		{name: "no header end", data: "INVITE sip:a@b SIP/2.0\r\nCall-ID: abc\r\n"},
+		{name: "short start line", data: "INVITE sip:a@b\r\n\r\n"},
+		{name: "wrong version", data: "INVITE sip:a@b SIP/3.0\r\n\r\n"},
+		{name: "invalid status code", data: "SIP/2.0 OK fine\r\n\r\n"},
+		{name: "header without colon", data: "BYE sip:a@b SIP/2.0\r\nCall-ID abc\r\n\r\n"},
+		{name: "negative content length", data: "BYE sip:a@b SIP/2.0\r\nContent-Length: -1\r\n\r\n"},
+		{name: "content length too long", data: "BYE sip:a@b SIP/2.0\r\nContent-Length: 10\r\n\r\nabc"},
+		{name: "invalid content length", data: "BYE sip:a@b SIP/2.0\r\nContent-Length: ten\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSIPMessage([]byte(tt.data))
+		if tt.want == nil {
+			if err != errSIPMalformed {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, errSIPMalformed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSIPMessageRoundTrip(t *testing.T) {
+	m := &sipMessage{method: "INVITE", requestURI: "sip:1000@pbx.test"}
+	m.add("Via", "SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bK1")
+	m.add("CSeq", "2 INVITE")
+	m.add("Content-Length", "99")
+	m.body = []byte("v=0\r\n")
+
+	got, err := parseSIPMessage(m.marshal())
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if seq, method := got.cseq(); seq != 2 || method != "INVITE" {
+		t.Errorf("cseq = %d %s, want 2 INVITE", seq, method)
+	}
+	if got.get("content-length") != "5" || string(got.body) != "v=0\r\n" {
+		t.Errorf("body = %q, content length %s", got.body, got.get("Content-Length"))
+	}
+}
+
+func TestSIPHeaderValues(t *testing.T) {
+	tests := []struct {
+		value, tag, user, address string
+	}{
+		{value: "<sip:1000@pbx.test;transport=udp>;tag=abc", tag: "abc", user: "1000", address: "pbx.test:5060"},
+		{value: "\"Alice\" <sips:alice@10.0.0.1:5070>", user: "alice", address: "10.0.0.1:5070"},
+		{value: "sip:room@sfu.test;tag=x", tag: "x", user: "room", address: "sfu.test:5060"},
+		{value: "sip:sfu.test", address: "sfu.test:5060"},
+	}
+
+	for _, tt := range tests {
+		if tag := sipHeaderParam(tt.value, "tag"); tag != tt.tag {
+			t.Errorf("%s tag = %q, want %q", tt.value, tag, tt.tag)
+		}
+		if user := sipURIUser(tt.value); user != tt.user {
+			t.Errorf("%s user = %q, want %q", tt.value, user, tt.user)
+		}
+		if address := sipURIAddress(tt.value); address != tt.address {
+			t.Errorf("%s address = %q, want %q", tt.value, address, tt.address)
+		}
+	}
+}
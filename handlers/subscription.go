@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// subscribeQuery ?subscribe=none 加入時不訂閱任何track，之後以subscribe event選擇，適合分頁顯示的grid view
+const subscribeQuery = "subscribe"
+
+// subscriptionRequest subscribe、unsubscribe、pause、resume event的payload
+// All為true時subscribe訂閱所有track(包含之後加入的)，unsubscribe取消所有訂閱
+type subscriptionRequest struct {
+	All            bool     `json:"all,omitempty"`
+	ParticipantIDs []string `json:"participantIDs,omitempty"`
+	TrackIDs       []string `json:"trackIDs,omitempty"`
+}
+
+// subscription 單一連線訂閱的track，只在持有room lock時讀寫
+// all時訂閱除了excluded以外的所有track，否則只訂閱指定的participant與track
+type subscription struct {
+	all bool
+
+	participants map[string]bool
+	tracks       map[string]bool
+
+	excludedParticipants map[string]bool
+	excludedTracks       map[string]bool
+}
+
+func newSubscription(all bool) *subscription {
+	return &subscription{
+		all:                  all,
+		participants:         make(map[string]bool),
+		tracks:               make(map[string]bool),
+		excludedParticipants: make(map[string]bool),
+		excludedTracks:       make(map[string]bool),
+	}
+}
+
+// wants participantID為track的publisher，SIP與relay過來的track為空字串，只能以track ID訂閱
+func (s *subscription) wants(trackID, participantID string) bool {
+	if s.tracks[trackID] || (participantID != "" && s.participants[participantID]) {
+		return true
+	}
+	if !s.all {
+		return false
+	}
+	return !s.excludedTracks[trackID] && (participantID == "" || !s.excludedParticipants[participantID])
+}
+
+func (s *subscription) subscribe(req *subscriptionRequest) {
+	if req.All {
+		s.all = true
+		s.excludedParticipants = make(map[string]bool)
+		s.excludedTracks = make(map[string]bool)
+	}
+	for _, id := range req.ParticipantIDs {
+		s.participants[id] = true
+		delete(s.excludedParticipants, id)
+	}
+	for _, id := range req.TrackIDs {
+		s.tracks[id] = true
+		delete(s.excludedTracks, id)
+	}
+}
+
+func (s *subscription) unsubscribe(req *subscriptionRequest) {
+	if req.All {
+		s.all = false
+		s.participants = make(map[string]bool)
+		s.tracks = make(map[string]bool)
+	}
+	for _, id := range req.ParticipantIDs {
+		delete(s.participants, id)
+		if s.all {
+			s.excludedParticipants[id] = true
+		}
+	}
+	for _, id := range req.TrackIDs {
+		delete(s.tracks, id)
+		if s.all {
+			s.excludedTracks[id] = true
+		}
+	}
+}
+
+// subscriptionEventHandler 處理client的subscribe、unsubscribe，更新後重新signal
+func (r *ConferenceRoom) subscriptionEventHandler(sub *subscription) func(n *negotiator, message *signalingMessage) bool {
+	return func(n *negotiator, message *signalingMessage) bool {
+		if message.Event != "subscribe" && message.Event != "unsubscribe" {
+			return false
+		}
+
+		req := subscriptionRequest{}
+		if err := json.Unmarshal(message.Data, &req); err != nil || (!req.All && len(req.ParticipantIDs) == 0 && len(req.TrackIDs) == 0) {
+			n.replyError(message.ID, signalingErrInvalidPayload, fmt.Errorf("%w: all, participantIDs or trackIDs required", errInvalidPayload))
+			return true
+		}
+
+		r.Lock()
+		if message.Event == "subscribe" {
+			sub.subscribe(&req)
+		} else {
+			sub.unsubscribe(&req)
+		}
+		r.Unlock()
+
+		r.signalPeerConnections()
+		return true
+	}
+}
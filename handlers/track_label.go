@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// publisher以trackLabel event標示track的用途，未標示時依kind視為camera或microphone
+const (
+	trackLabelCamera      = "camera"
+	trackLabelMicrophone  = "microphone"
+	trackLabelScreen      = "screen"
+	trackLabelScreenAudio = "screenAudio"
+)
+
+// admissionScreenShareBusy ExclusiveScreenShare時已有其他參與者在分享畫面
+const admissionScreenShareBusy = "screenShareBusy"
+
+// trackLabel trackLabel event的payload，需在送出帶有此track的answer或offer之前送出
+type trackLabel struct {
+	TrackID string `json:"trackID"`
+	Label   string `json:"label"`
+}
+
+// trackInfo tracks event中的一個track
+type trackInfo struct {
+	TrackID  string `json:"trackID"`
+	StreamID string `json:"streamID"`
+	Kind     string `json:"kind"`
+	Label    string `json:"label"`
+	// ParticipantID 此node上的publisher，電話為call ID，relay過來的track為空字串
+	ParticipantID string `json:"participantID,omitempty"`
+	// Subscribed 此連線是否訂閱此track，未訂閱的track不會出現在offer中
+	Subscribed bool `json:"subscribed"`
+}
+
+// trackList tracks event的payload，此連線可以訂閱的所有track，在offer之前或track列表變動時送出
+type trackList struct {
+	Tracks []trackInfo `json:"tracks"`
+}
+
+// defaultTrackLabel 未標示的track
+func defaultTrackLabel(kind webrtc.RTPCodecType) string {
+	if kind == webrtc.RTPCodecTypeAudio {
+		return trackLabelMicrophone
+	}
+	return trackLabelCamera
+}
+
+func isScreenLabel(label string) bool {
+	return label == trackLabelScreen || label == trackLabelScreenAudio
+}
+
+// validTrackLabel label是否為已知的用途
+func validTrackLabel(label string) bool {
+	switch label {
+	case trackLabelCamera, trackLabelMicrophone, trackLabelScreen, trackLabelScreenAudio:
+		return true
+	}
+	return false
+}
+
+// pendingLabels 單一連線收到但track尚未到達的label，key: track ID
+type pendingLabels struct {
+	labels map[string]string
+
+	sync.Mutex
+}
+
+func newPendingLabels() *pendingLabels {
+	return &pendingLabels{labels: make(map[string]string)}
+}
+
+// take OnTrack時取出label，沒有標示或label與kind不符時使用預設值
+func (p *pendingLabels) take(trackID string, kind webrtc.RTPCodecType) string {
+	p.Lock()
+	label, ok := p.labels[trackID]
+	delete(p.labels, trackID)
+	p.Unlock()
+
+	if !ok || (label == trackLabelScreen || label == trackLabelCamera) != (kind == webrtc.RTPCodecTypeVideo) {
+		return defaultTrackLabel(kind)
+	}
+	return label
+}
+
+func (p *pendingLabels) set(trackID, label string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.labels[trackID] = label
+}
+
+// eventHandler 處理publisher送出的trackLabel
+func (p *pendingLabels) eventHandler() func(n *negotiator, message *signalingMessage) bool {
+	return func(n *negotiator, message *signalingMessage) bool {
+		if message.Event != "trackLabel" {
+			return false
+		}
+
+		l := trackLabel{}
+		if err := json.Unmarshal(message.Data, &l); err != nil || l.TrackID == "" || !validTrackLabel(l.Label) {
+			n.replyError(message.ID, signalingErrInvalidPayload, fmt.Errorf("%w: trackID and label (camera, microphone, screen, screenAudio) required", errInvalidPayload))
+			return true
+		}
+
+		p.set(l.TrackID, l.Label)
+		return true
+	}
+}
+
+// trackLabelOf track的用途，呼叫者需持有room lock
+func (r *ConferenceRoom) trackLabelOf(trackID string, kind webrtc.RTPCodecType) string {
+	if label, ok := r.trackLabels[trackID]; ok {
+		return label
+	}
+	return defaultTrackLabel(kind)
+}
+
+// checkScreenShare ExclusiveScreenShare時只允許一個參與者分享畫面，同一個參與者可以同時有screen與screenAudio，呼叫者需持有room lock
+func (r *ConferenceRoom) checkScreenShare(publisher string) *admissionError {
+	if !r.sfu.config.ExclusiveScreenShare {
+		return nil
+	}
+
+	for id, label := range r.trackLabels {
+		if isScreenLabel(label) && r.trackPublishers[id] != publisher {
+			return &admissionError{code: admissionScreenShareBusy, reason: fmt.Sprintf("room %v screen is already shared", r.RoomID)}
+		}
+	}
+	return nil
+}
+
+// screenFirst tracks event中track的排序，screen share在前，其餘依track ID
+func screenFirst(labelA, idA, labelB, idB string) bool {
+	if isScreenLabel(labelA) != isScreenLabel(labelB) {
+		return isScreenLabel(labelA)
+	}
+	return idA < idB
+}
+
+// trackList available為此連線可以訂閱的track，subscribed為其中已訂閱的track，screen share排在最前面，呼叫者需持有room lock
+func (c *clientConnectionState) trackList(r *ConferenceRoom, available, subscribed map[string]localTrack) *trackList {
+	list := &trackList{Tracks: make([]trackInfo, 0, len(available))}
+	for id, track := range available {
+		_, ok := subscribed[id]
+		label := r.trackLabelOf(id, track.Kind())
+		if c.mixedAudio != nil && id == c.mixedAudio.ID() {
+			label = trackLabelMicrophone
+		}
+
+		list.Tracks = append(list.Tracks, trackInfo{
+			TrackID:       id,
+			StreamID:      track.StreamID(),
+			Kind:          track.Kind().String(),
+			Label:         label,
+			ParticipantID: r.trackPublishers[id],
+			Subscribed:    ok,
+		})
+	}
+
+	sort.Slice(list.Tracks, func(i, j int) bool {
+		a, b := list.Tracks[i], list.Tracks[j]
+		return screenFirst(a.Label, a.TrackID, b.Label, b.TrackID)
+	})
+	return list
+}
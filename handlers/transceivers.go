@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// publishQuery ?publish=audio,video,video 宣告要publish的track，server依此建立接收用的transceiver
+// 空字串為只收看，未帶此參數時沿用舊版的兩個video與一個audio
+const publishQuery = "publish"
+
+// admissionTooManyTracks 參與者接收用的transceiver已達MaxPublishTracks
+const admissionTooManyTracks = "tooManyTracks"
+
+// defaultReceiveKinds 未宣告publish的舊版client
+var defaultReceiveKinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}
+
+// publishRequest publish event的payload，請server新增一個接收kind的transceiver並重新發送offer
+type publishRequest struct {
+	Kind string `json:"kind"`
+}
+
+// parsePublishKinds 解析?publish=，超過max(0為不限制)時回傳錯誤
+func parsePublishKinds(query url.Values, max int) ([]webrtc.RTPCodecType, error) {
+	if _, ok := query[publishQuery]; !ok {
+		return defaultReceiveKinds, nil
+	}
+
+	kinds := []webrtc.RTPCodecType{}
+	for _, value := range strings.Split(query.Get(publishQuery), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+
+		kind := webrtc.NewRTPCodecType(value)
+		if kind == 0 {
+			return nil, fmt.Errorf("%w: unknown publish kind %q", errInvalidPayload, value)
+		}
+		kinds = append(kinds, kind)
+	}
+
+	if max > 0 && len(kinds) > max {
+		return nil, fmt.Errorf("%w: publish %d tracks, limit %d", errInvalidPayload, len(kinds), max)
+	}
+	return kinds, nil
+}
+
+// publishTransceivers 參與者用來publish的transceiver
+// pion的AddTrack會為downTrack建立sendrecv transceiver，因此不能以direction判斷，server建立的接收用transceiver另外記錄
+type publishTransceivers struct {
+	pc      *webrtc.PeerConnection
+	created map[*webrtc.RTPTransceiver]bool
+
+	sync.Mutex
+}
+
+func newPublishTransceivers(pc *webrtc.PeerConnection) *publishTransceivers {
+	return &publishTransceivers{
+		pc:      pc,
+		created: make(map[*webrtc.RTPTransceiver]bool),
+	}
+}
+
+// count server建立的接收用transceiver(尚未收到track也計入)，加上client offer新增或client送出track的其他transceiver
+func (p *publishTransceivers) count() int {
+	p.Lock()
+	defer p.Unlock()
+
+	count := 0
+	for _, t := range p.pc.GetTransceivers() {
+		if p.created[t] || (t.Receiver() != nil && t.Receiver().Track() != nil) {
+			count++
+		}
+	}
+	return count
+}
+
+// countWithOffer count加上client offer中新增的publish m-line(sendonly、sendrecv的audio/video)
+// 已計入count的transceiver以mid對應，不重複計算
+func (p *publishTransceivers) countWithOffer(offer webrtc.SessionDescription) (int, error) {
+	sd := &sdp.SessionDescription{}
+	if err := sd.Unmarshal([]byte(offer.SDP)); err != nil {
+		return 0, err
+	}
+
+	p.Lock()
+	count := 0
+	counted := map[string]bool{}
+	for _, t := range p.pc.GetTransceivers() {
+		if p.created[t] || (t.Receiver() != nil && t.Receiver().Track() != nil) {
+			count++
+			if mid := t.Mid(); mid != "" {
+				counted[mid] = true
+			}
+		}
+	}
+	p.Unlock()
+
+	for _, md := range sd.MediaDescriptions {
+		if webrtc.NewRTPCodecType(md.MediaName.Media) == 0 || md.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := md.Attribute("recvonly"); ok {
+			continue
+		}
+		if _, ok := md.Attribute("inactive"); ok {
+			continue
+		}
+		if mid, _ := md.Attribute("mid"); !counted[mid] {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// publishOfferCheck client自行發送的offer可以新增任意數量的publish m-line，SetRemoteDescription前檢查MaxPublishTracks
+// 無法解析的SDP交由SetRemoteDescription回報錯誤
+func (r *ConferenceRoom) publishOfferCheck(p *publishTransceivers) func(offer webrtc.SessionDescription) *admissionError {
+	return func(offer webrtc.SessionDescription) *admissionError {
+		max := r.sfu.config.MaxPublishTracks
+		if max <= 0 {
+			return nil
+		}
+
+		count, err := p.countWithOffer(offer)
+		if err != nil || count <= max {
+			return nil
+		}
+		return &admissionError{code: admissionTooManyTracks, reason: fmt.Sprintf("offer publishes %d tracks, limit %d", count, max)}
+	}
+}
+
+// addReceiveTransceiver 新增一個recvonly transceiver，會觸發negotiation needed
+func (r *ConferenceRoom) addReceiveTransceiver(p *publishTransceivers, kind webrtc.RTPCodecType) error {
+	transceiver, err := p.pc.AddTransceiverFromKind(kind,
+		webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.created[transceiver] = true
+	p.Unlock()
+
+	if kind == webrtc.RTPCodecTypeVideo && r.sfu.config.PreferH264Video {
+		if err := transceiver.SetCodecPreferences(h264CodecPreferences); err != nil {
+			r.sfu.log.Errorf("transceiver SetCodecPreferences err: %v", err)
+		}
+	}
+	return nil
+}
+
+// publishEventHandler 處理client在通話中送出的publish，新增transceiver後重新發送offer
+func (r *ConferenceRoom) publishEventHandler(p *publishTransceivers) func(n *negotiator, message *signalingMessage) bool {
+	return func(n *negotiator, message *signalingMessage) bool {
+		if message.Event != "publish" {
+			return false
+		}
+
+		req := publishRequest{}
+		if err := json.Unmarshal(message.Data, &req); err != nil || webrtc.NewRTPCodecType(req.Kind) == 0 {
+			n.replyError(message.ID, signalingErrInvalidPayload, fmt.Errorf("%w: kind must be audio or video", errInvalidPayload))
+			return true
+		}
+
+		if max := r.sfu.config.MaxPublishTracks; max > 0 && p.count() >= max {
+			n.replyError(message.ID, admissionTooManyTracks, fmt.Errorf("participant has %d publish transceivers", max))
+			return true
+		}
+
+		if err := r.addReceiveTransceiver(p, webrtc.NewRTPCodecType(req.Kind)); err != nil {
+			n.replyError(message.ID, signalingErrNegotiation, err)
+			return true
+		}
+		n.requestOffer()
+		return true
+	}
+}
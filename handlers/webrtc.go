@@ -2,96 +2,242 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"sort"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
-	"webrtc_sfu_conference/conf"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
 )
 
-var webrtcSrv = newWebRTCServer()
-
-type webRTCServer struct {
-	Rooms map[uuid.UUID]*ConferenceRoom
-	sync.RWMutex
-}
-
-func newWebRTCServer() *webRTCServer {
-	return &webRTCServer{
-		Rooms: make(map[uuid.UUID]*ConferenceRoom),
-	}
+// h264CodecPreferences 與預設MediaEngine註冊的H264 (packetization-mode=1) 相同，PayloadType由MediaEngine決定
+var h264CodecPreferences = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}},
+		},
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
+			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}},
+		},
+	},
 }
 
 // webSocketUpgrader 使用於webRTC peerConnection建立，需要做 CORS Domain 給外部的服務作為連接使用，因此always return true
 // 此func主要作為避免跨站點攻擊 cross-site request forgery。
+// Subprotocols 協商signaling協定版本，見signaling_protocol.go
 var webSocketUpgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: signalingSubprotocols,
 }
 
-func CreateRoom(w http.ResponseWriter, r *http.Request) {
-	room := newConferenceRoom()
+// createRoomRequest 建立房間的選項，body可省略
+type createRoomRequest struct {
+	// password或pin，加入房間時需帶X-Room-Password header或密碼表單設定的cookie
+	roomPassword
 
-	roomInfo := room.makeRoomInfoResponse()
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(roomInfo); err != nil {
-		Errorf("json encode err: %v", err)
-		return
+	// Lobby 參與者需要host允許才能加入
+	Lobby bool `json:"lobby"`
+
+	// StartTime 排程開始時間，之前無法加入，空房間的timeout從此時間起算
+	StartTime *time.Time `json:"startTime,omitempty"`
+	// EndTime 排程結束時間，到達時結束會議
+	EndTime *time.Time `json:"endTime,omitempty"`
+
+	// Alias 指定房間的alias，例如行事曆以event ID建立固定的房間，已被使用時回傳409
+	Alias string `json:"alias,omitempty"`
+	// ReadableAlias 未指定Alias時產生例如brave-otter-4821的alias
+	ReadableAlias bool `json:"readableAlias,omitempty"`
+}
+
+// settings 轉為房間設定，排程時間不合理時回傳error
+func (req *createRoomRequest) settings(hostToken string) (map[string]string, error) {
+	settings := map[string]string{
+		roomSettingHostTokenHash: hashHostToken(hostToken),
+	}
+	if req.Lobby {
+		settings[roomSettingLobby] = "true"
+	}
+
+	kind, hash, err := req.hash()
+	if err != nil {
+		return nil, err
+	}
+	setPasswordSettings(settings, kind, hash)
+
+	if req.EndTime != nil {
+		if !req.EndTime.After(time.Now()) {
+			return nil, fmt.Errorf("endTime must be in the future")
+		}
+		if req.StartTime != nil && !req.EndTime.After(*req.StartTime) {
+			return nil, fmt.Errorf("endTime must be after startTime")
+		}
+		settings[roomSettingEndTime] = req.EndTime.UTC().Format(time.RFC3339Nano)
 	}
+	if req.StartTime != nil {
+		settings[roomSettingStartTime] = req.StartTime.UTC().Format(time.RFC3339Nano)
+	}
+	return settings, nil
 }
 
-func RoomPage(w http.ResponseWriter, r *http.Request) {
-	var oldIndexTemplate = &template.Template{}
+// createRoomResponse hostToken只在建立房間時回傳，用於lobby的host以及更新房間設定
+type createRoomResponse struct {
+	roomInfomation
+	HostToken string `json:"hostToken,omitempty"`
+}
 
-	indexHTML, err := ioutil.ReadFile("./static/room.html")
+func (s *SFU) CreateRoom(w http.ResponseWriter, r *http.Request) {
+	req := createRoomRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("request body error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	hostToken := uuid.NewString()
+	settings, err := req.settings(hostToken)
 	if err != nil {
-		panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	oldIndexTemplate = template.Must(template.New("").Parse(string(indexHTML)))
 
+	// alias在建立房間之前保留，避免兩個房間使用同一個alias
+	roomID := uuid.New()
+	if req.Alias != "" || req.ReadableAlias {
+		alias, err := s.reserveAlias(req.Alias, roomID)
+		switch {
+		case errors.Is(err, errAliasInvalid):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrAliasTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			s.log.Errorf("reserve room alias error: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		settings[roomSettingAlias] = alias
+	}
+	room := s.newConferenceRoom(roomID, settings)
+
+	roomInfo := createRoomResponse{
+		roomInfomation: room.makeRoomInfoResponse(),
+		HostToken:      hostToken,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(roomInfo); err != nil {
+		s.log.Errorf("json encode err: %v", err)
+		return
+	}
+}
+
+func (s *SFU) RoomPage(w http.ResponseWriter, r *http.Request) {
 	// get url room id parameters
 	vars := mux.Vars(r)
 	inputRoomUUID := vars["roomid"]
 
-	roomID, err := uuid.Parse(inputRoomUUID)
+	roomID, err := s.resolveRoomID(inputRoomUUID, s.requestIP(r))
 	if err != nil {
-		Errorf("url room UUID error: %v", err)
+		s.log.Errorf("url room error: %v", err)
+		lookupErr, status := roomLookupError(err)
+		http.Error(w, lookupErr.Error(), status)
 		return
 	}
 
-	if _, ok := webrtcSrv.Rooms[roomID]; !ok {
+	room, err := s.getOrRelayRoom(roomID)
+	if err != nil {
 		// room doesn't exist]
-		Errorf("roomID %v not exist error", roomID)
+		s.log.Errorf("roomID %v not exist error: %v", roomID, err)
+		lookupErr, status := roomLookupError(err)
+		// lobby房間轉到origin node的同一個頁面
+		if status == http.StatusTemporaryRedirect {
+			http.Redirect(w, r, lookupErr.reason+r.URL.RequestURI(), status)
+			return
+		}
+		http.Error(w, lookupErr.Error(), status)
 		return
 	}
 
-	webSocketURL := fmt.Sprintf("wss://%s/room/%s/webSocket", conf.Domain, roomID.String())
+	// host以POST的host欄位送出host token，設定cookie後以GET重新載入，token不留在URL
+	if r.Method == http.MethodPost && r.PostFormValue("host") != "" {
+		token := r.PostFormValue("host")
+		if !room.isHost(token) {
+			s.log.Infof("room %v page: %v", roomID, errNotHost)
+			http.Error(w, errNotHost.Error(), http.StatusForbidden)
+			return
+		}
+		setRoomHostCookie(w, room, token)
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		return
+	}
+
+	// 有密碼的房間先顯示密碼表單，POST驗證成功後設定cookie並以GET重新載入，websocket同樣帶上cookie
+	if !isHostRequest(room, r) {
+		if r.Method == http.MethodPost {
+			if err := s.checkRoomPassword(room, s.requestIP(r), r.PostFormValue("password")); err != nil {
+				s.log.Infof("room %v page: %v", roomID, err)
+				writePasswordPage(w, room.passwordKind(), err)
+				return
+			}
+			setRoomAccessCookie(w, room)
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			return
+		}
+		if err := s.checkRoomAccess(room, r); err != nil {
+			s.log.Infof("room %v page: %v", roomID, err)
+			writePasswordPage(w, room.passwordKind(), err)
+			return
+		}
+	}
+
+	var oldIndexTemplate = &template.Template{}
+
+	indexHTML, err := ioutil.ReadFile("./static/room.html")
+	if err != nil {
+		panic(err)
+	}
+	oldIndexTemplate = template.Must(template.New("").Parse(string(indexHTML)))
+
+	webSocketURL := fmt.Sprintf("wss://%s/room/%s/webSocket", s.config.Domain, roomID.String())
+	// cluster中的lobby房間只能在origin加入，直接連線到此node
+	if s.config.NodeURL != "" && room.lobbyEnabled() {
+		// http -> ws, https -> wss
+		webSocketURL = fmt.Sprintf("ws%s/room/%s/webSocket", strings.TrimPrefix(s.config.NodeURL, "http"), roomID.String())
+	}
 
 	if err := oldIndexTemplate.Execute(w, webSocketURL); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func IndexPage(w http.ResponseWriter, r *http.Request) {
+func (s *SFU) IndexPage(w http.ResponseWriter, r *http.Request) {
 	var oldIndexTemplate = &template.Template{}
 
 	html, err := ioutil.ReadFile("./static/index.html")
 	if err != nil {
-		Errorf(err.Error())
+		s.log.Errorf(err.Error())
 		return
 	}
 	oldIndexTemplate = template.Must(template.New("").Parse(string(html)))
 
-	webSocketURL := fmt.Sprintf("wss://%s/roomsinfo/webSocket", conf.Domain)
+	webSocketURL := fmt.Sprintf("wss://%s/roomsinfo/webSocket", s.config.Domain)
 
 	if err := oldIndexTemplate.Execute(w, webSocketURL); err != nil {
 		log.Fatal(err)
@@ -99,90 +245,254 @@ func IndexPage(w http.ResponseWriter, r *http.Request) {
 }
 
 // Client 端加入單一房間，web socket endpoint
-func JoinMeeting(w http.ResponseWriter, r *http.Request) {
+func (s *SFU) JoinMeeting(w http.ResponseWriter, r *http.Request) {
 	// Upgrade HTTP request to Websocket
 	unsafeConn, err := webSocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		Errorf("upgrade err: %v", err)
+		s.log.Errorf("upgrade err: %v", err)
 		http.Error(w, fmt.Sprintf("webSocket Error: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	wsc := &threadSafeWebSocketWriter{
+	wsc := newSignalingConn(&threadSafeWebSocketWriter{
 		unsafeConn,
 		sync.Mutex{},
-	}
+	})
 
 	// When this frame returns close the Websocket
 	defer func() {
 		if cErr := wsc.Close(); cErr != nil {
 			if websocket.IsUnexpectedCloseError(cErr, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				Errorf("web socket read message Unexpected Close Error: %v", cErr)
+				s.log.Errorf("web socket read message Unexpected Close Error: %v", cErr)
 				return
 			}
 		}
 	}()
 
+	// get url room id，唯一與原程式碼不同處，判斷URL的roomid，選擇會議室
+	vars := mux.Vars(r)
+	inputRoomUUID := vars["roomid"]
+
+	// websocket已upgrade，以error event與close code通知client
+	roomID, err := s.resolveRoomID(inputRoomUUID, s.requestIP(r))
+	if err != nil {
+		s.log.Errorf("url room error: %v", err)
+		lookupErr, _ := roomLookupError(err)
+		rejectConnection(wsc, lookupErr)
+		return
+	}
+
+	// 房間不在此node時，若其他node上有此房間，建立edge room並relay
+	room, err := s.getOrRelayRoom(roomID)
+	if err != nil {
+		s.log.Errorf("room %v not exist: %v", roomID, err)
+		lookupErr, _ := roomLookupError(fmt.Errorf("room %v doesn't exist: %w", roomID, err))
+		rejectConnection(wsc, lookupErr)
+		return
+	}
+
+	// ?publish= 宣告要publish的track，resume沿用原本的transceiver
+	receiveKinds, err := parsePublishKinds(r.URL.Query(), s.config.MaxPublishTracks)
+	if err != nil {
+		s.log.Warnf("room %v reject participant: %v", roomID, err)
+		_ = wsc.sendError("", signalingErrInvalidPayload, err.Error())
+		return
+	}
+
+	// 斷線重連 ?resume=token，沿用原本的peerConnection與track
+	// token無效或已過期時client端的peerConnection無法再使用，通知client重新加入
+	if token := r.URL.Query().Get("resume"); token != "" {
+		if !room.resumeParticipant(token, wsc) {
+			s.log.Warnf("room %v resume token invalid or expired", roomID)
+			if err := wsc.send("resumeFailed", "", nil); err != nil {
+				s.log.Errorf("webSocket write resumeFailed error: %v", err)
+			}
+		}
+		return
+	}
+
+	// 帶X-Host-Token header或host cookie的host不需要密碼，也不需要在lobby等待
+	host := isHostRequest(room, r)
+	if !host {
+		if err := s.checkRoomAccess(room, r); err != nil {
+			s.log.Infof("room %v reject participant: %v", roomID, err)
+			rejectConnection(wsc, err)
+			return
+		}
+	}
+
+	if err := room.checkStarted(); err != nil {
+		s.log.Infof("room %v reject participant: %v", roomID, err)
+		rejectConnection(wsc, err)
+		return
+	}
+
+	// 容量檢查在連線加入room.conns之前，resume沿用原本的名額
+	release, admissionErr := room.admitParticipant()
+	if admissionErr != nil {
+		s.log.Warnf("room %v reject participant: %v", roomID, admissionErr)
+		rejectConnection(wsc, admissionErr)
+		return
+	}
+	defer release()
+
+	// lobby 參與者在建立peerConnection之前等待host允許
+	participantID := uuid.NewString()
+	if !host && room.lobbyEnabled() {
+		p := lobbyParticipant{ParticipantID: participantID, Name: r.URL.Query().Get("name")}
+		if !room.waitInLobby(wsc, p) {
+			return
+		}
+	}
+
+	room.serveConnection(wsc, connectionOptions{
+		receiveKinds:  receiveKinds,
+		mixedAudio:    r.URL.Query().Get("audio") == "mixed",
+		subscribeNone: r.URL.Query().Get(subscribeQuery) == "none",
+		participantID: participantID,
+		host:          host,
+	})
+}
+
+// connectionOptions serveConnection的參數
+type connectionOptions struct {
+	// receiveKinds 接收client publish用的recvonly transceivers
+	receiveKinds []webrtc.RTPCodecType
+
+	// mixedAudio 混音模式，只收一個混音後的audio track，適合頻寬不足的參與者
+	mixedAudio bool
+
+	// subscribeNone 加入時不訂閱任何track，由client以subscribe event選擇
+	subscribeNone bool
+
+	// relayNode 非空時此連線為其他node的relay，值為對方的node URL
+	relayNode string
+
+	// participantID 空字串時由serveConnection產生，relay沒有participant ID
+	participantID string
+
+	// host 以host token加入的參與者
+	host bool
+}
+
+// serveConnection 以server的角色(發送offer)處理單一websocket上的peerConnection，直到websocket斷線
+func (r *ConferenceRoom) serveConnection(wsc *signalingConn, opts connectionOptions) {
 	// Create new PeerConnection
-	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{
+	pc, err := newPeerConnection(webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{
 			{
 				URLs: []string{"stun:stun.l.google.com:19302"},
 			},
 		},
-	})
+	}, r.sfu.downTrackSenders)
 	if err != nil {
-		Errorf("peerConnection create err: %v", err)
-		http.Error(w, fmt.Sprintf("webRTC PeerConnection Create Error: %v", err), http.StatusInternalServerError)
+		r.sfu.log.Errorf("peerConnection create err: %v", err)
 		return
 	}
 
 	// When this frame returns close the PeerConnection
 	defer func() {
 		if cErr := pc.Close(); cErr != nil {
-			Errorf("cannot close peerConnection: %v\n", cErr)
+			r.sfu.log.Errorf("cannot close peerConnection: %v\n", cErr)
 		}
 	}()
 
-	// Accept one audio and two video track incoming
-	// 若有兩個video需求，此處需要正確設定RTP Codec Type以及數量
-	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+	// client宣告要publish的track，之後可再以publish event或client的offer新增
+	publishing := newPublishTransceivers(pc)
+	for _, typ := range opts.receiveKinds {
 		// AddTransceiverFromKind最終會使用addRTPTransceiver func，addRTPTransceiver會觸發On Negotiation needed Event
-		if _, err := pc.AddTransceiverFromKind(typ,
-			webrtc.RTPTransceiverInit{
-				Direction: webrtc.RTPTransceiverDirectionRecvonly,
-			},
-		); err != nil {
-			Errorf("peerConnection AddTransceiverFromKind err: %v", err)
-			http.Error(w, fmt.Sprintf("webRTC PeerConnection AddTransceiverFromKind err: %v", err), http.StatusInternalServerError)
+		if err := r.addReceiveTransceiver(publishing, typ); err != nil {
+			r.sfu.log.Errorf("peerConnection AddTransceiverFromKind err: %v", err)
 			return
 		}
 	}
 
-	// get url room id，唯一與原程式碼不同處，判斷URL的roomid，選擇會議室
-	vars := mux.Vars(r)
-	inputRoomUUID := vars["roomid"]
+	// relay一開始可能沒有任何track，offer沒有m-line時對方無法建立ICE，使用data channel確保至少有一個m-line
+	if opts.relayNode != "" {
+		if _, err := pc.CreateDataChannel("relay", nil); err != nil {
+			r.sfu.log.Errorf("relay peerConnection CreateDataChannel err: %v", err)
+			return
+		}
+	} else if len(opts.receiveKinds) <= 1 {
+		// answer只有一個m-line時，pion把answer宣告SSRC之前收到的RTP視為該m-line的track，track ID為空字串且之後不會更正
+		// client在publish後的answer送出時即開始送RTP，以data channel確保至少有兩個m-line
+		if _, err := pc.CreateDataChannel("sfu", nil); err != nil {
+			r.sfu.log.Errorf("peerConnection CreateDataChannel err: %v", err)
+			return
+		}
+	}
 
-	roomID, err := uuid.Parse(inputRoomUUID)
-	if err != nil {
-		Errorf("url room UUID error: %v", err)
-		http.Error(w, fmt.Sprintf("URL room UUID Format error: %v", err), http.StatusBadRequest)
-		return
+	// 混音模式 ?audio=mixed，只收一個混音後的audio track，適合頻寬不足的參與者
+	var mixedAudio *webrtc.TrackLocalStaticSample
+	if opts.mixedAudio {
+		// 混音器輸出mono，SDP的rtpmap依RFC 7587仍為opus/48000/2
+		mixedAudio, err = webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: mixerSampleRate, Channels: mixerChannels},
+			"mixed-audio-"+uuid.NewString(), "mixed-audio",
+		)
+		if err != nil {
+			r.sfu.log.Errorf("mixed audio track create err: %v", err)
+			return
+		}
+
+		output, err := r.addMixerOutput(pc, func(data []byte, duration time.Duration) error {
+			return mixedAudio.WriteSample(media.Sample{Data: data, Duration: duration})
+		})
+		if err != nil {
+			// 無法混音時退回一般模式
+			r.sfu.log.Warnf("room %v mixed audio unavailable, fallback to per publisher audio: %v", r.RoomID, err)
+			mixedAudio = nil
+		} else {
+			defer r.removeMixerOutput(output)
+		}
 	}
 
-	if _, ok := webrtcSrv.Rooms[roomID]; !ok {
-		Errorf("room %v not exist", roomID)
-		http.Error(w, fmt.Sprintf("room %v doesn't exist", roomID), http.StatusBadRequest)
-		return
+	// relay斷線時由relay自行重新連線，不保留session
+	resumable := opts.relayNode == "" && r.sfu.config.ResumeGracePeriod > 0
+
+	participantID := ""
+	if opts.relayNode == "" {
+		participantID = opts.participantID
+		if participantID == "" {
+			participantID = uuid.NewString()
+		}
+		r.addParticipant(participantID, participantKindWebRTC)
+		defer r.removeParticipant(participantID)
 	}
 
-	room := webrtcSrv.Rooms[roomID]
+	// labels publisher在track到達前以trackLabel event標示的用途
+	labels := newPendingLabels()
+	sub := newSubscription(!opts.subscribeNone)
+	downTracks := make(map[string]*downTrack)
+
+	n := newNegotiator(pc, wsc, r)
+	lobbyEvents, labelEvents, publishEvents := r.lobbyEventHandler(opts.host), labels.eventHandler(), r.publishEventHandler(publishing)
+	subscriptionEvents, pauseEvents := r.subscriptionEventHandler(sub), r.pauseEventHandler(downTracks)
+	n.onEvent = func(n *negotiator, message *signalingMessage) bool {
+		return lobbyEvents(n, message) || labelEvents(n, message) || publishEvents(n, message) ||
+			subscriptionEvents(n, message) || pauseEvents(n, message)
+	}
+	n.checkOffer = r.publishOfferCheck(publishing)
+	defer n.close()
+
+	r.Lock()
+	r.conns = append(r.conns, clientConnectionState{
+		peerConnection: pc,
+		negotiator:     n,
+		mixedAudio:     mixedAudio,
+		participantID:  participantID,
+		relayNode:      opts.relayNode,
+		host:           opts.host,
+		subscription:   sub,
+		downTracks:     downTracks,
+	})
+	r.Unlock()
 
-	room.Lock()
-	room.conns = append(room.conns, clientConnectionState{pc, wsc})
-	room.Unlock()
+	if opts.host {
+		r.sendLobby(wsc)
+	}
 
-	// pcIndex := len(room.conns) - 1
+	// pcIndex := len(r.conns) - 1
 
 	// Trickle ICE. Emit server candidate to client
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
@@ -190,18 +500,16 @@ func JoinMeeting(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		candidateString, err := json.Marshal(candidate.ToJSON())
-		if err != nil {
-			Errorf("candidateString json Marshal error: %v", err)
+		// pkg.Debugf("Peer Connection %v on candidate", pcIndex)
+
+		// websocket斷線等待resume期間不送出candidate，resume後ICE restart會重新收集
+		current := n.websocket()
+		if current == nil {
 			return
 		}
-		// pkg.Debugf("Peer Connection %v on candidate", pcIndex)
 
-		if err = wsc.WriteJSON(&websocketwebRTCMessage{
-			Event: "candidate",
-			Data:  string(candidateString),
-		}); err != nil {
-			Errorf("webScoket write Json error: %v", err)
+		if err := current.send("candidate", "", candidate.ToJSON()); err != nil {
+			r.sfu.log.Errorf("webScoket write Json error: %v", err)
 		}
 	})
 
@@ -209,39 +517,42 @@ func JoinMeeting(w http.ResponseWriter, r *http.Request) {
 	pc.OnConnectionStateChange(func(p webrtc.PeerConnectionState) {
 		switch p {
 		case webrtc.PeerConnectionStateFailed:
-			if err := pc.Close(); err != nil {
-				Errorf("PeerConnection Close error: %v", err)
+			if !resumable {
+				if err := pc.Close(); err != nil {
+					r.sfu.log.Errorf("PeerConnection Close error: %v", err)
+				}
+				return
 			}
+
+			// 網路切換等情況先嘗試ICE restart，grace period後仍未恢復才關閉
+			n.restartICE()
+			go func() {
+				time.Sleep(r.sfu.config.ResumeGracePeriod)
+				if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+					if err := pc.Close(); err != nil {
+						r.sfu.log.Errorf("PeerConnection Close error: %v", err)
+					}
+				}
+			}()
 		case webrtc.PeerConnectionStateClosed:
-			// signalingStateCheck(pc, fmt.Sprintf("Peer Connection %v closed", pcIndex))
-			room.signalPeerConnections()
+			r.signalPeerConnections()
 		}
 	})
 
 	// webRTC PeerConnection接收remote Track的event handler，新增track至local tracks map
-	pc.OnTrack(func(t *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
-		Infof("--------------------Peer Connection OnTrack Remote track ID : %v--------------------", t.ID())
+	pc.OnTrack(func(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		r.sfu.log.Infof("--------------------Peer Connection OnTrack Remote track ID : %v--------------------", t.ID())
 		// Debugf("Peer Connection ontrack signaling state: %v", pc.SignalingState())
 
-		signalingStateCheck(pc, "pc ontrack")
 		// Create a track to fan out our incoming video to all peers
-		trackLocal := room.addTrack(t)
-		defer func() {
-			// signalingStateCheck(pc, fmt.Sprintf("Peer Connection %v ontrack over, have to remove track", pcIndex))
-			room.removeTrack(trackLocal)
-		}()
-
-		buf := make([]byte, 1500)
-		for {
-			i, _, err := t.Read(buf)
-			if err != nil {
-				return
-			}
-
-			if _, err = trackLocal.Write(buf[:i]); err != nil {
-				return
-			}
+		trackLocal, err := r.addTrack(t, participantID, labels.take(t.ID(), t.Kind()))
+		if err != nil {
+			// 不轉送此track，client仍可留在房間收看
+			r.sfu.log.Warnf("room %v reject track %v: %v", r.RoomID, t.ID(), err)
+			n.replyError("", err.code, fmt.Errorf("track %s: %s", t.ID(), err.reason))
+			return
 		}
+		r.forwardRemoteTrack(t, receiver, trackLocal)
 	})
 
 	// pc.OnSignalingStateChange(func(s webrtc.SignalingState) {
@@ -253,38 +564,98 @@ func JoinMeeting(w http.ResponseWriter, r *http.Request) {
 	// })
 
 	// Signal for the new PeerConnection
-	room.signalPeerConnections()
+	r.signalPeerConnections()
+
+	if !resumable {
+		n.runSignaling(wsc)
+		return
+	}
+
+	session := r.newParticipantSession(participantID, wsc)
+	defer r.removeParticipantSession(session)
+
+	if err := wsc.send("session", "", session.info()); err != nil {
+		r.sfu.log.Errorf("webSocket write session error: %v", err)
+		return
+	}
+
+	var resumed *resumeRequest
+	for {
+		n.runSignaling(wsc)
+		// signaling錯誤時websocket可能還開著，關閉讓client端重新連線
+		_ = wsc.Close()
+		if resumed != nil {
+			close(resumed.done)
+		}
+
+		// websocket斷線，保留peerConnection與publish中的track，等待client帶resume token重新連線
+		n.suspend()
+		r.sfu.log.Infof("room %v participant %s websocket disconnected, waiting for resume", r.RoomID, participantID)
+
+		resumed = session.waitResume(r.sfu.config.ResumeGracePeriod)
+		if resumed == nil {
+			r.sfu.log.Infof("room %v participant %s resume timeout", r.RoomID, participantID)
+			return
+		}
+
+		wsc = resumed.wsc
+		session.setWebsocket(wsc)
+		if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			_ = wsc.send("resumeFailed", "", nil)
+			close(resumed.done)
+			return
+		}
+		n.resume(wsc)
+		r.sfu.log.Infof("room %v participant %s resumed", r.RoomID, participantID)
+
+		if err := wsc.send("session", "", session.info()); err != nil {
+			r.sfu.log.Errorf("webSocket write session error: %v", err)
+		}
+	}
+}
 
-	webSocketData := make(chan []byte)
+// runSignaling 處理client端透過websocket送來的signaling message，直到websocket斷線
+// offer/answer交由negotiator處理，避免與server端的renegotiation衝突
+// 格式錯誤、payload不合法或未知的event只回覆error，不中斷連線
+func (n *negotiator) runSignaling(wsc *signalingConn) {
+	messages := make(chan *signalingMessage)
 	stop := make(chan struct{}) // stop signal
+	exit := make(chan struct{})
+	defer close(exit)
 	go func() {
 		for {
-			_, rawData, err := wsc.ReadMessage()
+			message, parseErr, err := wsc.read()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					Errorf("web socket read message unexpected close error: %v", err)
+					n.log.Errorf("web socket read message unexpected close error: %v", err)
 				}
 				close(stop)
 				break
 			}
-			webSocketData <- rawData
+			if parseErr != nil {
+				n.log.Warnf("room %v web socket message json parse error: %v", n.roomID, parseErr)
+				n.replyError("", signalingErrMalformed, parseErr)
+				continue
+			}
+
+			select {
+			case messages <- message:
+			case <-exit:
+				return
+			}
 		}
 	}()
 
-	message := &websocketwebRTCMessage{}
 	keepAliveTicker := time.NewTicker(10 * time.Second)
+	defer keepAliveTicker.Stop()
 
 	for {
 		select {
 		case <-keepAliveTicker.C:
-			if err := wsc.WriteJSON(
-				&websocketwebRTCMessage{
-					Event: "keepalive",
-				},
-			); err != nil {
+			if err := wsc.send("keepalive", "", nil); err != nil {
 				keepAliveTicker.Stop()
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					Errorf("web socket keep alive Unexpected Close Error: %v", err)
+					n.log.Errorf("web socket keep alive Unexpected Close Error: %v", err)
 				}
 				return
 			}
@@ -292,105 +663,132 @@ func JoinMeeting(w http.ResponseWriter, r *http.Request) {
 		case <-stop:
 			return
 
-		case data := <-webSocketData:
-			err := json.Unmarshal(data, &message)
-			if err != nil {
-				Errorf("web socket message json parse error: %v", err)
-				return
-			}
+		case message := <-messages:
+			n.handleMessage(message)
+		}
+	}
+}
 
-			switch message.Event {
-			case "candidate":
-				candidate := webrtc.ICECandidateInit{}
-				if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
-					Errorf("webSocket candidate message json.Unmarshal error: %v", err)
-					return
-				}
+// handleMessage 處理單一client message
+func (n *negotiator) handleMessage(message *signalingMessage) {
+	switch message.Event {
+	case "candidate":
+		candidate, err := message.decodeCandidate()
+		if err != nil {
+			n.replyError(message.ID, signalingErrInvalidPayload, err)
+			return
+		}
 
-				if err := pc.AddICECandidate(candidate); err != nil {
-					Errorf("peerConnection AddICECandidate error: %v", err)
-					return
-				}
-			case "answer":
-				answer := webrtc.SessionDescription{}
-				if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
-					Errorf("webSocket answer message json.Unmarshal error: %v", err)
-					return
-				}
+		if err := n.pc.AddICECandidate(candidate); err != nil {
+			n.log.Errorf("peerConnection AddICECandidate error: %v", err)
+			n.replyError(message.ID, signalingErrInvalidPayload, err)
+		}
+	case "answer":
+		answer, err := message.decodeDescription(webrtc.SDPTypeAnswer)
+		if err != nil {
+			n.replyError(message.ID, signalingErrInvalidPayload, err)
+			return
+		}
 
-				if err := pc.SetRemoteDescription(answer); err != nil {
-					Errorf("peerConnection SetRemoteDescription error: %v", err)
-					return
-				}
-			case "addTrack":
-				offer, err := pc.CreateOffer(nil)
-				if err != nil {
-					Errorf("add multipal track create offer error: %v", err)
-					return
-				}
-				err = pc.SetLocalDescription(offer)
-				if err != nil {
-					Errorf("add multipal track Set Local Description error: %v", err)
-					return
-				}
-				offerString, err := json.Marshal(offer)
-				if err != nil {
-					Errorf("add multipal track offer json.Marshal error: %v", err)
-					return
-				}
+		n.handleAnswer(answer, message.ID)
+	case "offer":
+		// client發起的renegotiation，例如新增screen share track
+		offer, err := message.decodeDescription(webrtc.SDPTypeOffer)
+		if err != nil {
+			n.replyError(message.ID, signalingErrInvalidPayload, err)
+			return
+		}
 
-				if err = wsc.WriteJSON(&websocketwebRTCMessage{
-					Event: "offer",
-					Data:  string(offerString),
-				}); err != nil {
-					Errorf("add multipal track offer write json error: %v", err)
-					return
-				}
-			}
+		n.handleOffer(offer, message.ID)
+	case "addTrack":
+		// 舊版client新增track後要求server重新發送offer
+		n.requestOffer()
+	case "keepalive":
+	default:
+		if n.onEvent != nil && n.onEvent(n, message) {
+			return
 		}
+
+		// 較新的client可能送出server還不認得的event
+		n.log.Debugf("room %v unknown signaling event %q", n.roomID, message.Event)
+		n.replyError(message.ID, signalingErrUnknownEvent, fmt.Errorf("unknown event %q", message.Event))
+	}
+}
+
+// replyError 回覆client request錯誤
+func (n *negotiator) replyError(id, code string, err error) {
+	wsc := n.websocket()
+	if wsc == nil {
+		return
+	}
+	if wErr := wsc.sendError(id, code, err.Error()); wErr != nil {
+		n.log.Debugf("room %v error write json error: %v", n.roomID, wErr)
 	}
 }
 
-// GetRoomIDArray 單次獲取現在room info的API
-func GetRoomIDArray(w http.ResponseWriter, r *http.Request) {
-	roomsInfo := make([]roomInfomation, 0, len(webrtcSrv.Rooms))
-	for i := range webrtcSrv.Rooms {
-		roomsInfo = append(roomsInfo, webrtcSrv.Rooms[i].makeRoomInfoResponse())
+// forwardRemoteTrack 將remote track的RTP寫入room的local track，track結束時移除
+// receiver的sender report記錄於trackLocal，供downTrack與egress對齊audio、video
+func (r *ConferenceRoom) forwardRemoteTrack(t *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, trackLocal *forwardedTrack) {
+	if trackLocal == nil {
+		return
 	}
+	go readSenderReports(receiver, t.SSRC(), trackLocal)
+	trackLocal.keyFrames.setPublisher(receiver.Transport(), t.SSRC(), t.Codec(), r.sfu.config.KeyFrameRequestInterval)
 
-	// sorted by time
-	sort.Slice(roomsInfo,
-		func(i, j int) bool {
-			return roomsInfo[i].CreatedTime.Before(roomsInfo[j].CreatedTime)
-		},
-	)
+	defer func() {
+		r.removeTrack(trackLocal)
+	}()
+
+	for {
+		pkt, _, err := t.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		r.sfu.load.forwarded(len(pkt.Payload), trackLocal.forward(pkt))
+
+		// egress等非peerConnection的訂閱者
+		r.writeToSinks(t, pkt, &trackLocal.clock)
+	}
+}
+
+// GetRoomIDArray 單次獲取現在room info的API，共用store時包含其他instance的房間
+func (s *SFU) GetRoomIDArray(w http.ResponseWriter, r *http.Request) {
+	rooms, err := s.store.ListRooms()
+	if err != nil {
+		s.log.Errorf("getRoomIDArray list rooms err: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// store.ListRooms已依建立時間排序
+	roomsInfo := make([]roomInfomation, 0, len(rooms))
+	for _, meta := range rooms {
+		roomsInfo = append(roomsInfo, meta.roomInfo(s.config.Domain))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(roomsInfo)
+	err = json.NewEncoder(w).Encode(roomsInfo)
 	if err != nil {
-		Errorf("getRoomIDArray json encode err: %v", err)
+		s.log.Errorf("getRoomIDArray json encode err: %v", err)
 		return
 	}
 }
 
-// dispatchKeyFrame sends a keyframe to all PeerConnections, used everytime a new user joins the call
-func DispatchKeyFrameToAll() {
-	for _, room := range webrtcSrv.Rooms {
-		room.Lock()
-		defer room.Unlock()
-
-		for i := range room.conns {
-			for _, receiver := range room.conns[i].peerConnection.GetReceivers() {
-				if receiver.Track() == nil {
-					continue
-				}
+// DispatchKeyFrameToAll 要求所有房間的publisher送出keyframe，每個track各自節流
+func (s *SFU) DispatchKeyFrameToAll() {
+	s.RLock()
+	rooms := make([]*ConferenceRoom, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.RUnlock()
 
-				_ = room.conns[i].peerConnection.WriteRTCP([]rtcp.Packet{
-					&rtcp.PictureLossIndication{
-						MediaSSRC: uint32(receiver.Track().SSRC()),
-					},
-				})
-			}
+	for _, room := range rooms {
+		room.RLock()
+		for _, track := range room.clientTracks {
+			track.requestKeyFrame()
 		}
+		room.RUnlock()
 	}
 }
@@ -5,28 +5,40 @@ import (
 	"time"
 	"webrtc_sfu_conference/conf"
 	"webrtc_sfu_conference/handlers"
-
-	"github.com/gorilla/mux"
 )
 
 func main() {
-	r := mux.NewRouter()
+	opts := []handlers.Option{
+		handlers.WithConfig(handlers.DefaultConfig()),
+	}
 
-	// create room
-	r.HandleFunc("/create/room", handlers.CreateRoom).Methods("POST")
-	// room websocket webrtc peerConnection endpoint
-	r.HandleFunc("/room/{roomid}/webSocket", handlers.JoinMeeting)
-	// room page index.html handler
-	r.HandleFunc("/room/{roomid}", handlers.RoomPage)
+	if conf.RedisAddr != "" {
+		store, err := handlers.NewRedisRoomStore(conf.RedisAddr, conf.RedisPassword, conf.RedisDB, nil)
+		if err != nil {
+			handlers.Errorf("redis room store error: %v", err)
+			return
+		}
+		handlers.Infof("room store: redis %s", conf.RedisAddr)
+		opts = append(opts, handlers.WithStore(store))
+	}
 
-	r.HandleFunc("/index", handlers.IndexPage)
-	r.HandleFunc("/roomsinfo/webSocket", handlers.RoomInfoSignaling)
-	// conference room id API
-	r.HandleFunc("/getRoomsID", handlers.GetRoomIDArray)
+	sfu, err := handlers.NewSFU(opts...)
+	if err != nil {
+		handlers.Errorf("sfu config error: %v", err)
+		return
+	}
+	defer sfu.Close()
+
+	if conf.SIPAddr != "" {
+		if err := sfu.StartSIPGateway(conf.SIPAddr); err != nil {
+			handlers.Errorf("sip gateway start error: %v", err)
+			return
+		}
+	}
 
 	// start HTTP server
 	srv := &http.Server{
-		Handler: r,
+		Handler: sfu.Handler(),
 		Addr:    conf.Addr,
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
@@ -0,0 +1,11 @@
+// Package signalingpb signaling.proto以protoc-gen-go產生的Go型別，修改schema後執行go generate重新產生signaling.pb.go
+package signalingpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative signaling.proto
+
+const (
+	// Subprotocol room websocket的protobuf encoding
+	Subprotocol = "sfu.v2.proto"
+	// RoomsInfoSubprotocol rooms info websocket的protobuf encoding
+	RoomsInfoSubprotocol = "sfu.roomsinfo.proto"
+)